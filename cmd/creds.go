@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containers/image/v5/types"
+)
+
+// credentialDocument is the JSON document read from --creds-fd.
+type credentialDocument struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// IdentityToken is an OAuth2 refresh token, instead of a password
+	IdentityToken string `json:"identityToken"`
+	// BearerToken is sent to registries as is, instead of obtaining one
+	// with the credentials
+	BearerToken string `json:"bearerToken"`
+}
+
+// setCredentials sets the registry credentials of sys from the JSON
+// document data, read from --creds-fd so that they don't appear in the
+// command line or environment of the proxy.
+func setCredentials(sys *types.SystemContext, data []byte) error {
+	var creds credentialDocument
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&creds); err != nil {
+		return fmt.Errorf("parsing --creds-fd: %w", err)
+	}
+	switch {
+	case creds.BearerToken != "":
+		if creds.Username != "" || creds.Password != "" || creds.IdentityToken != "" {
+			return fmt.Errorf("invalid --creds-fd: bearerToken excludes other credentials")
+		}
+		sys.DockerBearerRegistryToken = creds.BearerToken
+	case creds.Username != "" && (creds.Password != "" || creds.IdentityToken != ""):
+		sys.DockerAuthConfig = &types.DockerAuthConfig{
+			Username:      creds.Username,
+			Password:      creds.Password,
+			IdentityToken: creds.IdentityToken,
+		}
+	default:
+		return fmt.Errorf("invalid --creds-fd: expected a username with a password or identityToken, or a bearerToken")
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sync"
+
+	"github.com/cgwalters/container-image-proxy/pkg/imageproxy"
+	"github.com/sirupsen/logrus"
+)
+
+// singleConnListener returns a single connection, so that HTTP can be
+// served on a connected socket.
+type singleConnListener struct {
+	lock   sync.Mutex
+	conn   net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.lock.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return &net.UnixAddr{Net: "unix"}
+}
+
+// serveHTTPFd serves handler in the background on the socket passed as
+// fd, either a listening socket or a connected one.  Like --sockfd, the
+// latter is served until the client closes it.
+func serveHTTPFd(flag string, fd int, handler http.Handler) error {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("%s %d", flag, fd))
+	defer f.Close()
+	listening, err := imageproxy.IsListening(f)
+	if err != nil {
+		return fmt.Errorf("invalid %s %d: %w", flag, fd, err)
+	}
+	var l net.Listener
+	if listening {
+		l, err = imageproxy.FileListener(f)
+	} else {
+		var conn net.Conn
+		conn, err = imageproxy.FileConn(f)
+		if err == nil {
+			l = newSingleConnListener(conn)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %d: %w", flag, fd, err)
+	}
+	go func() {
+		if err := http.Serve(l, handler); err != nil {
+			logrus.WithError(err).Errorf("serving %s", flag)
+		}
+	}()
+	return nil
+}
+
+// pprofHandler serves the runtime profiles, like importing net/http/pprof
+// does on the default mux.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
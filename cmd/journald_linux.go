@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalStream returns whether stderr is connected to the journal, as
+// systemd indicates with $JOURNAL_STREAM for services.
+func journalStream() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+	return stream == fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+}
+
+// journalHook sends log entries to the journal using its native protocol,
+// with their fields as journal fields.
+type journalHook struct {
+	conn       *net.UnixConn
+	identifier string
+}
+
+func newJournalHook() (*journalHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the journal: %w", err)
+	}
+	return &journalHook{conn: conn, identifier: filepath.Base(os.Args[0])}, nil
+}
+
+func (j *journalHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// journalPriority maps logrus levels to syslog priorities.
+func journalPriority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// journalFieldName converts a logrus field name to a valid journal field
+// name: uppercase letters, digits and underscores, not starting with an
+// underscore (which is reserved for trusted fields).
+func journalFieldName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return '_'
+		}
+	}, name)
+	return strings.TrimLeft(name, "_")
+}
+
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.ContainsRune(value, '\n') {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	// Values with newlines are sent with their length instead
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (j *journalHook) Fire(entry *logrus.Entry) error {
+	var buf bytes.Buffer
+	msg := entry.Message
+	if err, ok := entry.Data[logrus.ErrorKey]; ok {
+		msg = fmt.Sprintf("%s: %v", msg, err)
+	}
+	writeJournalField(&buf, "MESSAGE", msg)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(journalPriority(entry.Level)))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", j.identifier)
+	for k, v := range entry.Data {
+		name := journalFieldName(k)
+		if name == "" || name == "MESSAGE" || name == "PRIORITY" || name == "SYSLOG_IDENTIFIER" {
+			continue
+		}
+		writeJournalField(&buf, name, fmt.Sprint(v))
+	}
+	_, err := j.conn.Write(buf.Bytes())
+	if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+		return j.sendLarge(buf.Bytes())
+	}
+	return err
+}
+
+// sendLarge sends an entry too large for a datagram in a sealed memfd, as
+// journald accepts.
+func (j *journalHook) sendLarge(entry []byte) error {
+	fd, err := unix.MemfdCreate("journal-entry", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "journal-entry")
+	defer f.Close()
+	if _, err := f.Write(entry); err != nil {
+		return err
+	}
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL); err != nil {
+		return err
+	}
+	_, _, err = j.conn.WriteMsgUnix(nil, unix.UnixRights(int(f.Fd())), nil)
+	return err
+}
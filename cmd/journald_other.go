@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journalStream is only implemented on Linux.
+func journalStream() bool {
+	return false
+}
+
+type journalHook struct{}
+
+func newJournalHook() (*journalHook, error) {
+	return nil, fmt.Errorf("logging to the journal is only supported on Linux")
+}
+
+func (j *journalHook) Levels() []logrus.Level {
+	return nil
+}
+
+func (j *journalHook) Fire(entry *logrus.Entry) error {
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// readDecryptionKeys reads the private keys given with --decryption-key
+// (files) and --decryption-key-fd (e.g. pipes, so that keys needn't be
+// written to disk).
+func readDecryptionKeys(paths []string, fds []int) ([][]byte, error) {
+	var keys [][]byte
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading --decryption-key: %w", err)
+		}
+		keys = append(keys, data)
+	}
+	for _, fd := range fds {
+		data, err := readFd("--decryption-key-fd", fd)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, data)
+	}
+	return keys, nil
+}
+
+// readFd reads the whole content of the file descriptor given with flag,
+// closing it.
+func readFd(flag string, fd int) ([]byte, error) {
+	f := os.NewFile(uintptr(fd), flag)
+	if f == nil {
+		return nil, fmt.Errorf("invalid %s %d", flag, fd)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s %d: %w", flag, fd, err)
+	}
+	return data, nil
+}
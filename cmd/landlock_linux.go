@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/containers/storage"
+	"golang.org/x/sys/unix"
+)
+
+// Newer access rights than x/sys/unix defines, and whether rules apply
+// to files (as opposed to only directories); see landlock(7).
+const (
+	landlockAccessFsRefer    = 1 << 13
+	landlockAccessFsTruncate = 1 << 14
+	landlockAccessFsIoctlDev = 1 << 15
+
+	landlockRulePathBeneath = 1
+
+	landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | landlockAccessFsTruncate | landlockAccessFsIoctlDev
+	landlockReadAccess = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockExecAccess = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_EXECUTE
+)
+
+// Where the Go standard library looks for the system trust store
+var (
+	trustStoreFiles = []string{
+		"/etc/ssl/certs/ca-certificates.crt",
+		"/etc/pki/tls/certs/ca-bundle.crt",
+		"/etc/ssl/ca-bundle.pem",
+		"/etc/pki/tls/cacert.pem",
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+		"/etc/ssl/cert.pem",
+	}
+	trustStoreDirs = []string{
+		"/etc/ssl/certs",
+		"/etc/pki/tls/certs",
+	}
+)
+
+// landlockPaths returns the paths the proxy needs to access: the
+// configuration (registries.conf, auth files and certificates), the IMAGE
+// of a local transport, and for writing, the blob caches, temporary
+// directories and the store of a containers-storage: IMAGE.
+func landlockPaths(imageref, registriesConf, blobCacheDir, dockerHost string) (readOnly, readWrite []string) {
+	home, _ := os.UserHomeDir()
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" && home != "" {
+		configHome = filepath.Join(home, ".config")
+	}
+	readOnly = []string{
+		"/etc/containers",
+		"/etc/docker/certs.d",
+		fmt.Sprintf("/run/containers/%d", os.Getuid()),
+		// Name resolution
+		"/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf", "/etc/host.conf", "/etc/gai.conf",
+		// For the process metrics
+		"/proc/self",
+	}
+	if registriesConf != "" {
+		readOnly = append(readOnly, registriesConf)
+	}
+	if configHome != "" {
+		readOnly = append(readOnly, filepath.Join(configHome, "containers"))
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		readOnly = append(readOnly, filepath.Join(dir, "containers"))
+	}
+	if file := os.Getenv("REGISTRY_AUTH_FILE"); file != "" {
+		readOnly = append(readOnly, file)
+	}
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		readOnly = append(readOnly, filepath.Join(dir, "config.json"))
+	} else if home != "" {
+		readOnly = append(readOnly, filepath.Join(home, ".docker", "config.json"))
+	}
+	if home != "" {
+		readOnly = append(readOnly, filepath.Join(home, ".dockercfg"))
+	}
+	if file := os.Getenv("SSL_CERT_FILE"); file != "" {
+		readOnly = append(readOnly, file)
+	} else {
+		readOnly = append(readOnly, trustStoreFiles...)
+	}
+	if dirs := os.Getenv("SSL_CERT_DIR"); dirs != "" {
+		readOnly = append(readOnly, filepath.SplitList(dirs)...)
+	} else {
+		readOnly = append(readOnly, trustStoreDirs...)
+	}
+	readWrite = []string{"/var/tmp", os.TempDir()}
+	if parts := strings.SplitN(imageref, ":", 2); len(parts) == 2 {
+		switch parts[0] {
+		case "dir":
+			readOnly = append(readOnly, parts[1])
+		case "oci", "oci-archive", "docker-archive":
+			// The path may be followed by :reference
+			readOnly = append(readOnly, strings.SplitN(parts[1], ":", 2)[0])
+		case "containers-storage":
+			if file := os.Getenv("CONTAINERS_STORAGE_CONF"); file != "" {
+				readOnly = append(readOnly, file)
+			}
+			// Even reading takes the locks of the store
+			readWrite = append(readWrite, storageRoots(parts[1])...)
+		case "docker-daemon":
+			if dockerHost == "" {
+				dockerHost = "unix:///var/run/docker.sock"
+			}
+			if path := strings.TrimPrefix(dockerHost, "unix://"); path != dockerHost {
+				readWrite = append(readWrite, path)
+			}
+		}
+	}
+
+	if blobCacheDir != "" {
+		readWrite = append(readWrite, blobCacheDir)
+	}
+	// The default blob info cache, see pkg/blobinfocache
+	if os.Geteuid() == 0 {
+		readWrite = append(readWrite, "/var/lib/containers/cache")
+	} else if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+		readWrite = append(readWrite, filepath.Join(dataHome, "containers", "cache"))
+	} else if home != "" {
+		readWrite = append(readWrite, filepath.Join(home, ".local", "share", "containers", "cache"))
+	}
+	return readOnly, readWrite
+}
+
+// storageRoots returns the graph root and run root of the store of a
+// containers-storage: reference, which either starts with
+// [driver@graphroot+runroot:options] or uses the default store.  The roots
+// are created if needed, as Landlock can only allow existing paths.
+func storageRoots(ref string) []string {
+	var graphRoot, runRoot string
+	if opts, err := storage.DefaultStoreOptionsAutoDetectUID(); err == nil {
+		graphRoot, runRoot = opts.GraphRoot, opts.RunRoot
+	}
+	// As parsed by the containers-storage transport
+	if end := strings.IndexRune(ref, ']'); strings.HasPrefix(ref, "[") && end > 0 {
+		spec := ref[1:end]
+		if driver := strings.SplitN(spec, "@", 2); len(driver) == 2 {
+			spec = driver[1]
+		}
+		spec = strings.SplitN(spec, ":", 2)[0]
+		roots := strings.SplitN(spec, "+", 2)
+		if roots[0] != "" {
+			graphRoot = roots[0]
+		}
+		if len(roots) == 2 && roots[1] != "" {
+			runRoot = roots[1]
+		}
+	}
+	var paths []string
+	for _, root := range []string{graphRoot, runRoot} {
+		if root != "" {
+			os.MkdirAll(root, 0700)
+			paths = append(paths, root)
+		}
+	}
+	return paths
+}
+
+// libraryDirs returns the executable, and the directories of the shared
+// libraries it is linked with, from which libc also loads NSS modules.
+func libraryDirs() ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{exe}
+	f, err := os.Open("/proc/self/maps")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") || fields[5] == exe {
+			continue
+		}
+		dir := filepath.Dir(fields[5])
+		if !seen[dir] {
+			seen[dir] = true
+			paths = append(paths, dir)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// landlockRuleset returns a Landlock ruleset for restrictSelf, which only
+// allows access to readOnly and readWrite (and what's beneath them); the
+// directories of socketPaths (ignoring empty ones) are only writable to
+// create (and remove) the listening sockets.
+func landlockRuleset(readOnly, readWrite, socketPaths []string) (int, error) {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return -1, fmt.Errorf("--landlock is not supported by this kernel: %w", errno)
+	}
+	var handled uint64 = unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1
+	if abi >= 2 {
+		handled |= landlockAccessFsRefer
+	}
+	if abi >= 3 {
+		handled |= landlockAccessFsTruncate
+	}
+	if abi >= 5 {
+		handled |= landlockAccessFsIoctlDev
+	}
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("creating Landlock ruleset: %w", errno)
+	}
+	ruleset := int(fd)
+
+	libs, err := libraryDirs()
+	if err != nil {
+		unix.Close(ruleset)
+		return -1, err
+	}
+	var socketDirs []string
+	for _, path := range socketPaths {
+		if path != "" {
+			socketDirs = append(socketDirs, filepath.Dir(path))
+		}
+	}
+	for _, rule := range []struct {
+		paths  []string
+		access uint64
+	}{
+		{libs, landlockExecAccess},
+		{readOnly, landlockReadAccess},
+		{readWrite, handled},
+		{[]string{os.DevNull}, unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE},
+		{socketDirs, unix.LANDLOCK_ACCESS_FS_MAKE_SOCK | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE},
+	} {
+		for _, path := range rule.paths {
+			if err := addLandlockRule(ruleset, path, rule.access&handled); err != nil {
+				unix.Close(ruleset)
+				return -1, err
+			}
+		}
+	}
+	return ruleset, nil
+}
+
+// addLandlockRule allows access beneath path, which is ignored if it
+// doesn't exist.
+func addLandlockRule(ruleset int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err == unix.ENOENT || err == unix.ENOTDIR {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening %s for Landlock: %w", path, err)
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFileAccess
+	}
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("adding Landlock rule for %s: %w", path, errno)
+	}
+	return nil
+}
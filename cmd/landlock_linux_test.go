@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// landlockTestImage is set to the containers-storage: reference to open
+// in the restricted subprocess of TestLandlockContainersStorage
+const landlockTestImage = "LANDLOCK_TEST_IMAGE"
+
+// writeStorageImage stores a single layer image as localhost/test:latest
+// in a vfs store under dir, returning the store specifier and the digest
+// of the layer.
+func writeStorageImage(t *testing.T, dir string) (string, digest.Digest) {
+	graphRoot, runRoot := filepath.Join(dir, "graph"), filepath.Join(dir, "run")
+	store, err := storage.GetStore(storage.StoreOptions{GraphRoot: graphRoot, RunRoot: runRoot, GraphDriverName: "vfs"})
+	if err != nil {
+		t.Skipf("creating a vfs store: %v", err)
+	}
+	defer store.Shutdown(true)
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	content := []byte("hello\n")
+	tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	tw.Write(content)
+	tw.Close()
+	layerDigest := digest.FromBytes(layer.Bytes())
+	stored, _, err := store.PutLayer("", "", nil, "", false, nil, bytes.NewReader(layer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := json.Marshal(imgspecv1.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       imgspecv1.RootFS{Type: "layers", DiffIDs: []digest.Digest{layerDigest}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal(imgspecv1.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		Config:    imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers:    []imgspecv1.Descriptor{{MediaType: imgspecv1.MediaTypeImageLayer, Digest: layerDigest, Size: int64(layer.Len())}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := store.CreateImage("", []string{"localhost/test:latest"}, stored.ID, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := digest.FromBytes(manifest)
+	digestManifest := func([]byte) (digest.Digest, error) { return manifestDigest, nil }
+	if err := store.SetImageBigData(img.ID, storage.ImageDigestBigDataKey, manifest, digestManifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetImageBigData(img.ID, digest.FromBytes(config).String(), config, nil); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("[vfs@%s+%s]", graphRoot, runRoot), layerDigest
+}
+
+// openRestricted runs under Landlock, set up the way main does for ref.
+func openRestricted(t *testing.T, ref string) {
+	done, err := restricted(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done {
+		readOnly, readWrite := landlockPaths(ref, "", "", "")
+		ruleset, err := landlockRuleset(readOnly, readWrite, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Fatal(restrictSelf(false, ruleset))
+	}
+
+	if _, err := os.ReadFile("/etc/passwd"); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("reading /etc/passwd under Landlock: %v", err)
+	}
+	imgRef, err := alltransports.ParseImageName(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	src, err := imgRef.NewImageSource(ctx, &types.SystemContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if _, _, err := src.GetManifest(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	layerDigest := digest.Digest(os.Getenv(landlockTestImage + "_LAYER"))
+	blob, _, err := src.GetBlob(ctx, types.BlobInfo{Digest: layerDigest, Size: -1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	verifier := layerDigest.Verifier()
+	if _, err := io.Copy(verifier, blob); err != nil {
+		t.Fatal(err)
+	}
+	if !verifier.Verified() {
+		t.Fatalf("layer %s doesn't match its digest", layerDigest)
+	}
+}
+
+func TestLandlockContainersStorage(t *testing.T) {
+	if ref := os.Getenv(landlockTestImage); ref != "" {
+		openRestricted(t, ref)
+		return
+	}
+	ruleset, err := landlockRuleset(nil, nil, nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	os.NewFile(uintptr(ruleset), "ruleset").Close()
+
+	spec, layerDigest := writeStorageImage(t, t.TempDir())
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLandlockContainersStorage$", "-test.v")
+	cmd.Env = append(os.Environ(),
+		landlockTestImage+"=containers-storage:"+spec+"localhost/test:latest",
+		landlockTestImage+"_LAYER="+layerDigest.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("opening the image under Landlock: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+func landlockPaths(imageref, registriesConf, blobCacheDir, dockerHost string) (readOnly, readWrite []string) {
+	return nil, nil
+}
+
+// landlockRuleset is only implemented on Linux.
+func landlockRuleset(readOnly, readWrite, socketPaths []string) (int, error) {
+	return -1, fmt.Errorf("--landlock is only supported on Linux")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// setupLogging configures the standard logrus logger, which containers/image
+// logs to as well, so that its debug messages are included.  An empty format
+// selects journald if stderr is connected to the journal, or else text.
+func setupLogging(level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid --log-level: %w", err)
+	}
+	logrus.SetLevel(lvl)
+	logrus.SetOutput(os.Stderr)
+	if format == "" {
+		format = "text"
+		if journalStream() {
+			format = "journald"
+		}
+	}
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "journald":
+		hook, err := newJournalHook()
+		if err != nil {
+			return err
+		}
+		logrus.AddHook(hook)
+		logrus.SetOutput(io.Discard)
+	default:
+		return fmt.Errorf("invalid --log-format %q: must be text, json or journald", format)
+	}
+	return nil
+}
@@ -1,271 +1,409 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"fmt"
-	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
-	_ "crypto/sha256"
-	_ "crypto/sha512"
-
-	"github.com/containers/image/v5/image"
-	"github.com/containers/image/v5/manifest"
-	"github.com/containers/image/v5/pkg/blobinfocache"
-	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/cgwalters/container-image-proxy/pkg/imageproxy"
 	"github.com/containers/image/v5/types"
-	"github.com/opencontainers/go-digest"
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 )
 
-var Version = ""
-var quiet bool
-var defaultUserAgent = "ostree-container-backend/" + Version
-
-type proxyHandler struct {
-	imageref string
-	sysctx   *types.SystemContext
-	cache    types.BlobInfoCache
-	imgsrc   *types.ImageSource
-	img      *types.Image
-	shutdown bool
-}
-
-func (h *proxyHandler) ensureImage() error {
-	if h.img != nil {
-		return nil
+func run() error {
+	var version bool
+	var quiet bool
+	var logLevel, logFormat string
+	var sockFds []int
+	var socketPath string
+	var varlinkPath string
+	var grpcPath string
+	var vsockPort uint32
+	var shutdownTimeout time.Duration
+	var withParent bool
+	var useSeccomp bool
+	var useLandlock bool
+	var dropPrivileges bool
+	var pprofFd int
+	var metricsFd int
+	var metricsSocket string
+	var otlpEndpointFlag string
+	var opts imageproxy.Options
+	var maxBandwidth string
+	var bufferSize string
+	var maxManifestSize string
+	var blobCacheSize string
+	var prefetchSize string
+	var registriesConf string
+	var dockerHost string
+	var userAgent string
+	var httpProxy, socks5, noProxy string
+	var resolve []string
+	var registrySockets []string
+	var decryptionKeys []string
+	var decryptionKeyFds []int
+	var pullSecretFd int
+	var credsFd int
+
+	pflag.IntSliceVar(&sockFds, "sockfd", nil, "Serve on opened socket pair (may be given multiple times to serve several connections in parallel)")
+	pflag.StringVar(&socketPath, "socket", "", "Listen on a unix socket at this path, serving each client connection in its own session")
+	pflag.StringVar(&varlinkPath, "varlink", "", "Serve the org.containers.imageproxy varlink interface on a unix socket at this path, instead of HTTP")
+	pflag.StringVar(&grpcPath, "grpc-socket", "", "Serve the imageproxy.v1.ImageProxy gRPC service on a unix socket at this path, instead of HTTP")
+	pflag.Uint32Var(&vsockPort, "vsock-port", 0, "Listen for AF_VSOCK connections from virtual machines on this port, serving each in its own session")
+	pflag.DurationVar(&opts.IdleTimeout, "exit-idle-time", 0, "Exit after no request was handled for this long (0 to never exit)")
+	pflag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "On SIGTERM or SIGINT, how long to wait for requests in progress before aborting them")
+	pflag.UintSliceVar(&opts.AllowUIDs, "allow-uid", nil, "Also accept listening socket connections from this user (may be given multiple times; the proxy's own user and root always are)")
+	pflag.BoolVar(&opts.SamePidns, "same-pidns", false, "Only accept listening socket connections from processes in the proxy's PID namespace")
+	pflag.UintSliceVar(&opts.AllowCIDs, "allow-cid", nil, "Accept vsock connections from the VM with this context ID, or 2 for the host (may be given multiple times; required with --vsock-port)")
+	pflag.BoolVar(&useSeccomp, "seccomp", false, "Once set up, restrict the proxy to the system calls needed for serving (Linux on amd64 and arm64 only)")
+	pflag.BoolVar(&useLandlock, "landlock", false, "Restrict filesystem access to the configuration, auth files, certificates, the IMAGE and the caches (Linux only)")
+	pflag.BoolVar(&dropPrivileges, "drop-privileges", true, "Drop all capabilities and set no_new_privs at startup, re-executing the proxy through /proc/self/exe unless it already runs that way (Linux only; not by default for containers-storage: images as root)")
+	pflag.BoolVar(&withParent, "exit-with-parent", false, "Shut down when the parent process exits (Linux only; the default with --sockfd)")
+	pflag.BoolVarP(&quiet, "quiet", "q", false, "Suppress log messages (the same as --log-level=fatal)")
+	pflag.StringVar(&logLevel, "log-level", "info", "Log messages of at least this level: trace, debug, info, warning, error or fatal")
+	pflag.StringVar(&logFormat, "log-format", "", "Format of log messages: text, json, or journald to send them to the systemd journal (default journald if stderr is connected to it, else text)")
+	pflag.IntVar(&opts.Retries, "retry", 0, "Number of times to retry failed manifest and blob fetches")
+	pflag.DurationVar(&opts.RetryDelay, "retry-delay", time.Second, "Delay before the first retry, doubled (with jitter) for each subsequent one")
+	pflag.BoolVar(&opts.RetryRateLimited, "retry-rate-limited", false, "Also retry fetches rejected by the registry with 429 Too Many Requests")
+	pflag.DurationVar(&opts.RateLimitDelay, "rate-limit-delay", 30*time.Second, "Minimum delay before retrying after 429 Too Many Requests, also suggested to clients via Retry-After, when the registry's own Retry-After is unknown")
+	pflag.DurationVar(&opts.RequestTimeout, "timeout", 0, "Maximum time for handling a request, including streaming the response (0 for no limit)")
+	pflag.DurationVar(&opts.ResponseTimeout, "response-timeout", 0, "Maximum time to wait for the registry to respond to each operation, including connecting (0 for no limit)")
+	pflag.DurationVar(&opts.WriteTimeout, "write-timeout", 0, "Drop a --sockfd or --socket connection if writing a response to it makes no progress for this long (0 for no limit)")
+	pflag.IntVar(&opts.MaxStreams, "max-streams", 0, "Maximum number of requests streaming blob data at once; others are queued, taking turns between connections (0 for no limit)")
+	pflag.StringVar(&bufferSize, "buffer-size", "1MiB", "Kernel buffer size to request for sending responses (socket send buffer, or pipe buffer for stdout); 0 keeps the system default")
+	pflag.StringVar(&maxManifestSize, "max-manifest-size", "4MiB", "Reject manifests and manifest lists larger than this; containers/image never reads more than 4MiB from registries")
+	pflag.StringVar(&maxBandwidth, "max-bandwidth", "", "Limit the combined rate of blob transfers, in bytes per second (e.g. 10MB)")
+	pflag.StringVar(&opts.BlobCacheDir, "blob-cache", "", "Cache blobs in this directory")
+	pflag.StringVar(&blobCacheSize, "blob-cache-size", "10GB", "Maximum size of the blob cache; the least recently used blobs are removed beyond it")
+	pflag.StringVar(&prefetchSize, "prefetch-size", "2GB", "Maximum size of the blobs of a session kept in temporary files by POST /prefetch; the least recently used are dropped beyond it")
+	pflag.StringSliceVar(&opts.TrustedTransports, "trust-transport", nil, "Serve the blobs of images from this transport (e.g. oci or dir) without verifying their digest, as they were verified when written (may be given multiple times)")
+	pflag.BoolVar(&opts.Offline, "offline", false, "Refuse network access; docker:// images are served from the --blob-cache")
+	pflag.IntVar(&credsFd, "creds-fd", -1, "Read the registry credentials from this file descriptor, as JSON: {\"username\": ..., \"password\": ...}, or an identityToken or bearerToken")
+	pflag.IntVar(&pullSecretFd, "k8s-pull-secret-fd", -1, "Read a kubernetes.io/dockerconfigjson pull secret from this file descriptor, and use its credentials for the registries it lists")
+	pflag.StringVar(&opts.AuthFallback, "auth-fallback", "", "If the registry denies access, retry anonymously when credentials were rejected (anonymous), or with credentials after trying anonymously first (credentials)")
+	pflag.StringVar(&registriesConf, "registries-conf", "", "Use this registries.conf file instead of /etc/containers/registries.conf")
+	pflag.StringVar(&userAgent, "user-agent", "", "User-Agent to send to registries, instead of ostree-container-backend/VERSION")
+	pflag.StringVar(&opts.UserAgentSuffix, "user-agent-suffix", "", "Append this to the User-Agent sent to registries (e.g. bootc/1.1), to identify the product using the proxy")
+	pflag.StringVar(&httpProxy, "http-proxy", "", "Connect to registries through this HTTP proxy (e.g. http://proxy.example.com:3128), instead of $HTTPS_PROXY and $HTTP_PROXY")
+	pflag.StringVar(&socks5, "socks5", "", "Connect to registries through this SOCKS5 proxy, as [USER:PASSWORD@]HOST:PORT (e.g. an SSH tunnel or Tor)")
+	pflag.StringVar(&noProxy, "no-proxy", "", "Comma-separated registries (host names, domains like .example.com, or IP ranges, optionally with :port) to connect to directly, instead of $NO_PROXY")
+	pflag.StringArrayVar(&resolve, "resolve", nil, "Resolve a registry host name to these addresses, as HOST=ADDRESS[,ADDRESS...] (may be given multiple times)")
+	pflag.StringArrayVar(&registrySockets, "registry-unix-socket", nil, "Connect to registries through the unix socket at PATH, or only to HOST (or HOST:PORT) with HOST=PATH (may be given multiple times)")
+	pflag.StringArrayVar(&decryptionKeys, "decryption-key", nil, "Decrypt layers encrypted (with ocicrypt) to this private key, a PEM or DER file (may be given multiple times)")
+	pflag.IntSliceVar(&decryptionKeyFds, "decryption-key-fd", nil, "Read a --decryption-key from this file descriptor, e.g. a pipe (may be given multiple times)")
+	pflag.StringVar(&dockerHost, "docker-host", "", "Docker daemon to use for docker-daemon: images (default unix:///var/run/docker.sock)")
+	pflag.IntVar(&pprofFd, "pprof-fd", -1, "Serve net/http/pprof profiles (under /debug/pprof/) on this socket, listening or connected")
+	pflag.IntVar(&metricsFd, "metrics-fd", -1, "Serve Prometheus metrics (under /metrics) on this socket, listening or connected")
+	pflag.StringVar(&metricsSocket, "metrics-socket", "", "Serve Prometheus metrics (under /metrics) on a unix socket at this path")
+	pflag.StringVar(&otlpEndpointFlag, "otlp-endpoint", "", "Export traces of requests and image operations to this OpenTelemetry collector, using OTLP over HTTP (e.g. http://localhost:4318; defaults to $OTEL_EXPORTER_OTLP_ENDPOINT)")
+	pflag.StringVar(&opts.AuditLog, "audit-log", "", "Append a record of the resolved image and manifest digest, and of each blob served, to this file")
+	pflag.BoolVar(&version, "version", false, "show the version ("+imageproxy.Version+")")
+	pflag.Parse()
+	if version {
+		fmt.Printf("%s\n", imageproxy.Version)
+		os.Exit(0)
 	}
-	imgRef, err := alltransports.ParseImageName(h.imageref)
-	if err != nil {
-		return err
+	if quiet && !pflag.CommandLine.Changed("log-level") {
+		logLevel = "fatal"
 	}
-	imgsrc, err := imgRef.NewImageSource(context.Background(), h.sysctx)
-	if err != nil {
+	if err := setupLogging(logLevel, logFormat); err != nil {
 		return err
 	}
-	img, err := image.FromUnparsedImage(context.Background(), h.sysctx, image.UnparsedInstance(imgsrc, nil))
-	if err != nil {
-		return fmt.Errorf("failed to load image: %w", err)
+	// containers-storage needs its capabilities as root, e.g. to mount layers
+	if dropPrivileges && !pflag.CommandLine.Changed("drop-privileges") && os.Geteuid() == 0 && strings.HasPrefix(pflag.Arg(0), "containers-storage:") {
+		logrus.Debug("not dropping privileges for a containers-storage: image as root")
+		dropPrivileges = false
 	}
-	h.img = &img
-	h.imgsrc = &imgsrc
-	return nil
-}
-
-func (h *proxyHandler) implManifest(w http.ResponseWriter, r *http.Request) error {
-	if err := h.ensureImage(); err != nil {
-		return err
+	// This must happen before anything else, as the proxy re-executes
+	// itself to restrict all its threads
+	if dropPrivileges || useLandlock {
+		done, err := restricted(dropPrivileges, useLandlock)
+		if err != nil {
+			return err
+		}
+		if !done {
+			ruleset := -1
+			if useLandlock {
+				if opts.BlobCacheDir != "" {
+					if err := os.MkdirAll(opts.BlobCacheDir, 0700); err != nil {
+						return fmt.Errorf("creating blob cache: %w", err)
+					}
+				}
+				readOnly, readWrite := landlockPaths(pflag.Arg(0), registriesConf, opts.BlobCacheDir, dockerHost)
+				if opts.AuditLog != "" {
+					// Only existing files can be allowed
+					f, err := os.OpenFile(opts.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+					if err != nil {
+						return fmt.Errorf("opening audit log: %w", err)
+					}
+					f.Close()
+					readWrite = append(readWrite, opts.AuditLog)
+				}
+				readOnly = append(readOnly, decryptionKeys...)
+				ruleset, err = landlockRuleset(readOnly, readWrite, []string{socketPath, varlinkPath, grpcPath, metricsSocket})
+				if err != nil {
+					return err
+				}
+			}
+			if err := restrictSelf(dropPrivileges, ruleset); err != nil {
+				return err
+			}
+		}
 	}
-
-	_, err := io.Copy(io.Discard, r.Body)
-	if err != nil {
-		return err
+	modes := 0
+	for _, set := range []bool{len(sockFds) > 0, socketPath != "", varlinkPath != "", grpcPath != "", vsockPort != 0} {
+		if set {
+			modes++
+		}
 	}
-	ctx := context.TODO()
-	rawManifest, _, err := (*h.img).Manifest(ctx)
-	if err != nil {
-		return err
+	if modes > 1 {
+		return fmt.Errorf("--sockfd, --socket, --varlink, --grpc-socket and --vsock-port are mutually exclusive")
 	}
-	digest, err := manifest.Digest(rawManifest)
-	if err != nil {
-		return err
+	if vsockPort != 0 && len(opts.AllowCIDs) == 0 {
+		return fmt.Errorf("--vsock-port requires --allow-cid")
 	}
-	w.Header().Add("Manifest-Digest", digest.String())
-
-	ociManifest, err := manifest.OCI1FromManifest(rawManifest)
-	if err != nil {
-		return err
+	var activated []*os.File
+	if modes == 0 {
+		activated = activationSockets()
 	}
-	ociSerialized, err := ociManifest.Serialize()
-	if err != nil {
-		return err
+	if opts.WriteTimeout > 0 && modes == 0 && activated == nil {
+		return fmt.Errorf("--write-timeout requires --sockfd, --socket, --varlink, --grpc-socket, --vsock-port or socket activation")
 	}
-
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(ociSerialized)))
-	w.WriteHeader(200)
-	_, err = io.Copy(w, bytes.NewReader(ociSerialized))
-	if err != nil {
-		return err
+	if opts.Retries < 0 {
+		return fmt.Errorf("--retry must not be negative")
 	}
-	return nil
-}
-
-func (h *proxyHandler) implBlob(w http.ResponseWriter, r *http.Request, digestStr string) error {
-	if err := h.ensureImage(); err != nil {
-		return err
+	if opts.IdleTimeout < 0 {
+		return fmt.Errorf("--exit-idle-time must not be negative")
 	}
+	// Used for retry jitter
+	rand.Seed(time.Now().UnixNano())
 
-	_, err := io.Copy(io.Discard, r.Body)
-	if err != nil {
-		return err
+	var noProxyFlag *string
+	if pflag.CommandLine.Changed("no-proxy") {
+		noProxyFlag = &noProxy
 	}
-
-	ctx := context.TODO()
-	d, err := digest.Parse(digestStr)
+	sockets, err := parseRegistryUnixSockets(registrySockets)
 	if err != nil {
 		return err
 	}
-	blobr, blobSize, err := (*h.imgsrc).GetBlob(ctx, types.BlobInfo{Digest: d, Size: -1}, h.cache)
-	if err != nil {
+	if err := setProxyEnvironment(httpProxy, socks5, noProxyFlag, sockets); err != nil {
 		return err
 	}
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", blobSize))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.WriteHeader(200)
-	verifier := d.Verifier()
-	tr := io.TeeReader(blobr, verifier)
-	_, err = io.Copy(w, tr)
+	overrides, err := parseResolve(resolve)
 	if err != nil {
 		return err
 	}
-	if !verifier.Verified() {
-		return fmt.Errorf("Corrupted blob, expecting %s", d.String())
-	}
-	return nil
-}
+	setResolveOverrides(overrides)
 
-// ServeHTTP handles two requests:
-//
-// GET /manifest
-// GET /blobs/<digest>
-// POST /quit
-func (h *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
-		if r.URL.Path == "/quit" {
-			w.Header().Set("Content-Length", "0")
-			w.WriteHeader(200)
-			h.shutdown = true
-			return
+	opts.SystemContext = &types.SystemContext{
+		SystemRegistriesConfPath: registriesConf,
+		DockerDaemonHost:         dockerHost,
+		DockerRegistryUserAgent:  userAgent,
+	}
+	if credsFd >= 0 {
+		data, err := readFd("--creds-fd", credsFd)
+		if err != nil {
+			return err
+		}
+		if err := setCredentials(opts.SystemContext, data); err != nil {
+			return err
 		}
 	}
 
-	if r.Method != http.MethodGet {
-		w.Header().Set("Content-Length", "0")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
+	args := pflag.Args()
+	if len(args) > 1 {
+		return fmt.Errorf("At most one IMAGE may be specified")
 	}
-
-	if r.URL.Path == "" || !strings.HasPrefix(r.URL.Path, "/") {
-		w.Header().Set("Content-Length", "0")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	var imageref string
+	if len(args) == 1 {
+		imageref = args[0]
 	}
 
-	var err error
-	if err != nil {
-
+	if size, err := units.RAMInBytes(bufferSize); err != nil || size < 0 {
+		return fmt.Errorf("invalid --buffer-size %q", bufferSize)
+	} else {
+		opts.BufferSize = int(size)
 	}
-
-	if r.URL.Path == "/manifest" {
-		err = h.implManifest(w, r)
-	} else if strings.HasPrefix(r.URL.Path, "/blobs/") {
-		blob := filepath.Base(r.URL.Path)
-		err = h.implBlob(w, r, blob)
+	if size, err := units.RAMInBytes(maxManifestSize); err != nil || size <= 0 {
+		return fmt.Errorf("invalid --max-manifest-size %q", maxManifestSize)
 	} else {
-		w.Header().Set("Content-Length", "0")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		opts.MaxManifestSize = size
 	}
+	opts.DecryptionKeys, err = readDecryptionKeys(decryptionKeys, decryptionKeyFds)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		if !quiet {
-			fmt.Fprintf(os.Stderr, "%v\n", err)
+		return err
+	}
+	if pullSecretFd >= 0 {
+		opts.PullSecret, err = readFd("--k8s-pull-secret-fd", pullSecretFd)
+		if err != nil {
+			return err
 		}
-		w.Write([]byte(err.Error()))
-		return
 	}
-}
-
-type SockResponseWriter struct {
-	out     io.Writer
-	headers http.Header
-}
-
-func (rw SockResponseWriter) Header() http.Header {
-	return rw.headers
-}
-
-func (rw SockResponseWriter) Write(buf []byte) (int, error) {
-	return rw.out.Write(buf)
-}
-
-func (rw SockResponseWriter) WriteHeader(statusCode int) {
-	rw.out.Write([]byte(fmt.Sprintf("HTTP/1.1 %d OK\r\n", statusCode)))
-	rw.headers.Write(rw.out)
-	rw.out.Write([]byte("\r\n"))
-}
-
-func run() error {
-	var version bool
-	var sockFd int
-
-	pflag.IntVar(&sockFd, "sockfd", -1, "Serve on opened socket pair")
-	pflag.BoolVarP(&quiet, "quiet", "q", false, "Suppress output information when copying images")
-	pflag.BoolVar(&version, "version", false, "show the version ("+Version+")")
-	pflag.Parse()
-	if version {
-		fmt.Printf("%s\n", Version)
-		os.Exit(0)
+	if opts.MaxStreams < 0 {
+		return fmt.Errorf("--max-streams must not be negative")
 	}
-
-	sysCtx := &types.SystemContext{
-		DockerRegistryUserAgent: defaultUserAgent,
+	if maxBandwidth != "" {
+		rate, err := units.FromHumanSize(maxBandwidth)
+		if err != nil {
+			return fmt.Errorf("invalid --max-bandwidth: %w", err)
+		}
+		if rate <= 0 {
+			return fmt.Errorf("--max-bandwidth must be positive")
+		}
+		opts.MaxBandwidth = rate
 	}
-
-	args := pflag.Args()
-	if len(args) != 1 {
-		return fmt.Errorf("Exactly one IMAGE is required")
+	if opts.BlobCacheDir != "" {
+		maxSize, err := units.FromHumanSize(blobCacheSize)
+		if err != nil {
+			return fmt.Errorf("invalid --blob-cache-size: %w", err)
+		}
+		opts.BlobCacheSize = maxSize
 	}
-
-	handler := &proxyHandler{
-		imageref: args[0],
-		sysctx:   sysCtx,
-		cache:    blobinfocache.DefaultCache(sysCtx),
+	maxPrefetched, err := units.FromHumanSize(prefetchSize)
+	if err != nil {
+		return fmt.Errorf("invalid --prefetch-size: %w", err)
 	}
-
-	var buf *bufio.ReadWriter
-	if sockFd != -1 {
-		fd := os.NewFile(uintptr(sockFd), "sock")
-		buf = bufio.NewReadWriter(bufio.NewReader(fd), bufio.NewWriter(fd))
-	} else {
-		buf = bufio.NewReadWriter(bufio.NewReader(os.Stdin), bufio.NewWriter(os.Stdout))
+	if maxPrefetched <= 0 {
+		return fmt.Errorf("--prefetch-size must be positive")
+	}
+	opts.PrefetchSize = maxPrefetched
+	tracerProvider, err := imageproxy.NewTracerProvider(context.Background(), otlpEndpointFlag)
+	if err != nil {
+		return err
+	}
+	if tracerProvider != nil {
+		// Exports the remaining spans
+		defer tracerProvider.Shutdown(context.Background())
+		opts.TracerProvider = tracerProvider
+	}
+	server, err := imageproxy.NewServer(imageref, opts)
+	if err != nil {
+		return err
+	}
+	if pprofFd >= 0 {
+		if err := serveHTTPFd("--pprof-fd", pprofFd, pprofHandler()); err != nil {
+			return err
+		}
+	}
+	if metricsFd >= 0 || metricsSocket != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", imageproxy.MetricsHandler())
+		if metricsFd >= 0 {
+			if err := serveHTTPFd("--metrics-fd", metricsFd, mux); err != nil {
+				return err
+			}
+		}
+		if metricsSocket != "" {
+			l, err := listenUnix(metricsSocket)
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+			go func() {
+				if err := http.Serve(l, mux); err != nil && !server.Stopped() {
+					logrus.WithError(err).Error("serving --metrics-socket")
+				}
+			}()
+		}
 	}
 
-	for {
-		req, err := http.ReadRequest(buf.Reader)
-		if err != nil {
-			if err == io.EOF {
-				return nil
+	// serve runs until the clients are done, or the proxy is stopped
+	var serve func() error
+	stdio := false
+	if len(sockFds) > 0 {
+		var conns []net.Conn
+		for _, sockFd := range sockFds {
+			fd := os.NewFile(uintptr(sockFd), "sock")
+			conn, err := imageproxy.FileConn(fd)
+			fd.Close()
+			if err != nil {
+				return fmt.Errorf("invalid socket fd %d: %w", sockFd, err)
 			}
-			return err
+			conns = append(conns, conn)
 		}
-		resp := SockResponseWriter{
-			out:     buf,
-			headers: make(map[string][]string),
+		serve = func() error { return server.ServeConns(conns) }
+	} else if socketPath != "" || varlinkPath != "" || grpcPath != "" {
+		path, protocol := socketPath, imageproxy.ProtocolHTTP
+		if varlinkPath != "" {
+			path, protocol = varlinkPath, imageproxy.ProtocolVarlink
+		} else if grpcPath != "" {
+			path, protocol = grpcPath, imageproxy.ProtocolGRPC
 		}
-		handler.ServeHTTP(resp, req)
-		err = buf.Flush()
+		l, err := listenUnix(path)
 		if err != nil {
 			return err
 		}
-
-		if handler.shutdown {
-			break
+		defer l.Close()
+		serve = func() error { return server.ServeListener(l, protocol) }
+	} else if vsockPort != 0 {
+		l, err := imageproxy.ListenVsock(vsockPort)
+		if err != nil {
+			return err
 		}
+		defer l.Close()
+		serve = func() error { return server.ServeListener(l, imageproxy.ProtocolHTTP) }
+	} else if activated != nil {
+		serve = func() error { return server.ServeActivated(activated) }
+	} else {
+		stdio = true
+		serve = server.ServeStdio
 	}
 
-	if handler.img != nil {
-		if err := (*handler.imgsrc).Close(); err != nil {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	// A client holding the other end of --sockfd won't send POST /quit
+	// if it crashes
+	if !pflag.CommandLine.Changed("exit-with-parent") {
+		withParent = len(sockFds) > 0
+	}
+	if withParent {
+		if err := exitWithParent(); err != nil {
 			return err
 		}
 	}
-
-	return nil
+	// Limit what a malicious registry exploiting a parser bug could do
+	if useSeccomp {
+		if err := installSeccomp(); err != nil {
+			return err
+		}
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- serve()
+	}()
+	select {
+	case err = <-result:
+	case <-server.Idle():
+		logrus.Infof("exiting after being idle for %s", opts.IdleTimeout)
+		server.Stop()
+		// A read from stdin can't be interrupted; as no request is in
+		// progress, there is nothing to wait for anyway.
+		if !stdio {
+			err = <-result
+		}
+	case sig := <-signals:
+		logrus.Infof("received %s, shutting down", sig)
+		err = server.Shutdown(shutdownTimeout)
+		if !stdio {
+			if serveErr := <-result; err == nil {
+				err = serveErr
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return server.Close()
 }
 
 func main() {
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// setProxyEnvironment sets the proxy environment variables according to
+// --http-proxy, --socks5, --registry-unix-socket and --no-proxy, if given.
+// containers/image connects to registries (including for authentication)
+// with transports using http.ProxyFromEnvironment, which reads them once,
+// when first used, so this must be done before anything contacts a
+// registry.
+func setProxyEnvironment(httpProxy, socks5 string, noProxy *string, sockets unixRegistries) error {
+	proxyURL := ""
+	switch {
+	case httpProxy != "" && socks5 != "":
+		return fmt.Errorf("--http-proxy and --socks5 can't be used together")
+	case len(sockets) > 0:
+		if httpProxy != "" || socks5 != "" || noProxy != nil {
+			return fmt.Errorf("--registry-unix-socket can't be used with --http-proxy, --socks5 or --no-proxy")
+		}
+		u, err := startUnixRegistryProxy(sockets)
+		if err != nil {
+			return err
+		}
+		proxyURL = u
+		// All connections go through it, the others directly
+		empty := ""
+		noProxy = &empty
+	case httpProxy != "":
+		u, err := url.Parse(httpProxy)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid --http-proxy %q: expected a URL like http://proxy.example.com:3128", httpProxy)
+		}
+		proxyURL = httpProxy
+	case socks5 != "":
+		u, err := parseSOCKS5(socks5)
+		if err != nil {
+			return err
+		}
+		proxyURL = u.String()
+	}
+	if proxyURL != "" {
+		// Registries are usually reached over HTTPS, which only uses
+		// HTTPS_PROXY
+		for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+			os.Setenv(name, proxyURL)
+		}
+	}
+	if noProxy != nil {
+		os.Setenv("NO_PROXY", *noProxy)
+		os.Setenv("no_proxy", *noProxy)
+	}
+	proxy := os.Getenv("HTTPS_PROXY")
+	if proxy == "" {
+		proxy = os.Getenv("https_proxy")
+	}
+	if proxy != "" {
+		if u, err := url.Parse(proxy); err == nil {
+			proxy = redactedProxy(u)
+		} else {
+			proxy = "(invalid URL)"
+		}
+		logrus.WithFields(logrus.Fields{"proxy": proxy, "no_proxy": os.Getenv("NO_PROXY")}).Debug("connecting to registries through a proxy")
+	}
+	return nil
+}
+
+// parseSOCKS5 parses the [USER:PASSWORD@]HOST:PORT of --socks5 into a
+// socks5:// proxy URL.  net/http sends the host names of registries to
+// SOCKS5 proxies rather than resolving them, as needed with Tor.
+func parseSOCKS5(s string) (*url.URL, error) {
+	u := &url.URL{Scheme: "socks5"}
+	hostPort := s
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		hostPort = s[i+1:]
+		j := strings.Index(s[:i], ":")
+		if j < 1 {
+			return nil, fmt.Errorf("invalid --socks5 %q: expected USER:PASSWORD@ before the host", s)
+		}
+		u.User = url.UserPassword(s[:j], s[j+1:i])
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("invalid --socks5 %q: expected HOST:PORT, e.g. 127.0.0.1:1080", s)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return nil, fmt.Errorf("invalid --socks5 %q: invalid port %q", s, port)
+	}
+	u.Host = hostPort
+	return u, nil
+}
+
+// redactedProxy returns the proxy URL u without its password.
+func redactedProxy(u *url.URL) string {
+	if _, ok := u.User.Password(); ok {
+		r := *u
+		r.User = url.UserPassword(u.User.Username(), "xxxxx")
+		return r.String()
+	}
+	return u.String()
+}
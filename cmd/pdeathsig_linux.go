@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// exitWithParent arranges for the proxy to receive SIGTERM, and so shut
+// down, when its parent exits.  Note that the kernel sends the signal
+// when the thread which spawned the proxy exits, which for a
+// multithreaded client may be before the process does.
+func exitWithParent() error {
+	ppid := os.Getppid()
+	if err := unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(unix.SIGTERM), 0, 0, 0); err != nil {
+		return fmt.Errorf("setting parent death signal: %w", err)
+	}
+	// The parent may have exited before the signal was set up
+	if os.Getppid() != ppid {
+		return unix.Kill(os.Getpid(), unix.SIGTERM)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// exitWithParent is only implemented on Linux.
+func exitWithParent() error {
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS record types and classes answered for --resolve
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+)
+
+// parseResolve parses --resolve HOST=ADDRESS[,ADDRESS...] flags into the
+// addresses of each host, keyed by its lowercase fully qualified name.
+func parseResolve(flags []string) (map[string][]net.IP, error) {
+	overrides := make(map[string][]net.IP)
+	for _, f := range flags {
+		i := strings.Index(f, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid --resolve %q: expected HOST=ADDRESS, e.g. registry.example.com=10.0.0.5", f)
+		}
+		host := strings.ToLower(strings.TrimSuffix(f[:i], ".")) + "."
+		for _, a := range strings.Split(f[i+1:], ",") {
+			ip := net.ParseIP(strings.Trim(a, "[]"))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid --resolve %q: %q is not an IP address", f, a)
+			}
+			overrides[host] = append(overrides[host], ip)
+		}
+	}
+	return overrides, nil
+}
+
+// setResolveOverrides makes host names resolve to the given addresses in
+// this process, as containers/image doesn't allow choosing how it
+// connects to registries.  Go's own resolver is used, with its DNS
+// queries for these names answered in-process, and others sent to the
+// configured name servers as usual; /etc/hosts still takes precedence.
+func setResolveOverrides(overrides map[string][]net.IP) {
+	if len(overrides) == 0 {
+		return
+	}
+	var d net.Dialer
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c := &resolveConn{ctx: ctx, network: network, address: address, overrides: overrides, dialer: &d}
+			if strings.HasPrefix(network, "udp") {
+				// The resolver only sends queries as datagrams to
+				// PacketConns
+				return &resolvePacketConn{c}, nil
+			}
+			return c, nil
+		},
+	}
+}
+
+// resolveConn is a connection to a name server, which answers a query for
+// an overridden name itself, and connects to the name server for others.
+type resolveConn struct {
+	ctx       context.Context
+	network   string
+	address   string
+	overrides map[string][]net.IP
+	dialer    *net.Dialer
+
+	// server is the connection to the name server, once connected
+	server net.Conn
+	// reply is the rest of the answer to read, if answered here
+	reply []byte
+	// deadline is the deadline to apply to server
+	deadline time.Time
+}
+
+func (c *resolveConn) Write(b []byte) (int, error) {
+	if c.server != nil {
+		return c.server.Write(b)
+	}
+	query := b
+	stream := !strings.HasPrefix(c.network, "udp")
+	if stream {
+		// Messages are prefixed with their length over TCP
+		if len(query) < 2 {
+			return 0, fmt.Errorf("short DNS query")
+		}
+		query = query[2:]
+	}
+	if reply := answerQuery(query, c.overrides); reply != nil {
+		if stream {
+			reply = append([]byte{byte(len(reply) >> 8), byte(len(reply))}, reply...)
+		}
+		c.reply = reply
+		return len(b), nil
+	}
+	server, err := c.dialer.DialContext(c.ctx, c.network, c.address)
+	if err != nil {
+		return 0, err
+	}
+	if !c.deadline.IsZero() {
+		server.SetDeadline(c.deadline)
+	}
+	c.server = server
+	return server.Write(b)
+}
+
+func (c *resolveConn) Read(b []byte) (int, error) {
+	if c.server != nil {
+		return c.server.Read(b)
+	}
+	if c.reply == nil {
+		return 0, fmt.Errorf("no DNS query sent")
+	}
+	n := copy(b, c.reply)
+	c.reply = c.reply[n:]
+	return n, nil
+}
+
+func (c *resolveConn) Close() error {
+	if c.server != nil {
+		return c.server.Close()
+	}
+	return nil
+}
+
+func (c *resolveConn) LocalAddr() net.Addr {
+	if c.server != nil {
+		return c.server.LocalAddr()
+	}
+	return nil
+}
+
+func (c *resolveConn) RemoteAddr() net.Addr {
+	if c.server != nil {
+		return c.server.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *resolveConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	if c.server != nil {
+		return c.server.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *resolveConn) SetReadDeadline(t time.Time) error {
+	if c.server != nil {
+		return c.server.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *resolveConn) SetWriteDeadline(t time.Time) error {
+	if c.server != nil {
+		return c.server.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// resolvePacketConn is a resolveConn over UDP, each Read and Write being a
+// whole message.
+type resolvePacketConn struct {
+	*resolveConn
+}
+
+func (c *resolvePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *resolvePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// answerQuery returns the reply to a DNS query for the A or AAAA records
+// of an overridden name, with the addresses of its family, or nil if the
+// query is for anything else.
+func answerQuery(query []byte, overrides map[string][]net.IP) []byte {
+	// The header is followed by the question: the name, as labels
+	// prefixed by their length, then the type and class
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return nil
+	}
+	var name strings.Builder
+	i := 12
+	for {
+		if i >= len(query) {
+			return nil
+		}
+		n := int(query[i])
+		i++
+		if n == 0 {
+			break
+		}
+		if n > 63 || i+n > len(query) {
+			return nil
+		}
+		name.WriteString(strings.ToLower(string(query[i : i+n])))
+		name.WriteByte('.')
+		i += n
+	}
+	if i+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[i : i+2])
+	if binary.BigEndian.Uint16(query[i+2:i+4]) != dnsClassIN || (qtype != dnsTypeA && qtype != dnsTypeAAAA) {
+		return nil
+	}
+	addrs, ok := overrides[name.String()]
+	if !ok {
+		return nil
+	}
+	question := query[12 : i+4]
+
+	var answers [][]byte
+	for _, ip := range addrs {
+		rdata := ip.To4()
+		if qtype == dnsTypeAAAA {
+			if rdata != nil {
+				continue
+			}
+			rdata = ip.To16()
+		} else if rdata == nil {
+			continue
+		}
+		// The name is a pointer to the one in the question
+		rr := []byte{0xc0, 12, 0, 0, 0, dnsClassIN, 0, 0, 0, 60, 0, 0}
+		binary.BigEndian.PutUint16(rr[2:4], qtype)
+		binary.BigEndian.PutUint16(rr[10:12], uint16(len(rdata)))
+		answers = append(answers, append(rr, rdata...))
+	}
+	reply := make([]byte, 12, 512)
+	copy(reply[0:2], query[0:2])
+	// A response, authoritative, with recursion desired as in the query
+	// and available
+	flags := uint16(0x8480) | binary.BigEndian.Uint16(query[2:4])&0x0100
+	binary.BigEndian.PutUint16(reply[2:4], flags)
+	binary.BigEndian.PutUint16(reply[4:6], 1)
+	binary.BigEndian.PutUint16(reply[6:8], uint16(len(answers)))
+	reply = append(reply, question...)
+	for _, rr := range answers {
+		reply = append(reply, rr...)
+	}
+	return reply
+}
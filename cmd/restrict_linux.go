@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// reexecEnv is set when the proxy re-executes itself once restricted.
+const reexecEnv = "_CONTAINER_IMAGE_PROXY_RESTRICTED"
+
+// restricted returns true if the proxy is already restricted as asked,
+// checking the actual state of the process: no_new_privs must be set and,
+// with dropCaps, no capabilities may be left.  Landlock rulesets can't be
+// inspected, so with landlock the proxy must also have been re-executed by
+// restrictSelf, which sets reexecEnv; that alone is never trusted.
+func restricted(dropCaps, landlock bool) (bool, error) {
+	reexecuted := os.Getenv(reexecEnv) != ""
+	os.Unsetenv(reexecEnv)
+	ok := noNewPrivs() && (!dropCaps || capabilitiesDropped())
+	if reexecuted && !ok {
+		return false, fmt.Errorf("still not restricted after re-executing the proxy")
+	}
+	return ok && (reexecuted || !landlock), nil
+}
+
+// noNewPrivs returns true if no_new_privs is set.
+func noNewPrivs() bool {
+	set, err := unix.PrctlRetInt(unix.PR_GET_NO_NEW_PRIVS, 0, 0, 0, 0)
+	return err == nil && set == 1
+}
+
+// capabilitiesDropped returns true if the calling thread has no
+// capabilities, nor any to gain by executing a program: as root, this
+// requires the bounding set to be empty.
+func capabilitiesDropped() bool {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return false
+	}
+	for _, d := range data {
+		if d.Effective != 0 || d.Permitted != 0 || d.Inheritable != 0 {
+			return false
+		}
+	}
+	if ambient, err := unix.PrctlRetInt(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_IS_SET, 0, 0, 0); err == nil && ambient != 0 {
+		return false
+	}
+	if os.Geteuid() != 0 {
+		return true
+	}
+	for c := 0; ; c++ {
+		inSet, err := unix.PrctlRetInt(unix.PR_CAPBSET_READ, uintptr(c), 0, 0, 0)
+		if err != nil {
+			return true
+		}
+		if inSet != 0 {
+			return false
+		}
+	}
+}
+
+// dropCapabilities clears all the capabilities of the calling thread,
+// including the bounding set if it is allowed to, so that they aren't
+// regained on execve even as root.
+func dropCapabilities() error {
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("clearing ambient capabilities: %w", err)
+	}
+	for c := 0; ; c++ {
+		// Past the last capability the kernel supports
+		if _, err := unix.PrctlRetInt(unix.PR_CAPBSET_READ, uintptr(c), 0, 0, 0); err != nil {
+			break
+		}
+		// Without CAP_SETPCAP, there are no capabilities to regain anyway
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil && err != unix.EPERM {
+			return fmt.Errorf("dropping capability %d from the bounding set: %w", c, err)
+		}
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("clearing capabilities: %w", err)
+	}
+	return nil
+}
+
+// restrictSelf drops the capabilities of the proxy (if dropCaps is set),
+// sets no_new_privs and enforces the Landlock ruleset (unless it is
+// negative).  As these only apply to the calling thread, and the Go
+// runtime has several, the proxy then re-executes itself (which requires
+// /proc), so that it starts over restricted; use restricted to tell.
+func restrictSelf(dropCaps bool, ruleset int) error {
+	// This thread must be the one to execute the proxy again
+	runtime.LockOSThread()
+	if dropCaps {
+		if err := dropCapabilities(); err != nil {
+			return err
+		}
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("setting no_new_privs: %w", err)
+	}
+	if ruleset >= 0 {
+		if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0); errno != 0 {
+			return fmt.Errorf("enforcing Landlock ruleset: %w", errno)
+		}
+	}
+	env := append(os.Environ(), reexecEnv+"=1")
+	if err := unix.Exec("/proc/self/exe", os.Args, env); err != nil {
+		return fmt.Errorf("re-executing the proxy (is /proc mounted?): %w", err)
+	}
+	return nil
+}
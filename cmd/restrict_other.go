@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// restricted is only implemented on Linux.
+func restricted(dropCaps, landlock bool) (bool, error) {
+	return false, nil
+}
+
+// restrictSelf is only implemented on Linux; elsewhere there is nothing
+// to drop.
+func restrictSelf(dropCaps bool, ruleset int) error {
+	return nil
+}
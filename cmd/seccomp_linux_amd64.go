@@ -0,0 +1,16 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// seccompArch is AUDIT_ARCH_X86_64.
+const seccompArch = 0xc000003e
+
+// seccompArchSyscalls are the legacy system calls which still exist on
+// amd64, and which libc may use.
+var seccompArchSyscalls = []uintptr{
+	unix.SYS_ARCH_PRCTL, unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_NEWFSTATAT, unix.SYS_ACCESS,
+	unix.SYS_READLINK, unix.SYS_RENAME, unix.SYS_UNLINK, unix.SYS_MKDIR, unix.SYS_PIPE, unix.SYS_DUP2,
+	unix.SYS_POLL, unix.SYS_SELECT, unix.SYS_EPOLL_WAIT, unix.SYS_TIME,
+}
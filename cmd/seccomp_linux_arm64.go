@@ -0,0 +1,14 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// seccompArch is AUDIT_ARCH_AARCH64.
+const seccompArch = 0xc00000b7
+
+// seccompArchSyscalls are the system calls which are only named
+// differently on arm64.
+var seccompArchSyscalls = []uintptr{
+	unix.SYS_FSTATAT,
+}
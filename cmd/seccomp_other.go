@@ -0,0 +1,13 @@
+//go:build !linux || (!amd64 && !arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+import (
+	"fmt"
+)
+
+// installSeccomp is only implemented on Linux, for amd64 and arm64.
+func installSeccomp() error {
+	return fmt.Errorf("--seccomp is not supported on this platform")
+}
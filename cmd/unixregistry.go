@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// unixRegistries maps registries (HOST or HOST:PORT) to the unix sockets
+// they listen on; the one for "" is used for all others, if any.
+type unixRegistries map[string]string
+
+// parseRegistryUnixSockets parses --registry-unix-socket [HOST=]PATH flags.
+func parseRegistryUnixSockets(flags []string) (unixRegistries, error) {
+	sockets := make(unixRegistries)
+	for _, f := range flags {
+		host, path := "", f
+		if i := strings.Index(f, "="); i >= 0 {
+			host, path = strings.ToLower(f[:i]), f[i+1:]
+			if host == "" {
+				return nil, fmt.Errorf("invalid --registry-unix-socket %q: expected [HOST=]PATH", f)
+			}
+		}
+		if path == "" {
+			return nil, fmt.Errorf("invalid --registry-unix-socket %q: expected [HOST=]PATH", f)
+		}
+		if _, ok := sockets[host]; ok {
+			if host == "" {
+				return nil, fmt.Errorf("--registry-unix-socket PATH given more than once")
+			}
+			return nil, fmt.Errorf("--registry-unix-socket given more than once for %s", host)
+		}
+		sockets[host] = path
+	}
+	return sockets, nil
+}
+
+// socketFor returns the unix socket of the registry at addr (HOST:PORT),
+// if any.
+func (s unixRegistries) socketFor(addr string) (string, bool) {
+	addr = strings.ToLower(addr)
+	if path, ok := s[addr]; ok {
+		return path, true
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if path, ok := s[host]; ok {
+			return path, true
+		}
+	}
+	path, ok := s[""]
+	return path, ok
+}
+
+func (s unixRegistries) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if path, ok := s.socketFor(addr); ok {
+		return d.DialContext(ctx, "unix", path)
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// startUnixRegistryProxy starts an HTTP proxy on the loopback interface,
+// which connects to the registries in sockets through their unix socket,
+// and to others directly, returning its URL.  containers/image can only
+// connect to registries over TCP, but does so through the proxy set in
+// the environment, whatever their name (except localhost).  The proxy
+// requires a random password, so that other local users can't use it.
+func startUnixRegistryProxy(sockets unixRegistries) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("listening for registry connections: %w", err)
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	password := hex.EncodeToString(secret)
+	p := &unixRegistryProxy{
+		sockets:       sockets,
+		authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("imageproxy:"+password)),
+	}
+	p.reverse = &httputil.ReverseProxy{
+		Director:  func(*http.Request) {},
+		Transport: &http.Transport{DialContext: sockets.dial, DisableKeepAlives: true},
+	}
+	go func() {
+		if err := http.Serve(l, p); err != nil {
+			logrus.WithError(err).Error("registry unix socket proxy failed")
+		}
+	}()
+	return fmt.Sprintf("http://imageproxy:%s@%s", password, l.Addr()), nil
+}
+
+type unixRegistryProxy struct {
+	sockets       unixRegistries
+	authorization string
+	// reverse forwards plain HTTP requests
+	reverse *httputil.ReverseProxy
+}
+
+func (p *unixRegistryProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Proxy-Authorization")), []byte(p.authorization)) != 1 {
+		http.Error(w, "proxy authorization required", http.StatusProxyAuthRequired)
+		return
+	}
+	r.Header.Del("Proxy-Authorization")
+	if r.Method != http.MethodConnect {
+		if r.URL.Host == "" {
+			http.Error(w, "expected a proxy request", http.StatusBadRequest)
+			return
+		}
+		p.reverse.ServeHTTP(w, r)
+		return
+	}
+
+	// Tunnel a connection, e.g. for HTTPS
+	upstream, err := p.sockets.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		logrus.WithError(err).WithField("registry", r.Host).Debug("connecting to registry failed")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't tunnel connections", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		// Anything the client sent after the request is buffered
+		io.Copy(upstream, buffered)
+		closeWrite(upstream)
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	closeWrite(conn)
+	<-done
+}
+
+// closeWrite shuts down the writing side of c, if it supports that.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
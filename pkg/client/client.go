@@ -0,0 +1,529 @@
+// Package client talks to a container-image-proxy over a unix socket,
+// either one it spawns (with --sockfd) or one it connects to (--socket).
+//
+// Requests are pipelined on the connection with a Request-Id, so that
+// they can be made concurrently.  Blobs are written by the proxy to a pipe
+// passed along with the request (?fd=1), so streaming them doesn't hold up
+// the other requests.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Error is a failure reported by the proxy, as described in the README.
+type Error struct {
+	// Code is one of the error codes, e.g. ENOTFOUND
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+	// Status is the HTTP status of the failed registry response, if any
+	Status int `json:"status,omitempty"`
+	// Endpoint is the registry involved, if known
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// result is the response to a request, with its body.
+type result struct {
+	resp *http.Response
+	body []byte
+	err  error
+}
+
+// Client is a connection to the proxy.  Its methods may be called
+// concurrently.
+type Client struct {
+	conn *net.UnixConn
+	// cmd is the proxy, if spawned
+	cmd *exec.Cmd
+
+	// writeLock serializes sending requests, so that the responses
+	// without a Request-Id can be matched by their order
+	writeLock sync.Mutex
+
+	// lock protects the fields below
+	lock   sync.Mutex
+	nextID uint64
+	// pending are the requests with a Request-Id waiting for a response
+	pending map[string]chan result
+	// inOrder are the requests without a Request-Id, in the order sent
+	inOrder []chan result
+	// err is set once the connection failed
+	err error
+}
+
+// New returns a client for a connection to the proxy.
+func New(conn *net.UnixConn) *Client {
+	c := &Client{
+		conn:    conn,
+		pending: make(map[string]chan result),
+	}
+	go c.readResponses()
+	return c
+}
+
+// Connect connects to a proxy listening on the unix socket at path, with
+// --socket.
+func Connect(path string) (*Client, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	return New(conn), nil
+}
+
+// Spawn starts the proxy at path (container-image-proxy in $PATH if
+// empty) for image, with the additional command line args, and returns a
+// client connected to it.  The proxy exits when the client is closed.
+func Spawn(path, image string, args ...string) (*Client, error) {
+	if path == "" {
+		path = "container-image-proxy"
+	}
+	// Like os/exec, keep other children from inheriting our end
+	syscall.ForkLock.RLock()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err == nil {
+		unix.CloseOnExec(fds[0])
+		unix.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("creating socket pair: %w", err)
+	}
+	ours := os.NewFile(uintptr(fds[0]), "proxy socket")
+	defer ours.Close()
+	theirs := os.NewFile(uintptr(fds[1]), "proxy socket")
+	defer theirs.Close()
+
+	cmd := exec.Command(path, append(append([]string{"--sockfd", "3"}, args...), image)...)
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	conn, err := net.FileConn(ours)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	c := New(conn.(*net.UnixConn))
+	c.cmd = cmd
+	return c, nil
+}
+
+// Close ends the session (or shuts down a spawned proxy) with
+// POST /quit, once its requests in progress are done, and closes the
+// connection.
+func (c *Client) Close() error {
+	return c.quit("/quit")
+}
+
+// Abort is like Close, but aborts the requests in progress rather than
+// waiting for them.
+func (c *Client) Abort() error {
+	return c.quit("/quit?force=1")
+}
+
+func (c *Client) quit(path string) error {
+	ch, _, err := c.send(http.MethodPost, path, nil, false, nil)
+	if err == nil {
+		_, err = c.wait(context.Background(), ch, "")
+	}
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	if c.cmd != nil {
+		if werr := c.cmd.Wait(); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// readResponses reads the responses, handing each to the request it
+// answers, until the connection fails.
+func (c *Client) readResponses() {
+	r := bufio.NewReader(c.conn)
+	for {
+		resp, err := http.ReadResponse(r, nil)
+		var body []byte
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("the proxy closed the connection")
+			}
+			c.fail(err)
+			return
+		}
+		var ch chan result
+		c.lock.Lock()
+		if id := resp.Header.Get("Request-Id"); id != "" {
+			ch = c.pending[id]
+			delete(c.pending, id)
+		} else if len(c.inOrder) > 0 {
+			ch = c.inOrder[0]
+			c.inOrder = c.inOrder[1:]
+		}
+		c.lock.Unlock()
+		// The response to an abandoned request is dropped
+		if ch != nil {
+			ch <- result{resp: resp, body: body}
+		}
+	}
+}
+
+// fail fails the requests waiting for a response, and any made later.
+func (c *Client) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.err = err
+	for id, ch := range c.pending {
+		ch <- result{err: err}
+		delete(c.pending, id)
+	}
+	for _, ch := range c.inOrder {
+		ch <- result{err: err}
+	}
+	c.inOrder = nil
+}
+
+// send sends a request, with a Request-Id if async, and f (if not nil)
+// as ancillary data.  It returns the channel its response is sent to, and
+// its Request-Id.
+func (c *Client) send(method, path string, body []byte, async bool, f *os.File) (chan result, string, error) {
+	ch := make(chan result, 1)
+	var id string
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: proxy\r\n", method, path)
+	if body != nil {
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n", len(body))
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.lock.Lock()
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return nil, "", err
+	}
+	if async {
+		c.nextID++
+		id = strconv.FormatUint(c.nextID, 10)
+		c.pending[id] = ch
+		fmt.Fprintf(&buf, "Request-Id: %s\r\n", id)
+	} else {
+		c.inOrder = append(c.inOrder, ch)
+	}
+	c.lock.Unlock()
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	var oob []byte
+	if f != nil {
+		oob = unix.UnixRights(int(f.Fd()))
+	}
+	n, _, err := c.conn.WriteMsgUnix(buf.Bytes(), oob, nil)
+	if err == nil && n < buf.Len() {
+		_, err = c.conn.Write(buf.Bytes()[n:])
+	}
+	if err != nil {
+		// The connection is unusable; this fails the pending requests
+		c.conn.Close()
+		return nil, "", err
+	}
+	return ch, id, nil
+}
+
+// wait waits for the response on ch.  If ctx is done first, the request
+// is cancelled if it has a Request-Id.
+func (c *Client) wait(ctx context.Context, ch chan result, id string) (*result, error) {
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return nil, res.err
+		}
+		if res.resp.StatusCode >= 300 {
+			e := &Error{}
+			if err := json.Unmarshal(res.body, e); err != nil || e.Code == "" {
+				e = &Error{Code: "EIO", Message: res.resp.Status}
+			}
+			return nil, e
+		}
+		return &res, nil
+	case <-ctx.Done():
+		if id != "" {
+			c.lock.Lock()
+			delete(c.pending, id)
+			c.lock.Unlock()
+			c.cancel(id)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// cancel aborts the request with the Request-Id id, in the background.
+func (c *Client) cancel(id string) {
+	ch, _, err := c.send(http.MethodPost, "/cancel", []byte(id), false, nil)
+	if err != nil {
+		return
+	}
+	// The request may well have completed already
+	go c.wait(context.Background(), ch, "")
+}
+
+// SetImage replaces the image of the session with ref, once its requests
+// in progress are done, returning an error if it can't be opened.
+func (c *Client) SetImage(ctx context.Context, ref string) error {
+	ch, id, err := c.send(http.MethodPost, "/image", []byte(ref), false, nil)
+	if err == nil {
+		_, err = c.wait(ctx, ch, id)
+	}
+	return err
+}
+
+// GetManifest returns the manifest of the image, converted into OCI
+// format, and the digest of the original manifest.
+func (c *Client) GetManifest(ctx context.Context) (io.ReadCloser, string, error) {
+	r, digests, err := c.GetManifestDigests(ctx)
+	return r, digests.Digest, err
+}
+
+// ManifestDigests are the digests of the manifest returned by
+// GetManifestDigests.
+type ManifestDigests struct {
+	// Digest is that of the original manifest, as served by the registry
+	Digest string
+	// OCIDigest is that of the manifest converted into OCI format
+	OCIDigest string
+}
+
+// GetManifestDigests is like GetManifest, also returning the digest of the
+// converted manifest; either may be used to pin the image.
+func (c *Client) GetManifestDigests(ctx context.Context) (io.ReadCloser, ManifestDigests, error) {
+	ch, id, err := c.send(http.MethodGet, "/manifest", nil, true, nil)
+	if err != nil {
+		return nil, ManifestDigests{}, err
+	}
+	res, err := c.wait(ctx, ch, id)
+	if err != nil {
+		return nil, ManifestDigests{}, err
+	}
+	digests := ManifestDigests{
+		Digest:    res.resp.Header.Get("Manifest-Digest"),
+		OCIDigest: res.resp.Header.Get("OCI-Manifest-Digest"),
+	}
+	return io.NopCloser(bytes.NewReader(res.body)), digests, nil
+}
+
+// GetBlob returns the blob with the given digest, which is verified: the
+// reader only returns io.EOF once the proxy reported that the blob was
+// completely written and its digest matched.  Closing the reader early
+// cancels the request.
+func (c *Client) GetBlob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	ch, id, err := c.send(http.MethodGet, "/blobs/"+url.PathEscape(digest)+"?fd=1", nil, true, w)
+	// The proxy has its own copy now, so that the pipe ends once it
+	// closes it
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	br := &blobReader{c: c, ctx: ctx, f: r, id: id, ch: ch, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			// The proxy then closes the pipe, failing the read in
+			// progress
+			c.cancel(id)
+		case <-br.done:
+		}
+	}()
+	return br, nil
+}
+
+// blobReader reads a blob from the pipe passed to the proxy, and checks
+// the response once the pipe was closed.
+type blobReader struct {
+	c   *Client
+	ctx context.Context
+	f   *os.File
+	id  string
+	ch  chan result
+	// done is closed once the request completed, or the reader is closed
+	done     chan struct{}
+	doneOnce sync.Once
+	finished bool
+	err      error
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.f.Read(p)
+	if err == io.EOF {
+		r.finished = true
+		// The response is only sent once the blob was completely
+		// written and verified
+		if _, err = r.c.wait(context.Background(), r.ch, ""); err == nil {
+			err = io.EOF
+		} else if r.ctx.Err() != nil {
+			err = r.ctx.Err()
+		}
+		r.doneOnce.Do(func() { close(r.done) })
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *blobReader) Close() error {
+	if !r.finished {
+		r.c.lock.Lock()
+		delete(r.c.pending, r.id)
+		r.c.lock.Unlock()
+		r.c.cancel(r.id)
+	}
+	r.doneOnce.Do(func() { close(r.done) })
+	return r.f.Close()
+}
+
+// GetTOC returns the table of contents of a zstd:chunked or eStargz layer,
+// as JSON, and its format (zstd:chunked or estargz).  With it, clients can
+// fetch individual files or chunks with ranged requests.
+func (c *Client) GetTOC(ctx context.Context, digest string) (toc []byte, format string, err error) {
+	ch, id, err := c.send(http.MethodGet, "/toc/"+url.PathEscape(digest), nil, true, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	res, err := c.wait(ctx, ch, id)
+	if err != nil {
+		return nil, "", err
+	}
+	return res.body, res.resp.Header.Get("Toc-Format"), nil
+}
+
+// UncompressedSize is the uncompressed size of a layer, as returned by
+// GetBlobUncompressedSize.
+type UncompressedSize struct {
+	Size int64 `json:"size"`
+	// Exact is false for estimates from the TOC of chunked layers
+	Exact bool `json:"exact"`
+	// Source is cache, toc or decompressed
+	Source string `json:"source"`
+}
+
+// GetBlobUncompressedSize returns the uncompressed size of a layer, to
+// preallocate space or report the progress of applying it.  With exact,
+// it is never estimated; the proxy may have to fetch and decompress the
+// layer to measure it.
+func (c *Client) GetBlobUncompressedSize(ctx context.Context, digest string, exact bool) (UncompressedSize, error) {
+	path := "/uncompressed-size/" + url.PathEscape(digest)
+	if exact {
+		path += "?exact=1"
+	}
+	ch, id, err := c.send(http.MethodGet, path, nil, true, nil)
+	if err != nil {
+		return UncompressedSize{}, err
+	}
+	res, err := c.wait(ctx, ch, id)
+	if err != nil {
+		return UncompressedSize{}, err
+	}
+	var size UncompressedSize
+	err = json.Unmarshal(res.body, &size)
+	return size, err
+}
+
+// GetPipeProgress returns how many bytes of a blob returned by GetBlob
+// were fetched so far, and its total size, while the proxy writes it to
+// the pipe.  This is the compressed data, as it comes from the registry.
+// It fails with ENOTFOUND once the proxy is done with the blob.
+func (c *Client) GetPipeProgress(ctx context.Context, blob io.ReadCloser) (fetched, total int64, err error) {
+	br, ok := blob.(*blobReader)
+	if !ok {
+		return 0, 0, fmt.Errorf("not a blob returned by GetBlob")
+	}
+	ch, id, err := c.send(http.MethodGet, "/progress?id="+url.QueryEscape(br.id), nil, true, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	res, err := c.wait(ctx, ch, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	var progress struct {
+		Bytes int64 `json:"bytes"`
+		Size  int64 `json:"size"`
+	}
+	if err := json.Unmarshal(res.body, &progress); err != nil {
+		return 0, 0, err
+	}
+	return progress.Bytes, progress.Size, nil
+}
+
+// Event is a progress event, as returned by the stream of Events.
+type Event struct {
+	// Event is one of blob-start, blob-progress, blob-done, retry and
+	// resume
+	Event       string `json:"event"`
+	Digest      string `json:"digest,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Bytes       int64  `json:"bytes,omitempty"`
+	ThrottledMs int64  `json:"throttledMs,omitempty"`
+	Operation   string `json:"operation,omitempty"`
+	Attempt     string `json:"attempt,omitempty"`
+	DelayMs     int64  `json:"delayMs,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Cached      bool   `json:"cached,omitempty"`
+}
+
+// Events returns the stream of progress events of the requests made from
+// now on, as newline-delimited JSON which decodes into Event.  Events are
+// dropped if they aren't read fast enough.  The stream ends when the
+// connection is closed, and replaces any previous one.
+func (c *Client) Events(ctx context.Context) (io.ReadCloser, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	ch, id, err := c.send(http.MethodPost, "/events?fd=1", nil, true, w)
+	w.Close()
+	if err == nil {
+		_, err = c.wait(ctx, ch, id)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,62 @@
+package imageproxy
+
+import (
+	"context"
+	"encoding/json"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ociArtifactFields are the fields of an OCI manifest which tell
+// artifacts from container images.
+type ociArtifactFields struct {
+	ArtifactType string `json:"artifactType"`
+	Config       struct {
+		MediaType string `json:"mediaType"`
+	} `json:"config"`
+}
+
+// artifactType returns the type of the OCI artifact (e.g. a Helm chart
+// or WASM module) described by an image manifest, or "" for container
+// images.  Artifacts are recognised by a config which isn't an image
+// config; their type is the artifactType of the manifest if set, and
+// otherwise the media type of the config.
+func artifactType(rawManifest []byte, mimeType string) string {
+	if mimeType != imgspecv1.MediaTypeImageManifest {
+		return ""
+	}
+	var m ociArtifactFields
+	if err := json.Unmarshal(rawManifest, &m); err != nil {
+		return ""
+	}
+	if m.Config.MediaType == imgspecv1.MediaTypeImageConfig || m.Config.MediaType == "" {
+		return ""
+	}
+	if m.ArtifactType != "" {
+		return m.ArtifactType
+	}
+	return m.Config.MediaType
+}
+
+// imageArtifactType returns the artifact type of the opened image, or ""
+// if it is a container image.
+func (h *proxyHandler) imageArtifactType(ctx context.Context) (string, error) {
+	rawManifest, mimeType, err := h.loadedImage().Manifest(ctx)
+	if err != nil {
+		return "", err
+	}
+	return artifactType(rawManifest, mimeType), nil
+}
+
+// requireContainerImage fails if the opened image is an OCI artifact,
+// whose layers aren't filesystem layers and which has no image config.
+func (h *proxyHandler) requireContainerImage(ctx context.Context) error {
+	t, err := h.imageArtifactType(ctx)
+	if err != nil {
+		return err
+	}
+	if t != "" {
+		return invalidRequestf("%s is an OCI artifact of type %s, not a container image", h.imageName(), t)
+	}
+	return nil
+}
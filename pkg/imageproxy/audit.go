@@ -0,0 +1,97 @@
+package imageproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// auditLog records the images resolved and the blobs served, one JSON
+// object per line, so that what was delivered can be reconstructed later.
+// The file is only ever appended to, and each record is synced to disk
+// before the data it describes is served.
+type auditLog struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+// auditRecord is a line of the audit log.  Event is "image" when the
+// IMAGE is resolved, "blob" when a blob of it is served, or "copy" when
+// a blob is copied to a destination.
+type auditRecord struct {
+	Time           time.Time     `json:"time"`
+	Event          string        `json:"event"`
+	Image          string        `json:"image"`
+	Resolved       string        `json:"resolved,omitempty"`
+	ManifestDigest digest.Digest `json:"manifestDigest,omitempty"`
+	Digest         digest.Digest `json:"digest,omitempty"`
+	Size           int64         `json:"size,omitempty"`
+	Range          string        `json:"range,omitempty"`
+	Destination    string        `json:"destination,omitempty"`
+}
+
+// openAuditLog opens (creating it if needed) the audit log at path.
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	return &auditLog{f: f}, nil
+}
+
+// record appends rec to the log.  Serving should fail if it can't be
+// recorded.
+func (a *auditLog) record(rec auditRecord) error {
+	if a == nil {
+		return nil
+	}
+	rec.Time = time.Now().UTC()
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	// A single write, so that concurrent proxies can share the log
+	if _, err := a.f.Write(buf); err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	if err := a.f.Sync(); err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	return nil
+}
+
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+// auditImage records the image which the IMAGE resolved to.
+func (h *proxyHandler) auditImage(ctx context.Context, src types.ImageSource, img types.Image) error {
+	rawManifest, _, err := img.Manifest(ctx)
+	if err != nil {
+		return err
+	}
+	d, err := manifest.Digest(rawManifest)
+	if err != nil {
+		return err
+	}
+	return h.audit.record(auditRecord{
+		Event:          "image",
+		Image:          h.imageref,
+		Resolved:       transports.ImageName(src.Reference()),
+		ManifestDigest: d,
+	})
+}
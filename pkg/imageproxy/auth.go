@@ -0,0 +1,54 @@
+package imageproxy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// The values of Options.AuthFallback.
+const (
+	// authFallbackAnonymous retries anonymously if credentials are rejected
+	authFallbackAnonymous = "anonymous"
+	// authFallbackCredentials tries anonymously first, then with credentials
+	authFallbackCredentials = "credentials"
+)
+
+// anonymousSystemContext returns a copy of sys which sends no credentials
+// to registries.
+func anonymousSystemContext(sys *types.SystemContext) *types.SystemContext {
+	anonymous := *sys
+	anonymous.DockerAuthConfig = &types.DockerAuthConfig{}
+	anonymous.DockerBearerRegistryToken = ""
+	return &anonymous
+}
+
+// newImageSource opens ref with the backend.  Registries which reject the
+// credentials (or their absence) are tried again the other way if
+// h.authFallback says so, e.g. for mirrors which reject the credentials
+// meant for the registry they mirror.
+func (h *proxyHandler) newImageSource(ctx context.Context, ref types.ImageReference) (types.ImageSource, error) {
+	sys := h.systemContext(ref)
+	if h.authFallback == "" || ref.Transport().Name() != docker.Transport.Name() {
+		return h.backend.newImageSource(ctx, sys, ref)
+	}
+	first, second := sys, anonymousSystemContext(sys)
+	how := "anonymously"
+	if h.authFallback == authFallbackCredentials {
+		first, second = second, first
+		how = "with credentials"
+	}
+	src, err := h.backend.newImageSource(ctx, first, ref)
+	if err == nil || !isUnauthorized(err) {
+		return src, err
+	}
+	logrus.WithError(err).WithField("image", h.imageref).Infof("access denied, retrying %s", how)
+	src, fallbackErr := h.backend.newImageSource(ctx, second, ref)
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("%v; retrying %s: %w", err, how, fallbackErr)
+	}
+	return src, nil
+}
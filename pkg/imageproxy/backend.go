@@ -0,0 +1,29 @@
+package imageproxy
+
+import (
+	"context"
+
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/types"
+)
+
+// imageBackend opens the images served.  The handlers only get image
+// sources and images from it, so that they can be tested against a fake
+// one serving synthetic images, or failing on purpose.
+type imageBackend interface {
+	// newImageSource opens the image ref refers to.
+	newImageSource(ctx context.Context, sys *types.SystemContext, ref types.ImageReference) (types.ImageSource, error)
+	// newImage parses the manifest and config of the image src serves.
+	newImage(ctx context.Context, sys *types.SystemContext, src types.ImageSource) (types.Image, error)
+}
+
+// transportBackend opens images with their containers/image transport.
+type transportBackend struct{}
+
+func (transportBackend) newImageSource(ctx context.Context, sys *types.SystemContext, ref types.ImageReference) (types.ImageSource, error) {
+	return ref.NewImageSource(ctx, sys)
+}
+
+func (transportBackend) newImage(ctx context.Context, sys *types.SystemContext, src types.ImageSource) (types.Image, error) {
+	return image.FromUnparsedImage(ctx, sys, image.UnparsedInstance(src, nil))
+}
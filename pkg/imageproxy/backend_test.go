@@ -0,0 +1,1192 @@
+package imageproxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/ocicrypt"
+	encconfig "github.com/containers/ocicrypt/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeImageSource serves a synthetic image from memory.
+type fakeImageSource struct {
+	ref      types.ImageReference
+	manifest []byte
+	mimeType string
+	blobs    map[digest.Digest][]byte
+	// urlBlobs are served when GetBlob is given the URLs of a layer
+	urlBlobs map[digest.Digest][]byte
+
+	// lock protects the fields below
+	lock sync.Mutex
+	// blobFailures is the number of GetBlob calls to fail with blobErr
+	blobFailures int
+	blobErr      error
+	blobCalls    int
+	urlCalls     int
+}
+
+func (s *fakeImageSource) Reference() types.ImageReference { return s.ref }
+func (s *fakeImageSource) Close() error                    { return nil }
+func (s *fakeImageSource) HasThreadSafeGetBlob() bool      { return true }
+
+func (s *fakeImageSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	if instanceDigest != nil {
+		return nil, "", fmt.Errorf("no manifest list")
+	}
+	return s.manifest, s.mimeType, nil
+}
+
+func (s *fakeImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	s.lock.Lock()
+	s.blobCalls++
+	if s.blobFailures > 0 {
+		s.blobFailures--
+		s.lock.Unlock()
+		return nil, 0, s.blobErr
+	}
+	blobs := s.blobs
+	if len(info.URLs) > 0 {
+		s.urlCalls++
+		blobs = s.urlBlobs
+	}
+	s.lock.Unlock()
+	blob, ok := blobs[info.Digest]
+	if !ok {
+		return nil, 0, fmt.Errorf("blob %s: %w", info.Digest, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(blob)), int64(len(blob)), nil
+}
+
+func (s *fakeImageSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	return nil, nil
+}
+
+func (s *fakeImageSource) LayerInfosForCopy(ctx context.Context, instanceDigest *digest.Digest) ([]types.BlobInfo, error) {
+	return nil, nil
+}
+
+// fakeBackend opens src for any image, or fails with openErr, or with
+// what authErr returns for the credentials of sys.
+type fakeBackend struct {
+	src     *fakeImageSource
+	openErr error
+	authErr func(auth *types.DockerAuthConfig) error
+	// closable opens src as a source which fails once closed
+	closable bool
+	// chunked opens src as a chunkedImageSource
+	chunked bool
+}
+
+func (b *fakeBackend) newImageSource(ctx context.Context, sys *types.SystemContext, ref types.ImageReference) (types.ImageSource, error) {
+	if b.openErr != nil {
+		return nil, b.openErr
+	}
+	if b.authErr != nil {
+		if err := b.authErr(sys.DockerAuthConfig); err != nil {
+			return nil, err
+		}
+	}
+	if b.closable {
+		return &closableImageSource{fakeImageSource: b.src}, nil
+	}
+	if b.chunked {
+		return &chunkedImageSource{b.src}, nil
+	}
+	return b.src, nil
+}
+
+// closableImageSource is a fakeImageSource which can't be used once closed.
+type closableImageSource struct {
+	*fakeImageSource
+	closed int32
+}
+
+func (s *closableImageSource) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	return nil
+}
+
+func (s *closableImageSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return nil, "", errors.New("image source used after being closed")
+	}
+	return s.fakeImageSource.GetManifest(ctx, instanceDigest)
+}
+
+func (s *closableImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	// As slow as a registry, for the source to be closed meanwhile
+	time.Sleep(time.Millisecond)
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return nil, 0, errors.New("image source used after being closed")
+	}
+	return s.fakeImageSource.GetBlob(ctx, info, cache)
+}
+
+func (b *fakeBackend) newImage(ctx context.Context, sys *types.SystemContext, src types.ImageSource) (types.Image, error) {
+	return transportBackend{}.newImage(ctx, sys, src)
+}
+
+// newFakeImageSource returns a source for a single-layer image with a
+// docker schema2 manifest.
+func newFakeImageSource(t *testing.T) *fakeImageSource {
+	ref, err := alltransports.ParseImageName("oci:/fake:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := []byte("layer data")
+	config, err := json.Marshal(imgspecv1.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       imgspecv1.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(layer)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := manifest.Schema2FromComponents(
+		manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2ConfigMediaType, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		[]manifest.Schema2Descriptor{{MediaType: manifest.DockerV2Schema2LayerMediaType, Digest: digest.FromBytes(layer), Size: int64(len(layer))}})
+	raw, err := m.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeImageSource{
+		ref:      ref,
+		manifest: raw,
+		mimeType: manifest.DockerV2Schema2MediaType,
+		blobs: map[digest.Digest][]byte{
+			digest.FromBytes(config): config,
+			digest.FromBytes(layer):  layer,
+		},
+	}
+}
+
+// chunkedImageSource is a fakeImageSource supporting partial fetches, as
+// docker:// image sources do.
+type chunkedImageSource struct {
+	*fakeImageSource
+}
+
+// fakeChunk is a chunk of a blob, as the ImageSourceChunk of
+// containers/image.
+type fakeChunk struct {
+	Offset, Length uint64
+}
+
+func (s *chunkedImageSource) GetBlobAt(ctx context.Context, info types.BlobInfo, chunks []fakeChunk) (chan io.ReadCloser, chan error, error) {
+	blob, ok := s.blobs[info.Digest]
+	if !ok {
+		return nil, nil, fmt.Errorf("blob %s: %w", info.Digest, os.ErrNotExist)
+	}
+	streams := make(chan io.ReadCloser, len(chunks))
+	errs := make(chan error)
+	for _, c := range chunks {
+		if c.Offset+c.Length > uint64(len(blob)) {
+			return nil, nil, fmt.Errorf("chunk %d+%d past the end of blob %s", c.Offset, c.Length, info.Digest)
+		}
+		streams <- io.NopCloser(bytes.NewReader(blob[c.Offset : c.Offset+c.Length]))
+	}
+	close(streams)
+	close(errs)
+	return streams, errs, nil
+}
+
+// newFakeZstdChunkedSource returns a source for an OCI image whose
+// single layer is in the zstd:chunked format, to be opened as a
+// chunkedImageSource.
+func newFakeZstdChunkedSource(t *testing.T) (src *fakeImageSource, layer []byte) {
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	contents := []byte("file data")
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	toc := []byte(`{"version":1,"entries":[{"type":"reg","name":"file","size":9}]}`)
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	// The TOC is compressed in a frame of its own after the layer contents
+	layer = encoder.EncodeAll(tarball.Bytes(), nil)
+	offset := len(layer)
+	compressedTOC := encoder.EncodeAll(toc, nil)
+	layer = append(layer, compressedTOC...)
+
+	src = newFakeImageSource(t)
+	config, err := json.Marshal(imgspecv1.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       imgspecv1.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(append(tarball.Bytes(), toc...))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(imgspecv1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers: []imgspecv1.Descriptor{{
+			MediaType: "application/vnd.oci.image.layer.v1.tar+zstd",
+			Digest:    digest.FromBytes(layer),
+			Size:      int64(len(layer)),
+			Annotations: map[string]string{
+				zstdChunkedManifestChecksumKey: digest.FromBytes(compressedTOC).String(),
+				zstdChunkedManifestInfoKey:     fmt.Sprintf("%d:%d:%d:%d", offset, len(compressedTOC), len(toc), zstdChunkedManifestTypeCRFS),
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.manifest = raw
+	src.mimeType = imgspecv1.MediaTypeImageManifest
+	src.blobs = map[digest.Digest][]byte{
+		digest.FromBytes(config): config,
+		digest.FromBytes(layer):  layer,
+	}
+	return src, layer
+}
+
+// newFakeSchema1Source returns a source for an image with a docker
+// schema1 manifest, with a gzipped layer and an empty one on top.
+func newFakeSchema1Source(t *testing.T) (src *fakeImageSource, layer []byte, diffID digest.Digest) {
+	src = newFakeImageSource(t)
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	contents := []byte("hello\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(tarball.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer = gz.Bytes()
+
+	ref, err := reference.ParseNormalizedNamed("registry.example.com/fake:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseID := strings.Repeat("a", 64)
+	topID := strings.Repeat("b", 64)
+	m, err := manifest.Schema1FromComponents(ref,
+		[]manifest.Schema1FSLayers{{BlobSum: digest.FromString("empty")}, {BlobSum: digest.FromBytes(layer)}},
+		[]manifest.Schema1History{
+			{V1Compatibility: `{"id":"` + topID + `","parent":"` + baseID + `","architecture":"amd64","os":"linux","config":{"Env":["PATH=/bin"]},"container_config":{"Cmd":["/bin/sh -c #(nop) ENV PATH=/bin"]},"throwaway":true}`},
+			{V1Compatibility: `{"id":"` + baseID + `","container_config":{"Cmd":["/bin/sh -c #(nop) ADD file:hello in /"]}}`},
+		}, "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := m.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.manifest = raw
+	src.mimeType = manifest.GuessMIMEType(raw)
+	src.blobs = map[digest.Digest][]byte{digest.FromBytes(layer): layer}
+	return src, layer, digest.FromBytes(tarball.Bytes())
+}
+
+func newFakeHandler(t *testing.T, backend *fakeBackend, opts Options) *proxyHandler {
+	server, err := NewServer("oci:/fake:latest", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.h.backend = backend
+	t.Cleanup(func() { server.Close() })
+	return server.h
+}
+
+func doRequest(h *proxyHandler, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, "http://proxy"+path, nil))
+	return w
+}
+
+func replyCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	var reply errorReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("invalid error reply %q: %v", w.Body.String(), err)
+	}
+	return reply.Code
+}
+
+func TestBackendManifest(t *testing.T) {
+	src := newFakeImageSource(t)
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{})
+
+	w := doRequest(h, http.MethodGet, "/manifest")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /manifest: %d %s", w.Code, w.Body.String())
+	}
+	if d := w.Header().Get("Manifest-Digest"); d != digest.FromBytes(src.manifest).String() {
+		t.Errorf("Manifest-Digest %s, expected the digest of the original manifest", d)
+	}
+	if d := w.Header().Get("OCI-Manifest-Digest"); d != digest.FromBytes(w.Body.Bytes()).String() {
+		t.Errorf("OCI-Manifest-Digest %s, expected the digest of the converted manifest", d)
+	}
+	var m imgspecv1.Manifest
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Layers) != 1 || m.Layers[0].Digest != digest.FromString("layer data") {
+		t.Errorf("unexpected manifest %s", w.Body.String())
+	}
+
+	w = doRequest(h, http.MethodGet, "/manifest?raw=1")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), src.manifest) {
+		t.Errorf("GET /manifest?raw=1: %d %s, expected the original manifest", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != src.mimeType {
+		t.Errorf("GET /manifest?raw=1: Content-Type %s, expected %s", ct, src.mimeType)
+	}
+
+	w = doRequest(h, http.MethodGet, "/blobs/"+digest.FromString("layer data").String())
+	if w.Code != http.StatusOK || w.Body.String() != "layer data" {
+		t.Errorf("GET /blobs: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestBackendErrors(t *testing.T) {
+	src := newFakeImageSource(t)
+	h := newFakeHandler(t, &fakeBackend{openErr: fmt.Errorf("opening: %w", os.ErrNotExist)}, Options{})
+	w := doRequest(h, http.MethodGet, "/manifest")
+	if code := replyCode(t, w); code != errorCodeNotFound {
+		t.Errorf("failing to open the image: %s, expected %s", code, errorCodeNotFound)
+	}
+
+	h = newFakeHandler(t, &fakeBackend{src: src}, Options{})
+	w = doRequest(h, http.MethodGet, "/blobs/"+digest.FromString("missing").String())
+	if code := replyCode(t, w); code != errorCodeNotFound {
+		t.Errorf("missing blob: %s, expected %s", code, errorCodeNotFound)
+	}
+}
+
+func TestBackendAuthFallback(t *testing.T) {
+	// A mirror which rejects the credentials
+	var tried []string
+	rejectCredentials := func(auth *types.DockerAuthConfig) error {
+		tried = append(tried, auth.Username)
+		if auth.Username != "" {
+			return docker.ErrUnauthorizedForCredentials{Err: fmt.Errorf("invalid username/password")}
+		}
+		return nil
+	}
+	for _, c := range []struct {
+		fallback string
+		code     string
+		tried    []string
+	}{
+		{"", errorCodeAuth, []string{"user"}},
+		{authFallbackAnonymous, "", []string{"user", ""}},
+		{authFallbackCredentials, "", []string{""}},
+	} {
+		tried = nil
+		server, err := NewServer("docker://registry.example.com/foo:latest", Options{
+			SystemContext: &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "user", Password: "password"}},
+			AuthFallback:  c.fallback,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.h.backend = &fakeBackend{src: newFakeImageSource(t), authErr: rejectCredentials}
+		w := doRequest(server.h, http.MethodGet, "/manifest")
+		if c.code == "" && w.Code != http.StatusOK {
+			t.Errorf("fallback %q: %d %s", c.fallback, w.Code, w.Body.String())
+		} else if c.code != "" && replyCode(t, w) != c.code {
+			t.Errorf("fallback %q: %s, expected %s", c.fallback, w.Body.String(), c.code)
+		}
+		if strings.Join(tried, ",") != strings.Join(c.tried, ",") {
+			t.Errorf("fallback %q: tried users %q, expected %q", c.fallback, tried, c.tried)
+		}
+		server.Close()
+	}
+
+	if _, err := NewServer("", Options{AuthFallback: "never"}); err == nil {
+		t.Errorf("invalid AuthFallback accepted")
+	}
+}
+
+func TestBackendRetries(t *testing.T) {
+	src := newFakeImageSource(t)
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{Retries: 2, RetryDelay: time.Millisecond})
+	layer := digest.FromString("layer data")
+	if w := doRequest(h, http.MethodGet, "/manifest"); w.Code != http.StatusOK {
+		t.Fatalf("GET /manifest: %d %s", w.Code, w.Body.String())
+	}
+
+	src.lock.Lock()
+	src.blobErr = fmt.Errorf("fetching blob: %w", io.ErrUnexpectedEOF)
+	src.blobFailures = 2
+	src.blobCalls = 0
+	src.lock.Unlock()
+	w := doRequest(h, http.MethodGet, "/blobs/"+layer.String())
+	if w.Code != http.StatusOK || w.Body.String() != "layer data" {
+		t.Errorf("GET /blobs after 2 transient failures: %d %q", w.Code, w.Body.String())
+	}
+	if src.blobCalls != 3 {
+		t.Errorf("%d GetBlob calls, expected 3", src.blobCalls)
+	}
+
+	src.lock.Lock()
+	src.blobFailures = 3
+	src.lock.Unlock()
+	w = doRequest(h, http.MethodGet, "/blobs/"+layer.String())
+	var reply errorReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Retryable {
+		t.Errorf("GET /blobs after 3 transient failures: %+v, expected a retryable error", reply)
+	}
+
+	// Rejected credentials won't be accepted on the next attempt
+	src.lock.Lock()
+	src.blobErr = docker.ErrUnauthorizedForCredentials{Err: fmt.Errorf("denied")}
+	src.blobFailures = 1
+	src.blobCalls = 0
+	src.lock.Unlock()
+	w = doRequest(h, http.MethodGet, "/blobs/"+layer.String())
+	if code := replyCode(t, w); code != errorCodeAuth {
+		t.Errorf("GET /blobs after a 401: %s, expected %s", w.Body.String(), errorCodeAuth)
+	}
+	if src.blobCalls != 1 {
+		t.Errorf("%d GetBlob calls after a 401, expected 1", src.blobCalls)
+	}
+}
+
+// retryAfterError is a 429 carrying the registry's Retry-After.
+type retryAfterError struct{ after time.Duration }
+
+func (e retryAfterError) Error() string             { return docker.ErrTooManyRequests.Error() }
+func (e retryAfterError) Unwrap() error             { return docker.ErrTooManyRequests }
+func (e retryAfterError) RetryAfter() time.Duration { return e.after }
+
+func TestBackendRateLimited(t *testing.T) {
+	src := newFakeImageSource(t)
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{RateLimitDelay: 30 * time.Second})
+	layer := digest.FromString("layer data")
+	if w := doRequest(h, http.MethodGet, "/manifest"); w.Code != http.StatusOK {
+		t.Fatalf("GET /manifest: %d %s", w.Code, w.Body.String())
+	}
+
+	for _, c := range []struct {
+		err        error
+		retryAfter string
+	}{
+		{fmt.Errorf("fetching blob: %w", docker.ErrTooManyRequests), "30"},
+		{retryAfterError{1500 * time.Millisecond}, "2"},
+	} {
+		src.lock.Lock()
+		src.blobErr = c.err
+		src.blobFailures = 1
+		src.lock.Unlock()
+		w := doRequest(h, http.MethodGet, "/blobs/"+layer.String())
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != c.retryAfter {
+			t.Errorf("GET /blobs after %v: %d with Retry-After %q, expected 429 with %q", c.err, w.Code, w.Header().Get("Retry-After"), c.retryAfter)
+		}
+	}
+}
+
+func TestBackendEvents(t *testing.T) {
+	src := newFakeImageSource(t)
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{Retries: 1, RetryDelay: time.Millisecond})
+	layer := digest.FromString("layer data")
+	if w := doRequest(h, http.MethodGet, "/manifest"); w.Code != http.StatusOK {
+		t.Fatalf("GET /manifest: %d %s", w.Code, w.Body.String())
+	}
+	// Requests have the events of their session in their context, as
+	// set up by serveRequest
+	ctx := withEvents(context.Background(), &h.events)
+
+	if w := doRequest(h, http.MethodPost, "/events"); w.Code == http.StatusOK {
+		t.Errorf("POST /events without a file succeeded")
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://proxy/events?fd=1", nil)
+	h.ServeHTTP(w, req.WithContext(context.WithValue(ctx, passedFileKey{}, pw)))
+	pw.Close()
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /events: %d %s", w.Code, w.Body.String())
+	}
+
+	src.lock.Lock()
+	src.blobErr = fmt.Errorf("fetching blob: %w", io.ErrUnexpectedEOF)
+	src.blobFailures = 1
+	src.lock.Unlock()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://proxy/blobs/"+layer.String(), nil).WithContext(ctx))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /blobs: %d %s", w.Code, w.Body.String())
+	}
+
+	// Stopping the stream closes the pipe once all events were written
+	h.events.stop()
+	out, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		var ev progressEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("invalid event %q: %v", line, err)
+		}
+		events = append(events, ev.Event)
+		if ev.Event == "blob-done" && (ev.Digest != layer || ev.Bytes != int64(len("layer data")) || ev.Error != "") {
+			t.Errorf("unexpected event %s", line)
+		}
+	}
+	if strings.Join(events, " ") != "retry blob-start blob-done" {
+		t.Errorf("unexpected events %q", out)
+	}
+}
+
+func TestBackendProgress(t *testing.T) {
+	src := newFakeImageSource(t)
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{})
+	layer := digest.FromString("layer data")
+
+	// As set up by serveRequest for a request with a Request-Id
+	ctx, done := h.inflight.add(context.Background(), "1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://proxy/blobs/"+layer.String(), nil).WithContext(ctx))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /blobs: %d %s", w.Code, w.Body.String())
+	}
+	w = doRequest(h, http.MethodGet, "/progress?id=1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /progress: %d %s", w.Code, w.Body.String())
+	}
+	var progress progressReply
+	if err := json.Unmarshal(w.Body.Bytes(), &progress); err != nil {
+		t.Fatal(err)
+	}
+	if progress.Bytes != int64(len("layer data")) || progress.Size != progress.Bytes {
+		t.Errorf("unexpected progress %s", w.Body.String())
+	}
+
+	done()
+	w = doRequest(h, http.MethodGet, "/progress?id=1")
+	if code := replyCode(t, w); code != errorCodeNotFound {
+		t.Errorf("GET /progress of a completed request: %s, expected %s", code, errorCodeNotFound)
+	}
+}
+
+func TestBackendManifestSize(t *testing.T) {
+	src := newFakeImageSource(t)
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{MaxManifestSize: int64(len(src.manifest))})
+	if w := doRequest(h, http.MethodGet, "/manifest"); w.Code != http.StatusOK {
+		t.Fatalf("GET /manifest at the limit: %d %s", w.Code, w.Body.String())
+	}
+
+	h = newFakeHandler(t, &fakeBackend{src: src}, Options{MaxManifestSize: int64(len(src.manifest)) - 1, Retries: 2, RetryDelay: time.Millisecond})
+	w := doRequest(h, http.MethodGet, "/manifest")
+	var reply errorReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Code != errorCodeTooLarge || reply.Retryable {
+		t.Errorf("GET /manifest over the limit: %+v, expected a non-retryable %s error", reply, errorCodeTooLarge)
+	}
+}
+
+func TestBackendSchema1(t *testing.T) {
+	src, layer, diffID := newFakeSchema1Source(t)
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{})
+
+	w := doRequest(h, http.MethodGet, "/manifest")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /manifest: %d %s", w.Code, w.Body.String())
+	}
+	expected, err := manifest.Digest(src.manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := w.Header().Get("Manifest-Digest"); d != expected.String() {
+		t.Errorf("Manifest-Digest %s, expected %s, that of the schema1 manifest", d, expected)
+	}
+	if mt := w.Header().Get("Manifest-Media-Type"); mt != src.mimeType {
+		t.Errorf("Manifest-Media-Type %s, expected %s", mt, src.mimeType)
+	}
+	var m imgspecv1.Manifest
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.SchemaVersion != 2 || len(m.Layers) != 1 || m.Layers[0].Digest != digest.FromBytes(layer) || m.Layers[0].Size != int64(len(layer)) {
+		t.Fatalf("unexpected converted manifest %s", w.Body.String())
+	}
+
+	// The generated config is served as a blob
+	w = doRequest(h, http.MethodGet, "/blobs/"+m.Config.Digest.String())
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /blobs for the config: %d %s", w.Code, w.Body.String())
+	}
+	var config imgspecv1.Image
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.RootFS.DiffIDs) != 1 || config.RootFS.DiffIDs[0] != diffID {
+		t.Errorf("config diffIDs %v, expected [%s]", config.RootFS.DiffIDs, diffID)
+	}
+	if len(config.Config.Env) != 1 || config.Config.Env[0] != "PATH=/bin" || len(config.History) != 2 {
+		t.Errorf("unexpected config %s", w.Body.String())
+	}
+
+	w = doRequest(h, http.MethodGet, "/blobs/"+digest.FromBytes(layer).String()+"?decompress=1")
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /blobs?decompress=1: %d %s", w.Code, w.Body.String())
+	}
+
+	w = doRequest(h, http.MethodGet, "/manifest?raw=1")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), src.manifest) {
+		t.Errorf("GET /manifest?raw=1: %d %s, expected the schema1 manifest", w.Code, w.Body.String())
+	}
+}
+
+// newFakeArtifactSource returns a source for an OCI artifact with a
+// config which isn't JSON, and a single WASM module.
+func newFakeArtifactSource(t *testing.T) (src *fakeImageSource, module []byte) {
+	src = newFakeImageSource(t)
+	config := []byte("not an image config")
+	module = []byte("\x00asm\x01\x00\x00\x00")
+	raw, err := json.Marshal(imgspecv1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    imgspecv1.Descriptor{MediaType: "application/vnd.example.config.v1", Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers: []imgspecv1.Descriptor{{
+			MediaType:   "application/wasm",
+			Digest:      digest.FromBytes(module),
+			Size:        int64(len(module)),
+			Annotations: map[string]string{imgspecv1.AnnotationTitle: "module.wasm"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.manifest = raw
+	src.mimeType = imgspecv1.MediaTypeImageManifest
+	src.blobs = map[digest.Digest][]byte{
+		digest.FromBytes(config): config,
+		digest.FromBytes(module): module,
+	}
+	return src, module
+}
+
+func TestBackendArtifact(t *testing.T) {
+	src, module := newFakeArtifactSource(t)
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{})
+
+	w := doRequest(h, http.MethodGet, "/inspect")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /inspect: %d %s", w.Code, w.Body.String())
+	}
+	var info inspectOutput
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ArtifactType != "application/vnd.example.config.v1" || len(info.Layers) != 1 {
+		t.Errorf("unexpected inspect output %s", w.Body.String())
+	}
+
+	w = doRequest(h, http.MethodGet, "/layers")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /layers: %d %s", w.Code, w.Body.String())
+	}
+	var layers []layerInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &layers); err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 || layers[0].DiffID != "" || layers[0].Annotations[imgspecv1.AnnotationTitle] != "module.wasm" {
+		t.Errorf("unexpected layers %s", w.Body.String())
+	}
+
+	w = doRequest(h, http.MethodGet, "/blobs/"+digest.FromBytes(module).String())
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), module) {
+		t.Errorf("GET /blobs: %d %q", w.Code, w.Body.String())
+	}
+
+	// Only container images have filesystem layers
+	w = doRequest(h, http.MethodGet, "/flattened")
+	if code := replyCode(t, w); code != errorCodeInvalid {
+		t.Errorf("GET /flattened: %d %s, expected %s", w.Code, w.Body.String(), errorCodeInvalid)
+	}
+}
+
+// newFakeForeignSource returns a source for an image whose single layer
+// is foreign, and only available from its URL.
+func newFakeForeignSource(t *testing.T) (src *fakeImageSource, layer []byte) {
+	src = newFakeImageSource(t)
+	layer = []byte("foreign layer data")
+	config := []byte("{}")
+	m := manifest.Schema2FromComponents(
+		manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2ConfigMediaType, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		[]manifest.Schema2Descriptor{{
+			MediaType: manifest.DockerV2Schema2ForeignLayerMediaType,
+			Digest:    digest.FromBytes(layer),
+			Size:      int64(len(layer)),
+			URLs:      []string{"https://example.com/layer"},
+		}})
+	raw, err := m.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.manifest = raw
+	src.blobs = map[digest.Digest][]byte{digest.FromBytes(config): config}
+	src.urlBlobs = map[digest.Digest][]byte{digest.FromBytes(layer): layer}
+	return src, layer
+}
+
+func TestBackendForeignLayer(t *testing.T) {
+	src, layer := newFakeForeignSource(t)
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{})
+	path := "/blobs/" + digest.FromBytes(layer).String()
+	// Open the image, which reads the config
+	if w := doRequest(h, http.MethodGet, "/manifest"); w.Code != http.StatusOK {
+		t.Fatalf("GET /manifest: %d %s", w.Code, w.Body.String())
+	}
+	src.blobCalls = 0
+
+	// Local images are read first, then the URLs
+	w := doRequest(h, http.MethodGet, path)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), layer) {
+		t.Fatalf("GET /blobs: %d %q", w.Code, w.Body.String())
+	}
+	if src.blobCalls != 2 || src.urlCalls != 1 {
+		t.Errorf("%d GetBlob calls with %d from URLs, expected 2 and 1", src.blobCalls, src.urlCalls)
+	}
+
+	// Remote images are fetched from the URLs first
+	ref, err := alltransports.ParseImageName("docker://example.com/foreign:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.ref = ref
+	src.blobCalls, src.urlCalls = 0, 0
+	w = doRequest(h, http.MethodGet, path)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), layer) {
+		t.Fatalf("GET /blobs: %d %q", w.Code, w.Body.String())
+	}
+	if src.blobCalls != 1 || src.urlCalls != 1 {
+		t.Errorf("%d GetBlob calls with %d from URLs, expected 1 and 1", src.blobCalls, src.urlCalls)
+	}
+
+	// Failures name everywhere the layer was looked for
+	src.urlBlobs = nil
+	w = doRequest(h, http.MethodGet, path)
+	if w.Code == http.StatusOK || !strings.Contains(w.Body.String(), "https://example.com/layer, then the image") {
+		t.Errorf("GET /blobs: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestArtifactType(t *testing.T) {
+	for _, c := range []struct {
+		manifest, mimeType, expected string
+	}{
+		{`{"config":{"mediaType":"application/vnd.oci.image.config.v1+json"}}`, imgspecv1.MediaTypeImageManifest, ""},
+		{`{"config":{"mediaType":"application/vnd.cncf.helm.config.v1+json"}}`, imgspecv1.MediaTypeImageManifest, "application/vnd.cncf.helm.config.v1+json"},
+		{`{"artifactType":"application/wasm","config":{"mediaType":"application/vnd.oci.empty.v1+json"}}`, imgspecv1.MediaTypeImageManifest, "application/wasm"},
+		{`{"config":{"mediaType":"application/vnd.example"}}`, manifest.DockerV2Schema2MediaType, ""},
+	} {
+		if got := artifactType([]byte(c.manifest), c.mimeType); got != c.expected {
+			t.Errorf("artifactType(%s): %q, expected %q", c.manifest, got, c.expected)
+		}
+	}
+}
+
+// newFakeEncryptedSource returns a source for an OCI image whose layer is
+// encrypted with ocicrypt to the JWE recipient key.
+func newFakeEncryptedSource(t *testing.T, key crypto.PublicKey) (src *fakeImageSource, encrypted, layer []byte) {
+	src = newFakeImageSource(t)
+	layer = []byte("layer data")
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := encconfig.EncryptWithJwe([][]byte{pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, finalize, err := ocicrypt.EncryptLayer(cc.EncryptConfig, bytes.NewReader(layer), imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err = io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := json.Marshal(imgspecv1.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       imgspecv1.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(layer)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(imgspecv1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers: []imgspecv1.Descriptor{{
+			MediaType:   imgspecv1.MediaTypeImageLayer + "+encrypted",
+			Digest:      digest.FromBytes(encrypted),
+			Size:        int64(len(encrypted)),
+			Annotations: annotations,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.manifest = raw
+	src.mimeType = imgspecv1.MediaTypeImageManifest
+	src.blobs = map[digest.Digest][]byte{
+		digest.FromBytes(config):    config,
+		digest.FromBytes(encrypted): encrypted,
+	}
+	return src, encrypted, layer
+}
+
+func TestBackendDecryption(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	src, encrypted, layer := newFakeEncryptedSource(t, &key.PublicKey)
+	path := "/blobs/" + digest.FromBytes(encrypted).String()
+
+	// Without keys, encrypted layers are served as is
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{})
+	w := doRequest(h, http.MethodGet, path)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), encrypted) {
+		t.Errorf("GET /blobs without keys: %d %q", w.Code, w.Body.String())
+	}
+	w = doRequest(h, http.MethodGet, path+"?decompress=1")
+	if code := replyCode(t, w); code != errorCodeInvalid {
+		t.Errorf("GET /blobs?decompress=1 without keys: %d %s, expected %s", w.Code, w.Body.String(), errorCodeInvalid)
+	}
+
+	h = newFakeHandler(t, &fakeBackend{src: src}, Options{DecryptionKeys: [][]byte{keyPEM}})
+	for _, query := range []string{"", "?decompress=1"} {
+		w = doRequest(h, http.MethodGet, path+query)
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), layer) {
+			t.Errorf("GET /blobs%s: %d %q, expected the decrypted layer", query, w.Code, w.Body.String())
+		}
+		if d := w.Header().Get("Decrypted-Digest"); d != digest.FromBytes(layer).String() {
+			t.Errorf("GET /blobs%s: Decrypted-Digest %q", query, d)
+		}
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(other)})
+	h = newFakeHandler(t, &fakeBackend{src: src}, Options{DecryptionKeys: [][]byte{otherPEM}})
+	w = doRequest(h, http.MethodGet, path)
+	if code := replyCode(t, w); code != errorCodeInvalid {
+		t.Errorf("GET /blobs with another key: %d %s, expected %s", w.Code, w.Body.String(), errorCodeInvalid)
+	}
+
+	// EC keys, as SEC 1 PEM which ocicrypt doesn't parse itself
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, encrypted, layer = newFakeEncryptedSource(t, &ecKey.PublicKey)
+	h = newFakeHandler(t, &fakeBackend{src: src}, Options{DecryptionKeys: [][]byte{pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})}})
+	w = doRequest(h, http.MethodGet, "/blobs/"+digest.FromBytes(encrypted).String())
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), layer) {
+		t.Errorf("GET /blobs with an EC key: %d %q, expected the decrypted layer", w.Code, w.Body.String())
+	}
+}
+
+func TestBackendQuit(t *testing.T) {
+	h := newFakeHandler(t, &fakeBackend{src: newFakeImageSource(t)}, Options{})
+	// Another request of the session, and the POST /quit itself
+	h.active.begin()
+	h.active.begin()
+	replied := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		replied <- doRequest(h, http.MethodPost, "/quit")
+	}()
+	select {
+	case <-replied:
+		t.Fatal("POST /quit replied before the other request was done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if h.isShutdown() {
+		t.Error("shut down before the other request was done")
+	}
+	h.active.end()
+	if w := <-replied; w.Code != http.StatusOK {
+		t.Errorf("POST /quit: %d %s", w.Code, w.Body.String())
+	}
+	if !h.isShutdown() {
+		t.Error("not shut down after POST /quit")
+	}
+	h.active.end()
+
+	// With force=1, requests in progress are aborted
+	h = newFakeHandler(t, &fakeBackend{src: newFakeImageSource(t)}, Options{})
+	ctx, done := h.inflight.add(context.Background(), "1")
+	defer done()
+	h.active.begin()
+	defer h.active.end()
+	if w := doRequest(h, http.MethodPost, "/quit?force=1"); w.Code != http.StatusOK {
+		t.Errorf("POST /quit?force=1: %d %s", w.Code, w.Body.String())
+	}
+	if ctx.Err() == nil {
+		t.Error("request in progress not aborted")
+	}
+	if !h.isShutdown() {
+		t.Error("not shut down after POST /quit?force=1")
+	}
+}
+
+func TestBackendSetImage(t *testing.T) {
+	backend := &fakeBackend{src: newFakeImageSource(t)}
+	h := newFakeHandler(t, backend, Options{})
+	setImage := func(ref string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://proxy/image", strings.NewReader(ref)))
+		return w
+	}
+
+	first := doRequest(h, http.MethodGet, "/manifest").Header().Get("Manifest-Digest")
+	other := newFakeImageSource(t)
+	other.manifest = append(other.manifest, '\n')
+	backend.src = other
+	if w := setImage("oci:/other:latest\n"); w.Code != http.StatusOK {
+		t.Fatalf("POST /image: %d %s", w.Code, w.Body.String())
+	}
+	if h.imageref != "oci:/other:latest" {
+		t.Errorf("image %q after POST /image", h.imageref)
+	}
+	w := doRequest(h, http.MethodGet, "/manifest")
+	if d := w.Header().Get("Manifest-Digest"); d == first || d != digest.FromBytes(other.manifest).String() {
+		t.Errorf("Manifest-Digest %s after POST /image, expected that of the new image", d)
+	}
+
+	if w := setImage(""); w.Code == http.StatusOK {
+		t.Error("POST /image without a reference succeeded")
+	}
+	backend.openErr = docker.ErrUnauthorizedForCredentials{Err: fmt.Errorf("denied")}
+	if w := setImage("oci:/denied:latest"); replyCode(t, w) != errorCodeAuth {
+		t.Errorf("POST /image of an image which can't be opened: %s", w.Body.String())
+	}
+}
+
+// TestBackendSetImageConcurrent replaces the image while requests use it,
+// to be run with -race.
+func TestBackendSetImageConcurrent(t *testing.T) {
+	src := newFakeImageSource(t)
+	h := newFakeHandler(t, &fakeBackend{src: src, closable: true}, Options{})
+	var blob digest.Digest
+	for d := range src.blobs {
+		blob = d
+		break
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 100)
+	stop := make(chan struct{})
+	for _, path := range []string{"/manifest", "/inspect", "/blobs/" + blob.String()} {
+		path := path
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if w := doRequest(h, http.MethodGet, path); w.Code != http.StatusOK {
+					errs <- fmt.Sprintf("GET %s: %d %s", path, w.Code, w.Body.String())
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://proxy/image", strings.NewReader(fmt.Sprintf("oci:/image%d:latest", i))))
+		if w.Code != http.StatusOK {
+			t.Errorf("POST /image: %d %s", w.Code, w.Body.String())
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestBackendManifestNotModified(t *testing.T) {
+	h := newFakeHandler(t, &fakeBackend{src: newFakeImageSource(t)}, Options{})
+	getManifest := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://proxy/manifest", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	etag := getManifest("").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET /manifest without an ETag")
+	}
+	d, err := strconv.Unquote(etag)
+	if err != nil {
+		t.Fatalf("ETag %s: %v", etag, err)
+	}
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, `"sha256:0", ` + etag, d, "*"} {
+		w := getManifest(ifNoneMatch)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+			t.Errorf("If-None-Match: %s: %d, %d bytes, ETag %s", ifNoneMatch, w.Code, w.Body.Len(), w.Header().Get("ETag"))
+		}
+	}
+	w := getManifest(strconv.Quote(digest.FromString("other").String()))
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("If-None-Match with another digest: %d, %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+func TestBackendTrustedTransports(t *testing.T) {
+	for _, names := range [][]string{{"docker"}, {"nonexistent"}} {
+		if _, err := NewServer("oci:/fake:latest", Options{TrustedTransports: names}); err == nil {
+			t.Errorf("TrustedTransports %v accepted", names)
+		}
+	}
+	for _, trusted := range []bool{false, true} {
+		src := newFakeImageSource(t)
+		var opts Options
+		if trusted {
+			opts.TrustedTransports = []string{"dir", "oci"}
+		}
+		h := newFakeHandler(t, &fakeBackend{src: src}, opts)
+		if err := h.ensureImage(); err != nil {
+			t.Fatal(err)
+		}
+		d := digest.FromString("layer data")
+		if v := h.blobVerifier(d); (v == nil) != trusted {
+			t.Errorf("trusted %v: verifier %v", trusted, v)
+		}
+		// A trusted blob is served as is
+		src.blobs[d] = []byte("corrupted!")
+		if _, _, err := h.downloadBlob(context.Background(), d); (err == nil) != trusted {
+			t.Errorf("trusted %v: downloading a corrupted blob: %v", trusted, err)
+		}
+	}
+}
+
+func TestBackendUncompressedSize(t *testing.T) {
+	src := newFakeImageSource(t)
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{})
+	var layer digest.Digest
+	for d, data := range src.blobs {
+		if string(data) == "layer data" {
+			layer = d
+		}
+	}
+	getSize := func() uncompressedSize {
+		w := doRequest(h, http.MethodGet, "/uncompressed-size/"+layer.String())
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /uncompressed-size: %d %s", w.Code, w.Body.String())
+		}
+		var size uncompressedSize
+		if err := json.Unmarshal(w.Body.Bytes(), &size); err != nil {
+			t.Fatal(err)
+		}
+		return size
+	}
+	expected := uncompressedSize{Size: int64(len("layer data")), Exact: true, Source: sizeSourceDecompressed}
+	if size := getSize(); size != expected {
+		t.Errorf("first GET /uncompressed-size: %+v", size)
+	}
+	expected.Source = sizeSourceCache
+	if size := getSize(); size != expected {
+		t.Errorf("second GET /uncompressed-size: %+v", size)
+	}
+	if w := doRequest(h, http.MethodGet, "/uncompressed-size/"+digest.FromString("other").String()); replyCode(t, w) != errorCodeNotFound {
+		t.Errorf("GET /uncompressed-size of a blob which isn't a layer: %s", w.Body.String())
+	}
+}
+
+func TestBackendTOCNotChunked(t *testing.T) {
+	src := newFakeImageSource(t)
+	h := newFakeHandler(t, &fakeBackend{src: src}, Options{})
+	w := doRequest(h, http.MethodGet, "/toc/"+digest.FromString("layer data").String())
+	if code := replyCode(t, w); code != errorCodeInvalid {
+		t.Errorf("GET /toc of a gzip layer: %s %s", code, w.Body.String())
+	}
+}
@@ -0,0 +1,214 @@
+package imageproxy_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cgwalters/container-image-proxy/pkg/client"
+	"github.com/cgwalters/container-image-proxy/pkg/imageproxy"
+	"github.com/opencontainers/go-digest"
+)
+
+// benchFileSize is the size of the file in the layer of the benchmark
+// image; as it is random, the layer is about as large.
+const benchFileSize = 16 << 20
+
+// benchImage writes an image with a large layer as an oci: layout.
+func benchImage(b *testing.B) (*fixture, string) {
+	contents := make([]byte, benchFileSize)
+	if _, err := rand.Read(contents); err != nil {
+		b.Fatal(err)
+	}
+	fx := newFixtureWithFile(b, contents)
+	return fx, "oci:" + fx.writeOCILayout(b)
+}
+
+func benchServer(b *testing.B, image string, opts imageproxy.Options) *imageproxy.Server {
+	opts.SystemContext = systemContext(b)
+	server, err := imageproxy.NewServer(image, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { server.Close() })
+	return server
+}
+
+// serve serves a connection of its own, returning our end of it.
+func serve(b *testing.B, server *imageproxy.Server) *net.UnixConn {
+	ours, theirs := socketpair(b)
+	served := make(chan struct{})
+	go func() {
+		server.Serve(theirs)
+		theirs.Close()
+		close(served)
+	}()
+	b.Cleanup(func() {
+		ours.Close()
+		<-served
+	})
+	return ours
+}
+
+// inlineConn fetches blobs in the responses on a connection.
+type inlineConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *inlineConn) getBlob(d digest.Digest) (int64, error) {
+	if _, err := fmt.Fprintf(c.conn, "GET /blobs/%s HTTP/1.1\r\nHost: proxy\r\n\r\n", d); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET /blobs: %s", resp.Status)
+	}
+	return io.Copy(io.Discard, resp.Body)
+}
+
+// BenchmarkGetBlob measures the throughput of streaming a blob, in the
+// response ("inline") or to a pipe passed with the request ("pipe"), for
+// several kernel buffer sizes and numbers of concurrent streams.  Each
+// concurrent inline stream has a connection of its own, while the pipes
+// are all requested on a single connection.
+func BenchmarkGetBlob(b *testing.B) {
+	fx, image := benchImage(b)
+	size := int64(len(fx.blobs[fx.layer]))
+	for _, mode := range []string{"inline", "pipe"} {
+		for _, bufferSize := range []int{0, 256 << 10, 4 << 20} {
+			for _, streams := range []int{1, 4, 16} {
+				name := fmt.Sprintf("%s/buffer=%d/streams=%d", mode, bufferSize, streams)
+				b.Run(name, func(b *testing.B) {
+					server := benchServer(b, image, imageproxy.Options{BufferSize: bufferSize})
+					var fetch []func() (int64, error)
+					if mode == "inline" {
+						for i := 0; i < streams; i++ {
+							conn := serve(b, server)
+							c := &inlineConn{conn: conn, r: bufio.NewReader(conn)}
+							fetch = append(fetch, func() (int64, error) { return c.getBlob(fx.layer) })
+						}
+					} else {
+						c := client.New(serve(b, server))
+						fetch = append(fetch, func() (int64, error) {
+							r, err := c.GetBlob(context.Background(), fx.layer.String())
+							if err != nil {
+								return 0, err
+							}
+							defer r.Close()
+							return io.Copy(io.Discard, r)
+						})
+						for len(fetch) < streams {
+							fetch = append(fetch, fetch[0])
+						}
+					}
+					// The image is opened by the first request
+					if _, err := fetch[0](); err != nil {
+						b.Fatal(err)
+					}
+
+					b.SetBytes(size * int64(streams))
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						var wg sync.WaitGroup
+						errs := make(chan error, streams)
+						for _, f := range fetch {
+							wg.Add(1)
+							go func(f func() (int64, error)) {
+								defer wg.Done()
+								n, err := f()
+								if err == nil && n != size {
+									err = fmt.Errorf("read %d bytes, expected %d", n, size)
+								}
+								errs <- err
+							}(f)
+						}
+						wg.Wait()
+						close(errs)
+						for err := range errs {
+							if err != nil {
+								b.Fatal(err)
+							}
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkRequestLatency measures the latency of GET /manifest, with
+// that many requests in flight at once on a single connection.  It
+// reports the mean and 99th percentile latencies; ns/op is the inverse
+// of the throughput.
+func BenchmarkRequestLatency(b *testing.B) {
+	fx := newFixture(b)
+	image := "oci:" + fx.writeOCILayout(b)
+	for _, concurrency := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			c := client.New(serve(b, benchServer(b, image, imageproxy.Options{})))
+			ctx := context.Background()
+			getManifest := func() error {
+				r, _, err := c.GetManifest(ctx)
+				if err == nil {
+					r.Close()
+				}
+				return err
+			}
+			if err := getManifest(); err != nil {
+				b.Fatal(err)
+			}
+
+			latencies := make([]time.Duration, b.N)
+			var next int64 = -1
+			var wg sync.WaitGroup
+			errs := make(chan error, concurrency)
+			b.ResetTimer()
+			for i := 0; i < concurrency; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						n := atomic.AddInt64(&next, 1)
+						if n >= int64(b.N) {
+							return
+						}
+						start := time.Now()
+						if err := getManifest(); err != nil {
+							errs <- err
+							return
+						}
+						latencies[n] = time.Since(start)
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+			close(errs)
+			for err := range errs {
+				b.Fatal(err)
+			}
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			var total time.Duration
+			for _, l := range latencies {
+				total += l
+			}
+			b.ReportMetric(float64(total.Nanoseconds())/float64(b.N), "ns/request")
+			b.ReportMetric(float64(latencies[b.N*99/100].Nanoseconds()), "p99-ns/request")
+		})
+	}
+}
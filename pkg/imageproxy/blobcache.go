@@ -0,0 +1,280 @@
+package imageproxy
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// blobCache is a content-addressed directory of verified blobs, shared
+// by all images, with the least recently used blobs removed to keep the
+// total size under a limit.  Blobs are stored as <dir>/<algorithm>/<hex>.
+// Manifests and configs of docker:// images are stored as blobs too,
+// along with the digest of the manifest each image name refers to, in
+// <dir>/refs, so that these images can be used offline.
+type blobCache struct {
+	dir     string
+	maxSize int64
+
+	lock    sync.Mutex
+	entries map[digest.Digest]*blobCacheEntry
+	size    int64
+}
+
+type blobCacheEntry struct {
+	size int64
+	used time.Time
+}
+
+// newBlobCache opens (creating if needed) a blob cache in dir.  The
+// modification times of the files record when they were last used.
+func newBlobCache(dir string, maxSize int64) (*blobCache, error) {
+	c := &blobCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[digest.Digest]*blobCacheEntry),
+	}
+	// Leftovers from interrupted downloads
+	if err := os.RemoveAll(c.tmpDir()); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(c.tmpDir(), 0700); err != nil {
+		return nil, err
+	}
+	algos, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, algo := range algos {
+		if !algo.IsDir() || !digest.Algorithm(algo.Name()).Available() {
+			continue
+		}
+		blobs, err := os.ReadDir(filepath.Join(dir, algo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range blobs {
+			d := digest.NewDigestFromEncoded(digest.Algorithm(algo.Name()), blob.Name())
+			if d.Validate() != nil {
+				continue
+			}
+			info, err := blob.Info()
+			if err != nil {
+				return nil, err
+			}
+			c.entries[d] = &blobCacheEntry{size: info.Size(), used: info.ModTime()}
+			c.size += info.Size()
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evict("")
+	return c, nil
+}
+
+func (c *blobCache) tmpDir() string {
+	return filepath.Join(c.dir, "tmp")
+}
+
+func (c *blobCache) path(d digest.Digest) string {
+	return filepath.Join(c.dir, d.Algorithm().String(), d.Encoded())
+}
+
+// verifiedFile is a blob from the cache, whose digest was verified when it
+// was added, so that it can be sent without reading it again.
+type verifiedFile struct {
+	*os.File
+}
+
+// open returns a cached blob; ok is false if it isn't cached.
+func (c *blobCache) open(d digest.Digest) (f *os.File, size int64, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e := c.entries[d]
+	if e == nil {
+		return nil, 0, false
+	}
+	f, err := os.Open(c.path(d))
+	if err != nil {
+		// Removed behind our back
+		delete(c.entries, d)
+		c.size -= e.size
+		return nil, 0, false
+	}
+	e.used = time.Now()
+	// Best effort, this just affects eviction order after a restart
+	_ = os.Chtimes(c.path(d), e.used, e.used)
+	return f, e.size, true
+}
+
+// add moves the temporary file at tmpPath into the cache as the blob d.
+func (c *blobCache) add(tmpPath string, d digest.Digest, size int64) error {
+	if size > c.maxSize {
+		return os.Remove(tmpPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path(d)), 0700); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := os.Rename(tmpPath, c.path(d)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if e := c.entries[d]; e != nil {
+		c.size -= e.size
+	}
+	c.entries[d] = &blobCacheEntry{size: size, used: time.Now()}
+	c.size += size
+	c.evict(d)
+	return nil
+}
+
+// evict removes the least recently used blobs other than keep until
+// the cache fits in its maximum size.  Must be called with lock held.
+func (c *blobCache) evict(keep digest.Digest) {
+	for c.size > c.maxSize {
+		var oldest digest.Digest
+		for d, e := range c.entries {
+			if d != keep && (oldest == "" || e.used.Before(c.entries[oldest].used)) {
+				oldest = d
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		// Readers which already opened the file are unaffected
+		if err := os.Remove(c.path(oldest)); err != nil && !os.IsNotExist(err) {
+			logrus.WithError(err).WithField("digest", oldest).Warn("evicting blob from cache")
+		}
+		c.size -= c.entries[oldest].size
+		delete(c.entries, oldest)
+	}
+}
+
+// put adds a blob held in memory to the cache.
+func (c *blobCache) put(d digest.Digest, data []byte) error {
+	f, err := os.CreateTemp(c.tmpDir(), "blob")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return c.add(f.Name(), d, int64(len(data)))
+}
+
+// refPath returns the file recording which manifest an image name
+// refers to.  Names are hashed to get valid file names.
+func (c *blobCache) refPath(name string) string {
+	return filepath.Join(c.dir, "refs", digest.FromString(name).Encoded())
+}
+
+// setRef records that the image name refers to the manifest d.
+func (c *blobCache) setRef(name string, d digest.Digest) error {
+	if err := os.MkdirAll(filepath.Dir(c.refPath(name)), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.tmpDir(), "ref")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(d.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.refPath(name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// getRef returns the manifest last recorded for an image name, or ""
+// if there is none.
+func (c *blobCache) getRef(name string) (digest.Digest, error) {
+	buf, err := os.ReadFile(c.refPath(name))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return digest.Parse(string(buf))
+}
+
+// cachingReader passes through a blob as it is read, adding it to the
+// cache if it was read completely and matches its digest.
+type cachingReader struct {
+	r        io.ReadCloser
+	cache    *blobCache
+	digest   digest.Digest
+	verifier digest.Verifier
+	// f is nil once the blob was added to the cache or given up on
+	f    *os.File
+	size int64
+}
+
+// newCachingReader returns r unchanged if the temporary file can't be created.
+func (c *blobCache) newCachingReader(r io.ReadCloser, d digest.Digest) io.ReadCloser {
+	f, err := os.CreateTemp(c.tmpDir(), "blob")
+	if err != nil {
+		logrus.WithError(err).WithField("digest", d).Warn("not caching blob")
+		return r
+	}
+	return &cachingReader{
+		r:        r,
+		cache:    c,
+		digest:   d,
+		verifier: d.Verifier(),
+		f:        f,
+	}
+}
+
+func (c *cachingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 && c.f != nil {
+		if _, werr := c.f.Write(p[:n]); werr != nil {
+			logrus.WithError(werr).WithField("digest", c.digest).Warn("not caching blob")
+			c.discard()
+		} else {
+			c.verifier.Write(p[:n])
+			c.size += int64(n)
+		}
+	}
+	if err == io.EOF && c.f != nil {
+		f := c.f
+		c.f = nil
+		if cerr := f.Close(); cerr != nil || !c.verifier.Verified() {
+			os.Remove(f.Name())
+		} else if aerr := c.cache.add(f.Name(), c.digest, c.size); aerr != nil {
+			logrus.WithError(aerr).WithField("digest", c.digest).Warn("caching blob")
+		}
+	}
+	return n, err
+}
+
+func (c *cachingReader) discard() {
+	c.f.Close()
+	os.Remove(c.f.Name())
+	c.f = nil
+}
+
+func (c *cachingReader) Close() error {
+	if c.f != nil {
+		c.discard()
+	}
+	return c.r.Close()
+}
@@ -0,0 +1,64 @@
+package imageproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setBufferSize raises the kernel buffer used to send responses on conn
+// to size: the socket send buffer for --sockfd connections, or the pipe
+// buffer if stdout is a pipe.  It returns the resulting size, as reported
+// by the kernel (which may cap it, or for sockets double it to account
+// for its overhead), or 0 if the buffer can't be tuned.
+func setBufferSize(conn interface{}, size int) (int, error) {
+	switch c := conn.(type) {
+	case net.Conn:
+		sc, ok := c.(syscall.Conn)
+		if !ok {
+			return 0, nil
+		}
+		raw, err := sc.SyscallConn()
+		if err != nil {
+			return 0, err
+		}
+		var result int
+		var sockErr error
+		err = raw.Control(func(fd uintptr) {
+			if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, size); sockErr != nil {
+				return
+			}
+			result, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+		})
+		if err == nil {
+			err = sockErr
+		}
+		return result, err
+	case stdioConn:
+		f, ok := c.Writer.(*os.File)
+		if !ok {
+			return 0, nil
+		}
+		var st unix.Stat_t
+		if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+			return 0, err
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFIFO {
+			return 0, nil
+		}
+		result, err := unix.FcntlInt(f.Fd(), unix.F_SETPIPE_SZ, size)
+		if err != nil {
+			// Unprivileged processes are limited by /proc/sys/fs/pipe-max-size
+			current, gerr := unix.FcntlInt(f.Fd(), unix.F_GETPIPE_SZ, 0)
+			if gerr != nil {
+				return 0, err
+			}
+			return current, fmt.Errorf("setting pipe size to %d: %w", size, err)
+		}
+		return result, nil
+	}
+	return 0, nil
+}
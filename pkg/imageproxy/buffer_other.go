@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package imageproxy
+
+// setBufferSize is only implemented on Linux.
+func setBufferSize(conn interface{}, size int) (int, error) {
+	return 0, nil
+}
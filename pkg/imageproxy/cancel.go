@@ -0,0 +1,112 @@
+package imageproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// inflightRequest is a request carrying a Request-Id which is being handled.
+type inflightRequest struct {
+	cancel   context.CancelFunc
+	progress requestProgress
+}
+
+// inflightRequests tracks requests by their Request-Id so that they can
+// be cancelled, and their progress queried.  Several connections may use the same ids, so each maps
+// to all matching requests.
+type inflightRequests struct {
+	lock     sync.Mutex
+	requests map[string][]*inflightRequest
+}
+
+// add registers a request with the given id, returning a context which
+// is cancelled by cancel(id) and records the progress of the request,
+// and a function to call when it is done.
+func (t *inflightRequests) add(ctx context.Context, id string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	req := &inflightRequest{cancel: cancel}
+	ctx = context.WithValue(ctx, requestProgressKey{}, &req.progress)
+	t.lock.Lock()
+	if t.requests == nil {
+		t.requests = make(map[string][]*inflightRequest)
+	}
+	t.requests[id] = append(t.requests[id], req)
+	t.lock.Unlock()
+	return ctx, func() {
+		t.lock.Lock()
+		reqs := t.requests[id]
+		for i, r := range reqs {
+			if r == req {
+				reqs = append(reqs[:i], reqs[i+1:]...)
+				break
+			}
+		}
+		if len(reqs) == 0 {
+			delete(t.requests, id)
+		} else {
+			t.requests[id] = reqs
+		}
+		t.lock.Unlock()
+		cancel()
+	}
+}
+
+// cancel cancels the requests with the given id, returning false if
+// there are none.
+func (t *inflightRequests) cancel(id string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	reqs := t.requests[id]
+	for _, r := range reqs {
+		r.cancel()
+	}
+	return len(reqs) > 0
+}
+
+// cancelAll cancels all the requests.
+func (t *inflightRequests) cancelAll() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, reqs := range t.requests {
+		for _, r := range reqs {
+			r.cancel()
+		}
+	}
+}
+
+// progress returns the progress of the oldest request with the given
+// id, or nil if there are none.
+func (t *inflightRequests) progress(id string) *requestProgress {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	reqs := t.requests[id]
+	if len(reqs) == 0 {
+		return nil
+	}
+	return &reqs[0].progress
+}
+
+// implCancel handles POST /cancel, whose body is the Request-Id of
+// requests to abort.  Their contexts are cancelled, which stops fetching
+// from the image source; a request which hasn't started its response
+// yet fails with ECANCELED.  A response which has already started can't
+// be completed, so its connection is closed.
+func (h *proxyHandler) implCancel(w http.ResponseWriter, r *http.Request) error {
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	id := strings.TrimSpace(string(buf))
+	if id == "" {
+		return invalidRequestf("no Request-Id to cancel")
+	}
+	if !h.inflight.cancel(id) {
+		return notFoundf("no request with Request-Id %q in progress", id)
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(200)
+	return nil
+}
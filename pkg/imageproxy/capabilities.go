@@ -0,0 +1,88 @@
+package imageproxy
+
+import (
+	"io"
+	"net/http"
+)
+
+// endpoint describes a request the proxy handles, for GET /capabilities.
+type endpoint struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Parameters are the query parameters it accepts
+	Parameters []string `json:"parameters,omitempty"`
+	// Headers are the request headers it uses, besides those all
+	// requests accept
+	Headers []string `json:"headers,omitempty"`
+}
+
+// endpoints must be kept in sync with ServeHTTP, which only handles
+// requests matching one of them (see validateRequest).
+var endpoints = []endpoint{
+	{Method: http.MethodGet, Path: "/manifest", Parameters: []string{"raw"}, Headers: []string{"If-None-Match"}},
+	{Method: http.MethodHead, Path: "/manifest", Parameters: []string{"ref"}},
+	{Method: http.MethodDelete, Path: "/manifest", Parameters: []string{"ref"}},
+	{Method: http.MethodGet, Path: "/digest", Parameters: []string{"ref"}},
+	{Method: http.MethodGet, Path: "/inspect"},
+	{Method: http.MethodGet, Path: "/tags", Parameters: []string{"ref"}},
+	{Method: http.MethodGet, Path: "/blobs/<digest>", Parameters: []string{"decompress", "diffid", "fd", "sanitize", "whiteouts"}, Headers: []string{"Range"}},
+	{Method: http.MethodHead, Path: "/blobs/<digest>"},
+	{Method: http.MethodGet, Path: "/toc/<digest>"},
+	{Method: http.MethodGet, Path: "/uncompressed-size/<digest>", Parameters: []string{"exact"}},
+	{Method: http.MethodGet, Path: "/export/oci-archive", Parameters: []string{"name"}},
+	{Method: http.MethodGet, Path: "/export/docker-archive", Parameters: []string{"tag"}},
+	{Method: http.MethodGet, Path: "/flattened", Parameters: []string{"parallel"}},
+	{Method: http.MethodGet, Path: "/layers"},
+	{Method: http.MethodPost, Path: "/layers", Parameters: []string{"parallel"}},
+	{Method: http.MethodPost, Path: "/prefetch", Parameters: []string{"parallel"}},
+	{Method: http.MethodPost, Path: "/cancel"},
+	{Method: http.MethodPost, Path: "/events", Parameters: []string{"fd"}},
+	{Method: http.MethodGet, Path: "/progress", Parameters: []string{"id"}},
+	{Method: http.MethodPost, Path: "/copy"},
+	{Method: http.MethodPost, Path: "/image"},
+	{Method: http.MethodPost, Path: "/destination"},
+	{Method: http.MethodPut, Path: "/destination/blobs/<digest>", Parameters: []string{"config"}},
+	{Method: http.MethodPut, Path: "/destination/manifest", Headers: []string{"Content-Type"}},
+	{Method: http.MethodPost, Path: "/destination/commit"},
+	{Method: http.MethodGet, Path: "/ping"},
+	{Method: http.MethodGet, Path: "/stats"},
+	{Method: http.MethodGet, Path: "/capabilities"},
+	{Method: http.MethodPost, Path: "/quit", Parameters: []string{"force"}},
+}
+
+type capabilitiesReply struct {
+	Version   string     `json:"version"`
+	Endpoints []endpoint `json:"endpoints"`
+	// Headers are accepted by all requests
+	Headers  []string        `json:"headers"`
+	Features map[string]bool `json:"features"`
+}
+
+// implCapabilities handles GET /capabilities, describing the requests and
+// features supported, so that clients can detect them rather than
+// comparing versions.
+func (h *proxyHandler) implCapabilities(w http.ResponseWriter, r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	return writeReply(w, r, capabilitiesReply{
+		Version:   Version,
+		Endpoints: endpoints,
+		Headers:   []string{"Request-Id", "traceparent"},
+		Features: map[string]bool{
+			// Ranged GET /blobs requests (for docker:// images)
+			"partialPulls": true,
+			"push":         true,
+			"signatures":   false,
+			// Passing files with ?fd=1 over unix sockets
+			"fdPassing": true,
+			// Accept: application/cbor
+			"cbor":      true,
+			"blobCache": h.blobCache != nil,
+			"offline":   h.offline,
+			// POST /events
+			"progressEvents": true,
+		},
+	})
+}
@@ -0,0 +1,327 @@
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	cborMIMEType    = "application/cbor"
+	cborSeqMIMEType = "application/cbor-seq"
+)
+
+// CBOR major types
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+)
+
+// wantsCBOR returns whether the client accepts CBOR replies instead of
+// JSON.
+func wantsCBOR(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(t)
+			if err == nil && mediaType == cborMIMEType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sentCBOR returns whether the request body is CBOR instead of JSON.
+func sentCBOR(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == cborMIMEType
+}
+
+// encodeReply encodes v for the reply to r, returning its Content-Type.
+func encodeReply(r *http.Request, v interface{}) ([]byte, string, error) {
+	if wantsCBOR(r) {
+		buf, err := marshalCBOR(v)
+		return buf, cborMIMEType, err
+	}
+	buf, err := json.Marshal(v)
+	return buf, "application/json", err
+}
+
+// marshalCBOR encodes v as CBOR.  Values are converted via their JSON
+// encoding, so the CBOR replies have the same structure and field names
+// as the JSON ones, but integers are encoded as such.
+func marshalCBOR(v interface{}) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return jsonToCBOR(buf)
+}
+
+// jsonToCBOR converts a JSON document to CBOR.
+func jsonToCBOR(buf []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := encodeCBOR(&out, generic); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// unmarshalCBOR decodes CBOR into v, like json.Unmarshal would the
+// equivalent JSON.
+func unmarshalCBOR(data []byte, v interface{}) error {
+	d := cborDecoder{data: data}
+	generic, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return fmt.Errorf("trailing data after CBOR item")
+	}
+	buf, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func writeCBORHead(out *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		out.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		out.WriteByte(major<<5 | 24)
+		out.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		out.WriteByte(major<<5 | 25)
+		binary.Write(out, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		out.WriteByte(major<<5 | 26)
+		binary.Write(out, binary.BigEndian, uint32(n))
+	default:
+		out.WriteByte(major<<5 | 27)
+		binary.Write(out, binary.BigEndian, n)
+	}
+}
+
+// encodeCBOR encodes a value as decoded by encoding/json with UseNumber.
+// Map keys are sorted, so the encoding is deterministic.
+func encodeCBOR(out *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		out.WriteByte(cborSimple<<5 | 22)
+	case bool:
+		if v {
+			out.WriteByte(cborSimple<<5 | 21)
+		} else {
+			out.WriteByte(cborSimple<<5 | 20)
+		}
+	case string:
+		writeCBORHead(out, cborText, uint64(len(v)))
+		out.WriteString(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			if i >= 0 {
+				writeCBORHead(out, cborUnsigned, uint64(i))
+			} else {
+				writeCBORHead(out, cborNegative, uint64(-1-i))
+			}
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		out.WriteByte(cborSimple<<5 | 27)
+		binary.Write(out, binary.BigEndian, math.Float64bits(f))
+	case []interface{}:
+		writeCBORHead(out, cborArray, uint64(len(v)))
+		for _, e := range v {
+			if err := encodeCBOR(out, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeCBORHead(out, cborMap, uint64(len(keys)))
+		for _, k := range keys {
+			writeCBORHead(out, cborText, uint64(len(k)))
+			out.WriteString(k)
+			if err := encodeCBOR(out, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unexpected type %T", v)
+	}
+	return nil
+}
+
+// maxCBORDepth bounds the nesting of decoded items.
+const maxCBORDepth = 64
+
+// cborDecoder decodes CBOR items into the values encoding/json would
+// decode the equivalent JSON into.  Indefinite-length items aren't
+// supported.
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("truncated CBOR item")
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// head returns the major type and argument of the next item.
+func (d *cborDecoder) head() (byte, byte, uint64, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		arg, err := d.next(1 << (info - 24))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		var n uint64
+		for _, c := range arg {
+			n = n<<8 | uint64(c)
+		}
+		return major, info, n, nil
+	case info == 31:
+		return 0, 0, 0, fmt.Errorf("indefinite-length CBOR items are not supported")
+	default:
+		return 0, 0, 0, fmt.Errorf("invalid CBOR item")
+	}
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxCBORDepth {
+		return nil, fmt.Errorf("CBOR items nested too deeply")
+	}
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUnsigned:
+		return json.Number(fmt.Sprintf("%d", n)), nil
+	case cborNegative:
+		if n == math.MaxUint64 {
+			return json.Number("-18446744073709551616"), nil
+		}
+		return json.Number(fmt.Sprintf("-%d", n+1)), nil
+	case cborBytes, cborText:
+		// Like []byte in JSON, byte strings are decoded as strings
+		b, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case cborArray:
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("truncated CBOR item")
+		}
+		a := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			e, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, e)
+		}
+		return a, nil
+	case cborMap:
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("truncated CBOR item")
+		}
+		m := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("CBOR map keys must be strings")
+			}
+			if m[key], err = d.decode(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag:
+		// Tags only add semantics to the item they enclose
+		return d.decode(depth + 1)
+	default:
+		switch {
+		case info == 20:
+			return false, nil
+		case info == 21:
+			return true, nil
+		case info == 22 || info == 23:
+			return nil, nil
+		case info == 25:
+			return float16(uint16(n)), nil
+		case info == 26:
+			return float64(math.Float32frombits(uint32(n))), nil
+		case info == 27:
+			return math.Float64frombits(n), nil
+		}
+		return nil, fmt.Errorf("unsupported CBOR simple value %d", n)
+	}
+}
+
+// float16 converts an IEEE 754 half-precision float.
+func float16(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	frac := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
@@ -0,0 +1,82 @@
+package imageproxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+)
+
+// manifestETag returns the ETag of GET /manifest for the image whose
+// reference resolves to the manifest d (a manifest list, for
+// multi-architecture images).
+func manifestETag(d digest.Digest) string {
+	return strconv.Quote(d.String())
+}
+
+// etagMatches returns true if the If-None-Match header value matches etag:
+// it is "*", or a list of entity tags (whose weakness is ignored), one of
+// which is etag or the digest in it.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag || strconv.Quote(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvedManifestDigest returns the digest of the manifest the image
+// reference currently resolves to.  For docker:// images this is a HEAD
+// request to the registry, even if the image was already opened, so that
+// a tag which was moved since is noticed; other images are opened.
+func (h *proxyHandler) resolvedManifestDigest(ctx context.Context, r *http.Request) (digest.Digest, error) {
+	ref, err := h.requestImageRef(r)
+	if err != nil {
+		return "", err
+	}
+	if ref.Transport().Name() == docker.Transport.Name() && !h.offline {
+		return h.manifestDigest(ctx, ref)
+	}
+	if err := h.ensureImage(); err != nil {
+		return "", err
+	}
+	return h.openedManifestDigest(ctx)
+}
+
+// openedManifestDigest returns the digest of the manifest the opened image
+// was resolved to.
+func (h *proxyHandler) openedManifestDigest(ctx context.Context) (digest.Digest, error) {
+	topManifest, _, err := h.imageSource().GetManifest(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest(topManifest)
+}
+
+// manifestNotModified handles GET /manifest with If-None-Match, replying
+// 304 Not Modified and returning true if the image reference still
+// resolves to the manifest of the given ETag, without opening the image.
+func (h *proxyHandler) manifestNotModified(w http.ResponseWriter, r *http.Request) (bool, error) {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch == "" {
+		return false, nil
+	}
+	d, err := h.resolvedManifestDigest(r.Context(), r)
+	if err != nil {
+		return false, err
+	}
+	etag := manifestETag(d)
+	if !etagMatches(ifNoneMatch, etag) {
+		return false, nil
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusNotModified)
+	return true, nil
+}
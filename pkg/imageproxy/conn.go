@@ -0,0 +1,469 @@
+package imageproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// connWriter is the write side of a connection.  Requests carrying a
+// Request-Id header are handled concurrently, so the lock ensures only
+// one response at a time is written.
+type connWriter struct {
+	lock sync.Mutex
+	w    *bufio.Writer
+	// broken is set once a response was aborted; nothing more can be sent.
+	broken bool
+	// bufferSize is the kernel buffer size of the connection, if known
+	bufferSize int
+	// dst is what w writes to (the connection, or stdout), for sending
+	// files to it directly, and writeTimeout the timeout for writes to it
+	dst          interface{}
+	writeTimeout time.Duration
+}
+
+// stdioConn is the connection when serving on stdin and stdout.
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+// sockWriterKey is the context key for the SockResponseWriter of a request.
+type sockWriterKey struct{}
+
+// sockResponseWriter returns the SockResponseWriter the response to r is
+// written to, even if w wraps it (as when tracing), or nil.
+func sockResponseWriter(w http.ResponseWriter, r *http.Request) *SockResponseWriter {
+	if sw, ok := w.(*SockResponseWriter); ok {
+		return sw
+	}
+	sw, _ := r.Context().Value(sockWriterKey{}).(*SockResponseWriter)
+	return sw
+}
+
+type SockResponseWriter struct {
+	conn        *connWriter
+	out         io.Writer
+	headers     http.Header
+	head        bool
+	wroteHeader bool
+	chunked     bool
+	aborted     error
+	// status and written are recorded for metrics
+	status  int
+	written int64
+}
+
+func (rw *SockResponseWriter) Header() http.Header {
+	return rw.headers
+}
+
+func (rw *SockResponseWriter) Write(buf []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.head {
+		// Responses to HEAD never have a body
+		return len(buf), nil
+	}
+	if !rw.chunked {
+		n, err := rw.out.Write(buf)
+		rw.written += int64(n)
+		return n, err
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(rw.out, "%x\r\n", len(buf)); err != nil {
+		return 0, err
+	}
+	n, err := rw.out.Write(buf)
+	rw.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if _, err := rw.out.Write([]byte("\r\n")); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// Flush sends any buffered data to the client.
+func (rw *SockResponseWriter) Flush() {
+	if f, ok := rw.out.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+}
+
+// WriteHeader sends the status line and headers.  Responses which
+// don't declare a Content-Length (e.g. multipart range replies) use the
+// chunked transfer encoding so the client can still find the end of the body.
+// The connection is held until the response is completed.
+func (rw *SockResponseWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.status = statusCode
+	rw.conn.lock.Lock()
+	if rw.conn.broken {
+		rw.out = io.Discard
+	}
+	if rw.headers.Get("Content-Length") == "" && !rw.head {
+		rw.chunked = true
+		rw.headers.Set("Transfer-Encoding", "chunked")
+	}
+	rw.out.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))))
+	rw.headers.Write(rw.out)
+	rw.out.Write([]byte("\r\n"))
+}
+
+// sendFile sends the first size bytes of f as the body, without copying
+// them through userspace if the connection supports it.  handled is false
+// if the caller must write them itself.
+func (rw *SockResponseWriter) sendFile(f *os.File, size int64) (int64, bool, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.head || rw.chunked || rw.conn.dst == nil || rw.out != io.Writer(rw.conn.w) {
+		return 0, false, nil
+	}
+	if err := rw.conn.w.Flush(); err != nil {
+		return 0, true, err
+	}
+	written, handled, err := sendFile(rw.conn.dst, rw.conn.writeTimeout, f, size)
+	rw.written += written
+	return written, handled, err
+}
+
+// finish terminates the response body, sending any declared trailers.
+func (rw *SockResponseWriter) finish() error {
+	if !rw.wroteHeader {
+		if !rw.head {
+			rw.headers.Set("Content-Length", "0")
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.chunked {
+		if _, err := rw.out.Write([]byte("0\r\n")); err != nil {
+			return err
+		}
+		// Send the values of any headers declared as trailers
+		trailers := make(http.Header)
+		for _, v := range rw.headers.Values("Trailer") {
+			for _, k := range strings.Split(v, ",") {
+				k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+				if vals, ok := rw.headers[k]; ok {
+					trailers[k] = vals
+				}
+			}
+		}
+		if err := trailers.Write(rw.out); err != nil {
+			return err
+		}
+		if _, err := rw.out.Write([]byte("\r\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// complete finishes the response and flushes it to the connection,
+// releasing it for the next response.  If the response was aborted,
+// the connection is marked broken and an error is returned.
+func (rw *SockResponseWriter) complete() error {
+	var err error
+	if rw.aborted != nil {
+		rw.conn.broken = true
+		err = fmt.Errorf("aborted response: %w", rw.aborted)
+	} else {
+		err = rw.finish()
+	}
+	if ferr := rw.conn.w.Flush(); err == nil {
+		err = ferr
+	}
+	rw.conn.lock.Unlock()
+	return err
+}
+
+func (h *proxyHandler) isShutdown() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.shutdown
+}
+
+// serveRequest handles req, writing the response to conn.
+func (h *proxyHandler) serveRequest(conn *connWriter, req *http.Request) error {
+	resp := &SockResponseWriter{
+		conn:    conn,
+		out:     conn.w,
+		headers: make(map[string][]string),
+		head:    req.Method == http.MethodHead,
+	}
+	if id := req.Header.Get("Request-Id"); id != "" {
+		resp.headers.Set("Request-Id", id)
+		ctx, done := h.inflight.add(req.Context(), id)
+		defer done()
+		req = req.WithContext(ctx)
+	}
+	if h.timeouts.request > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), h.timeouts.request)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	// Lets clients size their reads for blob data
+	if conn.bufferSize > 0 && isStreamRequest(req) {
+		resp.headers.Set("Buffer-Size", fmt.Sprintf("%d", conn.bufferSize))
+	}
+	if f, ok := req.Context().Value(passedFileKey{}).(*os.File); ok {
+		defer f.Close()
+	}
+	req = req.WithContext(withEvents(withStats(context.WithValue(context.WithValue(req.Context(), connKey{}, conn), sockWriterKey{}, resp), h.stats), &h.events))
+	endpoint := metricEndpoint(req)
+	start := time.Now()
+	logrus.WithFields(logrus.Fields{"method": req.Method, "path": req.URL.Path}).Trace("dispatching request")
+	metricRequestsInProgress.Inc()
+	defer metricRequestsInProgress.Dec()
+	if isStreamRequest(req) {
+		metricActiveStreams.Inc()
+		defer metricActiveStreams.Dec()
+		atomic.AddInt64(&h.stats.activeStreams, 1)
+		defer atomic.AddInt64(&h.stats.activeStreams, -1)
+	}
+	// The request is only done once its response was flushed below
+	if h.requests.begin() {
+		defer h.requests.end()
+		h.active.begin()
+		defer h.active.end()
+		h.traced.ServeHTTP(resp, req)
+	} else {
+		h.replyError(resp, req, errShuttingDown)
+	}
+	// Handlers which fail early may not read the body; it must still be
+	// consumed so that the next request can be parsed.
+	_, drainErr := io.Copy(io.Discard, req.Body)
+	err := resp.complete()
+	log := logrus.WithFields(logrus.Fields{
+		"method":   req.Method,
+		"path":     req.URL.Path,
+		"status":   resp.status,
+		"bytes":    resp.written,
+		"duration": time.Since(start),
+	})
+	if id := req.Header.Get("Request-Id"); id != "" {
+		log = log.WithField("request_id", id)
+	}
+	log.Debug("request")
+	metricRequests.WithLabelValues(endpoint, strconv.Itoa(resp.status)).Inc()
+	atomic.AddInt64(&h.stats.requests, 1)
+	if isStreamRequest(req) {
+		atomic.AddInt64(&h.stats.bytesStreamed, resp.written)
+	}
+	metricResponseBytes.WithLabelValues(endpoint).Add(float64(resp.written))
+	if err != nil {
+		return err
+	}
+	return drainErr
+}
+
+// statusRecorder records the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rw *statusRecorder) WriteHeader(statusCode int) {
+	if rw.status == 0 {
+		rw.status = statusCode
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *statusRecorder) Write(buf []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(buf)
+	rw.written += int64(n)
+	return n, err
+}
+
+func (rw *statusRecorder) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serveInternal handles a request made on behalf of another frontend
+// (varlink or gRPC), with the same bookkeeping as serveRequest.  It
+// returns the status of the response.
+func (h *proxyHandler) serveInternal(w http.ResponseWriter, req *http.Request) int {
+	resp := &statusRecorder{ResponseWriter: w}
+	req = req.WithContext(withEvents(withStats(req.Context(), h.stats), &h.events))
+	endpoint := metricEndpoint(req)
+	metricRequestsInProgress.Inc()
+	defer metricRequestsInProgress.Dec()
+	if isStreamRequest(req) {
+		metricActiveStreams.Inc()
+		defer metricActiveStreams.Dec()
+		atomic.AddInt64(&h.stats.activeStreams, 1)
+		defer atomic.AddInt64(&h.stats.activeStreams, -1)
+	}
+	if h.requests.begin() {
+		h.active.begin()
+		h.ServeHTTP(resp, req)
+		h.active.end()
+		h.requests.end()
+	} else {
+		h.replyError(resp, req, errShuttingDown)
+	}
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	metricRequests.WithLabelValues(endpoint, strconv.Itoa(resp.status)).Inc()
+	atomic.AddInt64(&h.stats.requests, 1)
+	if isStreamRequest(req) {
+		atomic.AddInt64(&h.stats.bytesStreamed, resp.written)
+	}
+	metricResponseBytes.WithLabelValues(endpoint).Add(float64(resp.written))
+	return resp.status
+}
+
+// serveConn reads and handles requests from conn until EOF or shutdown.
+//
+// Requests are normally handled one at a time, in order.  A request
+// carrying a Request-Id header (and no body) is instead handled in the
+// background, and its response (echoing the Request-Id) is sent whenever
+// it is ready, possibly out of order.  This lets clients pipeline requests.
+func (h *proxyHandler) serveConn(conn io.ReadWriter) error {
+	var in io.Reader = conn
+	// Clients may pass files with requests on unix sockets, which may also
+	// be SOCK_SEQPACKET
+	var fds *fdReader
+	if uc, ok := conn.(*net.UnixConn); ok {
+		var err error
+		fds, err = newFdReader(uc)
+		if err != nil {
+			return err
+		}
+		in = fds
+	}
+	defer fds.close()
+	r := bufio.NewReader(in)
+	var out io.Writer = conn
+	cw := &connWriter{dst: conn}
+	if nc, ok := conn.(net.Conn); ok && h.timeouts.write > 0 {
+		out = &stallWriter{conn: nc, timeout: h.timeouts.write}
+		cw.writeTimeout = h.timeouts.write
+	}
+	if sc, ok := conn.(stdioConn); ok {
+		cw.dst = sc.Writer
+	}
+	cw.w = bufio.NewWriter(out)
+	if h.bufferSize > 0 {
+		size, err := setBufferSize(conn, h.bufferSize)
+		if err != nil {
+			logrus.WithError(err).Warn("setting connection buffer size")
+		}
+		cw.bufferSize = size
+	}
+
+	var wg sync.WaitGroup
+	var asyncLock sync.Mutex
+	var asyncErr error
+	// Wait for pipelined requests before returning, reporting their first error
+	finish := func(err error) error {
+		wg.Wait()
+		if err == nil {
+			err = asyncErr
+		}
+		return err
+	}
+
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			if err == io.EOF {
+				return finish(nil)
+			}
+			return finish(err)
+		}
+		req = fds.attachPassedFile(req)
+
+		async := req.Header.Get("Request-Id") != "" && req.ContentLength == 0 && req.URL.Path != "/quit"
+		if async {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := h.serveRequest(cw, req); err != nil {
+					asyncLock.Lock()
+					if asyncErr == nil {
+						asyncErr = err
+					}
+					asyncLock.Unlock()
+					// The client can't make sense of the connection anymore
+					if c, ok := conn.(io.Closer); ok {
+						c.Close()
+					}
+				}
+			}()
+			continue
+		}
+
+		if err := h.serveRequest(cw, req); err != nil {
+			return finish(err)
+		}
+
+		if h.isShutdown() {
+			return finish(nil)
+		}
+	}
+}
+
+// serveConns serves each connection in parallel, returning once all of
+// them are done or one of them requested a shutdown.  The first error
+// encountered (if any) is returned.
+func (h *proxyHandler) serveConns(conns []net.Conn) error {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(conns))
+	for _, conn := range conns {
+		go func(conn net.Conn) {
+			results <- result{conn, h.serveConn(conn)}
+		}(conn)
+	}
+
+	var firstErr error
+	for remaining := len(conns); remaining > 0; remaining-- {
+		res := <-results
+		res.conn.Close()
+		if h.isShutdown() {
+			// Unblock the other connections; their errors are expected
+			for _, conn := range conns {
+				conn.Close()
+			}
+			continue
+		}
+		if res.err != nil {
+			logrus.WithError(res.err).Error("serving connection")
+			if firstErr == nil {
+				firstErr = res.err
+			}
+		}
+	}
+	return firstErr
+}
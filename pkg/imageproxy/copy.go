@@ -0,0 +1,177 @@
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// copyProgress is one line of the newline-delimited JSON stream returned by POST /copy.
+type copyProgress struct {
+	Digest         string      `json:"digest,omitempty"`
+	Size           int64       `json:"size,omitempty"`
+	Reused         bool        `json:"reused,omitempty"`
+	ManifestDigest string      `json:"manifestDigest,omitempty"`
+	Error          *errorReply `json:"error,omitempty"`
+}
+
+// copyImage copies the opened image to dest, calling progress after each blob.
+// This is a simplified version of what containers/image/copy does: blobs are
+// copied as is, and the manifest is only converted if dest requires it.
+func (h *proxyHandler) copyImage(ctx context.Context, dest types.ImageDestination, progress func(copyProgress) error) (digest.Digest, error) {
+	src := h.imageSource()
+	img := h.loadedImage()
+
+	manifestBlob, mimeType, err := img.Manifest(ctx)
+	if err != nil {
+		return "", err
+	}
+	if supported := dest.SupportedManifestMIMETypes(); len(supported) > 0 && !containsString(supported, mimeType) {
+		var convertErr error
+		converted := false
+		for _, candidate := range supported {
+			updated, err := img.UpdatedImage(ctx, types.ManifestUpdateOptions{ManifestMIMEType: candidate})
+			if err != nil {
+				convertErr = err
+				continue
+			}
+			manifestBlob, mimeType, err = updated.Manifest(ctx)
+			if err != nil {
+				convertErr = err
+				continue
+			}
+			// Conversion may rewrite the config, so copy the blobs
+			// of the converted image.
+			img = updated
+			converted = true
+			break
+		}
+		if !converted {
+			return "", fmt.Errorf("converting manifest for destination: %w", convertErr)
+		}
+	}
+
+	blobs := img.LayerInfos()
+	configInfo := img.ConfigInfo()
+	if configInfo.Digest != "" {
+		blobs = append(blobs, configInfo)
+	}
+	for _, info := range blobs {
+		isConfig := info.Digest == configInfo.Digest
+		reused, _, err := dest.TryReusingBlob(ctx, info, h.cache, false)
+		if err != nil {
+			return "", withRegistry(dest.Reference(), err)
+		}
+		if !reused {
+			var blobr io.ReadCloser
+			if isConfig {
+				config, err := img.ConfigBlob(ctx)
+				if err != nil {
+					return "", err
+				}
+				blobr = io.NopCloser(bytes.NewReader(config))
+			} else {
+				blobr, _, err = h.getBlob(ctx, info)
+				if err != nil {
+					return "", err
+				}
+			}
+			_, err = dest.PutBlob(ctx, blobr, info, h.cache, isConfig)
+			blobr.Close()
+			if err != nil {
+				return "", withRegistry(dest.Reference(), fmt.Errorf("copying blob %s: %w", info.Digest, err))
+			}
+			if err := h.audit.record(auditRecord{Event: "copy", Image: h.imageName(), Digest: info.Digest, Size: info.Size, Destination: transports.ImageName(dest.Reference())}); err != nil {
+				return "", err
+			}
+		}
+		if err := progress(copyProgress{Digest: info.Digest.String(), Size: info.Size, Reused: reused}); err != nil {
+			return "", err
+		}
+	}
+
+	if err := dest.PutManifest(ctx, manifestBlob, nil); err != nil {
+		return "", withRegistry(dest.Reference(), err)
+	}
+	if err := dest.Commit(ctx, image.UnparsedInstance(src, nil)); err != nil {
+		return "", withRegistry(dest.Reference(), err)
+	}
+	return manifest.Digest(manifestBlob)
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// implCopy handles POST /copy; the request body is the destination image
+// reference.  Progress is streamed back as newline-delimited JSON, ending with
+// either the digest of the written manifest or an error.
+func (h *proxyHandler) implCopy(w http.ResponseWriter, r *http.Request) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	destRef, err := h.parseImageRef(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return err
+	}
+
+	ctx := r.Context()
+	dest, err := destRef.NewImageDestination(ctx, h.systemContext(destRef))
+	if err != nil {
+		return withRegistry(destRef, err)
+	}
+	defer dest.Close()
+
+	// Progress is sent as a sequence of JSON objects or CBOR items
+	cbor := wantsCBOR(r)
+	if cbor {
+		w.Header().Set("Content-Type", cborSeqMIMEType)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(200)
+	enc := json.NewEncoder(w)
+	progress := func(p copyProgress) error {
+		if cbor {
+			buf, err := marshalCBOR(p)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+		} else if err := enc.Encode(p); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	}
+	manifestDigest, err := h.copyImage(ctx, dest, progress)
+	if err != nil {
+		logrus.WithError(err).WithField("destination", transports.ImageName(destRef)).Error("copying image")
+		return progress(copyProgress{Error: newErrorReply(err)})
+	}
+	return progress(copyProgress{ManifestDigest: manifestDigest.String()})
+}
@@ -0,0 +1,190 @@
+package imageproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/blockcipher"
+	encconfig "github.com/containers/ocicrypt/config"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// annotationEncKeysPrefix is that of the annotations of layers encrypted
+// with ocicrypt (as by `skopeo copy --encryption-key`) holding their key,
+// wrapped for each recipient.
+const annotationEncKeysPrefix = "org.opencontainers.image.enc.keys."
+
+// parseDecryptionKey parses a private key, PEM or DER encoded, in PKCS #1,
+// PKCS #8 or SEC 1 (EC) format.
+func parseDecryptionKey(data []byte) (crypto.PrivateKey, error) {
+	der := data
+	if block, _ := pem.Decode(data); block != nil {
+		if _, encrypted := block.Headers["DEK-Info"]; encrypted || block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, fmt.Errorf("password-protected private keys are not supported")
+		}
+		der = block.Bytes
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		switch key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("not a PKCS #1, PKCS #8 or SEC 1 private key")
+}
+
+// newDecryptConfig returns the ocicrypt configuration decrypting layers
+// with keys, or nil if there are none.
+func newDecryptConfig(keys []crypto.PrivateKey) (*encconfig.DecryptConfig, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	// ocicrypt doesn't parse PEM encoded SEC 1 keys, unlike PKCS #8 ones
+	der := make([][]byte, len(keys))
+	for i, key := range keys {
+		var err error
+		der[i], err = x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cc, err := encconfig.DecryptWithPrivKeys(der, make([][]byte, len(keys)))
+	if err != nil {
+		return nil, err
+	}
+	return cc.DecryptConfig, nil
+}
+
+// layerDecryption is what is needed to decrypt an encrypted layer.
+type layerDecryption struct {
+	config *encconfig.DecryptConfig
+	desc   imgspecv1.Descriptor
+	// digest is that of the decrypted layer
+	digest digest.Digest
+}
+
+// layerDecryption returns how to decrypt the layer with digest d, or nil
+// if it isn't encrypted or no decryption keys were given, in which case it
+// is served as is.  It fails if none of the keys can decrypt the layer.
+func (h *proxyHandler) layerDecryption(d digest.Digest) (*layerDecryption, error) {
+	if h.decryptConfig == nil {
+		return nil, nil
+	}
+	info, err := h.layerInfo(d)
+	if err != nil {
+		// Not a layer
+		return nil, nil
+	}
+	if !isEncryptedLayer(info) {
+		return nil, nil
+	}
+	desc := imgspecv1.Descriptor{
+		MediaType:   info.MediaType,
+		Digest:      d,
+		Size:        info.Size,
+		Annotations: info.Annotations,
+	}
+	private, err := unwrapLayerOptions(h.decryptConfig, desc)
+	if err != nil {
+		return nil, err
+	}
+	if err := private.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("layer %s: invalid digest of the decrypted layer: %w", d, err)
+	}
+	return &layerDecryption{config: h.decryptConfig, desc: desc, digest: private.Digest}, nil
+}
+
+// unwrapLayerOptions returns the private options of an encrypted layer,
+// unwrapped with one of the keys of dc, or fails if none can, before the
+// layer is fetched.  They include the digest of the decrypted layer, which
+// ocicrypt.DecryptLayer doesn't return (in ocicrypt 1.1).
+func unwrapLayerOptions(dc *encconfig.DecryptConfig, desc imgspecv1.Descriptor) (*blockcipher.PrivateLayerBlockCipherOptions, error) {
+	var errs []string
+	for scheme, annotation := range ocicrypt.GetWrappedKeysMap(desc) {
+		keywrapper := ocicrypt.GetKeyWrapper(scheme)
+		if keywrapper.NoPossibleKeys(dc.Parameters) {
+			continue
+		}
+		for _, b64 := range strings.Split(annotation, ",") {
+			wrapped, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil {
+				return nil, fmt.Errorf("layer %s: invalid %s annotation: %w", desc.Digest, keywrapper.GetAnnotationID(), err)
+			}
+			data, err := keywrapper.UnwrapKey(dc, wrapped)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			var private blockcipher.PrivateLayerBlockCipherOptions
+			if err := json.Unmarshal(data, &private); err != nil {
+				return nil, fmt.Errorf("layer %s: invalid encryption options: %w", desc.Digest, err)
+			}
+			return &private, nil
+		}
+	}
+	if len(errs) == 0 {
+		return nil, invalidRequestf("layer %s is encrypted, and none of the decryption keys is one of its recipients", desc.Digest)
+	}
+	return nil, invalidRequestf("layer %s is encrypted, and none of the decryption keys can decrypt it: %s", desc.Digest, strings.Join(errs, "; "))
+}
+
+// isEncryptedLayer returns whether a layer was encrypted with ocicrypt.
+func isEncryptedLayer(info types.BlobInfo) bool {
+	if strings.HasSuffix(info.MediaType, "+encrypted") {
+		return true
+	}
+	for k := range info.Annotations {
+		if strings.HasPrefix(k, annotationEncKeysPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// reader returns the decrypted content of encrypted.  The encrypted layer
+// is verified against its digest, and authenticated, once it was all read.
+func (l *layerDecryption) reader(encrypted io.ReadCloser) (io.ReadCloser, error) {
+	verified := &verifyingReader{r: encrypted, digest: l.desc.Digest, verifier: l.desc.Digest.Verifier()}
+	plain, _, err := ocicrypt.DecryptLayer(l.config, verified, l.desc, false)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting layer %s: %w", l.desc.Digest, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{plain, encrypted}, nil
+}
+
+// verifyingReader fails at the end of r if it doesn't match digest.
+type verifyingReader struct {
+	r        io.Reader
+	digest   digest.Digest
+	verifier digest.Verifier
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.verifier.Write(p[:n])
+	if err == io.EOF && !r.verifier.Verified() {
+		return n, fmt.Errorf("Corrupted blob, expecting %s", r.digest.String())
+	}
+	return n, err
+}
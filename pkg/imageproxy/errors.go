@@ -0,0 +1,276 @@
+package imageproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/client"
+	"github.com/opencontainers/go-digest"
+)
+
+// Error codes sent in error replies, so that clients can tell the kinds
+// of failures apart without parsing messages.
+const (
+	errorCodeAuth      = "EAUTH"
+	errorCodeNotFound  = "ENOTFOUND"
+	errorCodeRateLimit = "ERATELIMIT"
+	errorCodePipe      = "EPIPE"
+	errorCodeInvalid   = "EINVAL"
+	errorCodeTimeout   = "ETIMEDOUT"
+	errorCodeCanceled  = "ECANCELED"
+	errorCodeShutdown  = "ESHUTDOWN"
+	errorCodeTooLarge  = "ETOOBIG"
+	errorCodeUnsafe    = "EUNSAFE"
+	errorCodeOther     = "EIO"
+)
+
+// errorReply is the body of an error response, and the error of a
+// POST /copy progress stream.
+type errorReply struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+	// Status is the HTTP status of the failed registry response, if any
+	Status int `json:"status,omitempty"`
+	// Endpoint is the registry involved, if known
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+func newErrorReply(err error) *errorReply {
+	return &errorReply{
+		Code:      errorCode(err),
+		Message:   err.Error(),
+		Retryable: isRetryable(err),
+		Status:    httpStatus(err),
+		Endpoint:  registryEndpoint(err),
+	}
+}
+
+// registryError records which registry an error came from.
+type registryError struct {
+	endpoint string
+	err      error
+}
+
+func (e *registryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *registryError) Unwrap() error {
+	return e.err
+}
+
+// withRegistry wraps err, if it isn't nil, to record the registry of
+// ref (if it is a docker:// reference).
+func withRegistry(ref types.ImageReference, err error) error {
+	if err == nil || ref == nil || ref.Transport().Name() != docker.Transport.Name() {
+		return err
+	}
+	var regErr *registryError
+	if errors.As(err, &regErr) {
+		return err
+	}
+	return &registryError{endpoint: reference.Domain(ref.DockerReference()), err: err}
+}
+
+// registryEndpoint returns the registry err came from, if known.  The
+// host of a failed HTTP request is preferred, as it may be a mirror.
+func registryEndpoint(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if u, perr := url.Parse(urlErr.URL); perr == nil && u.Host != "" {
+			return u.Host
+		}
+	}
+	var regErr *registryError
+	if errors.As(err, &regErr) {
+		return regErr.endpoint
+	}
+	return ""
+}
+
+// Registry errors often only carry the status in their message, either
+// as a bare number or followed by its text, e.g. "503 (Service Unavailable)".
+var (
+	registryStatusRegexp     = regexp.MustCompile(`(?:invalid status code from registry|StatusCode:) (\d{3})`)
+	registryStatusTextRegexp = regexp.MustCompile(`(\d{3}) \(([^)]+)\)`)
+)
+
+// httpStatus returns the HTTP status of the registry response err
+// reports, or 0 if there is none.
+func httpStatus(err error) int {
+	var credsErr docker.ErrUnauthorizedForCredentials
+	if errors.As(err, &credsErr) {
+		return http.StatusUnauthorized
+	}
+	if errors.Is(err, docker.ErrTooManyRequests) {
+		return http.StatusTooManyRequests
+	}
+	var ec errcode.Error
+	// Unknown codes are mapped to 500 regardless of the actual status
+	if errors.As(err, &ec) && ec.Code != errcode.ErrorCodeUnknown {
+		return ec.Code.Descriptor().HTTPStatusCode
+	}
+	var ecs errcode.Errors
+	if errors.As(err, &ecs) {
+		for _, e := range ecs {
+			if status := httpStatus(e); status != 0 {
+				return status
+			}
+		}
+	}
+	var statusErr *client.UnexpectedHTTPStatusError
+	if errors.As(err, &statusErr) {
+		if status, perr := strconv.Atoi(strings.SplitN(statusErr.Status, " ", 2)[0]); perr == nil {
+			return status
+		}
+	}
+	var responseErr *client.UnexpectedHTTPResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode
+	}
+	msg := err.Error()
+	if m := registryStatusRegexp.FindStringSubmatch(msg); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		return status
+	}
+	for _, m := range registryStatusTextRegexp.FindAllStringSubmatch(msg, -1) {
+		if status, _ := strconv.Atoi(m[1]); http.StatusText(status) == m[2] {
+			return status
+		}
+	}
+	return 0
+}
+
+// invalidRequestError is returned for requests which can't be valid,
+// e.g. with a malformed parameter.
+type invalidRequestError struct {
+	err error
+}
+
+func (e invalidRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e invalidRequestError) Unwrap() error {
+	return e.err
+}
+
+// invalidRequestf returns an invalidRequestError with a formatted message.
+func invalidRequestf(format string, args ...interface{}) error {
+	return invalidRequestError{fmt.Errorf(format, args...)}
+}
+
+// notFoundError is returned for things requested by the client which
+// don't exist; it matches os.ErrNotExist.
+type notFoundError struct {
+	msg string
+}
+
+func (e notFoundError) Error() string {
+	return e.msg
+}
+
+func (e notFoundError) Is(target error) bool {
+	return target == os.ErrNotExist
+}
+
+// notFoundf returns a notFoundError with a formatted message.
+func notFoundf(format string, args ...interface{}) error {
+	return notFoundError{fmt.Sprintf(format, args...)}
+}
+
+// tooLargeError is returned for manifests larger than the limit.
+type tooLargeError struct {
+	what  string
+	size  int64
+	limit int64
+}
+
+func (e *tooLargeError) Error() string {
+	return fmt.Sprintf("%s is %d bytes, more than the maximum of %d", e.what, e.size, e.limit)
+}
+
+// isTooLarge returns true if err is about something larger than a limit,
+// ours or one of containers/image (e.g. for manifests from registries).
+func isTooLarge(err error) bool {
+	var tooLarge *tooLargeError
+	return errors.As(err, &tooLarge) || strings.Contains(err.Error(), "exceeded maximum allowed size")
+}
+
+// errorCode classifies err into one of the error codes.
+func errorCode(err error) string {
+	var invalid invalidRequestError
+	switch {
+	case errors.As(err, &invalid),
+		errors.Is(err, digest.ErrDigestInvalidFormat),
+		errors.Is(err, digest.ErrDigestInvalidLength),
+		errors.Is(err, digest.ErrDigestUnsupported):
+		return errorCodeInvalid
+	case isRateLimited(err):
+		return errorCodeRateLimit
+	case isUnauthorized(err):
+		return errorCodeAuth
+	case isNotFound(err):
+		return errorCodeNotFound
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errNoResponse):
+		return errorCodeTimeout
+	case errors.Is(err, context.Canceled):
+		return errorCodeCanceled
+	case errors.Is(err, errShuttingDown):
+		return errorCodeShutdown
+	case isTooLarge(err):
+		return errorCodeTooLarge
+	case isUnsafeLayer(err):
+		return errorCodeUnsafe
+	case errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrClosedPipe), errors.Is(err, syscall.ECONNRESET):
+		return errorCodePipe
+	}
+	return errorCodeOther
+}
+
+// isRetryable returns true if err is likely to be transient, so that
+// repeating the request may succeed: timeouts, rate limiting, network
+// errors and server errors from the registry.
+func isRetryable(err error) bool {
+	switch errorCode(err) {
+	case errorCodeRateLimit, errorCodeTimeout, errorCodePipe, errorCodeShutdown:
+		return true
+	case errorCodeAuth, errorCodeNotFound, errorCodeInvalid, errorCodeCanceled, errorCodeTooLarge, errorCodeUnsafe:
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	return isServerError(err)
+}
+
+// isServerError returns true if err is a 5xx response from the registry.
+func isServerError(err error) bool {
+	return httpStatus(err) >= 500
+}
+
+// isUnauthorized returns true if err means the registry rejected our
+// credentials (or the lack of them).
+func isUnauthorized(err error) bool {
+	status := httpStatus(err)
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
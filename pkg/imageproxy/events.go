@@ -0,0 +1,253 @@
+package imageproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// progressInterval is the minimum interval between two progress events
+// for the same blob.
+const progressInterval = 250 * time.Millisecond
+
+// eventQueueSize is the number of events which can be waiting to be
+// written before new ones are dropped.
+const eventQueueSize = 256
+
+// progressEvent is one line of the newline-delimited JSON event stream.
+type progressEvent struct {
+	// Event is one of blob-start, blob-progress, blob-done, retry and
+	// resume
+	Event  string        `json:"event"`
+	Digest digest.Digest `json:"digest,omitempty"`
+	// Size is that of the blob, if known
+	Size int64 `json:"size,omitempty"`
+	// Bytes is the number of bytes of the blob transferred so far, or
+	// the offset it is resumed at
+	Bytes int64 `json:"bytes,omitempty"`
+	// Throttled is the time spent waiting for --max-bandwidth so far,
+	// in milliseconds
+	Throttled int64 `json:"throttledMs,omitempty"`
+	// Operation is what is retried
+	Operation string `json:"operation,omitempty"`
+	Attempt   string `json:"attempt,omitempty"`
+	// Delay is the time until the retry, in milliseconds
+	Delay int64  `json:"delayMs,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Cached is set for blobs served from the blob cache, which are
+	// only reported once
+	Cached bool `json:"cached,omitempty"`
+}
+
+// eventStream sends the progress events of a session to the file the
+// client gave with POST /events.  Events are written in the background,
+// and dropped rather than slowing transfers down if the client doesn't
+// keep up.  The zero value sends nowhere.
+type eventStream struct {
+	lock  sync.Mutex
+	queue chan []byte
+	// dropped counts the events dropped since the last one sent
+	dropped int64
+}
+
+// eventsKey is the context key for the event stream of the session a
+// request belongs to.
+type eventsKey struct{}
+
+func withEvents(ctx context.Context, events *eventStream) context.Context {
+	return context.WithValue(ctx, eventsKey{}, events)
+}
+
+// emitEvent sends ev to the event stream of the session of ctx, if any.
+func emitEvent(ctx context.Context, ev progressEvent) {
+	if events, ok := ctx.Value(eventsKey{}).(*eventStream); ok {
+		events.emit(ev)
+	}
+}
+
+// active returns true if events are sent anywhere.
+func (s *eventStream) active() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.queue != nil
+}
+
+func (s *eventStream) emit(ev progressEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.queue == nil {
+		return
+	}
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	select {
+	case s.queue <- append(buf, '\n'):
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// start sends the events to f from now on, instead of where they were
+// sent before.  f is closed once the stream is stopped, or if writing
+// to it fails (e.g. because the client closed the other end of a pipe).
+func (s *eventStream) start(f *os.File) {
+	queue := make(chan []byte, eventQueueSize)
+	s.lock.Lock()
+	if s.queue != nil {
+		close(s.queue)
+	}
+	s.queue = queue
+	s.lock.Unlock()
+	go s.write(f, queue)
+}
+
+func (s *eventStream) write(f *os.File, queue chan []byte) {
+	defer f.Close()
+	for buf := range queue {
+		if dropped := atomic.SwapInt64(&s.dropped, 0); dropped > 0 {
+			logrus.WithField("events", dropped).Debug("dropped progress events")
+		}
+		if _, err := f.Write(buf); err != nil {
+			logrus.WithError(err).Debug("stopped sending progress events")
+			s.lock.Lock()
+			if s.queue == queue {
+				close(s.queue)
+				s.queue = nil
+			}
+			s.lock.Unlock()
+			// Let emit proceed until the queue is closed
+			for range queue {
+			}
+			return
+		}
+	}
+}
+
+// stop stops sending events, closing the file they were sent to.
+func (s *eventStream) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.queue != nil {
+		close(s.queue)
+		s.queue = nil
+	}
+}
+
+// implEvents handles POST /events?fd=1, sending the progress events of
+// this session to the file descriptor which comes with the request
+// (typically a pipe), as newline-delimited JSON.  A later request
+// replaces it.
+func (h *proxyHandler) implEvents(w http.ResponseWriter, r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	f, err := passedFile(r)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return invalidRequestf("POST /events requires fd=1 and a file descriptor to send the events to")
+	}
+	// The passed file is closed with the request; the stream keeps its own
+	fd, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	h.events.start(os.NewFile(uintptr(fd), "progress events"))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(200)
+	return nil
+}
+
+// progressReader sends progress events for a blob as it is read, and
+// counts it in the progress of its request.
+type progressReader struct {
+	ctx    context.Context
+	digest digest.Digest
+	size   int64
+	r      io.ReadCloser
+	// throttled is nil unless the blob is rate limited
+	throttled *throttledReader
+	// request is nil unless the request has a Request-Id
+	request *requestProgress
+
+	bytes int64
+	last  time.Time
+	done  bool
+}
+
+// withProgress returns r, sending progress events as it is read if the
+// session of ctx has an event stream, and counting it in the progress of
+// the request of ctx.  throttled is the reader of the blob waiting for
+// --max-bandwidth, if any.
+func withProgress(ctx context.Context, d digest.Digest, size int64, r io.ReadCloser, throttled *throttledReader) io.ReadCloser {
+	events, _ := ctx.Value(eventsKey{}).(*eventStream)
+	request, _ := ctx.Value(requestProgressKey{}).(*requestProgress)
+	if (events == nil || !events.active()) && request == nil {
+		return r
+	}
+	if size < 0 {
+		size = 0
+	}
+	if request != nil {
+		atomic.AddInt64(&request.size, size)
+	}
+	p := &progressReader{ctx: ctx, digest: d, size: size, r: r, throttled: throttled, request: request, last: time.Now()}
+	emitEvent(ctx, progressEvent{Event: "blob-start", Digest: d, Size: size})
+	return p
+}
+
+func (p *progressReader) event(name string) progressEvent {
+	ev := progressEvent{Event: name, Digest: p.digest, Size: p.size, Bytes: p.bytes}
+	if p.throttled != nil {
+		ev.Throttled = p.throttled.waited.Milliseconds()
+	}
+	return ev
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.bytes += int64(n)
+	if p.request != nil {
+		atomic.AddInt64(&p.request.bytes, int64(n))
+	}
+	if p.done {
+		return n, err
+	}
+	if err != nil {
+		p.done = true
+		ev := p.event("blob-done")
+		if err != io.EOF {
+			ev.Error = err.Error()
+		}
+		emitEvent(p.ctx, ev)
+	} else if time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		emitEvent(p.ctx, p.event("blob-progress"))
+	}
+	return n, err
+}
+
+func (p *progressReader) Close() error {
+	if !p.done {
+		p.done = true
+		ev := p.event("blob-done")
+		if p.size > 0 && p.bytes < p.size {
+			ev.Error = "closed before the end of the blob"
+		}
+		emitEvent(p.ctx, ev)
+	}
+	return p.r.Close()
+}
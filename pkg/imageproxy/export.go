@@ -0,0 +1,94 @@
+package imageproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/transports/alltransports"
+)
+
+// exportArchive writes the opened image to an archive using transport
+// (e.g. oci-archive), and streams it as the response.  name is added to
+// the destination reference if not empty.  The archive is written to a
+// temporary file first, as containers/image only produces it on commit.
+func (h *proxyHandler) exportArchive(w http.ResponseWriter, r *http.Request, transport, name string) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		return err
+	}
+
+	tmpdir, err := os.MkdirTemp("", "container-image-proxy-export")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	path := filepath.Join(tmpdir, "image.tar")
+	destName := transport + ":" + path
+	if name != "" {
+		destName += ":" + name
+	}
+	destRef, err := alltransports.ParseImageName(destName)
+	if err != nil {
+		return err
+	}
+
+	ctx := r.Context()
+	dest, err := destRef.NewImageDestination(ctx, h.systemContext(destRef))
+	if err != nil {
+		return err
+	}
+	_, err = h.copyImage(ctx, dest, func(copyProgress) error { return nil })
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", transport, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", st.Size()))
+	w.WriteHeader(200)
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// implExportOCIArchive handles GET /export/oci-archive, returning the
+// image as an OCI archive; ?name= sets its org.opencontainers.image.ref.name.
+func (h *proxyHandler) implExportOCIArchive(w http.ResponseWriter, r *http.Request) error {
+	return h.exportArchive(w, r, "oci-archive", r.URL.Query().Get("name"))
+}
+
+// implExportDockerArchive handles GET /export/docker-archive, returning the
+// image as a tarball which can be passed to `docker load`.  It is tagged
+// with ?tag=, defaulting to the image's own tag if it has one.
+func (h *proxyHandler) implExportDockerArchive(w http.ResponseWriter, r *http.Request) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	// Docker archives can only hold container images
+	if err := h.requireContainerImage(r.Context()); err != nil {
+		return err
+	}
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		if named, ok := h.imageSource().Reference().DockerReference().(reference.NamedTagged); ok {
+			tag = named.String()
+		}
+	}
+	return h.exportArchive(w, r, "docker-archive", tag)
+}
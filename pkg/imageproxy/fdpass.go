@@ -0,0 +1,175 @@
+package imageproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxPassedFds is the number of file descriptors which can be received
+// along with a single read from a connection.
+const maxPassedFds = 16
+
+// maxPacketSize is the largest packet which can be received on a
+// SOCK_SEQPACKET connection.
+const maxPacketSize = 1 << 20
+
+// passedFileKey is the context key for the file passed with a request.
+type passedFileKey struct{}
+
+// fdReader reads from a unix socket connection, collecting the file
+// descriptors sent along with the data (SCM_RIGHTS), in order.
+//
+// On SOCK_SEQPACKET connections, a read returns (at most) one packet, and
+// whatever doesn't fit in the buffer is lost.  Packets are therefore read
+// whole into buf and returned from there, so that the data can still be
+// parsed as a stream.  A packet may hold any part of the requests, e.g.
+// one request each, or a request body split across several.
+type fdReader struct {
+	conn    *net.UnixConn
+	packet  bool
+	buf     []byte
+	pending []byte
+
+	lock sync.Mutex
+	fds  []*os.File
+}
+
+func newFdReader(conn *net.UnixConn) (*fdReader, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var sockType int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockType, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TYPE)
+	}); err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return &fdReader{conn: conn, packet: sockType == unix.SOCK_SEQPACKET}, nil
+}
+
+func (r *fdReader) Read(p []byte) (int, error) {
+	if !r.packet {
+		n, _, err := r.readMsg(p)
+		return n, err
+	}
+	if len(r.pending) == 0 {
+		if r.buf == nil {
+			r.buf = make([]byte, maxPacketSize)
+		}
+		n, flags, err := r.readMsg(r.buf)
+		if err != nil {
+			return 0, err
+		}
+		if flags&unix.MSG_TRUNC != 0 {
+			return 0, fmt.Errorf("received a packet larger than %d bytes", maxPacketSize)
+		}
+		// The peer closed the connection
+		if n == 0 {
+			return 0, io.EOF
+		}
+		r.pending = r.buf[:n]
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// readMsg reads data into p, collecting any file descriptors sent with it.
+func (r *fdReader) readMsg(p []byte) (int, int, error) {
+	oob := make([]byte, unix.CmsgSpace(maxPassedFds*4))
+	n, oobn, flags, _, err := r.conn.ReadMsgUnix(p, oob)
+	if n < 0 {
+		n = 0
+	}
+	if oobn > 0 {
+		if perr := r.addFds(oob[:oobn]); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return n, flags, err
+}
+
+func (r *fdReader) addFds(oob []byte) error {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, msg := range msgs {
+		fds, err := unix.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			r.fds = append(r.fds, os.NewFile(uintptr(fd), fmt.Sprintf("passed fd %d", fd)))
+		}
+	}
+	return nil
+}
+
+// take returns the oldest received file which wasn't taken yet, if any.
+func (r *fdReader) take() *os.File {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.fds) == 0 {
+		return nil
+	}
+	f := r.fds[0]
+	r.fds = r.fds[1:]
+	return f
+}
+
+// close closes the files which were never taken.
+func (r *fdReader) close() {
+	if r == nil {
+		return
+	}
+	for f := r.take(); f != nil; f = r.take() {
+		f.Close()
+	}
+}
+
+// attachPassedFile gives req the file which the client sent with it, if
+// it asks for one with ?fd=1.  This must be done as requests are read,
+// so that files are matched with requests in order even if they are
+// then handled concurrently.
+func (r *fdReader) attachPassedFile(req *http.Request) *http.Request {
+	if r == nil {
+		return req
+	}
+	if wants, err := queryBool(req, "fd"); err != nil || !wants {
+		return req
+	}
+	f := r.take()
+	if f == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), passedFileKey{}, f))
+}
+
+// passedFile returns the file passed with r, which the handler must
+// write to instead of the response body, or nil if it didn't ask for one.
+func passedFile(r *http.Request) (*os.File, error) {
+	wants, err := queryBool(r, "fd")
+	if err != nil || !wants {
+		return nil, err
+	}
+	f, _ := r.Context().Value(passedFileKey{}).(*os.File)
+	if f == nil {
+		return nil, invalidRequestf("fd=1 requires a file descriptor to be sent with the request (SCM_RIGHTS on a --sockfd connection)")
+	}
+	return f, nil
+}
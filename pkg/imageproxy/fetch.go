@@ -0,0 +1,237 @@
+package imageproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// Same default as containers/image/copy uses for pulls
+const defaultFetchParallelism = 6
+
+// spooledBlob is a verified blob ready to be sent.
+type spooledBlob struct {
+	digest digest.Digest
+	r      io.ReadCloser
+	size   int64
+	err    error
+}
+
+// downloadBlob fetches and verifies a blob into an unlinked temporary file.
+// If the blob is in the blob cache, the cached file is returned.
+func (h *proxyHandler) downloadBlob(ctx context.Context, d digest.Digest) (*os.File, int64, error) {
+	if h.blobCache != nil {
+		if f, size, ok := h.blobCache.open(d); ok {
+			atomic.AddInt64(&h.stats.cacheHits, 1)
+			return f, size, nil
+		}
+	}
+	blobr, _, err := h.fetchBlob(ctx, types.BlobInfo{Digest: d, Size: -1})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer blobr.Close()
+	f, err := os.CreateTemp("", "container-image-proxy-blob")
+	if err != nil {
+		return nil, 0, err
+	}
+	// Unlinked right away; the space is freed once f is closed
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	verifier := h.blobVerifier(d)
+	var r io.Reader = blobr
+	if verifier != nil {
+		r = io.TeeReader(r, verifier)
+	}
+	size, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if verifier != nil && !verifier.Verified() {
+		f.Close()
+		return nil, 0, fmt.Errorf("Corrupted blob, expecting %s", d.String())
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// spoolBlob returns a verified blob, either from the prefetched blobs or
+// downloaded into a temporary file.
+func (h *proxyHandler) spoolBlob(ctx context.Context, d digest.Digest) (io.ReadCloser, int64, error) {
+	var r io.ReadCloser
+	var size int64
+	if pr, psize, ok := h.prefetched.get(ctx, d); ok {
+		r, size = pr, psize
+	} else {
+		f, fsize, err := h.downloadBlob(ctx, d)
+		if err != nil {
+			return nil, 0, err
+		}
+		r, size = f, fsize
+	}
+	if err := h.blobServed(d, size, ""); err != nil {
+		r.Close()
+		return nil, 0, err
+	}
+	return r, size, nil
+}
+
+// fetchBlobs downloads blobs with at most parallel transfers at a time,
+// sending each to the returned channel as soon as it is complete.  Blobs
+// are not downloaded further ahead than parallel, so that bounds disk usage.
+// Cancelling ctx stops fetching; the channel is always eventually closed.
+func (h *proxyHandler) fetchBlobs(ctx context.Context, digests []digest.Digest, parallel int) <-chan spooledBlob {
+	results := make(chan spooledBlob)
+	slots := make(chan struct{}, parallel)
+	go func() {
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait()
+			close(results)
+		}()
+		for _, d := range digests {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func(d digest.Digest) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				r, size, err := h.spoolBlob(ctx, d)
+				select {
+				case results <- spooledBlob{digest: d, r: r, size: size, err: err}:
+				case <-ctx.Done():
+					if r != nil {
+						r.Close()
+					}
+				}
+			}(d)
+		}
+	}()
+	return results
+}
+
+// parseParallel returns the number of concurrent transfers given by
+// ?parallel=, defaulting to 6.
+func parseParallel(r *http.Request) (int, error) {
+	parallel := defaultFetchParallelism
+	if v := r.URL.Query().Get("parallel"); v != "" {
+		var err error
+		parallel, err = strconv.Atoi(v)
+		if err != nil || parallel < 1 {
+			return 0, invalidRequestf("invalid parallel parameter %q", v)
+		}
+	}
+	return parallel, nil
+}
+
+// parseLayersRequest parses a request naming a set of blobs to fetch
+// concurrently.  The request body is a JSON array of blob digests,
+// defaulting to all layers of the image; the number of concurrent
+// transfers is given by ?parallel=, defaulting to 6.
+func (h *proxyHandler) parseLayersRequest(r *http.Request) ([]digest.Digest, int, error) {
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	parallel, err := parseParallel(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var digests []digest.Digest
+	if len(buf) > 0 {
+		var digestStrs []string
+		unmarshal := json.Unmarshal
+		if sentCBOR(r) {
+			unmarshal = unmarshalCBOR
+		}
+		if err := unmarshal(buf, &digestStrs); err != nil {
+			return nil, 0, invalidRequestf("invalid request body: %w", err)
+		}
+		for _, s := range digestStrs {
+			d, err := digest.Parse(s)
+			if err != nil {
+				return nil, 0, err
+			}
+			digests = append(digests, d)
+		}
+	} else {
+		for _, layer := range h.loadedImage().LayerInfos() {
+			digests = append(digests, layer.Digest)
+		}
+	}
+	return digests, parallel, nil
+}
+
+// implFetchLayers handles POST /layers.  The request body is a JSON array
+// of blob digests; if empty, all layers of the image are fetched.  Blobs are
+// fetched concurrently (up to ?parallel=, default 6) and streamed back as the
+// parts of a multipart/mixed response, in the order they complete.
+func (h *proxyHandler) implFetchLayers(w http.ResponseWriter, r *http.Request) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	digests, parallel, err := h.parseLayersRequest(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	results := h.fetchBlobs(ctx, digests, parallel)
+	defer func() {
+		cancel()
+		for res := range results {
+			if res.r != nil {
+				res.r.Close()
+			}
+		}
+	}()
+
+	// The Content-Type is only set once something succeeded, so that
+	// an early error is returned as a plain error response.
+	mw := multipart.NewWriter(w)
+	setContentType := func() {
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	}
+	for res := range results {
+		if res.err != nil {
+			return fmt.Errorf("fetching %s: %w", res.digest, res.err)
+		}
+		setContentType()
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":   {"application/octet-stream"},
+			"Content-Length": {fmt.Sprintf("%d", res.size)},
+			"Blob-Digest":    {res.digest.String()},
+		})
+		if err == nil {
+			_, err = io.Copy(part, res.r)
+		}
+		res.r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	setContentType()
+	return mw.Close()
+}
@@ -0,0 +1,244 @@
+package imageproxy
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// fsNode is a path in the rootfs being flattened, recording the layer
+// whose entry for it ends up in the result (-1 for directories which are
+// only implied by their contents).
+type fsNode struct {
+	layer    int
+	dir      bool
+	children map[string]*fsNode
+}
+
+func newDirNode(layer int) *fsNode {
+	return &fsNode{layer: layer, dir: true, children: make(map[string]*fsNode)}
+}
+
+// lookup returns the node for the cleaned absolute path p, or nil.  With
+// create, missing nodes are added, and existing non-directory parents are
+// replaced by directories.
+func (n *fsNode) lookup(p string, create bool) *fsNode {
+	if p == "/" {
+		return n
+	}
+	for _, name := range strings.Split(p[1:], "/") {
+		if !n.dir {
+			if !create {
+				return nil
+			}
+			n.dir = true
+			n.layer = -1
+			n.children = make(map[string]*fsNode)
+		}
+		child := n.children[name]
+		if child == nil {
+			if !create {
+				return nil
+			}
+			child = newDirNode(-1)
+			n.children[name] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// layerEntry is the part of a tar header needed to flatten layers.
+type layerEntry struct {
+	path string
+	dir  bool
+}
+
+// cleanEntryPath returns the name of a tar entry as a cleaned absolute path.
+func cleanEntryPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// readLayerEntries lists the entries of a (possibly compressed) layer tarball.
+func readLayerEntries(r io.Reader) ([]layerEntry, error) {
+	stream, _, err := compression.AutoDecompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	var entries []layerEntry
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, layerEntry{path: cleanEntryPath(hdr.Name), dir: hdr.Typeflag == tar.TypeDir})
+	}
+}
+
+// applyLayer records the entries of layer i in the tree.  Whiteouts only
+// hide the contents of lower layers, so they are applied first regardless
+// of their position in the tarball.
+func (root *fsNode) applyLayer(i int, entries []layerEntry) {
+	for _, e := range entries {
+		base := path.Base(e.path)
+		if !strings.HasPrefix(base, whiteoutPrefix) {
+			continue
+		}
+		parent := root.lookup(path.Dir(e.path), false)
+		if parent == nil || !parent.dir {
+			continue
+		}
+		if base == whiteoutOpaque {
+			parent.children = make(map[string]*fsNode)
+		} else {
+			delete(parent.children, strings.TrimPrefix(base, whiteoutPrefix))
+		}
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(path.Base(e.path), whiteoutPrefix) {
+			continue
+		}
+		n := root.lookup(e.path, true)
+		n.layer = i
+		if e.dir {
+			if !n.dir {
+				n.dir = true
+				n.children = make(map[string]*fsNode)
+			}
+		} else {
+			n.dir = false
+			n.children = nil
+		}
+	}
+}
+
+// writeLayerEntries copies the entries of layer i which are part of the
+// flattened rootfs to tw.
+func (root *fsNode) writeLayerEntries(i int, r io.Reader, tw *tar.Writer) error {
+	stream, _, err := compression.AutoDecompress(r)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p := cleanEntryPath(hdr.Name)
+		if strings.HasPrefix(path.Base(p), whiteoutPrefix) {
+			continue
+		}
+		if n := root.lookup(p, false); n == nil || n.layer != i {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// implFlattened handles GET /flattened, which applies all layers of the
+// image in order and returns a single tarball of the resulting rootfs.
+// The layers are spooled to temporary files (fetched concurrently, up to
+// ?parallel=), read once to compute which entries survive the whiteouts
+// and overwrites of upper layers, then read again to send those entries,
+// lowest layer first.
+func (h *proxyHandler) implFlattened(w http.ResponseWriter, r *http.Request) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		return err
+	}
+	if err := h.requireContainerImage(r.Context()); err != nil {
+		return err
+	}
+	parallel, err := parseParallel(r)
+	if err != nil {
+		return err
+	}
+
+	var digests, unique []digest.Digest
+	layers := make(map[digest.Digest]io.ReadCloser)
+	for _, layer := range h.loadedImage().LayerInfos() {
+		digests = append(digests, layer.Digest)
+		if _, ok := layers[layer.Digest]; !ok {
+			layers[layer.Digest] = nil
+			unique = append(unique, layer.Digest)
+		}
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	results := h.fetchBlobs(ctx, unique, parallel)
+	defer func() {
+		cancel()
+		for res := range results {
+			if res.r != nil {
+				res.r.Close()
+			}
+		}
+		for _, l := range layers {
+			if l != nil {
+				l.Close()
+			}
+		}
+	}()
+	for res := range results {
+		if res.err != nil {
+			return fmt.Errorf("fetching %s: %w", res.digest, res.err)
+		}
+		layers[res.digest] = res.r
+		if _, ok := res.r.(io.Seeker); !ok {
+			return fmt.Errorf("internal error: blob %s is not seekable", res.digest)
+		}
+	}
+
+	root := newDirNode(-1)
+	for i, d := range digests {
+		if _, err := layers[d].(io.Seeker).Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		entries, err := readLayerEntries(layers[d])
+		if err != nil {
+			return fmt.Errorf("reading layer %s: %w", d, err)
+		}
+		root.applyLayer(i, entries)
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.WriteHeader(200)
+	tw := tar.NewWriter(w)
+	for i, d := range digests {
+		if _, err := layers[d].(io.Seeker).Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := root.writeLayerEntries(i, layers[d], tw); err != nil {
+			return fmt.Errorf("reading layer %s: %w", d, err)
+		}
+	}
+	return tw.Close()
+}
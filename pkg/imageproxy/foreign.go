@@ -0,0 +1,63 @@
+package imageproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// withLayerURLs returns info with the URLs of the layer from the manifest,
+// if it has some.  Foreign (non-distributable) layers, such as Windows
+// base layers, are usually only available from these.
+func (h *proxyHandler) withLayerURLs(info types.BlobInfo) types.BlobInfo {
+	if len(info.URLs) > 0 || h.offline {
+		return info
+	}
+	if layer, err := h.layerInfo(info.Digest); err == nil && len(layer.URLs) > 0 {
+		info.URLs = layer.URLs
+	}
+	return info
+}
+
+// getSourceBlob calls GetBlob on src, returning the info the blob was
+// fetched with.  A layer with URLs is fetched from them, falling back to
+// the registry if that fails, as the registry may have it too; from local
+// images, it is read from the image first.  The blob isn't verified here,
+// wherever it comes from.
+func (h *proxyHandler) getSourceBlob(ctx context.Context, src types.ImageSource, info types.BlobInfo) (io.ReadCloser, int64, types.BlobInfo, error) {
+	if len(info.URLs) == 0 {
+		blob, size, err := src.GetBlob(ctx, info, h.cache)
+		return blob, size, info, err
+	}
+	fromImage := info
+	fromImage.URLs = nil
+	attempts := []types.BlobInfo{info, fromImage}
+	if !remoteBlobs(src.Reference()) {
+		attempts = []types.BlobInfo{fromImage, info}
+	}
+	var failed []string
+	var err error
+	for _, attempt := range attempts {
+		var blob io.ReadCloser
+		var size int64
+		blob, size, err = src.GetBlob(ctx, attempt, h.cache)
+		if err == nil {
+			return blob, size, attempt, nil
+		}
+		where := "the image"
+		if len(attempt.URLs) > 0 {
+			where = strings.Join(attempt.URLs, ", ")
+		}
+		logrus.WithError(err).WithField("digest", info.Digest).Debugf("fetching foreign layer from %s failed", where)
+		failed = append(failed, where)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// The last error decides whether to retry
+	return nil, 0, info, fmt.Errorf("fetching foreign layer %s from %s: %w", info.Digest, strings.Join(failed, ", then "), err)
+}
@@ -0,0 +1,107 @@
+//go:build go1.18
+// +build go1.18
+
+package imageproxy
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const (
+	seedOCIManifest = `{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:5da0759c13284927e63f2ffeb9924cf103328da122ae0db4f49f8760c061cbbd","size":120,"annotations":{"a":"b"}}]}`
+	seedSchema2     = `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","digest":"sha256:5da0759c13284927e63f2ffeb9924cf103328da122ae0db4f49f8760c061cbbd","size":120,"urls":["https://example.com/layer"]}]}`
+	seedSchema1     = `{"schemaVersion":1,"name":"example/image","tag":"latest","architecture":"amd64","fsLayers":[{"blobSum":"sha256:5da0759c13284927e63f2ffeb9924cf103328da122ae0db4f49f8760c061cbbd"}],"history":[{"v1Compatibility":"{\"id\":\"abc\"}"}]}`
+	seedIndex       = `{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:cf129df6d2b1a6e7d8c1ba8d3e6ab4c7ab4d5ff3e28dcfc1c5a9e1e5f8a0b1c2","size":400,"platform":{"architecture":"amd64","os":"linux"}}]}`
+)
+
+// FuzzConvertToOCI checks that converting whatever a registry sends
+// doesn't panic, and that converting the result again doesn't change it.
+func FuzzConvertToOCI(f *testing.F) {
+	for _, seed := range []string{seedOCIManifest, seedSchema2, seedSchema1, seedIndex, `{}`, `null`, `[]`} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		converted, err := convertToOCI(raw)
+		if err != nil {
+			return
+		}
+		again, err := convertToOCI(converted)
+		if err != nil {
+			t.Fatalf("converting %q again: %v", converted, err)
+		}
+		if !bytes.Equal(converted, again) {
+			t.Fatalf("converting %q again returned %q", converted, again)
+		}
+	})
+}
+
+// FuzzUnmarshalCBOR checks that decoding CBOR doesn't panic, and that what
+// it decodes into can be encoded again and decodes the same.
+func FuzzUnmarshalCBOR(f *testing.F) {
+	for _, seed := range []string{`["sha256:5da0759c13284927e63f2ffeb9924cf103328da122ae0db4f49f8760c061cbbd"]`, `{"a":[1,-2,3.5,true,null,"x"]}`, `"text"`} {
+		buf, err := jsonToCBOR([]byte(seed))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf)
+	}
+	f.Add([]byte{0x9f, 0x01, 0xff})
+	f.Add([]byte{0xbf, 0x61, 0x61, 0x01, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v interface{}
+		if err := unmarshalCBOR(data, &v); err != nil {
+			return
+		}
+		encoded, err := marshalCBOR(v)
+		if err != nil {
+			t.Fatalf("encoding %#v: %v", v, err)
+		}
+		var again interface{}
+		if err := unmarshalCBOR(encoded, &again); err != nil {
+			t.Fatalf("decoding %x: %v", encoded, err)
+		}
+		if !reflect.DeepEqual(v, again) {
+			t.Fatalf("%x decoded as %#v, then as %#v", data, v, again)
+		}
+	})
+}
+
+// FuzzParseLayersRequest checks the parsing of the bodies of POST /layers
+// and /prefetch, as JSON or CBOR.
+func FuzzParseLayersRequest(f *testing.F) {
+	f.Add([]byte(`["sha256:5da0759c13284927e63f2ffeb9924cf103328da122ae0db4f49f8760c061cbbd"]`), false, "4")
+	f.Add([]byte(`["sha256:short"]`), false, "")
+	f.Add([]byte(`{"a":1}`), false, "0")
+	f.Add([]byte{0x81, 0x60}, true, "")
+	h := &proxyHandler{}
+	f.Fuzz(func(t *testing.T, body []byte, cbor bool, parallel string) {
+		// An empty body means all the layers of the image, which there
+		// is none of here
+		if len(body) == 0 {
+			return
+		}
+		r, err := http.NewRequest(http.MethodPost, "http://proxy/layers", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.URL.RawQuery = "parallel=" + parallel
+		if cbor {
+			r.Header.Set("Content-Type", cborMIMEType)
+		}
+		digests, n, err := h.parseLayersRequest(r)
+		if err != nil {
+			return
+		}
+		if n < 1 {
+			t.Fatalf("parallel %q parsed as %d", parallel, n)
+		}
+		for _, d := range digests {
+			if err := d.Validate(); err != nil {
+				t.Fatalf("invalid digest %q accepted: %v", d, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,375 @@
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cgwalters/container-image-proxy/pkg/imageproxypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// maxGRPCMessage bounds the size of request messages, and of the blob
+// chunks sent.
+const maxGRPCMessage = 1 << 20
+
+// grpcErrorTrailer carries the error reply (as JSON) of failed calls,
+// with the same fields as HTTP error replies.
+const grpcErrorTrailer = "imageproxy-error-bin"
+
+// grpcCode maps error codes to gRPC status codes.
+func grpcCode(code string) codes.Code {
+	switch code {
+	case errorCodeNotFound:
+		return codes.NotFound
+	case errorCodeAuth:
+		return codes.Unauthenticated
+	case errorCodeRateLimit, errorCodeTooLarge:
+		return codes.ResourceExhausted
+	case errorCodeInvalid:
+		return codes.InvalidArgument
+	case errorCodeUnsafe:
+		return codes.FailedPrecondition
+	case errorCodeTimeout:
+		return codes.DeadlineExceeded
+	case errorCodeCanceled:
+		return codes.Canceled
+	case errorCodeShutdown, errorCodePipe:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// grpcError returns the status of a call failing with reply, which is
+// also sent in the error trailer.
+func grpcError(ctx context.Context, reply *errorReply) error {
+	if buf, err := json.Marshal(reply); err == nil {
+		grpc.SetTrailer(ctx, metadata.Pairs(grpcErrorTrailer, string(buf)))
+	}
+	return status.Error(grpcCode(reply.Code), reply.Message)
+}
+
+// stallConn applies a stallWriter to the writes of a connection.
+type stallConn struct {
+	net.Conn
+	out *stallWriter
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+// closeNotifyConn is a connection which tells when it is closed.
+type closeNotifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// connListener is a listener accepting a single connection, for a
+// grpc.Server to serve it.  Once accepted, Accept blocks until the
+// listener is closed.
+type connListener struct {
+	conns  chan net.Conn
+	addr   net.Addr
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{conns: make(chan net.Conn, 1), addr: conn.LocalAddr(), closed: make(chan struct{})}
+	l.conns <- conn
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// serveGRPC serves the imageproxy.v1.ImageProxy gRPC service on conn
+// (HTTP/2 without TLS), translating each call into the equivalent
+// request.
+func (h *proxyHandler) serveGRPC(conn io.ReadWriter) error {
+	nc, ok := conn.(net.Conn)
+	if !ok {
+		return fmt.Errorf("gRPC can only be served on sockets")
+	}
+	if h.timeouts.write > 0 {
+		nc = &stallConn{Conn: nc, out: &stallWriter{conn: nc, timeout: h.timeouts.write}}
+	}
+	c := &closeNotifyConn{Conn: nc, closed: make(chan struct{})}
+	defer c.Close()
+	srv := grpc.NewServer(grpc.MaxRecvMsgSize(maxGRPCMessage))
+	imageproxypb.RegisterImageProxyServer(srv, &grpcImageProxy{h: h, srv: srv})
+	// The server only stops serving the connection once stopped
+	go func() {
+		<-c.closed
+		srv.Stop()
+	}()
+	return srv.Serve(newConnListener(c))
+}
+
+// grpcImageProxy implements the ImageProxy service for a session.
+type grpcImageProxy struct {
+	imageproxypb.UnimplementedImageProxyServer
+	h   *proxyHandler
+	srv *grpc.Server
+}
+
+// grpcResponse buffers the response to a request made for a gRPC call,
+// unless it is a successful blob response, sent with send.
+type grpcResponse struct {
+	// send is set for GetBlob calls
+	send    func([]byte) error
+	headers http.Header
+	status  int
+	body    bytes.Buffer
+}
+
+func (rw *grpcResponse) Header() http.Header {
+	return rw.headers
+}
+
+func (rw *grpcResponse) WriteHeader(statusCode int) {
+	if rw.status == 0 {
+		rw.status = statusCode
+	}
+}
+
+func (rw *grpcResponse) Write(buf []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	if rw.send == nil || rw.status >= 300 {
+		return rw.body.Write(buf)
+	}
+	written := 0
+	for len(buf) > 0 {
+		chunk := buf
+		if len(chunk) > maxGRPCMessage {
+			chunk = chunk[:maxGRPCMessage]
+		}
+		if err := rw.send(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		buf = buf[len(chunk):]
+	}
+	return written, nil
+}
+
+// call serves the request equivalent to a call, returning its response,
+// or the status of the call if it failed.
+func (s *grpcImageProxy) call(ctx context.Context, method, path string, query url.Values, resp *grpcResponse) (*grpcResponse, error) {
+	if resp == nil {
+		resp = &grpcResponse{}
+	}
+	resp.headers = make(http.Header)
+	req, err := http.NewRequestWithContext(ctx, method, path, http.NoBody)
+	if err != nil {
+		// Only the digest is part of the path
+		return nil, grpcError(ctx, &errorReply{Code: errorCodeInvalid, Message: fmt.Sprintf("invalid digest in %q", path)})
+	}
+	req.URL.RawQuery = query.Encode()
+	status := s.h.serveInternal(resp, req)
+	if s.h.isShutdown() {
+		go s.srv.GracefulStop()
+	}
+	if status >= 300 {
+		var reply errorReply
+		if err := json.Unmarshal(resp.body.Bytes(), &reply); err != nil {
+			reply = errorReply{Code: errorCodeInvalid, Message: http.StatusText(status)}
+		}
+		return nil, grpcError(ctx, &reply)
+	}
+	return resp, nil
+}
+
+// callJSON makes a call whose reply is the JSON of the response.
+func (s *grpcImageProxy) callJSON(ctx context.Context, path string) (*imageproxypb.JSONReply, error) {
+	resp, err := s.call(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &imageproxypb.JSONReply{Json: resp.body.Bytes()}, nil
+}
+
+// decode decodes the JSON of the response to a call into v.
+func (s *grpcImageProxy) decode(ctx context.Context, resp *grpcResponse, v interface{}) error {
+	if err := json.Unmarshal(resp.body.Bytes(), v); err != nil {
+		return grpcError(ctx, &errorReply{Code: errorCodeOther, Message: err.Error()})
+	}
+	return nil
+}
+
+// refQuery returns the query for the ref of an ImageRequest.
+func refQuery(ref string) url.Values {
+	query := url.Values{}
+	if ref != "" {
+		query.Set("ref", ref)
+	}
+	return query
+}
+
+// digestPath returns the path of the request for a blob, checking that
+// the call has a digest.
+func digestPath(ctx context.Context, prefix, d string) (string, error) {
+	if d == "" {
+		return "", grpcError(ctx, &errorReply{Code: errorCodeInvalid, Message: "missing digest"})
+	}
+	return prefix + d, nil
+}
+
+func (s *grpcImageProxy) GetManifest(ctx context.Context, req *imageproxypb.ManifestRequest) (*imageproxypb.ManifestReply, error) {
+	query := url.Values{}
+	if req.Raw {
+		query.Set("raw", "1")
+	}
+	resp, err := s.call(ctx, http.MethodGet, "/manifest", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &imageproxypb.ManifestReply{
+		Manifest:  resp.body.Bytes(),
+		Digest:    resp.headers.Get("Manifest-Digest"),
+		OciDigest: resp.headers.Get("OCI-Manifest-Digest"),
+	}, nil
+}
+
+func (s *grpcImageProxy) GetDigest(ctx context.Context, req *imageproxypb.ImageRequest) (*imageproxypb.DigestReply, error) {
+	resp, err := s.call(ctx, http.MethodGet, "/digest", refQuery(req.Ref), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &imageproxypb.DigestReply{Digest: strings.TrimSpace(resp.body.String())}, nil
+}
+
+func (s *grpcImageProxy) Inspect(ctx context.Context, req *imageproxypb.Empty) (*imageproxypb.JSONReply, error) {
+	return s.callJSON(ctx, "/inspect")
+}
+
+func (s *grpcImageProxy) GetLayers(ctx context.Context, req *imageproxypb.Empty) (*imageproxypb.JSONReply, error) {
+	return s.callJSON(ctx, "/layers")
+}
+
+func (s *grpcImageProxy) GetTags(ctx context.Context, req *imageproxypb.ImageRequest) (*imageproxypb.TagsReply, error) {
+	resp, err := s.call(ctx, http.MethodGet, "/tags", refQuery(req.Ref), nil)
+	if err != nil {
+		return nil, err
+	}
+	var tags tagList
+	if err := s.decode(ctx, resp, &tags); err != nil {
+		return nil, err
+	}
+	return &imageproxypb.TagsReply{Repository: tags.Repository, Tags: tags.Tags}, nil
+}
+
+func (s *grpcImageProxy) GetBlob(req *imageproxypb.GetBlobRequest, stream imageproxypb.ImageProxy_GetBlobServer) error {
+	ctx := stream.Context()
+	path, err := digestPath(ctx, "/blobs/", req.Digest)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	if req.Decompress {
+		query.Set("decompress", "1")
+	}
+	if req.Sanitize {
+		query.Set("sanitize", "1")
+	}
+	if req.Whiteouts != "" {
+		query.Set("whiteouts", req.Whiteouts)
+	}
+	_, err = s.call(ctx, http.MethodGet, path, query, &grpcResponse{
+		send: func(data []byte) error {
+			return stream.Send(&imageproxypb.BlobChunk{Data: data})
+		},
+	})
+	return err
+}
+
+func (s *grpcImageProxy) GetTOC(ctx context.Context, req *imageproxypb.TOCRequest) (*imageproxypb.TOCReply, error) {
+	path, err := digestPath(ctx, "/toc/", req.Digest)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.call(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &imageproxypb.TOCReply{Format: resp.headers.Get("Toc-Format"), Toc: resp.body.Bytes()}, nil
+}
+
+func (s *grpcImageProxy) GetBlobUncompressedSize(ctx context.Context, req *imageproxypb.UncompressedSizeRequest) (*imageproxypb.UncompressedSizeReply, error) {
+	path, err := digestPath(ctx, "/uncompressed-size/", req.Digest)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	if req.Exact {
+		query.Set("exact", "1")
+	}
+	resp, err := s.call(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var size uncompressedSize
+	if err := s.decode(ctx, resp, &size); err != nil {
+		return nil, err
+	}
+	return &imageproxypb.UncompressedSizeReply{Size: size.Size, Exact: size.Exact, Source: size.Source}, nil
+}
+
+func (s *grpcImageProxy) GetStats(ctx context.Context, req *imageproxypb.Empty) (*imageproxypb.JSONReply, error) {
+	return s.callJSON(ctx, "/stats")
+}
+
+func (s *grpcImageProxy) Ping(ctx context.Context, req *imageproxypb.Empty) (*imageproxypb.PingReply, error) {
+	resp, err := s.call(ctx, http.MethodGet, "/ping", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var ping pingReply
+	if err := s.decode(ctx, resp, &ping); err != nil {
+		return nil, err
+	}
+	return &imageproxypb.PingReply{Version: ping.Version, Uptime: ping.Uptime}, nil
+}
+
+func (s *grpcImageProxy) GetCapabilities(ctx context.Context, req *imageproxypb.Empty) (*imageproxypb.JSONReply, error) {
+	return s.callJSON(ctx, "/capabilities")
+}
+
+func (s *grpcImageProxy) Quit(ctx context.Context, req *imageproxypb.Empty) (*imageproxypb.Empty, error) {
+	if _, err := s.call(ctx, http.MethodPost, "/quit", nil, nil); err != nil {
+		return nil, err
+	}
+	return &imageproxypb.Empty{}, nil
+}
@@ -0,0 +1,285 @@
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cgwalters/container-image-proxy/pkg/imageproxypb"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// TestGRPCService calls every method of the ImageProxy service with a
+// gRPC client, comparing the replies with those of the equivalent HTTP
+// requests.
+func TestGRPCService(t *testing.T) {
+	server, err := NewServer("oci:/fake:latest", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A zstd:chunked layer, for GetTOC to succeed
+	src, layerData := newFakeZstdChunkedSource(t)
+	server.h.backend = &fakeBackend{src: src, chunked: true}
+	t.Cleanup(func() { server.Close() })
+	sock := filepath.Join(t.TempDir(), "grpc.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeListener(l, ProtocolGRPC)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "unix://"+sock, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := imageproxypb.NewImageProxyClient(conn)
+
+	// getBlob returns the data of the chunks streamed by GetBlob.
+	getBlob := func(req *imageproxypb.GetBlobRequest) ([]byte, error) {
+		stream, err := client.GetBlob(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		for {
+			chunk, err := stream.Recv()
+			if err == io.EOF {
+				return data, nil
+			} else if err != nil {
+				return nil, err
+			}
+			data = append(data, chunk.Data...)
+		}
+	}
+	sameJSON := func(t *testing.T, reply *imageproxypb.JSONReply, w *httptest.ResponseRecorder) {
+		if !bytes.Equal(reply.Json, w.Body.Bytes()) {
+			t.Errorf("json %q, expected %q", reply.Json, w.Body.String())
+		}
+	}
+
+	layer := digest.FromBytes(layerData).String()
+	// A layout with a tag, for GetTags
+	layout := t.TempDir()
+	index := `{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + digest.FromBytes(src.manifest).String() + `","size":1,"annotations":{"org.opencontainers.image.ref.name":"v1"}}]}`
+	if err := os.WriteFile(filepath.Join(layout, "index.json"), []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	layoutRef := "oci:" + layout + ":v1"
+	cases := []struct {
+		method string
+		// path is that of the equivalent HTTP request
+		path string
+		// call makes the call, checking its reply against the HTTP
+		// response if it succeeds
+		call func(t *testing.T, w *httptest.ResponseRecorder) error
+	}{
+		{"GetManifest", "/manifest", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			reply, err := client.GetManifest(ctx, &imageproxypb.ManifestRequest{})
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(reply.Manifest, w.Body.Bytes()) {
+				t.Errorf("manifest %q, expected %q", reply.Manifest, w.Body.String())
+			}
+			if reply.Digest != w.Header().Get("Manifest-Digest") {
+				t.Errorf("digest %q, expected %q", reply.Digest, w.Header().Get("Manifest-Digest"))
+			}
+			if reply.OciDigest != w.Header().Get("OCI-Manifest-Digest") {
+				t.Errorf("oci_digest %q, expected %q", reply.OciDigest, w.Header().Get("OCI-Manifest-Digest"))
+			}
+			return nil
+		}},
+		{"GetManifest", "/manifest?raw=1", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			reply, err := client.GetManifest(ctx, &imageproxypb.ManifestRequest{Raw: true})
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(reply.Manifest, w.Body.Bytes()) {
+				t.Errorf("manifest %q, expected %q", reply.Manifest, w.Body.String())
+			}
+			return nil
+		}},
+		{"GetDigest", "/digest?ref=oci:/other:latest", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			reply, err := client.GetDigest(ctx, &imageproxypb.ImageRequest{Ref: "oci:/other:latest"})
+			if err != nil {
+				return err
+			}
+			if reply.Digest != strings.TrimSpace(w.Body.String()) {
+				t.Errorf("digest %q, expected %q", reply.Digest, w.Body.String())
+			}
+			return nil
+		}},
+		{"Inspect", "/inspect", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			reply, err := client.Inspect(ctx, &imageproxypb.Empty{})
+			if err == nil {
+				sameJSON(t, reply, w)
+			}
+			return err
+		}},
+		{"GetLayers", "/layers", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			reply, err := client.GetLayers(ctx, &imageproxypb.Empty{})
+			if err == nil {
+				sameJSON(t, reply, w)
+			}
+			return err
+		}},
+		{"GetTags", "/tags?ref=" + url.QueryEscape(layoutRef), func(t *testing.T, w *httptest.ResponseRecorder) error {
+			reply, err := client.GetTags(ctx, &imageproxypb.ImageRequest{Ref: layoutRef})
+			if err != nil {
+				return err
+			}
+			var expected tagList
+			if err := json.Unmarshal(w.Body.Bytes(), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Repository != expected.Repository {
+				t.Errorf("repository %q, expected %q", reply.Repository, expected.Repository)
+			}
+			if len(reply.Tags) == 0 || strings.Join(reply.Tags, ",") != strings.Join(expected.Tags, ",") {
+				t.Errorf("tags %v, expected %v", reply.Tags, expected.Tags)
+			}
+			return nil
+		}},
+		{"GetBlob", "/blobs/" + layer + "?decompress=1", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			data, err := getBlob(&imageproxypb.GetBlobRequest{Digest: layer, Decompress: true})
+			if err == nil && !bytes.Equal(data, w.Body.Bytes()) {
+				t.Errorf("blob %q, expected %q", data, w.Body.String())
+			}
+			return err
+		}},
+		{"GetBlob", "/blobs/" + layer + "?sanitize=1", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			stream, err := client.GetBlob(ctx, &imageproxypb.GetBlobRequest{Digest: layer, Sanitize: true})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			// The error reply is in the trailer
+			var reply errorReply
+			if values := stream.Trailer().Get(grpcErrorTrailer); len(values) != 1 || json.Unmarshal([]byte(values[0]), &reply) != nil || reply.Code != replyCode(t, w) {
+				t.Errorf("error trailer %q, expected the reply %s", values, w.Body.String())
+			}
+			return err
+		}},
+		{"GetBlob", "/blobs/" + layer + "?decompress=1&whiteouts=bogus", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			_, err := getBlob(&imageproxypb.GetBlobRequest{Digest: layer, Decompress: true, Whiteouts: "bogus"})
+			return err
+		}},
+		{"GetTOC", "/toc/" + layer, func(t *testing.T, w *httptest.ResponseRecorder) error {
+			reply, err := client.GetTOC(ctx, &imageproxypb.TOCRequest{Digest: layer})
+			if err != nil {
+				return err
+			}
+			if reply.Format != w.Header().Get("Toc-Format") {
+				t.Errorf("format %q, expected %q", reply.Format, w.Header().Get("Toc-Format"))
+			}
+			if !bytes.Equal(reply.Toc, w.Body.Bytes()) {
+				t.Errorf("toc %q, expected %q", reply.Toc, w.Body.String())
+			}
+			return nil
+		}},
+		{"GetBlobUncompressedSize", "/uncompressed-size/" + layer + "?exact=1", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			reply, err := client.GetBlobUncompressedSize(ctx, &imageproxypb.UncompressedSizeRequest{Digest: layer, Exact: true})
+			if err != nil {
+				return err
+			}
+			var expected uncompressedSize
+			if err := json.Unmarshal(w.Body.Bytes(), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Size != expected.Size || reply.Exact != expected.Exact || reply.Source != expected.Source {
+				t.Errorf("size %d, exact %v, source %q, expected %+v", reply.Size, reply.Exact, reply.Source, expected)
+			}
+			return nil
+		}},
+		{"GetStats", "/stats", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			reply, err := client.GetStats(ctx, &imageproxypb.Empty{})
+			// The counters are those of the connection
+			if err == nil && !json.Valid(reply.Json) {
+				t.Errorf("invalid json %q", reply.Json)
+			}
+			return err
+		}},
+		{"Ping", "/ping", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			reply, err := client.Ping(ctx, &imageproxypb.Empty{})
+			if err != nil {
+				return err
+			}
+			var expected pingReply
+			if err := json.Unmarshal(w.Body.Bytes(), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Version != expected.Version {
+				t.Errorf("version %q, expected %q", reply.Version, expected.Version)
+			}
+			if reply.Uptime < 0 {
+				t.Errorf("uptime %v", reply.Uptime)
+			}
+			return nil
+		}},
+		{"GetCapabilities", "/capabilities", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			reply, err := client.GetCapabilities(ctx, &imageproxypb.Empty{})
+			if err == nil {
+				sameJSON(t, reply, w)
+			}
+			return err
+		}},
+		// Last, as it ends the session
+		{"Quit", "", func(t *testing.T, w *httptest.ResponseRecorder) error {
+			_, err := client.Quit(ctx, &imageproxypb.Empty{})
+			return err
+		}},
+	}
+
+	tested := make(map[string]bool)
+	for _, c := range cases {
+		tested[c.method] = true
+		w := httptest.NewRecorder()
+		if c.path != "" {
+			w = doRequest(server.h, http.MethodGet, c.path)
+		}
+		t.Run(c.method, func(t *testing.T) {
+			err := c.call(t, w)
+			if w.Code == http.StatusOK {
+				if err != nil {
+					t.Errorf("%s: %v", c.path, err)
+				}
+				return
+			}
+			// The call fails in the same way
+			expected := grpcCode(replyCode(t, w))
+			if got := status.Code(err); got != expected {
+				t.Errorf("status %s (%v), expected %s as GET %s failed with %s", got, err, expected, c.path, w.Body.String())
+			}
+		})
+	}
+	desc := imageproxypb.ImageProxy_ServiceDesc
+	for _, m := range desc.Methods {
+		if !tested[m.MethodName] {
+			t.Errorf("%s isn't tested", m.MethodName)
+		}
+	}
+	for _, s := range desc.Streams {
+		if !tested[s.StreamName] {
+			t.Errorf("%s isn't tested", s.StreamName)
+		}
+	}
+}
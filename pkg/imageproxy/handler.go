@@ -0,0 +1,952 @@
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"sync/atomic"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	encconfig "github.com/containers/ocicrypt/config"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Version is the version of the proxy, set at build time.
+var Version = ""
+var defaultUserAgent = "ostree-container-backend/" + Version
+
+// proxyHandler may serve several connections concurrently.
+type proxyHandler struct {
+	imageref string
+	sysctx   *types.SystemContext
+	cache    types.BlobInfoCache
+	backend  imageBackend
+	retry    retryPolicy
+	timeouts timeouts
+	// bandwidth is nil if blob transfers aren't rate limited
+	bandwidth *bandwidthLimiter
+
+	// imageLock is held for reading by the requests of the session, and
+	// for writing by POST /image as it replaces the image, so that the
+	// image doesn't change under a request.
+	imageLock sync.RWMutex
+
+	// lock protects the fields below.  It is only held while
+	// initializing them, never while streaming data.
+	lock     sync.Mutex
+	imgsrc   *types.ImageSource
+	img      *types.Image
+	shutdown bool
+	// stoppers are closed by stop
+	stoppers map[io.Closer]struct{}
+	// schema1Manifest is the original manifest of img if it was
+	// converted from docker schema1, nil otherwise
+	schema1Manifest *sourceManifest
+
+	// destLock serializes the push operations using imgdest.
+	destLock sync.Mutex
+	imgdest  *types.ImageDestination
+	pushed   *pushedImage
+
+	// blobLock serializes GetBlob for sources which don't support concurrent calls.
+	blobLock sync.Mutex
+
+	prefetched prefetchCache
+	// blobCache is nil unless --blob-cache is used
+	blobCache *blobCache
+	// offline refuses network access
+	offline bool
+	// trustedTransports are those whose blobs aren't verified
+	trustedTransports map[string]bool
+	// credentials are those of the pull secret, by registry
+	credentials registryCredentials
+	// authFallback is authFallbackAnonymous or authFallbackCredentials to
+	// retry opening images the other way when access is denied
+	authFallback string
+	// inflight tracks requests with a Request-Id for POST /cancel
+	inflight inflightRequests
+	// active counts the requests in progress, for POST /quit
+	active sessionRequests
+	// manifests caches the manifests fetched from registries
+	manifests *manifestCache
+	// uncompressedSizes are those of the layers decompressed so far
+	uncompressedSizes *uncompressedSizes
+	// tracerProvider is nil unless requests and operations are traced
+	tracerProvider trace.TracerProvider
+	// traced is the handler instrumented for tracing (h itself if not)
+	traced http.Handler
+	// streams is nil unless --max-streams is used
+	streams *streamLimiter
+	// bufferSize is the kernel buffer size to request for connections
+	// (0 to keep the default)
+	bufferSize int
+	// maxManifestSize is the largest manifest accepted
+	maxManifestSize int64
+	// decryptConfig decrypts encrypted layers as they are served, if
+	// decryption keys were given
+	decryptConfig *encconfig.DecryptConfig
+	// requests tracks the requests in progress, of all sessions
+	requests *requestTracker
+	// peers restricts the clients of listening sockets
+	peers *peerPolicy
+	// stats counts what this session did
+	stats *sessionStats
+	// events are sent where POST /events asked
+	events eventStream
+	// audit is nil unless an audit log is kept
+	audit *auditLog
+	// started is when the Server was created, for the uptime reported
+	// by GET /ping
+	started time.Time
+}
+
+func (h *proxyHandler) ensureImage() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.img != nil {
+		return nil
+	}
+	if h.imageref == "" {
+		return fmt.Errorf("No IMAGE was specified")
+	}
+	imgRefs, err := h.shortNameCandidates(h.imageref)
+	if err != nil {
+		return err
+	}
+	if imgRefs == nil {
+		imgRef, err := alltransports.ParseImageName(h.imageref)
+		if err != nil {
+			return err
+		}
+		imgRefs = []types.ImageReference{imgRef}
+	}
+	// Loading is shared by all requests, so it isn't cancelled with them
+	ctx, span := h.startSpan(withEvents(withStats(context.Background(), h.stats), &h.events), "load image", attribute.String("image.ref", h.imageref))
+	var imgsrc types.ImageSource
+	var img types.Image
+	timer := prometheus.NewTimer(metricFetchDuration.WithLabelValues("image"))
+	cancel := func() {}
+	err = h.retry.do(ctx, "loading image", func() error {
+		var err error
+		cancel, err = h.withResponseTimeout(ctx, func(ctx context.Context) error {
+			// Keep the image source across retries if it was opened
+			if imgsrc == nil {
+				src, err := h.openFirstImageSource(ctx, imgRefs)
+				if err != nil {
+					return err
+				}
+				imgsrc = src
+			}
+			// The manifest list, if any, is checked before it is parsed
+			topManifest, _, err := imgsrc.GetManifest(ctx, nil)
+			if err != nil {
+				return fmt.Errorf("failed to load image: %w", err)
+			}
+			if err := h.checkManifestSize(topManifest); err != nil {
+				return err
+			}
+			img, err = h.backend.newImage(ctx, h.sysctx, imgsrc)
+			if err != nil {
+				return fmt.Errorf("failed to load image: %w", err)
+			}
+			instanceManifest, _, err := img.Manifest(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to load image: %w", err)
+			}
+			if err := h.checkManifestSize(instanceManifest); err != nil {
+				return err
+			}
+			img, err = withStoredLayers(ctx, imgsrc, img)
+			if err != nil {
+				return fmt.Errorf("failed to read stored layers: %w", err)
+			}
+			// types.Image caches the config lazily, which isn't safe for
+			// concurrent use; load it now while holding the lock.
+			if _, err := img.ConfigBlob(ctx); err != nil {
+				return fmt.Errorf("failed to load image config: %w", err)
+			}
+			return nil
+		})
+		return err
+	})
+	defer cancel()
+	var schema1Manifest *sourceManifest
+	if err == nil {
+		schema1Manifest, img, err = h.convertSchema1(ctx, imgsrc, img)
+	}
+	timer.ObserveDuration()
+	endSpan(span, err)
+	if err != nil {
+		if imgsrc != nil {
+			err = withRegistry(imgsrc.Reference(), err)
+			imgsrc.Close()
+		}
+		return err
+	}
+	if h.audit != nil {
+		if err := h.auditImage(ctx, imgsrc, img); err != nil {
+			imgsrc.Close()
+			return err
+		}
+	}
+	if err := h.cacheManifests(ctx, imgsrc, img); err != nil {
+		logrus.WithError(err).WithField("image", h.imageref).Warn("caching image manifests")
+	}
+	h.img = &img
+	h.imgsrc = &imgsrc
+	h.schema1Manifest = schema1Manifest
+	return nil
+}
+
+// imageSource and loadedImage return the image opened by ensureImage,
+// and convertedSchema1 its original manifest if it was converted from
+// docker schema1.  They are read under h.lock, as POST /image replaces
+// them (once the requests using them are done, see imageLock).
+func (h *proxyHandler) imageSource() types.ImageSource {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return *h.imgsrc
+}
+
+func (h *proxyHandler) loadedImage() types.Image {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return *h.img
+}
+
+func (h *proxyHandler) convertedSchema1() *sourceManifest {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.schema1Manifest
+}
+
+// imageName returns the IMAGE of the session, as given by the client.
+func (h *proxyHandler) imageName() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.imageref
+}
+
+// defaultMaxManifestSize is the default limit on the size of manifests,
+// that of containers/image for registries.
+const defaultMaxManifestSize = 4 << 20
+
+// checkManifestSize fails if a manifest (or manifest list) is larger than
+// allowed, so that pathologically large ones aren't processed further.
+func (h *proxyHandler) checkManifestSize(rawManifest []byte) error {
+	if int64(len(rawManifest)) > h.maxManifestSize {
+		return &tooLargeError{what: "manifest", size: int64(len(rawManifest)), limit: h.maxManifestSize}
+	}
+	return nil
+}
+
+// convertToOCI converts a manifest, as sent by the registry, into OCI
+// format.
+func convertToOCI(rawManifest []byte) ([]byte, error) {
+	ociManifest, err := manifest.OCI1FromManifest(rawManifest)
+	if err != nil {
+		return nil, err
+	}
+	return ociManifest.Serialize()
+}
+
+func (h *proxyHandler) implManifest(w http.ResponseWriter, r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	if notModified, err := h.manifestNotModified(w, r); err != nil || notModified {
+		return err
+	}
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	topDigest, err := h.openedManifestDigest(ctx)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", manifestETag(topDigest))
+	rawManifest, mimeType, err := h.loadedImage().Manifest(ctx)
+	if err != nil {
+		return err
+	}
+	// The digest and type are those of the manifest as served, before
+	// conversion
+	origManifest, origMIMEType := rawManifest, mimeType
+	if schema1Manifest := h.convertedSchema1(); schema1Manifest != nil {
+		origManifest, origMIMEType = schema1Manifest.raw, schema1Manifest.mimeType
+	}
+	manifestDigest, err := manifest.Digest(origManifest)
+	if err != nil {
+		return err
+	}
+	w.Header().Add("Manifest-Digest", manifestDigest.String())
+	w.Header().Set("Manifest-Media-Type", origMIMEType)
+
+	// With ?raw=1, the manifest is returned as is, for clients which
+	// handle its format and need the bytes matching the digest
+	raw, err := queryBool(r, "raw")
+	if err != nil {
+		return err
+	}
+	if raw {
+		w.Header().Set("Content-Type", origMIMEType)
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(origManifest)))
+		w.WriteHeader(200)
+		_, err = w.Write(origManifest)
+		return err
+	}
+
+	ociSerialized, err := convertToOCI(rawManifest)
+	if err != nil {
+		return err
+	}
+	// Conversion changes the bytes, so clients may pin either digest
+	w.Header().Set("OCI-Manifest-Digest", digest.FromBytes(ociSerialized).String())
+
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(ociSerialized)))
+	w.WriteHeader(200)
+	_, err = io.Copy(w, bytes.NewReader(ociSerialized))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// getBlob returns a blob of the opened image, using the prefetched
+// copy if there is one.
+func (h *proxyHandler) getBlob(ctx context.Context, info types.BlobInfo) (io.ReadCloser, int64, error) {
+	// The config of a converted schema1 image was generated here
+	if h.convertedSchema1() != nil && info.Digest == h.loadedImage().ConfigInfo().Digest {
+		config, err := h.loadedImage().ConfigBlob(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NopCloser(bytes.NewReader(config)), int64(len(config)), nil
+	}
+	if r, size, ok := h.prefetched.get(ctx, info.Digest); ok {
+		metricBlobFetches.WithLabelValues("prefetch").Inc()
+		return r, size, nil
+	}
+	return h.fetchBlob(ctx, info)
+}
+
+// fetchBlob wraps GetBlob on the opened image, serializing calls if the
+// source doesn't support concurrent use, and retrying failures according
+// to the retry policy.  With retries enabled, a stream which breaks is
+// resumed where it stopped if the source supports ranged requests.
+// Foreign layers are fetched from their URLs, see getSourceBlob.
+// The stream is throttled if a maximum bandwidth is configured.  If there
+// is a blob cache, it is checked first, and blobs fetched from remote
+// images are added to it.  Progress is reported as the blob is read.
+func (h *proxyHandler) fetchBlob(ctx context.Context, info types.BlobInfo) (io.ReadCloser, int64, error) {
+	if h.blobCache != nil {
+		if f, size, ok := h.blobCache.open(info.Digest); ok {
+			metricBlobFetches.WithLabelValues("cache").Inc()
+			atomic.AddInt64(&h.stats.cacheHits, 1)
+			emitEvent(ctx, progressEvent{Event: "blob-done", Digest: info.Digest, Size: size, Bytes: size, Cached: true})
+			if request, ok := ctx.Value(requestProgressKey{}).(*requestProgress); ok {
+				atomic.AddInt64(&request.size, size)
+				atomic.AddInt64(&request.bytes, size)
+			}
+			return verifiedFile{f}, size, nil
+		}
+	}
+	src := h.imageSource()
+	if !src.HasThreadSafeGetBlob() {
+		h.blobLock.Lock()
+		defer h.blobLock.Unlock()
+	}
+	var blob io.ReadCloser
+	var size int64
+	info = h.withLayerURLs(info)
+	timer := prometheus.NewTimer(metricFetchDuration.WithLabelValues("blob"))
+	spanCtx, span := h.startSpan(ctx, "get blob", attribute.String("blob.digest", info.Digest.String()))
+	var cancel context.CancelFunc
+	err := h.retry.do(spanCtx, "fetching blob "+info.Digest.String(), func() error {
+		var err error
+		cancel, err = h.withResponseTimeout(spanCtx, func(ctx context.Context) error {
+			var err error
+			blob, size, info, err = h.getSourceBlob(ctx, src, info)
+			return err
+		})
+		return err
+	})
+	timer.ObserveDuration()
+	endSpan(span, err)
+	if err != nil {
+		return nil, 0, withRegistry(src.Reference(), err)
+	}
+	blob = &cancelOnClose{ReadCloser: blob, cancel: cancel}
+	// Local images don't benefit from resuming or caching
+	remote := remoteBlobs(src.Reference())
+	if remote {
+		metricBlobFetches.WithLabelValues("registry").Inc()
+	} else {
+		metricBlobFetches.WithLabelValues("local").Inc()
+	}
+	if remote && h.retry.attempts > 0 && size >= 0 {
+		blob = &resumableBlob{
+			ctx:  ctx,
+			src:  src,
+			info: info,
+			h:    h,
+			size: size,
+			r:    blob,
+		}
+	}
+	var throttled *throttledReader
+	if h.bandwidth != nil {
+		throttled = &throttledReader{
+			ctx:     ctx,
+			limiter: h.bandwidth,
+			r:       blob,
+		}
+		blob = throttled
+	}
+	if remote && h.blobCache != nil {
+		blob = h.blobCache.newCachingReader(blob, info.Digest)
+	}
+	return withProgress(ctx, info.Digest, size, blob, throttled), size, nil
+}
+
+// requestImageRef returns the image given by the ?ref= parameter of
+// a request, defaulting to the IMAGE the proxy was started with (as
+// resolved when opening it, if it was).
+func (h *proxyHandler) requestImageRef(r *http.Request) (types.ImageReference, error) {
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		h.lock.Lock()
+		imgsrc := h.imgsrc
+		h.lock.Unlock()
+		if imgsrc != nil {
+			return h.parseImageRef(transports.ImageName((*imgsrc).Reference()))
+		}
+		ref = h.imageName()
+	}
+	if ref == "" {
+		return nil, fmt.Errorf("No IMAGE was specified")
+	}
+	return h.resolveImageName(ref)
+}
+
+// implDeleteManifest handles DELETE /manifest, deleting the image from
+// its registry.  By default this is the opened image; a different one
+// may be given with ?ref=.
+func (h *proxyHandler) implDeleteManifest(w http.ResponseWriter, r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	imgRef, err := h.requestImageRef(r)
+	if err != nil {
+		return err
+	}
+	if err := imgRef.DeleteImage(r.Context(), h.sysctx); err != nil {
+		return withRegistry(imgRef, err)
+	}
+
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(200)
+	return nil
+}
+
+// layerDiffID returns the uncompressed digest (diffID) the image config
+// records for the layer with digest d.
+func (h *proxyHandler) layerDiffID(ctx context.Context, d digest.Digest) (digest.Digest, error) {
+	config, err := h.loadedImage().OCIConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	for i, layer := range h.loadedImage().LayerInfos() {
+		if layer.Digest != d {
+			continue
+		}
+		if i >= len(config.RootFS.DiffIDs) {
+			return "", fmt.Errorf("image config has no diffID for layer %s", d)
+		}
+		return config.RootFS.DiffIDs[i], nil
+	}
+	return "", fmt.Errorf("layer %s not found in manifest", d)
+}
+
+func (h *proxyHandler) implBlob(w http.ResponseWriter, r *http.Request, digestStr string) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+
+	decompress, err := queryBool(r, "decompress")
+	if err != nil {
+		return err
+	}
+	reportDiffID, err := queryBool(r, "diffid")
+	if err != nil {
+		return err
+	}
+	// With ?sanitize=1, the entries of the decompressed layer are checked
+	// as it is streamed, failing on the first unsafe one
+	sanitize, err := queryBool(r, "sanitize")
+	if err != nil {
+		return err
+	}
+	if sanitize && !decompress {
+		return invalidRequestf("sanitize requires decompress")
+	}
+	// With ?whiteouts=, the whiteouts of the decompressed layer are
+	// rewritten into that format
+	whiteouts := r.URL.Query().Get("whiteouts")
+	switch whiteouts {
+	case "", whiteoutsOverlay, whiteoutsOCI:
+	default:
+		return invalidRequestf("invalid whiteouts %q (expected %q or %q)", whiteouts, whiteoutsOverlay, whiteoutsOCI)
+	}
+	if whiteouts != "" && !decompress {
+		return invalidRequestf("whiteouts requires decompress")
+	}
+	// With ?fd=1, the blob is written to the file the client passed with
+	// the request, and the (empty) response is sent once it is complete.
+	dest, err := passedFile(r)
+	if err != nil {
+		return err
+	}
+	var out io.Writer = w
+	if dest != nil {
+		out = dest
+	}
+
+	ctx := r.Context()
+	d, err := digest.Parse(digestStr)
+	if err != nil {
+		return err
+	}
+	if decompress {
+		if err := h.requireContainerImage(ctx); err != nil {
+			return err
+		}
+	}
+	var diffID digest.Digest
+	if decompress || reportDiffID {
+		diffID, err = h.layerDiffID(ctx, d)
+		// For blobs which aren't layers, the uncompressed digest can still be reported
+		if err != nil && decompress {
+			return err
+		}
+	}
+	// Encrypted layers are decrypted if there is a key for them, and the
+	// decrypted layer is verified against the digest it had then
+	decryption, err := h.layerDecryption(d)
+	if err != nil {
+		return err
+	}
+	if (decompress || reportDiffID) && decryption == nil {
+		if info, err := h.layerInfo(d); err == nil && isEncryptedLayer(info) {
+			return invalidRequestf("layer %s is encrypted, and no decryption keys were given", d)
+		}
+	}
+	blobr, blobSize, err := h.getBlob(ctx, types.BlobInfo{Digest: d, Size: -1})
+	if err != nil {
+		return err
+	}
+	defer blobr.Close()
+	if err := h.blobServed(d, blobSize, ""); err != nil {
+		return err
+	}
+	expected := d
+	if decryption != nil {
+		blobr, err = decryption.reader(blobr)
+		if err != nil {
+			return err
+		}
+		expected = decryption.digest
+		w.Header().Set("Decrypted-Digest", expected.String())
+	}
+
+	if decompress {
+		decompressor, stream, err := compression.DetectCompression(blobr)
+		if err != nil {
+			return err
+		}
+		if decompressor != nil {
+			rc, err := decompressor(stream)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			stream = rc
+		}
+		diffIDVerifier := h.blobVerifier(diffID)
+		if diffIDVerifier != nil {
+			stream = io.TeeReader(stream, diffIDVerifier)
+		}
+		counter := &countingReader{r: stream}
+		stream = counter
+		if dest == nil {
+			w.Header().Set("Content-Type", "application/x-tar")
+			w.WriteHeader(200)
+		}
+		switch {
+		case whiteouts != "":
+			err = rewriteWhiteouts(out, stream, whiteouts, sanitize)
+		case sanitize:
+			err = copySanitizedTar(out, stream)
+		default:
+			_, err = io.Copy(out, stream)
+		}
+		if err != nil {
+			return err
+		}
+		if diffIDVerifier != nil && !diffIDVerifier.Verified() {
+			return fmt.Errorf("Corrupted blob, expecting diffID %s", diffID.String())
+		}
+		h.uncompressedSizes.put(d, counter.n)
+		return nil
+	}
+
+	var uncompressed *uncompressedDigester
+	if reportDiffID {
+		uncompressed = newUncompressedDigester()
+		defer uncompressed.pw.Close()
+	}
+	if dest == nil {
+		if uncompressed != nil {
+			// The digest is only known at the end, so it is sent as a trailer
+			w.Header().Set("Trailer", "Uncompressed-Digest")
+		} else {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", blobSize))
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(200)
+	}
+	// Blobs which don't need to be read here can be sent directly
+	if vf, ok := blobr.(verifiedFile); ok && uncompressed == nil {
+		var handled bool
+		if dest != nil {
+			_, handled, err = sendFile(dest, 0, vf.File, blobSize)
+		} else if sw := sockResponseWriter(w, r); sw != nil {
+			_, handled, err = sw.sendFile(vf.File, blobSize)
+		}
+		if handled {
+			return err
+		}
+	}
+	verifier := h.blobVerifier(expected)
+	var tr io.Reader = blobr
+	if verifier != nil {
+		tr = io.TeeReader(tr, verifier)
+	}
+	if uncompressed != nil {
+		tr = io.TeeReader(tr, uncompressed)
+	}
+	_, err = io.Copy(out, tr)
+	if err != nil {
+		return err
+	}
+	if verifier != nil && !verifier.Verified() {
+		return fmt.Errorf("Corrupted blob, expecting %s", expected.String())
+	}
+	if uncompressed != nil {
+		uncompressedDigest, err := uncompressed.Digest()
+		if err != nil {
+			return err
+		}
+		if diffID != "" && uncompressedDigest != diffID {
+			return fmt.Errorf("Corrupted blob, expecting diffID %s got %s", diffID, uncompressedDigest)
+		}
+		w.Header().Set("Uncompressed-Digest", uncompressedDigest.String())
+	}
+	return nil
+}
+
+// uncompressedDigester computes the digest of the decompressed form
+// of the data written to it, decompressing in a separate goroutine.
+type uncompressedDigester struct {
+	pw     *io.PipeWriter
+	done   chan struct{}
+	digest digest.Digest
+	err    error
+}
+
+func newUncompressedDigester() *uncompressedDigester {
+	pr, pw := io.Pipe()
+	u := &uncompressedDigester{
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(u.done)
+		stream, _, err := compression.AutoDecompress(pr)
+		if err != nil {
+			u.err = err
+			pr.CloseWithError(err)
+			return
+		}
+		defer stream.Close()
+		digester := digest.Canonical.Digester()
+		if _, err := io.Copy(digester.Hash(), stream); err != nil {
+			u.err = err
+			pr.CloseWithError(err)
+			return
+		}
+		// Consume anything after the end of the compressed stream
+		if _, err := io.Copy(io.Discard, pr); err != nil {
+			u.err = err
+			return
+		}
+		u.digest = digester.Digest()
+	}()
+	return u
+}
+
+func (u *uncompressedDigester) Write(p []byte) (int, error) {
+	return u.pw.Write(p)
+}
+
+// Digest waits for decompression to complete and returns the uncompressed digest.
+func (u *uncompressedDigester) Digest() (digest.Digest, error) {
+	u.pw.Close()
+	<-u.done
+	return u.digest, u.err
+}
+
+// queryBool parses an optional boolean query parameter.
+func queryBool(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, invalidRequestf("invalid %s parameter %q", name, v)
+	}
+	return b, nil
+}
+
+// imageIndependent are the endpoints (see metricEndpoint) which don't use
+// the image, and so needn't wait for POST /image: in particular, the
+// requests it waits for may be cancelled meanwhile.
+var imageIndependent = map[string]bool{
+	"POST /quit":        true,
+	"POST /cancel":      true,
+	"POST /events":      true,
+	"GET /progress":     true,
+	"GET /ping":         true,
+	"GET /stats":        true,
+	"GET /capabilities": true,
+}
+
+// ServeHTTP handles these requests:
+//
+// GET /manifest
+// HEAD /manifest
+// DELETE /manifest
+// GET /digest
+// GET /inspect
+// GET /tags
+// GET /blobs/<digest>
+// HEAD /blobs/<digest>
+// GET /toc/<digest>
+// GET /uncompressed-size/<digest>
+// GET /export/oci-archive
+// GET /export/docker-archive
+// GET /flattened
+// GET /layers
+// POST /layers
+// POST /prefetch
+// POST /cancel
+// POST /events
+// GET /progress
+// POST /copy
+// POST /image
+// POST /destination
+// PUT /destination/blobs/<digest>
+// PUT /destination/manifest
+// POST /destination/commit
+// GET /stats
+// GET /ping
+// GET /capabilities
+// POST /quit
+func (h *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := validateRequest(r); err != nil {
+		h.replyError(w, r, err)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if r.URL.Path == "/quit" {
+			if err := h.implQuit(w, r); err != nil {
+				h.replyError(w, r, err)
+			}
+			return
+		}
+	}
+
+	if r.Method == http.MethodPost && r.URL.Path == "/image" {
+		// Takes imageLock for writing itself
+	} else if !imageIndependent[metricEndpoint(r)] {
+		h.imageLock.RLock()
+		defer h.imageLock.RUnlock()
+	}
+
+	if isStreamRequest(r) {
+		release, err := h.streams.acquire(r)
+		if err != nil {
+			h.replyError(w, r, err)
+			return
+		}
+		defer release()
+	}
+
+	var err error
+	if r.Method == http.MethodGet && r.URL.Path == "/manifest" {
+		err = h.implManifest(w, r)
+	} else if r.Method == http.MethodHead && r.URL.Path == "/manifest" {
+		err = h.implManifestExists(w, r)
+	} else if r.Method == http.MethodDelete && r.URL.Path == "/manifest" {
+		err = h.implDeleteManifest(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == "/digest" {
+		err = h.implDigest(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == "/inspect" {
+		err = h.implInspect(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == "/ping" {
+		err = h.implPing(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == "/stats" {
+		err = h.implStats(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == "/capabilities" {
+		err = h.implCapabilities(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == "/tags" {
+		err = h.implTags(w, r)
+	} else if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/blobs/") {
+		blob := filepath.Base(r.URL.Path)
+		if r.Header.Get("Range") != "" {
+			err = h.implBlobChunks(w, r, blob)
+		} else {
+			err = h.implBlob(w, r, blob)
+		}
+	} else if r.Method == http.MethodHead && strings.HasPrefix(r.URL.Path, "/blobs/") {
+		err = h.implBlobExists(w, r, filepath.Base(r.URL.Path))
+	} else if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/toc/") {
+		err = h.implTOC(w, r, filepath.Base(r.URL.Path))
+	} else if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/uncompressed-size/") {
+		err = h.implUncompressedSize(w, r, filepath.Base(r.URL.Path))
+	} else if r.Method == http.MethodGet && r.URL.Path == "/export/oci-archive" {
+		err = h.implExportOCIArchive(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == "/export/docker-archive" {
+		err = h.implExportDockerArchive(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == "/flattened" {
+		err = h.implFlattened(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == "/layers" {
+		err = h.implLayerInfo(w, r)
+	} else if r.Method == http.MethodPost && r.URL.Path == "/layers" {
+		err = h.implFetchLayers(w, r)
+	} else if r.Method == http.MethodPost && r.URL.Path == "/prefetch" {
+		err = h.implPrefetch(w, r)
+	} else if r.Method == http.MethodPost && r.URL.Path == "/cancel" {
+		err = h.implCancel(w, r)
+	} else if r.Method == http.MethodPost && r.URL.Path == "/events" {
+		err = h.implEvents(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == "/progress" {
+		err = h.implProgress(w, r)
+	} else if r.Method == http.MethodPost && r.URL.Path == "/copy" {
+		err = h.implCopy(w, r)
+	} else if r.Method == http.MethodPost && r.URL.Path == "/image" {
+		err = h.implSetImage(w, r)
+	} else if r.Method == http.MethodPost && r.URL.Path == "/destination" {
+		err = h.implOpenDestination(w, r)
+	} else if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/destination/blobs/") {
+		err = h.implPutBlob(w, r, filepath.Base(r.URL.Path))
+	} else if r.Method == http.MethodPut && r.URL.Path == "/destination/manifest" {
+		err = h.implPutManifest(w, r)
+	} else if r.Method == http.MethodPost && r.URL.Path == "/destination/commit" {
+		err = h.implCommit(w, r)
+	} else {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.replyError(w, r, err)
+	}
+}
+
+// replyError reports a failed request, aborting the response if it
+// was already started.
+func (h *proxyHandler) replyError(w http.ResponseWriter, r *http.Request, err error) {
+	log := logrus.WithError(err).WithFields(logrus.Fields{
+		"image":  h.imageName(),
+		"method": r.Method,
+		"path":   r.URL.Path,
+	})
+	if strings.HasPrefix(r.URL.Path, "/blobs/") {
+		log = log.WithField("digest", filepath.Base(r.URL.Path))
+	}
+	log.Error("request failed")
+	if sw := sockResponseWriter(w, r); sw != nil && sw.wroteHeader {
+		// Too late to send an error status; the connection is dropped
+		// so the client sees a truncated response instead of bad data.
+		sw.aborted = err
+		return
+	}
+	reply := newErrorReply(err)
+	status := http.StatusInternalServerError
+	var badRequest *badRequestError
+	if errors.As(err, &badRequest) {
+		status = badRequest.status
+		if len(badRequest.allow) > 0 {
+			w.Header().Set("Allow", strings.Join(badRequest.allow, ", "))
+		}
+	}
+	if reply.Code == errorCodeRateLimit {
+		retryAfter := int64(math.Ceil(h.retry.rateLimitWait(err).Seconds()))
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+		status = http.StatusTooManyRequests
+		reply.Message = fmt.Sprintf("rate limited, retry after %ds: %v", retryAfter, err)
+	}
+	buf, contentType, _ := encodeReply(r, reply)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(buf)))
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+// close releases the opened image and destination, and the prefetched blobs.
+func (h *proxyHandler) close() error {
+	h.prefetched.close()
+	h.events.stop()
+	h.lock.Lock()
+	imgsrc := h.imgsrc
+	h.lock.Unlock()
+	if imgsrc != nil {
+		if err := (*imgsrc).Close(); err != nil {
+			return err
+		}
+	}
+	h.destLock.Lock()
+	defer h.destLock.Unlock()
+	return h.closeDestination()
+}
@@ -0,0 +1,147 @@
+package imageproxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+)
+
+// layerInfo describes one layer of the image, as returned by GET /layers.
+type layerInfo struct {
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+	MediaType string        `json:"mediaType"`
+	DiffID    digest.Digest `json:"diffID,omitempty"`
+	Empty     bool          `json:"empty"`
+	// Annotations are those of the layer in the manifest; for OCI
+	// artifacts, org.opencontainers.image.title is usually its file name.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// implLayerInfo handles GET /layers, listing the layers of the image in
+// order, with their diffIDs from the config.  OCI artifacts have no image
+// config, so their layers have no diffIDs.
+func (h *proxyHandler) implLayerInfo(w http.ResponseWriter, r *http.Request) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	img := h.loadedImage()
+	rawManifest, mimeType, err := img.Manifest(ctx)
+	if err != nil {
+		return err
+	}
+	m, err := manifest.FromBlob(rawManifest, mimeType)
+	if err != nil {
+		return err
+	}
+	var diffIDs []digest.Digest
+	if artifactType(rawManifest, mimeType) == "" {
+		config, err := img.OCIConfig(ctx)
+		if err != nil {
+			return err
+		}
+		diffIDs = config.RootFS.DiffIDs
+	}
+
+	// Layers which schema1 marks as empty have no diffID
+	layers := []layerInfo{}
+	for _, l := range m.LayerInfos() {
+		info := layerInfo{
+			Digest:      l.Digest,
+			Size:        l.Size,
+			MediaType:   l.MediaType,
+			Empty:       l.EmptyLayer || l.Digest == image.GzippedEmptyLayerDigest,
+			Annotations: l.Annotations,
+		}
+		if !l.EmptyLayer && len(diffIDs) > 0 {
+			info.DiffID = diffIDs[0]
+			diffIDs = diffIDs[1:]
+		}
+		layers = append(layers, info)
+	}
+	return writeReply(w, r, layers)
+}
+
+// inspectOutput is returned by GET /inspect; it matches the output of
+// `skopeo inspect`, except that tags are only listed by GET /tags.
+type inspectOutput struct {
+	Name          string `json:",omitempty"`
+	Digest        digest.Digest
+	Created       *time.Time
+	DockerVersion string
+	Labels        map[string]string
+	Architecture  string
+	Variant       string `json:",omitempty"`
+	Os            string
+	Layers        []string
+	Env           []string
+	// ArtifactType is set for OCI artifacts, which are only described
+	// by their manifest, as their config isn't an image config.
+	ArtifactType string `json:",omitempty"`
+}
+
+// implInspect handles GET /inspect, summarizing the image and its config.
+func (h *proxyHandler) implInspect(w http.ResponseWriter, r *http.Request) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	src := h.imageSource()
+	// As for skopeo, this is the digest of the manifest list if there is one
+	rawManifest, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return err
+	}
+	manifestDigest, err := manifest.Digest(rawManifest)
+	if err != nil {
+		return err
+	}
+	var name string
+	if dockerRef := src.Reference().DockerReference(); dockerRef != nil {
+		name = dockerRef.Name()
+	}
+	t, err := h.imageArtifactType(ctx)
+	if err != nil {
+		return err
+	}
+	if t != "" {
+		out := inspectOutput{
+			Name:         name,
+			Digest:       manifestDigest,
+			ArtifactType: t,
+			Layers:       []string{},
+		}
+		for _, layer := range h.loadedImage().LayerInfos() {
+			out.Layers = append(out.Layers, layer.Digest.String())
+		}
+		return writeReply(w, r, out)
+	}
+	info, err := h.loadedImage().Inspect(ctx)
+	if err != nil {
+		return err
+	}
+	out := inspectOutput{
+		Name:          name,
+		Digest:        manifestDigest,
+		Created:       info.Created,
+		DockerVersion: info.DockerVersion,
+		Labels:        info.Labels,
+		Architecture:  info.Architecture,
+		Variant:       info.Variant,
+		Os:            info.Os,
+		Layers:        info.Layers,
+		Env:           info.Env,
+	}
+	return writeReply(w, r, out)
+}
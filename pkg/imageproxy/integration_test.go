@@ -0,0 +1,633 @@
+package imageproxy_test
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cgwalters/container-image-proxy/pkg/client"
+	"github.com/cgwalters/container-image-proxy/pkg/imageproxy"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/sys/unix"
+)
+
+// fixture is a single-layer image.
+type fixture struct {
+	manifest       []byte
+	manifestDigest digest.Digest
+	blobs          map[digest.Digest][]byte
+	config         digest.Digest
+	layer          digest.Digest
+	// layerTar is the uncompressed layer
+	layerTar []byte
+	// manifestFetches and blobFetches count the manifests and blobs
+	// served by serveRegistry
+	manifestFetches int32
+	blobFetches     int32
+}
+
+const fixtureFile = "hello from the fixture\n"
+
+func newFixture(t testing.TB) *fixture {
+	return newFixtureWithFile(t, []byte(fixtureFile))
+}
+
+// newFixtureWithFile returns a fixture whose layer holds a file with the
+// given contents.
+func newFixtureWithFile(t testing.TB, contents []byte) *fixture {
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	if err := tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: int64(len(contents))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(contents)
+	tw.Close()
+	var gzBuf bytes.Buffer
+	gz := gzip.NewWriter(&gzBuf)
+	gz.Write(tarBuf.Bytes())
+	gz.Close()
+
+	config, err := json.Marshal(imgspecv1.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: imgspecv1.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromBytes(tarBuf.Bytes())},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fixture{
+		blobs:    make(map[digest.Digest][]byte),
+		config:   digest.FromBytes(config),
+		layer:    digest.FromBytes(gzBuf.Bytes()),
+		layerTar: tarBuf.Bytes(),
+	}
+	f.blobs[f.config] = config
+	f.blobs[f.layer] = gzBuf.Bytes()
+	f.manifest, err = json.Marshal(imgspecv1.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		Config: imgspecv1.Descriptor{
+			MediaType: imgspecv1.MediaTypeImageConfig,
+			Digest:    f.config,
+			Size:      int64(len(config)),
+		},
+		Layers: []imgspecv1.Descriptor{{
+			MediaType: imgspecv1.MediaTypeImageLayerGzip,
+			Digest:    f.layer,
+			Size:      int64(gzBuf.Len()),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.manifestDigest = digest.FromBytes(f.manifest)
+	f.blobs[f.manifestDigest] = f.manifest
+	return f
+}
+
+// writeOCILayout writes the fixture as an oci: layout, tagged latest.
+func (f *fixture) writeOCILayout(t testing.TB) string {
+	dir := t.TempDir()
+	blobDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for d, data := range f.blobs {
+		if err := os.WriteFile(filepath.Join(blobDir, d.Encoded()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := json.Marshal(imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		Manifests: []imgspecv1.Descriptor{{
+			MediaType:   imgspecv1.MediaTypeImageManifest,
+			Digest:      f.manifestDigest,
+			Size:        int64(len(f.manifest)),
+			Annotations: map[string]string{imgspecv1.AnnotationRefName: "latest"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// registryError replies like a registry does.
+func registryError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, strings.ToLower(code))
+}
+
+// serveRegistry serves the fixture as test/image:latest from a throwaway
+// registry, returning its host.  Anything under test/private requires
+// credentials.
+func (f *fixture) serveRegistry(t *testing.T) string {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		switch {
+		case path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case strings.HasPrefix(path, "/v2/test/private/"):
+			registryError(w, http.StatusUnauthorized, "UNAUTHORIZED")
+		case path == "/v2/test/image/tags/list":
+			fmt.Fprint(w, `{"name":"test/image","tags":["latest"]}`)
+		case path == "/v2/test/image/manifests/latest", path == "/v2/test/image/manifests/"+f.manifestDigest.String():
+			w.Header().Set("Content-Type", imgspecv1.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", f.manifestDigest.String())
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(f.manifest)))
+			if r.Method != http.MethodHead {
+				atomic.AddInt32(&f.manifestFetches, 1)
+				w.Write(f.manifest)
+			}
+		case strings.HasPrefix(path, "/v2/test/image/manifests/"):
+			registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+		case strings.HasPrefix(path, "/v2/test/image/blobs/"):
+			data, ok := f.blobs[digest.Digest(strings.TrimPrefix(path, "/v2/test/image/blobs/"))]
+			if !ok {
+				registryError(w, http.StatusNotFound, "BLOB_UNKNOWN")
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+			if r.Method != http.MethodHead {
+				atomic.AddInt32(&f.blobFetches, 1)
+				w.Write(data)
+			}
+		default:
+			registryError(w, http.StatusNotFound, "NAME_UNKNOWN")
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "https://")
+}
+
+// systemContext isolates containers/image from the configuration of the
+// host, and trusts the throwaway registry.
+func systemContext(t testing.TB) *types.SystemContext {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "registries.conf")
+	if err := os.WriteFile(conf, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &types.SystemContext{
+		SystemRegistriesConfPath:    conf,
+		SystemRegistriesConfDirPath: filepath.Join(dir, "registries.conf.d"),
+		AuthFilePath:                filepath.Join(dir, "auth.json"),
+		BlobInfoCacheDir:            dir,
+		DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+	}
+}
+
+// proxy is a Server for the test, with a client connected to it over a
+// socketpair.
+type proxy struct {
+	server *imageproxy.Server
+	client *client.Client
+}
+
+func socketpair(t testing.TB) (*net.UnixConn, *net.UnixConn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func startProxy(t *testing.T, image string) *proxy {
+	return startProxyWithOptions(t, image, imageproxy.Options{})
+}
+
+func startProxyWithOptions(t *testing.T, image string, opts imageproxy.Options) *proxy {
+	opts.SystemContext = systemContext(t)
+	server, err := imageproxy.NewServer(image, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours, theirs := socketpair(t)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(theirs)
+		theirs.Close()
+	}()
+	p := &proxy{server: server, client: client.New(ours)}
+	t.Cleanup(func() {
+		if err := p.client.Close(); err != nil {
+			t.Errorf("closing client: %v", err)
+		}
+		if err := <-served; err != nil {
+			t.Errorf("serving: %v", err)
+		}
+		if err := server.Close(); err != nil {
+			t.Errorf("closing server: %v", err)
+		}
+	})
+	return p
+}
+
+// get makes a request on a connection of its own, returning the response
+// and its body.
+func (p *proxy) get(t *testing.T, path string) (*http.Response, []byte) {
+	return p.request(t, http.MethodGet, path)
+}
+
+func (p *proxy) request(t *testing.T, method, path string) (*http.Response, []byte) {
+	ours, theirs := socketpair(t)
+	defer ours.Close()
+	go func() {
+		p.server.Serve(theirs)
+		theirs.Close()
+	}()
+	req, err := http.NewRequest(method, "http://proxy"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Write(ours); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(ours), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func errorCode(err error) string {
+	var e *client.Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// checkImage validates the manifest, blobs and digest served for the
+// fixture.
+func checkImage(t *testing.T, p *proxy, f *fixture) {
+	ctx := context.Background()
+	r, digests, err := p.client.GetManifestDigests(ctx)
+	if err != nil {
+		t.Fatalf("GetManifest: %v", err)
+	}
+	raw, _ := io.ReadAll(r)
+	r.Close()
+	if digests.Digest != f.manifestDigest.String() {
+		t.Errorf("manifest digest %s, expected %s", digests.Digest, f.manifestDigest)
+	}
+	if digests.OCIDigest != digest.FromBytes(raw).String() {
+		t.Errorf("OCI manifest digest %s, expected that of the returned manifest, %s", digests.OCIDigest, digest.FromBytes(raw))
+	}
+	var m imgspecv1.Manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		t.Fatalf("invalid manifest: %v", err)
+	}
+	if m.Config.Digest != f.config || len(m.Layers) != 1 || m.Layers[0].Digest != f.layer {
+		t.Errorf("unexpected manifest %s", raw)
+	}
+
+	for _, d := range []digest.Digest{f.config, f.layer} {
+		r, err := p.client.GetBlob(ctx, d.String())
+		if err != nil {
+			t.Fatalf("GetBlob %s: %v", d, err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("reading blob %s: %v", d, err)
+		}
+		if !bytes.Equal(data, f.blobs[d]) {
+			t.Errorf("blob %s has unexpected content", d)
+		}
+	}
+
+	resp, body := p.get(t, "/digest")
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != f.manifestDigest.String() {
+		t.Errorf("GET /digest: %s %q", resp.Status, body)
+	}
+
+	resp, body = p.get(t, "/blobs/"+f.layer.String()+"?decompress=1")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, f.layerTar) {
+		t.Errorf("GET /blobs?decompress=1: %s, %d bytes", resp.Status, len(body))
+	}
+
+	missing := digest.FromString("missing")
+	r, err = p.client.GetBlob(ctx, missing.String())
+	if err == nil {
+		_, err = io.ReadAll(r)
+		r.Close()
+	}
+	if code := errorCode(err); code != "ENOTFOUND" {
+		t.Errorf("GetBlob of a missing blob: %v, expected ENOTFOUND", err)
+	}
+
+	r, err = p.client.GetBlob(ctx, "sha256:invalid")
+	if err == nil {
+		_, err = io.ReadAll(r)
+		r.Close()
+	}
+	if code := errorCode(err); code != "EINVAL" {
+		t.Errorf("GetBlob of an invalid digest: %v, expected EINVAL", err)
+	}
+}
+
+func TestOCILayout(t *testing.T) {
+	f := newFixture(t)
+	dir := f.writeOCILayout(t)
+	p := startProxy(t, "oci:"+dir+":latest")
+	checkImage(t, p, f)
+}
+
+func TestLocalTransports(t *testing.T) {
+	f := newFixture(t)
+	dir := f.writeOCILayout(t)
+	cacheDir := t.TempDir()
+	p := startProxyWithOptions(t, "oci:"+dir+":latest", imageproxy.Options{BlobCacheDir: cacheDir})
+	checkImage(t, p, f)
+
+	resp, body := p.get(t, "/digest?ref="+url.QueryEscape("oci:"+dir+":latest"))
+	if resp.StatusCode != http.StatusOK || string(body) != f.manifestDigest.String() {
+		t.Errorf("GET /digest of the oci: image: %s %q", resp.Status, body)
+	}
+	var tags struct {
+		Repository string   `json:"repository"`
+		Tags       []string `json:"tags"`
+	}
+	resp, body = p.get(t, "/tags?ref="+url.QueryEscape("oci:"+dir))
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &tags) != nil || tags.Repository != dir || len(tags.Tags) != 1 || tags.Tags[0] != "latest" {
+		t.Errorf("GET /tags of the oci: layout: %s %q", resp.Status, body)
+	}
+
+	const tag = "example.com/test/image:latest"
+	resp, body = p.get(t, "/export/docker-archive?tag="+url.QueryEscape(tag))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /export/docker-archive: %s %q", resp.Status, body)
+	}
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(archive, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	resp, body = p.get(t, "/digest?ref="+url.QueryEscape("docker-archive:"+archive))
+	if _, err := digest.Parse(string(body)); resp.StatusCode != http.StatusOK || err != nil {
+		t.Errorf("GET /digest of the docker-archive: image: %s %q", resp.Status, body)
+	}
+	tags.Tags = nil
+	resp, body = p.get(t, "/tags?ref="+url.QueryEscape("docker-archive:"+archive))
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &tags) != nil || len(tags.Tags) != 1 || tags.Tags[0] != tag {
+		t.Errorf("GET /tags of the docker-archive: %s %q", resp.Status, body)
+	}
+
+	// Local images are cheap to read, so nothing of them is cached
+	err := filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			t.Errorf("%s was cached", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	f := newFixture(t)
+	host := f.serveRegistry(t)
+	p := startProxy(t, "docker://"+host+"/test/image:latest")
+	checkImage(t, p, f)
+
+	resp, body := p.get(t, "/tags")
+	var tags struct {
+		Tags []string `json:"tags"`
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &tags) != nil || len(tags.Tags) != 1 || tags.Tags[0] != "latest" {
+		t.Errorf("GET /tags: %s %q", resp.Status, body)
+	}
+}
+
+func TestRegistryBlobExists(t *testing.T) {
+	f := newFixture(t)
+	host := f.serveRegistry(t)
+	p := startProxy(t, "docker://"+host+"/test/image:latest")
+	resp, _ := p.request(t, http.MethodHead, "/blobs/"+f.layer.String())
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(f.blobs[f.layer])) {
+		t.Errorf("HEAD /blobs of the layer: %s, Content-Length %d", resp.Status, resp.ContentLength)
+	}
+	resp, _ = p.request(t, http.MethodHead, "/blobs/"+digest.FromString("missing").String())
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD /blobs of a missing blob: %s", resp.Status)
+	}
+	// Only the config was fetched, when loading the image
+	if n := atomic.LoadInt32(&f.blobFetches); n != 1 {
+		t.Errorf("%d blobs fetched, expected only the config", n)
+	}
+}
+
+func TestRegistryManifestCache(t *testing.T) {
+	f := newFixture(t)
+	host := f.serveRegistry(t)
+	ctx := context.Background()
+	p := startProxy(t, "docker://"+host+"/test/image:latest")
+	checkImage(t, p, f)
+	if n := atomic.LoadInt32(&f.manifestFetches); n != 1 {
+		t.Fatalf("manifest fetched %d times, expected once", n)
+	}
+	for _, image := range []string{
+		"docker://" + host + "/test/image:latest",
+		"docker://" + host + "/test/image@" + f.manifestDigest.String(),
+	} {
+		if err := p.client.SetImage(ctx, image); err != nil {
+			t.Fatal(err)
+		}
+		r, _, err := p.client.GetManifest(ctx)
+		if err != nil {
+			t.Fatalf("GetManifest of %s: %v", image, err)
+		}
+		r.Close()
+		if n := atomic.LoadInt32(&f.manifestFetches); n != 1 {
+			t.Errorf("manifest of %s fetched again", image)
+		}
+	}
+	// The image is opened for its layers
+	checkImage(t, p, f)
+}
+
+func TestRegistryResumeUnauthorized(t *testing.T) {
+	f := newFixture(t)
+	layer := f.blobs[f.layer]
+	var lock sync.Mutex
+	// Tokens are numbered from 1; those up to revoked are rejected
+	issued, revoked := 0, 0
+	broken := false
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.URL.Path == "/token" {
+			issued++
+			fmt.Fprintf(w, `{"token":"%d","expires_in":3600}`, issued)
+			return
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err != nil || n <= revoked {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, srv.URL))
+			registryError(w, http.StatusUnauthorized, "UNAUTHORIZED")
+			return
+		}
+		switch path := r.URL.Path; {
+		case path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case path == "/v2/test/image/manifests/latest":
+			w.Header().Set("Content-Type", imgspecv1.MediaTypeImageManifest)
+			w.Write(f.manifest)
+		case path == "/v2/test/image/blobs/"+f.layer.String() && r.Header.Get("Range") != "":
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || end >= len(layer) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(layer)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(layer[start : end+1])
+		case path == "/v2/test/image/blobs/"+f.layer.String() && !broken:
+			// Break the stream halfway, with the token revoked meanwhile
+			broken = true
+			revoked = issued
+			w.Header().Set("Content-Length", strconv.Itoa(len(layer)))
+			w.Write(layer[:len(layer)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		case strings.HasPrefix(path, "/v2/test/image/blobs/"):
+			data, ok := f.blobs[digest.Digest(strings.TrimPrefix(path, "/v2/test/image/blobs/"))]
+			if !ok {
+				registryError(w, http.StatusNotFound, "BLOB_UNKNOWN")
+				return
+			}
+			w.Write(data)
+		default:
+			registryError(w, http.StatusNotFound, "NAME_UNKNOWN")
+		}
+	}))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	p := startProxyWithOptions(t, "docker://"+host+"/test/image:latest", imageproxy.Options{Retries: 1, RetryDelay: time.Millisecond})
+	r, err := p.client.GetBlob(context.Background(), f.layer.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(data, layer) {
+		t.Fatalf("reading the layer: %v, %d bytes", err, len(data))
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !broken || issued != 2 {
+		t.Errorf("%d tokens issued, expected a new one to resume the layer", issued)
+	}
+}
+
+// spanRecorder collects the spans ended.
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (r *spanRecorder) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+func (r *spanRecorder) Shutdown(context.Context) error                  { return nil }
+func (r *spanRecorder) ForceFlush(context.Context) error                { return nil }
+
+func (r *spanRecorder) OnEnd(s sdktrace.ReadOnlySpan) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func TestRegistryTracing(t *testing.T) {
+	f := newFixture(t)
+	host := f.serveRegistry(t)
+	recorder := &spanRecorder{}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	p := startProxyWithOptions(t, "docker://"+host+"/test/image:latest", imageproxy.Options{TracerProvider: provider})
+	checkImage(t, p, f)
+	if resp, _ := p.get(t, "/tags"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /tags: %s", resp.Status)
+	}
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	traced := map[string]bool{}
+	for _, span := range recorder.spans {
+		for _, attr := range span.Attributes() {
+			if attr.Key == "net.peer.name" && attr.Value.AsString() == host {
+				traced[span.Name()] = true
+			}
+		}
+	}
+	for _, name := range []string{"registry open", "registry get blob", "registry list tags"} {
+		if !traced[name] {
+			t.Errorf("no %q span for the registry, got %v", name, traced)
+		}
+	}
+}
+
+func TestRegistryErrors(t *testing.T) {
+	f := newFixture(t)
+	host := f.serveRegistry(t)
+	for _, tc := range []struct {
+		image string
+		code  string
+	}{
+		{"docker://" + host + "/test/image:missing", "ENOTFOUND"},
+		{"docker://" + host + "/test/private:latest", "EAUTH"},
+	} {
+		t.Run(tc.code, func(t *testing.T) {
+			p := startProxy(t, tc.image)
+			_, _, err := p.client.GetManifest(context.Background())
+			if code := errorCode(err); code != tc.code {
+				t.Errorf("GetManifest of %s: %v, expected %s", tc.image, err, tc.code)
+			}
+		})
+	}
+}
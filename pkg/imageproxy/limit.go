@@ -0,0 +1,131 @@
+package imageproxy
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// connKey is the context key for the connection a request was read from.
+type connKey struct{}
+
+// streamLimiter bounds the number of concurrent streaming requests.
+// Waiting requests are queued per connection, and connections are served
+// round-robin, so a client with many requests in flight can't starve the
+// others.
+type streamLimiter struct {
+	lock   sync.Mutex
+	max    int
+	active int
+	// waiting holds the queued requests of each connection, and order
+	// the connections with queued requests, in the order to serve them.
+	waiting map[interface{}][]chan struct{}
+	order   []interface{}
+}
+
+func newStreamLimiter(max int) *streamLimiter {
+	return &streamLimiter{
+		max:     max,
+		waiting: make(map[interface{}][]chan struct{}),
+	}
+}
+
+// isStreamRequest returns true for requests which transfer blob data.
+func isStreamRequest(r *http.Request) bool {
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/blobs/"),
+		r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/export/"),
+		r.Method == http.MethodGet && r.URL.Path == "/flattened",
+		r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/uncompressed-size/"),
+		r.Method == http.MethodPost && r.URL.Path == "/layers",
+		r.Method == http.MethodPost && r.URL.Path == "/copy":
+		return true
+	}
+	return false
+}
+
+// acquire waits until r may start streaming, returning the function to
+// call when it is done.  A nil limiter allows any number of streams.
+func (l *streamLimiter) acquire(r *http.Request) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	conn := r.Context().Value(connKey{})
+	l.lock.Lock()
+	if l.active < l.max && len(l.order) == 0 {
+		l.active++
+		l.lock.Unlock()
+		return l.release, nil
+	}
+	ready := make(chan struct{})
+	if len(l.waiting[conn]) == 0 {
+		l.order = append(l.order, conn)
+	}
+	l.waiting[conn] = append(l.waiting[conn], ready)
+	l.lock.Unlock()
+
+	select {
+	case <-ready:
+		return l.release, nil
+	case <-r.Context().Done():
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	select {
+	case <-ready:
+		// Granted just as the request was cancelled
+		l.releaseLocked()
+	default:
+		l.dequeueLocked(conn, ready)
+	}
+	return nil, r.Context().Err()
+}
+
+func (l *streamLimiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.releaseLocked()
+}
+
+// releaseLocked ends a stream, and grants its slot to the first queued
+// request of the next connection in turn.
+func (l *streamLimiter) releaseLocked() {
+	l.active--
+	if len(l.order) == 0 {
+		return
+	}
+	conn := l.order[0]
+	l.order = l.order[1:]
+	queue := l.waiting[conn]
+	ready := queue[0]
+	if len(queue) > 1 {
+		l.waiting[conn] = queue[1:]
+		l.order = append(l.order, conn)
+	} else {
+		delete(l.waiting, conn)
+	}
+	l.active++
+	close(ready)
+}
+
+// dequeueLocked removes a request which gave up waiting.
+func (l *streamLimiter) dequeueLocked(conn interface{}, ready chan struct{}) {
+	queue := l.waiting[conn]
+	for i, c := range queue {
+		if c == ready {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		l.waiting[conn] = queue
+		return
+	}
+	delete(l.waiting, conn)
+	for i, c := range l.order {
+		if c == conn {
+			l.order = append(l.order[:i], l.order[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package imageproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// IsListening returns true if f is a listening socket, as opposed to a
+// connected one.
+func IsListening(f *os.File) (bool, error) {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	var accepting int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		accepting, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+	}); err != nil {
+		return false, err
+	}
+	return accepting != 0, sockErr
+}
+
+// serveActivated serves the sockets passed by socket activation.  With
+// Accept=no (the default), these are listening sockets, whose clients are
+// each served in their own session like with --socket.  With Accept=yes,
+// systemd starts an instance per connection, which is served like a
+// --sockfd one.
+func (h *proxyHandler) serveActivated(files []*os.File) error {
+	var listeners []net.Listener
+	var conns []net.Conn
+	for _, f := range files {
+		listening, err := IsListening(f)
+		if err != nil {
+			return fmt.Errorf("invalid activation socket %s: %w", f.Name(), err)
+		}
+		if listening {
+			l, err := FileListener(f)
+			if err != nil {
+				return fmt.Errorf("invalid activation socket %s: %w", f.Name(), err)
+			}
+			defer l.Close()
+			h.closeOnStop(l)
+			listeners = append(listeners, l)
+		} else {
+			conn, err := FileConn(f)
+			if err != nil {
+				return fmt.Errorf("invalid activation socket %s: %w", f.Name(), err)
+			}
+			h.closeOnStop(conn)
+			conns = append(conns, conn)
+		}
+		f.Close()
+	}
+	if len(listeners) == 0 {
+		return h.serveConns(conns)
+	}
+	if len(conns) > 0 {
+		return fmt.Errorf("socket activation with both listening and connected sockets is not supported")
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- h.serveListener(l, (*proxyHandler).serveConn)
+		}(l)
+	}
+	return <-errs
+}
+
+// newSession returns a handler for a client of the --socket listener.
+// It shares the configuration, blob cache and limits of h, but opens its
+// own image and destination.
+func (h *proxyHandler) newSession() *proxyHandler {
+	s := &proxyHandler{
+		imageref:          h.imageName(),
+		sysctx:            h.sysctx,
+		cache:             h.cache,
+		backend:           h.backend,
+		retry:             h.retry,
+		timeouts:          h.timeouts,
+		bandwidth:         h.bandwidth,
+		blobCache:         h.blobCache,
+		manifests:         h.manifests,
+		uncompressedSizes: h.uncompressedSizes,
+		offline:           h.offline,
+		trustedTransports: h.trustedTransports,
+		credentials:       h.credentials,
+		authFallback:      h.authFallback,
+		streams:           h.streams,
+		bufferSize:        h.bufferSize,
+		maxManifestSize:   h.maxManifestSize,
+		decryptConfig:     h.decryptConfig,
+		requests:          h.requests,
+		stats:             &sessionStats{},
+		audit:             h.audit,
+		tracerProvider:    h.tracerProvider,
+		started:           h.started,
+		prefetched:        prefetchCache{maxSize: h.prefetched.maxSize},
+	}
+	s.traced = s.tracedHandler()
+	return s
+}
+
+// serveListener accepts connections on l, serving each with serve (e.g.
+// serveConn) in its own session until the client closes it or sends
+// POST /quit.  Connections from
+// peers which h.peers doesn't allow are closed right away.  It only returns if
+// accepting fails; if that is because the proxy is shutting down, it
+// waits for the sessions to end.
+func (h *proxyHandler) serveListener(l net.Listener, serve func(*proxyHandler, io.ReadWriter) error) error {
+	var wg sync.WaitGroup
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !h.isShutdown() && !h.requests.isDraining() {
+				return err
+			}
+			wg.Wait()
+			return nil
+		}
+		if err := h.peers.check(conn); err != nil {
+			logrus.WithError(err).Warn("rejected connection")
+			conn.Close()
+			continue
+		}
+		unregister := h.closeOnStop(conn)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log := logrus.WithField("peer", conn.RemoteAddr().String())
+			log.Debug("session started")
+			defer log.Debug("session ended")
+			session := h.newSession()
+			err := serve(session, conn)
+			unregister()
+			conn.Close()
+			if cerr := session.close(); err == nil {
+				err = cerr
+			}
+			// Connections are expected to fail once stopped
+			if err != nil && !h.isShutdown() {
+				logrus.WithError(err).Error("serving connection")
+			}
+		}()
+	}
+}
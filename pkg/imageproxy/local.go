@@ -0,0 +1,114 @@
+package imageproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// manifestDigest returns the digest of the manifest ref refers to.  For
+// docker:// this is a single HEAD request; other transports are opened
+// to read the manifest (which is cheap for local ones).
+func (h *proxyHandler) manifestDigest(ctx context.Context, ref types.ImageReference) (digest.Digest, error) {
+	if ref.Transport().Name() == docker.Transport.Name() {
+		ctx, span := h.registrySpan(ctx, ref, "get digest")
+		d, err := docker.GetDigest(ctx, h.systemContext(ref), ref)
+		endSpan(span, err)
+		return d, withRegistry(ref, err)
+	}
+	src, err := h.backend.newImageSource(ctx, h.sysctx, ref)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	buf, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := h.checkManifestSize(buf); err != nil {
+		return "", err
+	}
+	return manifest.Digest(buf)
+}
+
+// splitLocalRef splits the reference of an oci: or docker-archive: image
+// into the path and the image within it, the same way these transports do.
+func splitLocalRef(ref types.ImageReference) (string, string) {
+	s := ref.StringWithinTransport()
+	if i := strings.Index(s, ":"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// localTags lists the images stored in an oci: directory (by their
+// org.opencontainers.image.ref.name annotation) or a docker-archive:
+// file (by their full names, e.g. docker.io/library/busybox:latest).
+// The path is returned as the repository.
+func (h *proxyHandler) localTags(ref types.ImageReference) (string, []string, error) {
+	path, _ := splitLocalRef(ref)
+	tags := []string{}
+	switch ref.Transport().Name() {
+	case layout.Transport.Name():
+		buf, err := os.ReadFile(filepath.Join(path, "index.json"))
+		if err != nil {
+			return "", nil, err
+		}
+		var index imgspecs.Index
+		if err := json.Unmarshal(buf, &index); err != nil {
+			return "", nil, fmt.Errorf("parsing index.json: %w", err)
+		}
+		for _, m := range index.Manifests {
+			if name, ok := m.Annotations[imgspecs.AnnotationRefName]; ok {
+				tags = append(tags, name)
+			}
+		}
+	case archive.Transport.Name():
+		reader, err := archive.NewReader(h.sysctx, path)
+		if err != nil {
+			return "", nil, err
+		}
+		defer reader.Close()
+		images, err := reader.List()
+		if err != nil {
+			return "", nil, err
+		}
+		for _, refs := range images {
+			for _, r := range refs {
+				if named, ok := r.DockerReference().(reference.NamedTagged); ok {
+					tags = append(tags, named.String())
+				}
+			}
+		}
+	default:
+		return "", nil, fmt.Errorf("listing tags is not supported for %s: images", ref.Transport().Name())
+	}
+	return path, tags, nil
+}
+
+// withStoredLayers returns img updated to describe the layers as src
+// actually stores them, if they differ from the manifest.  This is the
+// case for containers-storage:, which keeps layers uncompressed, so
+// GetBlob can only return data matching their uncompressed digests.
+func withStoredLayers(ctx context.Context, src types.ImageSource, img types.Image) (types.Image, error) {
+	infos, err := src.LayerInfosForCopy(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if infos == nil {
+		return img, nil
+	}
+	return img.UpdatedImage(ctx, types.ManifestUpdateOptions{LayerInfos: infos})
+}
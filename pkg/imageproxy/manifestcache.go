@@ -0,0 +1,320 @@
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// maxCachedManifests is the number of manifests and configs kept in memory.
+const maxCachedManifests = 64
+
+// manifestCache caches the manifests and configs of the docker:// images
+// loaded by all sessions, by digest, along with the manifest each image
+// reference was resolved to.  With a blob cache, they are also stored
+// there, so that they are kept across restarts (and usable offline).
+type manifestCache struct {
+	// disk is nil unless there is a blob cache
+	disk *blobCache
+
+	lock sync.Mutex
+	// blobs are the manifests and configs, by digest
+	blobs map[digest.Digest]*cachedManifest
+	// refs are the manifests image references were last resolved to
+	refs map[string]digest.Digest
+}
+
+// cachedManifest is a manifest or config.
+type cachedManifest struct {
+	body []byte
+	// mimeType is that sent by the registry for manifests, if known
+	mimeType string
+}
+
+func newManifestCache(disk *blobCache) *manifestCache {
+	return &manifestCache{disk: disk}
+}
+
+// get returns the manifest or config d, or nil if it isn't cached.
+func (c *manifestCache) get(d digest.Digest) *cachedManifest {
+	c.lock.Lock()
+	m := c.blobs[d]
+	c.lock.Unlock()
+	if m != nil || c.disk == nil {
+		return m
+	}
+	f, _, ok := c.disk.open(d)
+	if !ok {
+		return nil
+	}
+	defer f.Close()
+	body, err := io.ReadAll(io.LimitReader(f, defaultMaxManifestSize+1))
+	if err != nil || len(body) > defaultMaxManifestSize {
+		return nil
+	}
+	m = &cachedManifest{body: body}
+	c.putMemory(d, m)
+	return m
+}
+
+// put caches the manifest or config d.
+func (c *manifestCache) put(d digest.Digest, m *cachedManifest) {
+	if len(m.body) > defaultMaxManifestSize {
+		return
+	}
+	c.putMemory(d, m)
+	if c.disk == nil {
+		return
+	}
+	if err := c.disk.put(d, m.body); err != nil {
+		logrus.WithError(err).WithField("digest", d).Debug("storing manifest in the blob cache")
+	}
+}
+
+func (c *manifestCache) putMemory(d digest.Digest, m *cachedManifest) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.blobs == nil {
+		c.blobs = make(map[digest.Digest]*cachedManifest)
+	}
+	if _, ok := c.blobs[d]; !ok && len(c.blobs) >= maxCachedManifests {
+		for k := range c.blobs {
+			delete(c.blobs, k)
+			break
+		}
+	}
+	c.blobs[d] = m
+}
+
+// getRef returns the manifest the image name was last resolved to, or ""
+// if it is unknown.
+func (c *manifestCache) getRef(name string) digest.Digest {
+	c.lock.Lock()
+	d := c.refs[name]
+	c.lock.Unlock()
+	if d != "" || c.disk == nil {
+		return d
+	}
+	d, err := c.disk.getRef(name)
+	if err != nil {
+		return ""
+	}
+	return d
+}
+
+// setRef records that the image name was resolved to the manifest d.
+func (c *manifestCache) setRef(name string, d digest.Digest) error {
+	c.lock.Lock()
+	if c.refs == nil {
+		c.refs = make(map[string]digest.Digest)
+	}
+	if _, ok := c.refs[name]; !ok && len(c.refs) >= maxCachedManifests {
+		for k := range c.refs {
+			delete(c.refs, k)
+			break
+		}
+	}
+	c.refs[name] = d
+	c.lock.Unlock()
+	if c.disk == nil {
+		return nil
+	}
+	return c.disk.setRef(name, d)
+}
+
+// openCachedImageSource opens a docker:// image whose manifest is cached,
+// returning nil if it isn't.  Whether the reference still resolves to the
+// cached manifest is checked with a HEAD request (which also checks that
+// the image can still be accessed); the manifest and config are then
+// served from the cache, the registry only being contacted again for the
+// other blobs.  Unlike caching the registry responses, this also covers
+// the manifest fetched by containers/image as an image source is opened.
+func (h *proxyHandler) openCachedImageSource(ctx context.Context, ref types.ImageReference) types.ImageSource {
+	if h.manifests == nil || !remoteBlobs(ref) || ref.DockerReference() == nil {
+		return nil
+	}
+	// Images which were never loaded aren't worth a HEAD request
+	if _, digested := ref.DockerReference().(reference.Digested); !digested && h.manifests.getRef(transports.ImageName(ref)) == "" {
+		return nil
+	}
+	d, err := h.manifestDigest(ctx, ref)
+	if err != nil {
+		logrus.WithError(err).WithField("image", transports.ImageName(ref)).Debug("revalidating cached manifest")
+		return nil
+	}
+	m := h.manifests.get(d)
+	if m == nil {
+		return nil
+	}
+	// The blobs are fetched by digest, in case the tag is moved meanwhile
+	pinned, err := reference.WithDigest(reference.TrimNamed(ref.DockerReference()), d)
+	if err != nil {
+		return nil
+	}
+	pinnedRef, err := docker.NewReference(pinned)
+	if err != nil {
+		return nil
+	}
+	logrus.WithField("image", transports.ImageName(ref)).Debug("using cached manifest")
+	return &cachedImageSource{
+		ref:      ref,
+		cache:    h.manifests,
+		manifest: d,
+		open: func(ctx context.Context) (types.ImageSource, error) {
+			return h.openRegistrySource(ctx, pinnedRef)
+		},
+	}
+}
+
+// cacheManifests stores the manifests and config of a loaded docker://
+// image in the manifest cache, and records which manifest its reference
+// was resolved to.
+func (h *proxyHandler) cacheManifests(ctx context.Context, src types.ImageSource, img types.Image) error {
+	ref := src.Reference()
+	if h.manifests == nil || ref.Transport().Name() != docker.Transport.Name() {
+		return nil
+	}
+	// The manifest as found by the reference, possibly a manifest list
+	topManifest, topType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return err
+	}
+	topDigest, err := manifest.Digest(topManifest)
+	if err != nil {
+		return err
+	}
+	h.manifests.put(topDigest, &cachedManifest{body: topManifest, mimeType: topType})
+	instanceManifest, instanceType, err := img.Manifest(ctx)
+	if err != nil {
+		return err
+	}
+	instanceDigest, err := manifest.Digest(instanceManifest)
+	if err != nil {
+		return err
+	}
+	h.manifests.put(instanceDigest, &cachedManifest{body: instanceManifest, mimeType: instanceType})
+	config, err := img.ConfigBlob(ctx)
+	if err != nil {
+		return err
+	}
+	// Converted schema1 images have a generated config, which can't be verified
+	if configDigest := img.ConfigInfo().Digest; configDigest != "" && configDigest == digest.FromBytes(config) {
+		h.manifests.put(configDigest, &cachedManifest{body: config})
+	}
+	return h.manifests.setRef(transports.ImageName(ref), topDigest)
+}
+
+// cachedImageSource serves the manifests and config of a docker:// image
+// from the manifest cache, opening the image for anything else.
+type cachedImageSource struct {
+	ref      types.ImageReference
+	cache    *manifestCache
+	manifest digest.Digest
+	// open opens the image, pinned to manifest
+	open func(ctx context.Context) (types.ImageSource, error)
+
+	lock sync.Mutex
+	src  types.ImageSource
+}
+
+// source returns the image source, opening it on first use.
+func (s *cachedImageSource) source(ctx context.Context) (types.ImageSource, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.src == nil {
+		src, err := s.open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.src = src
+	}
+	return s.src, nil
+}
+
+func (s *cachedImageSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *cachedImageSource) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.src == nil {
+		return nil
+	}
+	return s.src.Close()
+}
+
+func (s *cachedImageSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	d := s.manifest
+	if instanceDigest != nil {
+		d = *instanceDigest
+	}
+	if m := s.cache.get(d); m != nil {
+		mimeType := m.mimeType
+		if mimeType == "" {
+			mimeType = manifest.GuessMIMEType(m.body)
+		}
+		return m.body, mimeType, nil
+	}
+	src, err := s.source(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	buf, mimeType, err := src.GetManifest(ctx, instanceDigest)
+	if err != nil {
+		return nil, "", err
+	}
+	if got, err := manifest.Digest(buf); err == nil && got == d {
+		s.cache.put(d, &cachedManifest{body: buf, mimeType: mimeType})
+	}
+	return buf, mimeType, nil
+}
+
+func (s *cachedImageSource) HasThreadSafeGetBlob() bool {
+	return true
+}
+
+func (s *cachedImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	if m := s.cache.get(info.Digest); m != nil && digest.FromBytes(m.body) == info.Digest {
+		return io.NopCloser(bytes.NewReader(m.body)), int64(len(m.body)), nil
+	}
+	src, err := s.source(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return src.GetBlob(ctx, info, cache)
+}
+
+func (s *cachedImageSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	src, err := s.source(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return src.GetSignatures(ctx, instanceDigest)
+}
+
+// LayerInfosForCopy returns nil, as docker:// image sources do, so that
+// the image isn't opened just for this.
+func (s *cachedImageSource) LayerInfosForCopy(ctx context.Context, instanceDigest *digest.Digest) ([]types.BlobInfo, error) {
+	return nil, nil
+}
+
+// underlying returns the image source s stands for, for the methods
+// containers/image only offers on its own image sources.
+func (s *cachedImageSource) underlying(ctx context.Context) (types.ImageSource, error) {
+	src, err := s.source(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", transports.ImageName(s.ref), err)
+	}
+	return src, nil
+}
@@ -0,0 +1,58 @@
+package imageproxy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestManifestCache(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	d := digest.FromBytes(manifest)
+	const name = "docker://example.com/foo:latest"
+
+	disk, err := newBlobCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newManifestCache(disk)
+	if cache.get(d) != nil || cache.getRef(name) != "" {
+		t.Fatal("empty cache returned a manifest")
+	}
+	cache.put(d, &cachedManifest{body: manifest, mimeType: "application/vnd.oci.image.manifest.v1+json"})
+	if err := cache.setRef(name, d); err != nil {
+		t.Fatal(err)
+	}
+	if m := cache.get(d); m == nil || string(m.body) != string(manifest) || m.mimeType == "" {
+		t.Errorf("cached manifest: %+v", m)
+	}
+	if got := cache.getRef(name); got != d {
+		t.Errorf("reference resolved to %q, expected %s", got, d)
+	}
+
+	// Only so many are kept in memory
+	for i := 0; i < 2*maxCachedManifests; i++ {
+		body := []byte(fmt.Sprintf(`{"schemaVersion":2,"n":%d}`, i))
+		cache.put(digest.FromBytes(body), &cachedManifest{body: body})
+	}
+	if n := len(cache.blobs); n > maxCachedManifests {
+		t.Errorf("%d manifests in memory", n)
+	}
+
+	// After a restart, they are in the blob cache
+	cache = newManifestCache(disk)
+	if m := cache.get(d); m == nil || string(m.body) != string(manifest) {
+		t.Errorf("manifest after a restart: %+v", m)
+	}
+	if got := cache.getRef(name); got != d {
+		t.Errorf("reference resolved to %q after a restart, expected %s", got, d)
+	}
+
+	// Without a blob cache, nothing is kept across restarts
+	cache = newManifestCache(nil)
+	cache.put(d, &cachedManifest{body: manifest})
+	if newManifestCache(nil).get(d) != nil {
+		t.Error("manifest kept without a blob cache")
+	}
+}
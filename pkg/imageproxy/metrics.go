@@ -0,0 +1,83 @@
+package imageproxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "container_image_proxy"
+
+// The metrics exported with --metrics-fd and --metrics-socket.  They are
+// always collected, which is cheap, and cover all sessions.
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Requests handled, by endpoint and status code.",
+	}, []string{"endpoint", "code"})
+	metricRequestsInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_in_progress",
+		Help:      "Requests being handled.",
+	})
+	metricActiveStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_streams",
+		Help:      "Requests streaming blob data in progress.",
+	})
+	metricResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "response_bytes_total",
+		Help:      "Bytes of response bodies sent to clients, by endpoint.",
+	}, []string{"endpoint"})
+	metricBlobFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "blob_fetches_total",
+		Help:      "Blobs fetched, by source: registry (remote images), local (other transports), cache (--blob-cache) or prefetch.",
+	}, []string{"source"})
+	metricFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "fetch_duration_seconds",
+		Help:      "Time for the image source to load the image (manifest and config) or start returning a blob, including retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+	}, []string{"operation"})
+	metricRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retries_total",
+		Help:      "Operations retried after a failure (see --retry).",
+	})
+)
+
+// MetricsHandler serves the metrics, along with those of the Go runtime
+// and the process.
+func MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		metricRequests,
+		metricRequestsInProgress,
+		metricActiveStreams,
+		metricResponseBytes,
+		metricBlobFetches,
+		metricFetchDuration,
+		metricRetries,
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// metricEndpoint returns the endpoint of r for metric labels, without
+// the digests in its path (e.g. "GET /blobs"), or "other" for requests
+// which don't match any endpoint, so that clients can't create labels.
+func metricEndpoint(r *http.Request) string {
+	matched, _ := matchEndpoint(r.URL.Path)
+	for _, e := range matched {
+		if e.Method == r.Method {
+			return e.Method + " " + strings.TrimSuffix(e.Path, "/<digest>")
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,152 @@
+package imageproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// usesNetwork returns true for references to images which may be remote.
+func usesNetwork(ref types.ImageReference) bool {
+	switch ref.Transport().Name() {
+	case docker.Transport.Name(), "docker-daemon":
+		return true
+	}
+	return false
+}
+
+// remoteBlobs returns true for references to images whose blobs are
+// fetched over the network on demand.  Unlike docker://, docker-daemon:
+// copies the whole image from the daemon when it is opened, after which
+// its blobs are read locally.
+func remoteBlobs(ref types.ImageReference) bool {
+	return ref.Transport().Name() == docker.Transport.Name()
+}
+
+// parseImageRef parses an image name given by a client, refusing
+// images which would need network access in offline mode.
+func (h *proxyHandler) parseImageRef(name string) (types.ImageReference, error) {
+	ref, err := alltransports.ParseImageName(name)
+	if err != nil {
+		return nil, invalidRequestError{err}
+	}
+	if h.offline && usesNetwork(ref) {
+		return nil, fmt.Errorf("offline: refusing to access %s", transports.ImageName(ref))
+	}
+	return ref, nil
+}
+
+// openImageSource opens the image to serve.  In offline mode, docker://
+// images are served from the blob cache instead of the registry.
+func (h *proxyHandler) openImageSource(ctx context.Context, ref types.ImageReference) (types.ImageSource, error) {
+	if h.offline && usesNetwork(ref) {
+		if ref.Transport().Name() != docker.Transport.Name() || h.blobCache == nil {
+			return nil, fmt.Errorf("offline: refusing to access %s (only docker:// images in the --blob-cache can be used)", transports.ImageName(ref))
+		}
+		return newOfflineImageSource(ref, h.blobCache)
+	}
+	ctx, span := h.startSpan(ctx, "open image", attribute.String("image.ref", transports.ImageName(ref)))
+	src := h.openCachedImageSource(ctx, ref)
+	if src != nil {
+		endSpan(span, nil)
+		return src, nil
+	}
+	src, err := h.openRegistrySource(ctx, ref)
+	endSpan(span, err)
+	return src, err
+}
+
+// openRegistrySource opens the image ref refers to with its transport.
+// Opening a docker:// image fetches the manifest its reference refers to.
+func (h *proxyHandler) openRegistrySource(ctx context.Context, ref types.ImageReference) (types.ImageSource, error) {
+	ctx, span := h.registrySpan(ctx, ref, "open")
+	src, err := h.newImageSource(ctx, ref)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return h.tracedRegistrySource(src), nil
+}
+
+// offlineImageSource serves a docker:// image from the blob cache.
+type offlineImageSource struct {
+	ref      types.ImageReference
+	cache    *blobCache
+	manifest digest.Digest
+}
+
+func newOfflineImageSource(ref types.ImageReference, cache *blobCache) (*offlineImageSource, error) {
+	var d digest.Digest
+	if digested, ok := ref.DockerReference().(reference.Digested); ok {
+		d = digested.Digest()
+	} else {
+		var err error
+		d, err = cache.getRef(transports.ImageName(ref))
+		if err != nil {
+			return nil, err
+		}
+		if d == "" {
+			return nil, fmt.Errorf("offline: %s is not in the blob cache", transports.ImageName(ref))
+		}
+	}
+	return &offlineImageSource{
+		ref:      ref,
+		cache:    cache,
+		manifest: d,
+	}, nil
+}
+
+func (s *offlineImageSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *offlineImageSource) Close() error {
+	return nil
+}
+
+func (s *offlineImageSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	d := s.manifest
+	if instanceDigest != nil {
+		d = *instanceDigest
+	}
+	f, _, ok := s.cache.open(d)
+	if !ok {
+		return nil, "", fmt.Errorf("offline: manifest %s of %s is not in the blob cache", d, transports.ImageName(s.ref))
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf, manifest.GuessMIMEType(buf), nil
+}
+
+func (s *offlineImageSource) HasThreadSafeGetBlob() bool {
+	return true
+}
+
+func (s *offlineImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	f, size, ok := s.cache.open(info.Digest)
+	if !ok {
+		return nil, 0, fmt.Errorf("offline: blob %s of %s is not in the blob cache: %w", info.Digest, transports.ImageName(s.ref), os.ErrNotExist)
+	}
+	return f, size, nil
+}
+
+func (s *offlineImageSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	return nil, nil
+}
+
+func (s *offlineImageSource) LayerInfosForCopy(ctx context.Context, instanceDigest *digest.Digest) ([]types.BlobInfo, error) {
+	return nil, nil
+}
@@ -0,0 +1,412 @@
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containers/image/v5/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// Annotations set by containers/storage on zstd:chunked layers
+	zstdChunkedManifestChecksumKey = "io.containers.zstd-chunked.manifest-checksum"
+	zstdChunkedManifestInfoKey     = "io.containers.zstd-chunked.manifest-position"
+	zstdChunkedFooterSize          = 40
+	zstdChunkedManifestTypeCRFS    = 1
+
+	// Refuse to load pathologically large TOCs into memory
+	maxTOCSize = 50 * 1024 * 1024
+)
+
+var zstdChunkedFrameMagic = []byte{0x47, 0x6e, 0x55, 0x6c, 0x49, 0x6e, 0x55, 0x78}
+
+// blobChunk is a portion of a blob.  This mirrors the experimental
+// ImageSourceChunk type of containers/image, which lives in an internal package.
+type blobChunk struct {
+	Offset uint64
+	Length uint64
+}
+
+// getBlobAt calls the experimental GetBlobAt method of an ImageSource.
+// Because the chunk type it accepts is internal to containers/image, the
+// call is made via reflection.
+func getBlobAt(ctx context.Context, src types.ImageSource, info types.BlobInfo, chunks []blobChunk) (chan io.ReadCloser, chan error, error) {
+	if cached, ok := src.(*cachedImageSource); ok {
+		var err error
+		if src, err = cached.underlying(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	if traced, ok := src.(*tracedImageSource); ok {
+		ctx, span := traced.h.registrySpan(ctx, src.Reference(), "get blob at", attribute.String("blob.digest", info.Digest.String()), attribute.Int("blob.chunks", len(chunks)))
+		streams, errs, err := getBlobAt(ctx, traced.ImageSource, info, chunks)
+		endSpan(span, err)
+		return streams, errs, err
+	}
+	m := reflect.ValueOf(src).MethodByName("GetBlobAt")
+	if !m.IsValid() {
+		return nil, nil, fmt.Errorf("transport %s does not support partial blob fetches", src.Reference().Transport().Name())
+	}
+	mt := m.Type()
+	if mt.NumIn() != 3 || mt.NumOut() != 3 || mt.In(2).Kind() != reflect.Slice {
+		return nil, nil, fmt.Errorf("unexpected GetBlobAt signature: %s", mt)
+	}
+	chunkType := mt.In(2).Elem()
+	for _, name := range []string{"Offset", "Length"} {
+		if f, ok := chunkType.FieldByName(name); !ok || f.Type.Kind() != reflect.Uint64 {
+			return nil, nil, fmt.Errorf("unexpected GetBlobAt chunk type: %s", chunkType)
+		}
+	}
+	vchunks := reflect.MakeSlice(mt.In(2), len(chunks), len(chunks))
+	for i, c := range chunks {
+		v := vchunks.Index(i)
+		v.FieldByName("Offset").SetUint(c.Offset)
+		v.FieldByName("Length").SetUint(c.Length)
+	}
+	out := m.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(info), vchunks})
+	if err, _ := out[2].Interface().(error); err != nil {
+		return nil, nil, err
+	}
+	streams, ok := out[0].Interface().(chan io.ReadCloser)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected GetBlobAt signature: %s", mt)
+	}
+	errs, ok := out[1].Interface().(chan error)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected GetBlobAt signature: %s", mt)
+	}
+	return streams, errs, nil
+}
+
+// drainChunks consumes the channels returned by getBlobAt in the
+// background, so the goroutine feeding them exits.
+func drainChunks(streams chan io.ReadCloser, errs chan error) {
+	go func() {
+		for r := range streams {
+			r.Close()
+		}
+	}()
+	go func() {
+		for range errs {
+		}
+	}()
+}
+
+// readChunks invokes fn with the stream for each of the n requested chunks in order.
+func readChunks(streams chan io.ReadCloser, errs chan error, n int, fn func(int, io.Reader) error) error {
+	// Whatever happens, consume the channels so the goroutine feeding them exits.
+	defer drainChunks(streams, errs)
+
+	i := 0
+	for i < n {
+		select {
+		case r, ok := <-streams:
+			if !ok {
+				return fmt.Errorf("expected %d chunks, got %d", n, i)
+			}
+			err := fn(i, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			i++
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// readBlobChunk returns the contents of a single chunk of a blob.
+func (h *proxyHandler) readBlobChunk(ctx context.Context, info types.BlobInfo, offset, length uint64) ([]byte, error) {
+	streams, errs, err := getBlobAt(ctx, h.imageSource(), info, []blobChunk{{Offset: offset, Length: length}})
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	err = readChunks(streams, errs, 1, func(_ int, r io.Reader) error {
+		_, err := io.ReadFull(r, buf)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// layerInfo returns the manifest's description of the layer with digest d.
+func (h *proxyHandler) layerInfo(d digest.Digest) (types.BlobInfo, error) {
+	for _, layer := range h.loadedImage().LayerInfos() {
+		if layer.Digest == d {
+			return layer, nil
+		}
+	}
+	return types.BlobInfo{}, fmt.Errorf("layer %s not found in manifest", d)
+}
+
+// parseRange parses the byte ranges of a Range header; size may be -1 if unknown.
+func parseRange(header string, size int64) ([]blobChunk, error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, invalidRequestf("invalid range %q", header)
+	}
+	var chunks []blobChunk
+	var next uint64
+	for _, spec := range strings.Split(strings.TrimPrefix(header, "bytes="), ",") {
+		spec = strings.TrimSpace(spec)
+		i := strings.Index(spec, "-")
+		if i <= 0 {
+			return nil, invalidRequestf("invalid range %q", spec)
+		}
+		start, err := strconv.ParseUint(spec[:i], 10, 64)
+		if err != nil {
+			return nil, invalidRequestf("invalid range %q: %w", spec, err)
+		}
+		var end uint64
+		if spec[i+1:] == "" {
+			if size < 0 {
+				return nil, fmt.Errorf("open-ended range %q requires a known blob size", spec)
+			}
+			end = uint64(size) - 1
+		} else {
+			end, err = strconv.ParseUint(spec[i+1:], 10, 64)
+			if err != nil {
+				return nil, invalidRequestf("invalid range %q: %w", spec, err)
+			}
+		}
+		if end < start || start < next || (size >= 0 && end >= uint64(size)) {
+			return nil, invalidRequestf("invalid range %q", spec)
+		}
+		chunks = append(chunks, blobChunk{Offset: start, Length: end - start + 1})
+		next = end + 1
+	}
+	return chunks, nil
+}
+
+// implBlobChunks handles a GET /blobs/<digest> carrying a Range header.
+// A single range is returned as is; multiple ranges use multipart/byteranges.
+// Unlike full blob fetches, the content cannot be verified against the digest.
+func (h *proxyHandler) implBlobChunks(w http.ResponseWriter, r *http.Request, digestStr string) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+
+	ctx := r.Context()
+	d, err := digest.Parse(digestStr)
+	if err != nil {
+		return err
+	}
+	info := types.BlobInfo{Digest: d, Size: -1}
+	if layer, err := h.layerInfo(d); err == nil {
+		info = layer
+	}
+	chunks, err := parseRange(r.Header.Get("Range"), info.Size)
+	if err != nil {
+		return err
+	}
+	streams, errs, err := getBlobAt(ctx, h.imageSource(), info, chunks)
+	if err != nil {
+		return err
+	}
+	if err := h.blobServed(d, info.Size, r.Header.Get("Range")); err != nil {
+		return err
+	}
+
+	sizeStr := "*"
+	if info.Size >= 0 {
+		sizeStr = fmt.Sprintf("%d", info.Size)
+	}
+	contentRange := func(c blobChunk) string {
+		return fmt.Sprintf("bytes %d-%d/%s", c.Offset, c.Offset+c.Length-1, sizeStr)
+	}
+
+	if len(chunks) == 1 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", chunks[0].Length))
+		w.Header().Set("Content-Range", contentRange(chunks[0]))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusPartialContent)
+		return readChunks(streams, errs, 1, func(_ int, r io.Reader) error {
+			_, err := io.CopyN(w, r, int64(chunks[0].Length))
+			return err
+		})
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+	err = readChunks(streams, errs, len(chunks), func(i int, r io.Reader) error {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {"application/octet-stream"},
+			"Content-Range": {contentRange(chunks[i])},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(part, r, int64(chunks[i].Length))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// readZstdChunkedTOC returns the uncompressed TOC of a zstd:chunked layer.
+func (h *proxyHandler) readZstdChunkedTOC(ctx context.Context, info types.BlobInfo) ([]byte, error) {
+	var offset, length, lengthUncompressed, manifestType uint64
+	if position := info.Annotations[zstdChunkedManifestInfoKey]; position != "" {
+		if _, err := fmt.Sscanf(position, "%d:%d:%d:%d", &offset, &length, &lengthUncompressed, &manifestType); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", zstdChunkedManifestInfoKey, err)
+		}
+	} else {
+		if info.Size <= zstdChunkedFooterSize {
+			return nil, fmt.Errorf("blob %s too small", info.Digest)
+		}
+		footer, err := h.readBlobChunk(ctx, info, uint64(info.Size-zstdChunkedFooterSize), zstdChunkedFooterSize)
+		if err != nil {
+			return nil, err
+		}
+		offset = binary.LittleEndian.Uint64(footer[0:8])
+		length = binary.LittleEndian.Uint64(footer[8:16])
+		lengthUncompressed = binary.LittleEndian.Uint64(footer[16:24])
+		manifestType = binary.LittleEndian.Uint64(footer[24:32])
+		if !bytes.Equal(footer[32:40], zstdChunkedFrameMagic) {
+			return nil, fmt.Errorf("invalid zstd:chunked footer magic in %s", info.Digest)
+		}
+	}
+	if manifestType != zstdChunkedManifestTypeCRFS {
+		return nil, fmt.Errorf("unsupported zstd:chunked manifest type %d", manifestType)
+	}
+	if length > maxTOCSize || lengthUncompressed > maxTOCSize {
+		return nil, fmt.Errorf("zstd:chunked manifest of %s too large", info.Digest)
+	}
+
+	compressed, err := h.readBlobChunk(ctx, info, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := digest.Parse(info.Annotations[zstdChunkedManifestChecksumKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", zstdChunkedManifestChecksumKey, err)
+	}
+	if actual := expected.Algorithm().FromBytes(compressed); actual != expected {
+		return nil, fmt.Errorf("Corrupted zstd:chunked manifest, expecting %s got %s", expected, actual)
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return decoder.DecodeAll(compressed, make([]byte, 0, lengthUncompressed))
+}
+
+// readEstargzTOC returns the TOC of an eStargz layer.
+func (h *proxyHandler) readEstargzTOC(ctx context.Context, info types.BlobInfo) ([]byte, error) {
+	gz := &estargz.GzipDecompressor{}
+	footerSize := gz.FooterSize()
+	if info.Size <= footerSize {
+		return nil, fmt.Errorf("blob %s too small", info.Digest)
+	}
+	footer, err := h.readBlobChunk(ctx, info, uint64(info.Size-footerSize), uint64(footerSize))
+	if err != nil {
+		return nil, err
+	}
+	tocOffset, tocSize, err := gz.ParseFooter(footer)
+	if err != nil {
+		return nil, err
+	}
+	if tocSize <= 0 {
+		tocSize = info.Size - footerSize - tocOffset
+	}
+	if tocOffset < 0 || tocSize <= 0 || tocSize > maxTOCSize {
+		return nil, fmt.Errorf("invalid eStargz TOC location in %s", info.Digest)
+	}
+	tocData, err := h.readBlobChunk(ctx, info, uint64(tocOffset), uint64(tocSize))
+	if err != nil {
+		return nil, err
+	}
+	toc, tocDigest, err := gz.ParseTOC(bytes.NewReader(tocData))
+	if err != nil {
+		return nil, err
+	}
+	if expected := info.Annotations[estargz.TOCJSONDigestAnnotation]; tocDigest.String() != expected {
+		return nil, fmt.Errorf("Corrupted eStargz TOC, expecting %s got %s", expected, tocDigest)
+	}
+	return json.Marshal(toc)
+}
+
+// implTOC handles GET /toc/<digest>, returning the table of contents
+// of a zstd:chunked or eStargz layer.
+func (h *proxyHandler) implTOC(w http.ResponseWriter, r *http.Request, digestStr string) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+
+	ctx := r.Context()
+	d, err := digest.Parse(digestStr)
+	if err != nil {
+		return err
+	}
+	info, err := h.layerInfo(d)
+	if err != nil {
+		return err
+	}
+
+	var toc []byte
+	var format string
+	if _, ok := info.Annotations[zstdChunkedManifestChecksumKey]; ok {
+		format = "zstd:chunked"
+		toc, err = h.readZstdChunkedTOC(ctx, info)
+	} else if _, ok := info.Annotations[estargz.TOCJSONDigestAnnotation]; ok {
+		format = "estargz"
+		toc, err = h.readEstargzTOC(ctx, info)
+	} else {
+		return invalidRequestf("layer %s is not in a chunked format", d)
+	}
+	if err != nil {
+		return err
+	}
+	contentType := "application/json"
+	if wantsCBOR(r) {
+		toc, err = jsonToCBOR(toc)
+		if err != nil {
+			return err
+		}
+		contentType = cborMIMEType
+	}
+
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(toc)))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Toc-Format", format)
+	w.WriteHeader(200)
+	_, err = io.Copy(w, bytes.NewReader(toc))
+	return err
+}
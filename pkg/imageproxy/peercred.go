@@ -0,0 +1,34 @@
+package imageproxy
+
+import (
+	"os"
+)
+
+// peerPolicy restricts which local processes may connect to a listening
+// unix socket, and which virtual machines to a vsock one.
+type peerPolicy struct {
+	// uids are the users allowed to connect, besides root
+	uids map[uint32]bool
+	// cids are the vsock context IDs allowed to connect; there are none
+	// by default
+	cids map[uint32]bool
+	// samePidns requires peers to be in the proxy's PID namespace
+	samePidns bool
+}
+
+// newPeerPolicy allows the proxy's own user, root, and allowUids, and
+// the VMs in allowCids.
+func newPeerPolicy(allowUids, allowCids []uint, samePidns bool) *peerPolicy {
+	p := &peerPolicy{
+		uids:      map[uint32]bool{uint32(os.Geteuid()): true},
+		cids:      map[uint32]bool{},
+		samePidns: samePidns,
+	}
+	for _, uid := range allowUids {
+		p.uids[uint32(uid)] = true
+	}
+	for _, cid := range allowCids {
+		p.cids[uint32(cid)] = true
+	}
+	return p
+}
@@ -0,0 +1,70 @@
+package imageproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// check returns an error if the peer of conn isn't allowed to use the
+// proxy, which would let it pull with the proxy's credentials.  Unix
+// socket peers are checked with SO_PEERCRED.  The clients of AF_VSOCK
+// sockets are virtual machines, whose processes don't have credentials on
+// the host, so only their CID can be checked.  Peers on any other kind of
+// socket are rejected.  A nil policy allows any peer.
+func (p *peerPolicy) check(conn net.Conn) error {
+	if p == nil {
+		return nil
+	}
+	switch c := conn.(type) {
+	case *net.UnixConn:
+		return p.checkUnix(c)
+	case *vsockConn:
+		if !p.cids[c.remote.cid] {
+			return fmt.Errorf("rejecting connection from vsock CID %d", c.remote.cid)
+		}
+		return nil
+	}
+	return fmt.Errorf("rejecting connection from %s: can't check peers of %s sockets", conn.RemoteAddr(), conn.RemoteAddr().Network())
+}
+
+// checkUnix checks the credentials of the process connected to uc.
+func (p *peerPolicy) checkUnix(uc *net.UnixConn) error {
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cred *unix.Ucred
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, sockErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("getting peer credentials: %w", sockErr)
+	}
+	if cred.Uid != 0 && !p.uids[cred.Uid] {
+		return fmt.Errorf("rejecting connection from uid %d (pid %d)", cred.Uid, cred.Pid)
+	}
+	if p.samePidns {
+		// The peer's pid is 0 if it isn't visible in our namespace
+		if cred.Pid == 0 {
+			return fmt.Errorf("rejecting connection from uid %d in another PID namespace", cred.Uid)
+		}
+		ours, err := os.Readlink("/proc/self/ns/pid")
+		if err != nil {
+			return err
+		}
+		theirs, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", cred.Pid))
+		if err != nil {
+			return fmt.Errorf("checking PID namespace of pid %d: %w", cred.Pid, err)
+		}
+		if theirs != ours {
+			return fmt.Errorf("rejecting connection from pid %d in another PID namespace", cred.Pid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package imageproxy
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPeerPolicy(t *testing.T) {
+	p := newPeerPolicy(nil, []uint{3}, false)
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(fds[1])
+	f := os.NewFile(uintptr(fds[0]), "socketpair")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := p.check(conn); err != nil {
+		t.Errorf("connection from the proxy's own user rejected: %v", err)
+	}
+
+	if err := p.check(&vsockConn{remote: vsockAddr{cid: 3, port: 1024}}); err != nil {
+		t.Errorf("connection from an allowed CID rejected: %v", err)
+	}
+	for _, cid := range []uint32{unix.VMADDR_CID_HOST, 4} {
+		if err := p.check(&vsockConn{remote: vsockAddr{cid: cid, port: 1024}}); err == nil {
+			t.Errorf("connection from CID %d accepted", cid)
+		}
+	}
+	if err := newPeerPolicy(nil, nil, false).check(&vsockConn{remote: vsockAddr{cid: 3}}); err == nil {
+		t.Errorf("vsock connection accepted without allowed CIDs")
+	}
+
+	// Peers of other kinds of sockets can't be checked
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := p.check(c1); err == nil {
+		t.Errorf("connection on a pipe accepted")
+	}
+}
@@ -0,0 +1,26 @@
+package imageproxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+type pingReply struct {
+	Version string `json:"version"`
+	// Uptime is in seconds
+	Uptime float64 `json:"uptime"`
+}
+
+// implPing handles GET /ping, which lets supervising clients check that
+// the proxy still handles requests.
+func (h *proxyHandler) implPing(w http.ResponseWriter, r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	return writeReply(w, r, pingReply{
+		Version: Version,
+		Uptime:  time.Since(h.started).Seconds(),
+	})
+}
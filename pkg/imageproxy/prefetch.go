@@ -0,0 +1,270 @@
+package imageproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// prefetchedBlob is a blob being (or already) fetched in the background.
+type prefetchedBlob struct {
+	// done is closed once the fields below are set
+	done chan struct{}
+	file *os.File
+	size int64
+	err  error
+
+	// readers counts the open readers of file, which is only closed once
+	// the blob was evicted and they are all closed
+	readers int
+	evicted bool
+}
+
+// prefetchCache holds blobs fetched ahead of time by POST /prefetch,
+// as unlinked temporary files, until the session ends.  Beyond maxSize,
+// the least recently used blobs are dropped, to be fetched again if
+// requested.
+type prefetchCache struct {
+	// maxSize is the total size of the blobs kept (0 for no limit)
+	maxSize int64
+
+	lock  sync.Mutex
+	blobs map[digest.Digest]*prefetchedBlob
+	// used are the fetched blobs, least recently used first, and size
+	// their total size
+	used []digest.Digest
+	size int64
+	// closed is set once the blobs are no longer needed
+	closed bool
+	// ctx is that of the transfers, cancelled by close
+	ctx    context.Context
+	cancel context.CancelFunc
+	// transfers tracks the prefetches in progress, which use the image
+	transfers sync.WaitGroup
+}
+
+// start registers a blob about to be prefetched; it returns nil if
+// the blob is already there or being fetched.
+func (c *prefetchCache) start(d digest.Digest) *prefetchedBlob {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.blobs[d]; ok {
+		return nil
+	}
+	if c.blobs == nil {
+		c.blobs = make(map[digest.Digest]*prefetchedBlob)
+	}
+	b := &prefetchedBlob{done: make(chan struct{})}
+	c.blobs[d] = b
+	return b
+}
+
+// context returns the context of the transfers, which lasts as long as
+// the session unless close is called first.
+func (c *prefetchCache) context() context.Context {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.ctx == nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		if c.closed {
+			c.cancel()
+		}
+	}
+	return c.ctx
+}
+
+// finish records the result of prefetching a blob.  Failed blobs
+// are forgotten, so they can be fetched again.
+func (c *prefetchCache) finish(d digest.Digest, b *prefetchedBlob, file *os.File, size int64, err error) {
+	b.file, b.size, b.err = file, size, err
+	c.lock.Lock()
+	switch {
+	case err != nil:
+		delete(c.blobs, d)
+	case c.closed:
+		delete(c.blobs, d)
+		file.Close()
+	default:
+		c.used = append(c.used, d)
+		c.size += size
+		for c.maxSize > 0 && c.size > c.maxSize {
+			c.evict(c.used[0])
+		}
+	}
+	c.lock.Unlock()
+	close(b.done)
+}
+
+// evict drops the fetched blob d.  c.lock must be held.
+func (c *prefetchCache) evict(d digest.Digest) {
+	b := c.blobs[d]
+	delete(c.blobs, d)
+	c.removeUsed(d)
+	c.size -= b.size
+	b.evicted = true
+	if b.readers == 0 {
+		b.file.Close()
+	}
+}
+
+// removeUsed removes d from c.used.  c.lock must be held.
+func (c *prefetchCache) removeUsed(d digest.Digest) {
+	for i, used := range c.used {
+		if used == d {
+			c.used = append(c.used[:i], c.used[i+1:]...)
+			return
+		}
+	}
+}
+
+// wait waits for the prefetches in progress to complete.
+func (c *prefetchCache) wait() {
+	c.transfers.Wait()
+}
+
+// isClosed returns true once close was called.
+func (c *prefetchCache) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// close stops the transfers and frees the prefetched blobs.  Blobs still
+// being fetched are freed when they complete, and those not started yet
+// are no longer fetched.
+func (c *prefetchCache) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	if c.cancel != nil {
+		c.cancel()
+	}
+	for len(c.used) > 0 {
+		c.evict(c.used[0])
+	}
+}
+
+// get returns a prefetched blob, waiting if it is still being fetched.
+// ok is false if the blob isn't available.
+func (c *prefetchCache) get(ctx context.Context, d digest.Digest) (r io.ReadCloser, size int64, ok bool) {
+	c.lock.Lock()
+	b := c.blobs[d]
+	c.lock.Unlock()
+	if b == nil {
+		return nil, 0, false
+	}
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return nil, 0, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if b.err != nil || b.evicted {
+		return nil, 0, false
+	}
+	b.readers++
+	c.removeUsed(d)
+	c.used = append(c.used, d)
+	// A section reader doesn't share the file offset, so any number
+	// of readers can use the file concurrently.
+	return &prefetchReader{SectionReader: io.NewSectionReader(b.file, 0, b.size), cache: c, blob: b}, b.size, true
+}
+
+// prefetchReader is a seekable io.ReadCloser reading a prefetched blob,
+// whose file stays open until the blob is evicted.
+type prefetchReader struct {
+	*io.SectionReader
+	cache  *prefetchCache
+	blob   *prefetchedBlob
+	closed bool
+}
+
+func (r *prefetchReader) Close() error {
+	r.cache.lock.Lock()
+	defer r.cache.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.blob.readers--
+	if r.blob.evicted && r.blob.readers == 0 {
+		return r.blob.file.Close()
+	}
+	return nil
+}
+
+// prefetch starts fetching blobs into the prefetch cache in the
+// background, with at most parallel transfers at a time.  The blobs are
+// registered before returning, so that requests for them wait for the
+// prefetch instead of fetching them again.  Errors are only logged; a
+// blob which failed to prefetch is fetched again when requested.
+func (h *proxyHandler) prefetch(digests []digest.Digest, parallel int) {
+	pending := make(map[digest.Digest]*prefetchedBlob)
+	var order []digest.Digest
+	for _, d := range digests {
+		if b := h.prefetched.start(d); b != nil {
+			pending[d] = b
+			order = append(order, d)
+		}
+	}
+	// The transfers outlive the request, but not the session
+	ctx := withStats(h.prefetched.context(), h.stats)
+	h.prefetched.transfers.Add(1)
+	go func() {
+		defer h.prefetched.transfers.Done()
+		slots := make(chan struct{}, parallel)
+		for i, d := range order {
+			slots <- struct{}{}
+			if h.prefetched.isClosed() {
+				<-slots
+				// Requests waiting for the blobs not started fetch
+				// them instead
+				for _, d := range order[i:] {
+					h.prefetched.finish(d, pending[d], nil, 0, errShuttingDown)
+				}
+				break
+			}
+			go func(d digest.Digest, b *prefetchedBlob) {
+				defer func() { <-slots }()
+				f, size, err := h.downloadBlob(ctx, d)
+				if err != nil {
+					logrus.WithError(err).WithField("digest", d).Warn("prefetching blob")
+				}
+				h.prefetched.finish(d, b, f, size, err)
+			}(d, pending[d])
+		}
+		// Wait for the last transfers
+		for i := 0; i < parallel; i++ {
+			slots <- struct{}{}
+		}
+	}()
+}
+
+// implPrefetch handles POST /prefetch, which starts fetching blobs in the
+// background and returns immediately.  The request is the same as for
+// POST /layers.  Requests for the blobs (e.g. GET /blobs/<digest>) are
+// then served from the prefetched copy, waiting for it if necessary.
+// This does nothing for images which aren't remote.
+func (h *proxyHandler) implPrefetch(w http.ResponseWriter, r *http.Request) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	digests, parallel, err := h.parseLayersRequest(r)
+	if err != nil {
+		return err
+	}
+	// Local images can be read directly just as fast
+	if remoteBlobs(h.imageSource().Reference()) {
+		h.prefetch(digests, parallel)
+	}
+
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
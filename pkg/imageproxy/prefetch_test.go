@@ -0,0 +1,78 @@
+package imageproxy
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestPrefetchCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	c := &prefetchCache{maxSize: 10}
+	put := func(content string) digest.Digest {
+		d := digest.FromString(content)
+		f, err := os.CreateTemp(t.TempDir(), "blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(content)
+		c.finish(d, c.start(d), f, int64(len(content)), nil)
+		return d
+	}
+
+	first := put("aaaa")
+	second := put("bbbb")
+	r, _, ok := c.get(ctx, first)
+	if !ok {
+		t.Fatal("prefetched blob not found")
+	}
+	// first was used last, so second is dropped
+	third := put("cccc")
+	if _, _, ok := c.get(ctx, second); ok {
+		t.Error("least recently used blob kept")
+	}
+	if r2, _, ok := c.get(ctx, third); !ok {
+		t.Error("last blob dropped")
+	} else {
+		r2.Close()
+	}
+
+	// Evicted blobs stay readable until closed
+	put("dddddddddd")
+	if _, _, ok := c.get(ctx, first); ok {
+		t.Error("blob kept beyond the maximum size")
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "aaaa" {
+		t.Errorf("reading evicted blob: %q, %v", data, err)
+	}
+	r.Close()
+
+	ctx = c.context()
+	c.close()
+	if ctx.Err() == nil {
+		t.Error("transfers not cancelled by close")
+	}
+	if len(c.blobs) != 0 || c.size != 0 {
+		t.Errorf("%d blobs (%d bytes) left after close", len(c.blobs), c.size)
+	}
+}
+
+func TestPrefetchClosed(t *testing.T) {
+	h := newFakeHandler(t, &fakeBackend{src: newFakeImageSource(t)}, Options{})
+	layer := digest.FromString("layer data")
+	h.prefetched.close()
+	h.prefetch([]digest.Digest{layer}, 1)
+	h.prefetched.wait()
+
+	// Blobs which weren't fetched don't keep requests waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, ok := h.prefetched.get(ctx, layer); ok || ctx.Err() != nil {
+		t.Errorf("waited for a blob not prefetched after close: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,47 @@
+package imageproxy
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// requestProgress counts the blob data transferred for a request.  The
+// counters are updated atomically.
+type requestProgress struct {
+	// bytes is the number of bytes of blobs read so far
+	bytes int64
+	// size is the total size of the blobs started so far
+	size int64
+}
+
+// requestProgressKey is the context key for the progress of a request
+// with a Request-Id.
+type requestProgressKey struct{}
+
+type progressReply struct {
+	Bytes int64 `json:"bytes"`
+	Size  int64 `json:"size"`
+}
+
+// implProgress handles GET /progress?id=<Request-Id>, returning how much
+// of the blobs of a request in progress was transferred, so that clients
+// can poll it (e.g. for a progress bar) instead of using POST /events.
+func (h *proxyHandler) implProgress(w http.ResponseWriter, r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		return invalidRequestf("GET /progress requires the Request-Id of a request as ?id=")
+	}
+	progress := h.inflight.progress(id)
+	if progress == nil {
+		return notFoundf("no request with Request-Id %q in progress", id)
+	}
+	return writeReply(w, r, progressReply{
+		Bytes: atomic.LoadInt64(&progress.bytes),
+		Size:  atomic.LoadInt64(&progress.size),
+	})
+}
@@ -0,0 +1,191 @@
+package imageproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+)
+
+// registryCredential is the credential for the images of a registry, or of
+// a namespace of it, from a pull secret.
+type registryCredential struct {
+	// host is the registry (with its port, if any), where "*" matches a
+	// single DNS label, e.g. "*.example.com"
+	host string
+	// path is the repository prefix, e.g. "team/" for "team/app", or empty
+	// for the whole registry
+	path string
+	auth types.DockerAuthConfig
+}
+
+// registryCredentials are ordered from the most to the least specific, the
+// first matching one being used.
+type registryCredentials []registryCredential
+
+// dockerConfigEntry is a registry of the "auths" of a docker config.
+type dockerConfigEntry struct {
+	// Auth is the base64-encoded "username:password"
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// parsePullSecret parses a kubernetes.io/dockerconfigjson pull secret:
+// either its .dockerconfigjson payload, which has the format of
+// ~/.docker/config.json, or the whole Secret object in JSON.
+func parsePullSecret(data []byte) (registryCredentials, error) {
+	var secret struct {
+		Auths map[string]dockerConfigEntry `json:"auths"`
+		// The fields of a Secret object
+		Kind string            `json:"kind"`
+		Type string            `json:"type"`
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return nil, fmt.Errorf("parsing pull secret: %w", err)
+	}
+	if secret.Kind == "Secret" {
+		if secret.Type != "kubernetes.io/dockerconfigjson" {
+			return nil, fmt.Errorf("pull secret has type %q, expected kubernetes.io/dockerconfigjson", secret.Type)
+		}
+		payload, err := base64.StdEncoding.DecodeString(secret.Data[".dockerconfigjson"])
+		if err != nil || len(payload) == 0 {
+			return nil, fmt.Errorf("pull secret has no valid .dockerconfigjson")
+		}
+		return parsePullSecret(payload)
+	}
+	if secret.Auths == nil {
+		return nil, fmt.Errorf("pull secret has no \"auths\"")
+	}
+	var creds registryCredentials
+	for key, entry := range secret.Auths {
+		cred, err := parseCredentialKey(key)
+		if err != nil {
+			return nil, err
+		}
+		cred.auth, err = entry.authConfig()
+		if err != nil {
+			return nil, fmt.Errorf("pull secret for %q: %w", key, err)
+		}
+		creds = append(creds, cred)
+	}
+	sort.Slice(creds, func(i, j int) bool {
+		a, b := creds[i], creds[j]
+		if wa, wb := strings.Contains(a.host, "*"), strings.Contains(b.host, "*"); wa != wb {
+			return wb
+		}
+		if len(a.path) != len(b.path) {
+			return len(a.path) > len(b.path)
+		}
+		return a.host+"/"+a.path < b.host+"/"+b.path
+	})
+	return creds, nil
+}
+
+// parseCredentialKey parses a registry of the "auths" of a docker config,
+// e.g. "registry.example.com", "registry.example.com/team" or
+// "https://index.docker.io/v1/".
+func parseCredentialKey(key string) (registryCredential, error) {
+	k := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	k = strings.TrimSuffix(k, "/")
+	host, repo := k, ""
+	if i := strings.Index(k, "/"); i >= 0 {
+		host, repo = k[:i], k[i+1:]
+	}
+	if host == "" {
+		return registryCredential{}, fmt.Errorf("invalid registry %q in pull secret", key)
+	}
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "docker.io":
+		host = "docker.io"
+		// The API versions of the legacy Docker Hub keys aren't namespaces
+		if repo == "v1" || repo == "v2" {
+			repo = ""
+		}
+	}
+	if _, err := path.Match(host, ""); err != nil {
+		return registryCredential{}, fmt.Errorf("invalid registry %q in pull secret", key)
+	}
+	if repo != "" {
+		repo += "/"
+	}
+	return registryCredential{host: host, path: repo}, nil
+}
+
+func (e dockerConfigEntry) authConfig() (types.DockerAuthConfig, error) {
+	auth := types.DockerAuthConfig{Username: e.Username, Password: e.Password, IdentityToken: e.IdentityToken}
+	if e.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(e.Auth)
+		if err != nil {
+			return auth, fmt.Errorf("invalid \"auth\": %w", err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return auth, fmt.Errorf("invalid \"auth\": not username:password")
+		}
+		auth.Username, auth.Password = parts[0], parts[1]
+	}
+	if auth.Username == "" && auth.IdentityToken == "" {
+		return auth, fmt.Errorf("no credentials")
+	}
+	return auth, nil
+}
+
+// matches returns true if the credential applies to the repository at
+// repo (e.g. "team/app") in the registry host.
+func (c registryCredential) matches(host, repo string) bool {
+	if c.path != "" && !strings.HasPrefix(repo+"/", c.path) {
+		return false
+	}
+	if !strings.Contains(c.host, "*") {
+		return c.host == host
+	}
+	// As for kubelet, each label of the pattern matches one label
+	patternLabels, hostLabels := strings.Split(c.host, "."), strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+	for i := range patternLabels {
+		if ok, _ := path.Match(patternLabels[i], hostLabels[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the credential for named, or nil if the pull secret has
+// none for it.
+func (creds registryCredentials) lookup(named reference.Named) *types.DockerAuthConfig {
+	host, repo := reference.Domain(named), reference.Path(named)
+	for i := range creds {
+		if creds[i].matches(host, repo) {
+			auth := creds[i].auth
+			return &auth
+		}
+	}
+	return nil
+}
+
+// systemContext returns the system context to access ref with: that of the
+// session, with the credentials from the pull secret for docker:// images
+// it has some for.  Credentials given in the SystemContext take precedence.
+func (h *proxyHandler) systemContext(ref types.ImageReference) *types.SystemContext {
+	if len(h.credentials) == 0 || h.sysctx.DockerAuthConfig != nil || ref.Transport().Name() != docker.Transport.Name() || ref.DockerReference() == nil {
+		return h.sysctx
+	}
+	auth := h.credentials.lookup(ref.DockerReference())
+	if auth == nil {
+		return h.sysctx
+	}
+	sys := *h.sysctx
+	sys.DockerAuthConfig = auth
+	return &sys
+}
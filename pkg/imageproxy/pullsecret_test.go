@@ -0,0 +1,96 @@
+package imageproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+)
+
+func TestPullSecret(t *testing.T) {
+	payload := `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("hub:hubpass")) + `"},
+		"registry.example.com": {"username": "all", "password": "p"},
+		"registry.example.com/team": {"username": "team", "password": "p"},
+		"*.mirror.example.com": {"username": "mirror", "password": "p"},
+		"registry.example.com:5000": {"identitytoken": "token"}
+	}}`
+	secret, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"type":       "kubernetes.io/dockerconfigjson",
+		"data":       map[string]string{".dockerconfigjson": base64.StdEncoding.EncodeToString([]byte(payload))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := "oci:" + t.TempDir()
+	for _, data := range []string{payload, string(secret)} {
+		server, err := NewServer("", Options{PullSecret: []byte(data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct {
+			image string
+			user  string
+		}{
+			{"docker://busybox", "hub"},
+			{"docker://registry.example.com/app", "all"},
+			{"docker://registry.example.com/team/app", "team"},
+			{"docker://registry.example.com/teams/app", "all"},
+			{"docker://eu.mirror.example.com/app", "mirror"},
+			{"docker://mirror.example.com/app", ""},
+			{"docker://registry.example.com:5000/app", ""},
+			{"docker://quay.io/app", ""},
+			{local, ""},
+		} {
+			ref, err := alltransports.ParseImageName(c.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var user string
+			if auth := server.h.systemContext(ref).DockerAuthConfig; auth != nil {
+				user = auth.Username
+				if c.image == "docker://registry.example.com:5000/app" && auth.IdentityToken != "token" {
+					t.Errorf("%s: no identity token", c.image)
+				}
+			}
+			if user != c.user {
+				t.Errorf("%s: user %q, expected %q", c.image, user, c.user)
+			}
+		}
+		server.Close()
+	}
+
+	// Explicit credentials take precedence
+	server, err := NewServer("", Options{
+		PullSecret:    []byte(payload),
+		SystemContext: &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "explicit"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := alltransports.ParseImageName("docker://registry.example.com/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := server.h.systemContext(ref).DockerAuthConfig.Username; user != "explicit" {
+		t.Errorf("user %q, expected the explicit one", user)
+	}
+	server.Close()
+
+	for _, invalid := range []string{
+		`not json`,
+		`{}`,
+		`{"auths": {"registry.example.com": {}}}`,
+		`{"auths": {"registry.example.com": {"auth": "bm9jb2xvbg=="}}}`,
+		`{"auths": {"[registry": {"username": "u"}}}`,
+		`{"kind": "Secret", "type": "Opaque", "data": {}}`,
+	} {
+		if _, err := NewServer("", Options{PullSecret: []byte(invalid)}); err == nil {
+			t.Errorf("%s: no error", invalid)
+		}
+	}
+}
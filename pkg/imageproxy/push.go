@@ -0,0 +1,185 @@
+package imageproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// pushedImage describes the manifest written by the client; it is
+// passed to ImageDestination.Commit.
+type pushedImage struct {
+	ref      types.ImageReference
+	manifest []byte
+	mimeType string
+}
+
+func (i *pushedImage) Reference() types.ImageReference {
+	return i.ref
+}
+
+func (i *pushedImage) Manifest(ctx context.Context) ([]byte, string, error) {
+	return i.manifest, i.mimeType, nil
+}
+
+func (i *pushedImage) Signatures(ctx context.Context) ([][]byte, error) {
+	return nil, nil
+}
+
+// closeDestination must be called with destLock held.
+func (h *proxyHandler) closeDestination() error {
+	if h.imgdest == nil {
+		return nil
+	}
+	err := (*h.imgdest).Close()
+	h.imgdest = nil
+	h.pushed = nil
+	return err
+}
+
+func (h *proxyHandler) ensureDestination() error {
+	if h.imgdest == nil {
+		return fmt.Errorf("No destination has been opened")
+	}
+	return nil
+}
+
+// implOpenDestination handles POST /destination; the request body is
+// the image reference to write to, e.g. docker://quay.io/example/foo:latest
+func (h *proxyHandler) implOpenDestination(w http.ResponseWriter, r *http.Request) error {
+	h.destLock.Lock()
+	defer h.destLock.Unlock()
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	destRef, err := h.parseImageRef(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return err
+	}
+	if err := h.closeDestination(); err != nil {
+		return err
+	}
+	imgdest, err := destRef.NewImageDestination(context.Background(), h.systemContext(destRef))
+	if err != nil {
+		return withRegistry(destRef, err)
+	}
+	h.imgdest = &imgdest
+
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(200)
+	return nil
+}
+
+// implPutBlob handles PUT /destination/blobs/<digest>, uploading the request body.
+// Config blobs must be marked with ?config=true.
+func (h *proxyHandler) implPutBlob(w http.ResponseWriter, r *http.Request, digestStr string) error {
+	h.destLock.Lock()
+	if err := h.ensureDestination(); err != nil {
+		h.destLock.Unlock()
+		return err
+	}
+	dest := *h.imgdest
+	// Uploads can proceed in parallel if the destination supports it
+	if dest.HasThreadSafePutBlob() {
+		h.destLock.Unlock()
+	} else {
+		defer h.destLock.Unlock()
+	}
+	isConfig, err := queryBool(r, "config")
+	if err != nil {
+		return err
+	}
+	d, err := digest.Parse(digestStr)
+	if err != nil {
+		return err
+	}
+
+	ctx := r.Context()
+	info, err := dest.PutBlob(ctx, r.Body, types.BlobInfo{Digest: d, Size: r.ContentLength}, h.cache, isConfig)
+	if err != nil {
+		return withRegistry(dest.Reference(), err)
+	}
+	// PutBlob may stop short on error paths; keep the connection in sync
+	_, err = io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Blob-Digest", info.Digest.String())
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// implPutManifest handles PUT /destination/manifest.  All blobs it
+// references must have been uploaded first.
+func (h *proxyHandler) implPutManifest(w http.ResponseWriter, r *http.Request) error {
+	h.destLock.Lock()
+	defer h.destLock.Unlock()
+	if err := h.ensureDestination(); err != nil {
+		return err
+	}
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	mimeType := r.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = manifest.GuessMIMEType(buf)
+	}
+
+	ctx := r.Context()
+	if err := (*h.imgdest).PutManifest(ctx, buf, nil); err != nil {
+		return withRegistry((*h.imgdest).Reference(), err)
+	}
+	h.pushed = &pushedImage{
+		ref:      (*h.imgdest).Reference(),
+		manifest: buf,
+		mimeType: mimeType,
+	}
+	digest, err := manifest.Digest(buf)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Manifest-Digest", digest.String())
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// implCommit handles POST /destination/commit, finalizing the image
+// and closing the destination.
+func (h *proxyHandler) implCommit(w http.ResponseWriter, r *http.Request) error {
+	h.destLock.Lock()
+	defer h.destLock.Unlock()
+	if err := h.ensureDestination(); err != nil {
+		return err
+	}
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	if h.pushed == nil {
+		return fmt.Errorf("A manifest must be written before committing")
+	}
+
+	ctx := r.Context()
+	if err := (*h.imgdest).Commit(ctx, h.pushed); err != nil {
+		return withRegistry((*h.imgdest).Reference(), err)
+	}
+	if err := h.closeDestination(); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(200)
+	return nil
+}
@@ -0,0 +1,295 @@
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// writeReply sends v as a JSON response, or as CBOR if r accepts it.
+func writeReply(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	buf, contentType, err := encodeReply(r, v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(buf)))
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(200)
+	_, err = io.Copy(w, bytes.NewReader(buf))
+	return err
+}
+
+type tagList struct {
+	Repository string   `json:"repository"`
+	Tags       []string `json:"tags"`
+}
+
+// implTags handles GET /tags, listing all tags in the repository of the
+// opened image (or of ?ref=), or the images in an oci: or docker-archive:
+// location.
+func (h *proxyHandler) implTags(w http.ResponseWriter, r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	imgRef, err := h.requestImageRef(r)
+	if err != nil {
+		return err
+	}
+	if imgRef.Transport().Name() != docker.Transport.Name() {
+		path, tags, err := h.localTags(imgRef)
+		if err != nil {
+			return err
+		}
+		return writeReply(w, r, tagList{
+			Repository: path,
+			Tags:       tags,
+		})
+	}
+	ctx, span := h.registrySpan(r.Context(), imgRef, "list tags")
+	tags, err := docker.GetRepositoryTags(ctx, h.systemContext(imgRef), imgRef)
+	endSpan(span, err)
+	if err != nil {
+		return withRegistry(imgRef, err)
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	return writeReply(w, r, tagList{
+		Repository: imgRef.DockerReference().Name(),
+		Tags:       tags,
+	})
+}
+
+// implDigest handles GET /digest, resolving the image (or ?ref=) to its
+// manifest digest, using only a HEAD request for registries.
+func (h *proxyHandler) implDigest(w http.ResponseWriter, r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	imgRef, err := h.requestImageRef(r)
+	if err != nil {
+		return err
+	}
+	d, err := h.manifestDigest(r.Context(), imgRef)
+	if err != nil {
+		return err
+	}
+
+	body := d.String()
+	w.Header().Set("Manifest-Digest", body)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(200)
+	_, err = io.WriteString(w, body)
+	return err
+}
+
+// isNotFound returns true if err indicates the requested image or blob
+// does not exist.  Registry errors unfortunately often only carry the
+// status code in their message.
+func isNotFound(err error) bool {
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	var ec errcode.Error
+	if errors.As(err, &ec) {
+		switch ec.Code {
+		case v2.ErrorCodeManifestUnknown, v2.ErrorCodeBlobUnknown, v2.ErrorCodeNameUnknown:
+			return true
+		}
+	}
+	var ecs errcode.Errors
+	if errors.As(err, &ecs) {
+		for _, e := range ecs {
+			if isNotFound(e) {
+				return true
+			}
+		}
+	}
+	var statusErr *client.UnexpectedHTTPStatusError
+	if errors.As(err, &statusErr) && strings.HasPrefix(statusErr.Status, "404") {
+		return true
+	}
+	var responseErr *client.UnexpectedHTTPResponseError
+	if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "StatusCode: 404") || strings.Contains(msg, "404 (Not Found)") ||
+		strings.Contains(msg, "no descriptor found for reference") // oci:
+}
+
+// isRateLimited returns true if err means the registry rejected a request
+// with 429 Too Many Requests.
+func isRateLimited(err error) bool {
+	if errors.Is(err, docker.ErrTooManyRequests) {
+		return true
+	}
+	var ec errcode.Error
+	if errors.As(err, &ec) && ec.Code == errcode.ErrorCodeTooManyRequests {
+		return true
+	}
+	var ecs errcode.Errors
+	if errors.As(err, &ecs) {
+		for _, e := range ecs {
+			if isRateLimited(e) {
+				return true
+			}
+		}
+	}
+	var statusErr *client.UnexpectedHTTPStatusError
+	if errors.As(err, &statusErr) && strings.HasPrefix(statusErr.Status, "429") {
+		return true
+	}
+	var responseErr *client.UnexpectedHTTPResponseError
+	if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "StatusCode: 429") || strings.Contains(msg, "429 (Too Many Requests)")
+}
+
+// registryRetryAfter returns the delay the registry asked for in the
+// Retry-After header of its 429 response, if err carries it.
+// containers/image v5.16 honors that header in its own retries but only
+// returns docker.ErrTooManyRequests, so for now this only applies to
+// errors implementing RetryAfter.
+func registryRetryAfter(err error) (time.Duration, bool) {
+	var ra interface{ RetryAfter() time.Duration }
+	if errors.As(err, &ra) && ra.RetryAfter() > 0 {
+		return ra.RetryAfter(), true
+	}
+	return 0, false
+}
+
+// implManifestExists handles HEAD /manifest, returning 200 (with the
+// digest in Manifest-Digest) if the image (or ?ref=) exists, and 404 if
+// not.  For docker:// references this is a single HEAD request to the
+// registry.
+func (h *proxyHandler) implManifestExists(w http.ResponseWriter, r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	imgRef, err := h.requestImageRef(r)
+	if err != nil {
+		return err
+	}
+
+	d, err := h.manifestDigest(r.Context(), imgRef)
+	if err != nil {
+		if isNotFound(err) {
+			w.WriteHeader(http.StatusNotFound)
+			return nil
+		}
+		return err
+	}
+
+	w.Header().Set("Manifest-Digest", d.String())
+	w.WriteHeader(200)
+	return nil
+}
+
+// implBlobExists handles HEAD /blobs/<digest>, returning 200 with the
+// blob size in Content-Length if it exists, and 404 if not.  None of the
+// blob is fetched: registries are asked with a HEAD request.
+func (h *proxyHandler) implBlobExists(w http.ResponseWriter, r *http.Request, digestStr string) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	d, err := digest.Parse(digestStr)
+	if err != nil {
+		return err
+	}
+
+	exists, blobSize, err := h.blobExists(r.Context(), d)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	if blobSize >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", blobSize))
+	}
+	w.WriteHeader(200)
+	return nil
+}
+
+// blobExists returns whether the opened image has the blob d, and its
+// size (-1 if unknown).  Blobs of docker:// images which aren't in the blob
+// cache are checked with a HEAD request, the way containers/image checks
+// whether blobs need pushing; other image sources are cheap to open.
+func (h *proxyHandler) blobExists(ctx context.Context, d digest.Digest) (bool, int64, error) {
+	if h.blobCache != nil {
+		if f, size, ok := h.blobCache.open(d); ok {
+			f.Close()
+			return true, size, nil
+		}
+	}
+	ref := h.imageSource().Reference()
+	// The config of a converted schema1 image was generated here
+	generated := h.convertedSchema1() != nil && d == h.loadedImage().ConfigInfo().Digest
+	if remoteBlobs(ref) && !h.offline && !generated {
+		exists, size, err := h.registryBlobExists(ctx, ref, d)
+		if err == nil {
+			return exists, size, nil
+		}
+		// Registries may refuse the push access asked for along the way
+		logrus.WithError(err).WithField("digest", d).Debug("checking for the blob with a HEAD request; opening it instead")
+	}
+	blobr, size, err := h.getBlob(ctx, types.BlobInfo{Digest: d, Size: -1})
+	if err != nil {
+		if isNotFound(err) {
+			return false, -1, nil
+		}
+		return false, -1, err
+	}
+	blobr.Close()
+	return true, size, nil
+}
+
+// registryBlobExists sends a HEAD request for the blob d to the registry
+// of the docker:// image ref.
+func (h *proxyHandler) registryBlobExists(ctx context.Context, ref types.ImageReference, d digest.Digest) (bool, int64, error) {
+	dest, err := ref.NewImageDestination(ctx, h.systemContext(ref))
+	if err != nil {
+		return false, -1, err
+	}
+	defer dest.Close()
+	var exists bool
+	var info types.BlobInfo
+	cancel, err := h.withResponseTimeout(ctx, func(ctx context.Context) error {
+		var err error
+		exists, info, err = dest.TryReusingBlob(ctx, types.BlobInfo{Digest: d, Size: -1}, none.NoCache, false)
+		return err
+	})
+	defer cancel()
+	if err != nil || !exists {
+		return false, -1, err
+	}
+	return true, info.Size, nil
+}
@@ -0,0 +1,100 @@
+//go:build go1.18
+// +build go1.18
+
+package imageproxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cgwalters/container-image-proxy/pkg/imageproxy"
+)
+
+// readOnlyRequest returns true for the requests which may be fuzzed: the
+// others write to destinations, or stop the server.
+func readOnlyRequest(req *http.Request) bool {
+	// The image given could be anywhere
+	if _, ok := req.URL.Query()["ref"]; ok {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		switch req.URL.Path {
+		case "/layers", "/prefetch", "/cancel":
+			return true
+		}
+	}
+	return false
+}
+
+// FuzzRequest sends a request to a server for the fixture, checking that
+// it gets a well-formed response.
+func FuzzRequest(f *testing.F) {
+	fx := newFixture(f)
+	for _, seed := range []string{
+		"GET /manifest HTTP/1.1\r\nHost: proxy\r\n\r\n",
+		"HEAD /manifest HTTP/1.1\r\nHost: proxy\r\nAccept: application/cbor\r\n\r\n",
+		"GET /blobs/" + fx.layer.String() + "?decompress=1&diffid=1 HTTP/1.1\r\nHost: proxy\r\nRequest-Id: 1\r\n\r\n",
+		"GET /blobs/" + fx.config.String() + " HTTP/1.1\r\nHost: proxy\r\nRange: bytes=1-3\r\n\r\n",
+		"GET /layers HTTP/1.1\r\nHost: proxy\r\n\r\n",
+		"POST /layers?parallel=2 HTTP/1.1\r\nHost: proxy\r\nContent-Length: 75\r\n\r\n[\"" + fx.layer.String() + "\"]",
+		"POST /prefetch HTTP/1.1\r\nHost: proxy\r\nTransfer-Encoding: chunked\r\n\r\n2\r\n[]\r\n0\r\n\r\n",
+		"POST /cancel HTTP/1.1\r\nHost: proxy\r\nContent-Length: 1\r\n\r\n7",
+		"GET /inspect HTTP/1.1\r\nHost: proxy\r\n\r\n",
+		"GET /export/oci-archive?name=x HTTP/1.1\r\nHost: proxy\r\n\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	server, err := imageproxy.NewServer("oci:"+fx.writeOCILayout(f), imageproxy.Options{
+		SystemContext: systemContext(f),
+		Offline:       true,
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer server.Close()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Only the first request is sent, if it may be
+		in := bytes.NewReader(data)
+		br := bufio.NewReader(in)
+		req, err := http.ReadRequest(br)
+		if err != nil || !readOnlyRequest(req) {
+			return
+		}
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			return
+		}
+		sent := data[:len(data)-in.Len()-br.Buffered()]
+
+		ours, theirs := socketpair(t)
+		defer ours.Close()
+		served := make(chan struct{})
+		go func() {
+			server.Serve(theirs)
+			theirs.Close()
+			close(served)
+		}()
+		defer func() { <-served }()
+		ours.SetDeadline(time.Now().Add(30 * time.Second))
+		if _, err := ours.Write(sent); err != nil {
+			t.Fatal(err)
+		}
+		ours.CloseWrite()
+
+		resp, err := http.ReadResponse(bufio.NewReader(ours), req)
+		if err != nil {
+			t.Fatalf("reading the response to %q: %v", sent, err)
+		}
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			t.Fatalf("reading the response to %q: %v", sent, err)
+		}
+	})
+}
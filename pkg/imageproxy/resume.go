@@ -0,0 +1,168 @@
+package imageproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// resumableBlob reads a blob, transparently reopening it at the current
+// offset with a ranged request if the stream breaks.  Digest verification
+// is left to the caller, which sees one continuous stream.
+type resumableBlob struct {
+	ctx     context.Context
+	src     types.ImageSource
+	info    types.BlobInfo
+	h       *proxyHandler
+	size    int64
+	offset  int64
+	resumes int
+	r       io.ReadCloser
+	// reopened is the image source opened again by reopenSource, if any
+	reopened types.ImageSource
+}
+
+func (b *resumableBlob) Read(p []byte) (int, error) {
+	for {
+		n, err := b.r.Read(p)
+		b.offset += int64(n)
+		if err == io.EOF && b.offset < b.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if rerr := b.resume(err); rerr != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume reopens the blob at the current offset after err.
+func (b *resumableBlob) resume(err error) error {
+	retry := &b.h.retry
+	if b.resumes >= retry.attempts || !isRetryable(err) || b.ctx.Err() != nil {
+		return err
+	}
+	delay := retry.backoff(b.resumes)
+	b.resumes++
+	attempt := fmt.Sprintf("%d/%d", b.resumes, retry.attempts+1)
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"digest":  b.info.Digest,
+		"offset":  b.offset,
+		"attempt": attempt,
+	}).Warnf("fetching blob failed, resuming in %s", delay)
+	emitEvent(b.ctx, progressEvent{Event: "resume", Digest: b.info.Digest, Bytes: b.offset, Attempt: attempt, Delay: delay.Milliseconds(), Error: err.Error()})
+	if err := sleepContext(b.ctx, delay); err != nil {
+		return err
+	}
+	var r io.ReadCloser
+	cancel, err := b.h.withResponseTimeout(b.ctx, func(ctx context.Context) error {
+		var err error
+		r, err = b.open(ctx)
+		if err != nil && isUnauthorized(err) && b.reopened == nil {
+			logrus.WithError(err).WithField("digest", b.info.Digest).Warn("resuming blob rejected, opening the image again for a new token")
+			if err := b.reopenSource(ctx); err != nil {
+				return err
+			}
+			r, err = b.open(ctx)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	b.r.Close()
+	b.r = &cancelOnClose{ReadCloser: r, cancel: cancel}
+	return nil
+}
+
+// open returns a stream of the blob from the current offset.
+func (b *resumableBlob) open(ctx context.Context) (io.ReadCloser, error) {
+	if len(b.info.URLs) > 0 {
+		return b.reopen(ctx)
+	}
+	return openBlobAt(ctx, b.src, b.info, uint64(b.offset), uint64(b.size-b.offset))
+}
+
+// reopenSource opens the image again to fetch the rest of the blob.
+// containers/image keeps using the token it got for an image source until
+// it expires according to the token server, so a token the registry
+// stopped accepting earlier (e.g. because the clocks disagree, or it was
+// revoked) is only replaced by opening a new source.
+func (b *resumableBlob) reopenSource(ctx context.Context) error {
+	src, err := b.h.openRegistrySource(ctx, b.src.Reference())
+	if err != nil {
+		return err
+	}
+	b.src = src
+	b.reopened = src
+	return nil
+}
+
+// reopen fetches the blob again from the start, skipping what was read
+// already, for foreign layers fetched from their URLs, which can't be
+// requested at an offset.
+func (b *resumableBlob) reopen(ctx context.Context) (io.ReadCloser, error) {
+	r, _, err := b.src.GetBlob(ctx, b.info, b.h.cache)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, b.offset); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (b *resumableBlob) Close() error {
+	err := b.r.Close()
+	if b.reopened != nil {
+		b.reopened.Close()
+	}
+	return err
+}
+
+// chunkStream is the single stream returned by a GetBlobAt call.
+type chunkStream struct {
+	io.ReadCloser
+	streams chan io.ReadCloser
+	errs    chan error
+}
+
+func (c *chunkStream) Close() error {
+	drainChunks(c.streams, c.errs)
+	return c.ReadCloser.Close()
+}
+
+// openBlobAt returns a stream of length bytes of a blob, starting at offset.
+func openBlobAt(ctx context.Context, src types.ImageSource, info types.BlobInfo, offset, length uint64) (io.ReadCloser, error) {
+	streams, errs, err := getBlobAt(ctx, src, info, []blobChunk{{Offset: offset, Length: length}})
+	if err != nil {
+		return nil, err
+	}
+	// errs is set to nil once closed, so keep the original for draining
+	allErrs := errs
+	for {
+		select {
+		case r, ok := <-streams:
+			if !ok {
+				return nil, fmt.Errorf("no data returned for blob %s at offset %d", info.Digest, offset)
+			}
+			return &chunkStream{ReadCloser: r, streams: streams, errs: allErrs}, nil
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			drainChunks(streams, allErrs)
+			return nil, err
+		}
+	}
+}
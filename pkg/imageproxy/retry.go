@@ -0,0 +1,92 @@
+package imageproxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// retryPolicy describes how operations talking to the image source
+// are retried after a failure.
+type retryPolicy struct {
+	// attempts is the number of retries after the first failure
+	attempts int
+	// delay is the initial delay, doubled after each retry
+	delay time.Duration
+	// rateLimited enables retrying requests rejected with 429 Too Many
+	// Requests.  containers/image already retries those a few times
+	// itself (honoring Retry-After), so by default they are returned to
+	// the client right away.
+	rateLimited bool
+	// rateLimitDelay is the minimum delay after a 429, and the delay
+	// suggested to clients in Retry-After, unless the registry sent its
+	// own.
+	rateLimitDelay time.Duration
+}
+
+// rateLimitWait returns how long to wait after err, a 429: what the
+// registry asked for if known, rateLimitDelay otherwise.
+func (p *retryPolicy) rateLimitWait(err error) time.Duration {
+	if d, ok := registryRetryAfter(err); ok {
+		return d
+	}
+	return p.rateLimitDelay
+}
+
+// backoff returns the delay before retry number i (starting at 0), with
+// up to 50% of random jitter added so that many clients retrying at
+// once don't stay in lockstep.
+func (p *retryPolicy) backoff(i int) time.Duration {
+	d := p.delay << uint(i)
+	if d <= 0 {
+		return 0
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// do calls fn until it succeeds, it fails with an error isRetryable
+// rejects, or the retry attempts are exhausted.
+func (p *retryPolicy) do(ctx context.Context, what string, fn func() error) error {
+	var err error
+	for i := 0; ; i++ {
+		err = fn()
+		if err == nil || i >= p.attempts {
+			return err
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		delay := p.backoff(i)
+		if isRateLimited(err) {
+			if !p.rateLimited {
+				return err
+			}
+			if wait := p.rateLimitWait(err); delay < wait {
+				delay = wait
+			}
+		}
+		attempt := fmt.Sprintf("%d/%d", i+1, p.attempts+1)
+		logrus.WithError(err).WithField("attempt", attempt).Warnf("%s failed, retrying in %s", what, delay)
+		emitEvent(ctx, progressEvent{Event: "retry", Operation: what, Attempt: attempt, Delay: delay.Milliseconds(), Error: err.Error()})
+		if sleepContext(ctx, delay) != nil {
+			return err
+		}
+		metricRetries.Inc()
+		countRetry(ctx)
+	}
+}
+
+// sleepContext waits for d, or until ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,138 @@
+package imageproxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// maxTarHeaderSize bounds the names and PAX records of a tar entry of a
+// sanitized layer; the tar format doesn't limit them, and clients
+// extracting layers may not expect long ones.
+const maxTarHeaderSize = 64 * 1024
+
+// unsafeLayerError is returned when a sanitized layer has an entry which
+// could escape or damage the directory it is extracted to.
+type unsafeLayerError struct {
+	entry  string
+	reason string
+}
+
+func (e *unsafeLayerError) Error() string {
+	if e.entry == "" {
+		return fmt.Sprintf("unsafe layer: %s", e.reason)
+	}
+	return fmt.Sprintf("unsafe layer entry %q: %s", e.entry, e.reason)
+}
+
+// isUnsafeLayer returns true if err rejected a sanitized layer.
+func isUnsafeLayer(err error) bool {
+	var unsafe *unsafeLayerError
+	return errors.As(err, &unsafe)
+}
+
+// hasDotDot returns true if p has a ".." component.
+func hasDotDot(p string) bool {
+	for _, c := range strings.Split(p, "/") {
+		if c == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTarEntry returns an unsafeLayerError if hdr shouldn't be extracted
+// by a client applying layers directly: absolute paths, paths (or hard
+// link targets) going up with "..", device nodes (other than overlayfs
+// whiteouts) and oversized headers.
+// Symbolic links are left to the client, as absolute ones are common in
+// images and only resolved within the rootfs.
+func checkTarEntry(hdr *tar.Header) error {
+	size := len(hdr.Name) + len(hdr.Linkname)
+	for k, v := range hdr.PAXRecords {
+		size += len(k) + len(v)
+	}
+	if size > maxTarHeaderSize {
+		name := hdr.Name
+		if len(name) > 256 {
+			name = name[:256] + "..."
+		}
+		return &unsafeLayerError{entry: name, reason: fmt.Sprintf("header of %d bytes, more than the maximum of %d", size, maxTarHeaderSize)}
+	}
+	switch {
+	case path.IsAbs(hdr.Name):
+		return &unsafeLayerError{entry: hdr.Name, reason: "absolute path"}
+	case hasDotDot(hdr.Name):
+		return &unsafeLayerError{entry: hdr.Name, reason: "path with .."}
+	case hdr.Typeflag == tar.TypeLink && (path.IsAbs(hdr.Linkname) || hasDotDot(hdr.Linkname)):
+		return &unsafeLayerError{entry: hdr.Name, reason: fmt.Sprintf("hard link to %q outside of the layer", hdr.Linkname)}
+	// Character devices 0/0 are overlayfs whiteouts
+	case hdr.Typeflag == tar.TypeBlock || (hdr.Typeflag == tar.TypeChar && (hdr.Devmajor != 0 || hdr.Devminor != 0)):
+		return &unsafeLayerError{entry: hdr.Name, reason: "device node"}
+	}
+	return nil
+}
+
+// nextSanitizedEntry returns the next entry of tr, or io.EOF at the end,
+// failing with an unsafeLayerError if it is unsafe or malformed.
+func nextSanitizedEntry(tr *tar.Reader) (*tar.Header, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		if errors.Is(err, tar.ErrHeader) {
+			return nil, &unsafeLayerError{reason: err.Error()}
+		}
+		return nil, err
+	}
+	if err := checkTarEntry(hdr); err != nil {
+		return nil, err
+	}
+	return hdr, nil
+}
+
+// copySanitizedTar copies the tar stream r to w unchanged, checking each
+// entry with checkTarEntry before writing it, so that the client never
+// gets the header of an unsafe entry.  Only the data of the current
+// entry is buffered.
+func copySanitizedTar(w io.Writer, r io.Reader) error {
+	var pending bytes.Buffer
+	tr := tar.NewReader(io.TeeReader(r, &pending))
+	flush := func() error {
+		_, err := pending.WriteTo(w)
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		_, err := nextSanitizedEntry(tr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		for {
+			_, err := tr.Read(buf)
+			if ferr := flush(); ferr != nil {
+				return ferr
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	// The padding after the end of the archive
+	_, err := io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,79 @@
+package imageproxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCopySanitizedTar(t *testing.T) {
+	makeTar := func(hdrs ...*tar.Header) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			if hdr.Typeflag == tar.TypeReg {
+				hdr.Size = int64(len(hdr.Name))
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := tw.Write([]byte(hdr.Name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	safe := makeTar(
+		&tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "usr/bin/true", Typeflag: tar.TypeReg, Mode: 0755},
+		&tar.Header{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "/usr/bin"},
+		&tar.Header{Name: "usr/bin/..true", Typeflag: tar.TypeLink, Linkname: "usr/bin/true"},
+		&tar.Header{Name: "run/fifo", Typeflag: tar.TypeFifo},
+		&tar.Header{Name: "usr/lib", Typeflag: tar.TypeChar},
+	)
+	var out bytes.Buffer
+	if err := copySanitizedTar(&out, bytes.NewReader(safe)); err != nil {
+		t.Fatalf("safe layer: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), safe) {
+		t.Errorf("safe layer changed: %d bytes instead of %d", out.Len(), len(safe))
+	}
+
+	for name, hdr := range map[string]*tar.Header{
+		"absolute path":  {Name: "/etc/passwd", Typeflag: tar.TypeReg},
+		"path with ..":   {Name: "usr/../../etc/passwd", Typeflag: tar.TypeReg},
+		"hard link":      {Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"},
+		"device node":    {Name: "dev/sda", Typeflag: tar.TypeBlock, Devmajor: 8},
+		"header of":      {Name: strings.Repeat("a/", maxTarHeaderSize), Typeflag: tar.TypeDir},
+		"invalid header": nil,
+	} {
+		var layer []byte
+		if hdr != nil {
+			layer = makeTar(&tar.Header{Name: "ok", Typeflag: tar.TypeReg}, hdr)
+		} else {
+			// A corrupted header after the first entry
+			layer = makeTar(&tar.Header{Name: "ok", Typeflag: tar.TypeReg})
+			layer = append(layer[:1024], bytes.Repeat([]byte{'x'}, 512)...)
+		}
+		out.Reset()
+		err := copySanitizedTar(&out, bytes.NewReader(layer))
+		if err == nil || errorCode(err) != errorCodeUnsafe {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if hdr != nil && !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: %v", name, err)
+		}
+		// The header of the unsafe entry is never written
+		if out.Len() > 1024 {
+			t.Errorf("%s: %d bytes written", name, out.Len())
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package imageproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// sourceManifest is a manifest as served by the image source.
+type sourceManifest struct {
+	raw      []byte
+	mimeType string
+}
+
+// convertSchema1 converts img to an OCI image if it has a docker schema1
+// manifest, returning that manifest (or nil if img was left as is) and
+// the converted image.  Schema1 manifests have no config, and don't
+// record the sizes and uncompressed digests (diffIDs) of layers which
+// the generated one needs, so all layers are read here to compute them;
+// the converted image serves the generated config as a blob.
+func (h *proxyHandler) convertSchema1(ctx context.Context, src types.ImageSource, img types.Image) (*sourceManifest, types.Image, error) {
+	rawManifest, mimeType, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mimeType != manifest.DockerV2Schema1MediaType && mimeType != manifest.DockerV2Schema1SignedMediaType {
+		return nil, img, nil
+	}
+	m, err := manifest.Schema1FromManifest(rawManifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	logrus.WithField("image", h.imageref).Debug("converting docker schema1 manifest, reading all layers")
+
+	// Indexed like the layers of the converted image, including empty
+	// ones, which conversion skips
+	layers := m.LayerInfos()
+	infos := make([]types.BlobInfo, len(layers))
+	diffIDs := make([]digest.Digest, len(layers))
+	read := make(map[digest.Digest]int)
+	for i, layer := range layers {
+		if layer.EmptyLayer {
+			continue
+		}
+		if j, ok := read[layer.Digest]; ok {
+			infos[i], diffIDs[i] = infos[j], diffIDs[j]
+			continue
+		}
+		size, diffID, err := h.readSchema1Layer(ctx, src, layer.BlobInfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("converting schema1 manifest: %w", err)
+		}
+		infos[i] = types.BlobInfo{Digest: layer.Digest, Size: size}
+		diffIDs[i] = diffID
+		read[layer.Digest] = i
+	}
+	converted, err := img.UpdatedImage(ctx, types.ManifestUpdateOptions{
+		ManifestMIMEType: imgspecv1.MediaTypeImageManifest,
+		InformationOnly: types.ManifestUpdateInformation{
+			LayerInfos:   infos,
+			LayerDiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("converting schema1 manifest: %w", err)
+	}
+	return &sourceManifest{raw: rawManifest, mimeType: mimeType}, converted, nil
+}
+
+// readSchema1Layer reads a layer of a schema1 image, returning its size
+// and diffID.
+func (h *proxyHandler) readSchema1Layer(ctx context.Context, src types.ImageSource, info types.BlobInfo) (int64, digest.Digest, error) {
+	var blob io.ReadCloser
+	var cancel context.CancelFunc
+	err := h.retry.do(ctx, "fetching blob "+info.Digest.String(), func() error {
+		var err error
+		cancel, err = h.withResponseTimeout(ctx, func(ctx context.Context) error {
+			var err error
+			blob, _, err = src.GetBlob(ctx, info, h.cache)
+			return err
+		})
+		return err
+	})
+	if err != nil {
+		return 0, "", withRegistry(src.Reference(), err)
+	}
+	defer cancel()
+	defer blob.Close()
+
+	verifier := info.Digest.Verifier()
+	counter := &countingReader{r: io.TeeReader(blob, verifier)}
+	decompressor, stream, err := compression.DetectCompression(counter)
+	if err != nil {
+		return 0, "", err
+	}
+	if decompressor != nil {
+		rc, err := decompressor(stream)
+		if err != nil {
+			return 0, "", err
+		}
+		defer rc.Close()
+		stream = rc
+	}
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), stream); err != nil {
+		return 0, "", err
+	}
+	// Read what the decompressor left, so that the blob is verified
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return 0, "", err
+	}
+	if !verifier.Verified() {
+		return 0, "", fmt.Errorf("Corrupted blob, expecting %s", info.Digest.String())
+	}
+	return counter.n, digester.Digest(), nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,348 @@
+package imageproxy
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/containers/image/v5/pkg/blobinfocache"
+	"github.com/containers/image/v5/types"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Options configures a Server.  The zero value has the same defaults as
+// container-image-proxy, except that no kernel buffer size is requested.
+type Options struct {
+	// SystemContext configures containers/image; nil for the defaults
+	SystemContext *types.SystemContext
+	// PullSecret is a kubernetes.io/dockerconfigjson pull secret (its
+	// .dockerconfigjson payload, or the Secret object in JSON), whose
+	// credentials are used for the registries (or namespaces) it lists;
+	// the auth files are used for the others.
+	PullSecret []byte
+	// AuthFallback retries opening docker:// images when the registry
+	// denies access: "anonymous" retries without the credentials if they
+	// are rejected, and "credentials" tries anonymously first, then with
+	// the credentials.  Empty for no fallback.
+	AuthFallback string
+	// UserAgentSuffix is appended, after a space, to the User-Agent sent
+	// to registries: SystemContext.DockerRegistryUserAgent if set, else
+	// ostree-container-backend/Version.  Products embedding the proxy can
+	// identify themselves with it, e.g. "bootc/1.1".
+	UserAgentSuffix string
+
+	// Retries is the number of times to retry failed manifest and blob
+	// fetches, after RetryDelay (default 1s), doubled (with jitter) for
+	// each subsequent one.
+	Retries    int
+	RetryDelay time.Duration
+	// RetryRateLimited also retries fetches rejected by the registry with
+	// 429 Too Many Requests, after at least RateLimitDelay (default 30s)
+	// or the registry's Retry-After if known.  The same delay is suggested
+	// to clients in the Retry-After of 429 replies.
+	RetryRateLimited bool
+	RateLimitDelay   time.Duration
+
+	// RequestTimeout bounds handling a request, including streaming the
+	// response; ResponseTimeout bounds waiting for the registry to
+	// respond to each operation; WriteTimeout drops a connection if
+	// writing a response to it makes no progress.  0 means no limit.
+	RequestTimeout  time.Duration
+	ResponseTimeout time.Duration
+	WriteTimeout    time.Duration
+
+	// MaxBandwidth limits the combined rate of blob transfers, in bytes
+	// per second (0 for no limit).
+	MaxBandwidth int64
+	// MaxStreams is the maximum number of requests streaming blob data at
+	// once (0 for no limit).
+	MaxStreams int
+	// BufferSize is the kernel buffer size to request for sending
+	// responses (0 keeps the system default).
+	BufferSize int
+	// MaxManifestSize is the largest manifest or manifest list accepted,
+	// in bytes (default 4MiB, the limit of containers/image for
+	// registries, which can't be raised).
+	MaxManifestSize int64
+	// DecryptionKeys are private keys (PEM or DER encoded) with which
+	// layers encrypted with ocicrypt are decrypted as they are served.
+	DecryptionKeys [][]byte
+
+	// BlobCacheDir caches blobs in this directory, up to BlobCacheSize
+	// bytes (default 10GB).
+	BlobCacheDir  string
+	BlobCacheSize int64
+	// PrefetchSize bounds the blobs of a session kept in temporary files
+	// by POST /prefetch (default 2GB); the least recently used are
+	// dropped beyond it.
+	PrefetchSize int64
+	// Offline refuses network access; docker:// images are served from
+	// the blob cache.
+	Offline bool
+	// TrustedTransports are the names of transports, such as "oci" or
+	// "dir", whose blobs are served without verifying their digest, for
+	// local images which were verified when they were written.
+	TrustedTransports []string
+	// AuditLog appends a record of the resolved image and of each blob
+	// served to this file.
+	AuditLog string
+	// TracerProvider traces each request, loading the image, fetching
+	// blobs and the calls made to registries, if set (see
+	// NewTracerProvider).
+	TracerProvider trace.TracerProvider
+
+	// IdleTimeout closes the channel returned by Server.Idle once no
+	// request was handled for this long (0 to never close it).
+	IdleTimeout time.Duration
+	// AllowUIDs also accepts connections on listeners from these users
+	// (the proxy's own user and root always are).  SamePidns rejects
+	// processes in other PID namespaces.  AllowCIDs are the vsock context
+	// IDs of the VMs (or 2 for the host) accepted on vsock listeners; any
+	// other vsock peer is rejected.
+	AllowUIDs []uint
+	SamePidns bool
+	AllowCIDs []uint
+}
+
+// Protocol is what ServeListener serves on each connection.
+type Protocol int
+
+const (
+	// ProtocolHTTP is the HTTP/1.1 protocol described in the README.
+	ProtocolHTTP Protocol = iota
+	// ProtocolVarlink is the org.containers.imageproxy varlink interface.
+	ProtocolVarlink
+	// ProtocolGRPC is the imageproxy.v1.ImageProxy gRPC service.
+	ProtocolGRPC
+)
+
+// Server serves an image (if any) to clients, in-process.  It may serve
+// several connections concurrently.
+type Server struct {
+	h *proxyHandler
+}
+
+// NewServer returns a Server for image, a containers/image reference
+// like docker://quay.io/example/image:latest; it is only opened once a
+// client asks for it.  Without an image, clients must pass ?ref= to each
+// request.
+func NewServer(image string, opts Options) (*Server, error) {
+	if opts.Retries < 0 {
+		return nil, fmt.Errorf("Retries must not be negative")
+	}
+	if opts.MaxStreams < 0 {
+		return nil, fmt.Errorf("MaxStreams must not be negative")
+	}
+	if opts.MaxManifestSize < 0 {
+		return nil, fmt.Errorf("MaxManifestSize must not be negative")
+	}
+	if opts.MaxManifestSize == 0 {
+		opts.MaxManifestSize = defaultMaxManifestSize
+	}
+	var decryptionKeys []crypto.PrivateKey
+	for i, data := range opts.DecryptionKeys {
+		key, err := parseDecryptionKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("decryption key %d: %w", i+1, err)
+		}
+		decryptionKeys = append(decryptionKeys, key)
+	}
+	decryptConfig, err := newDecryptConfig(decryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	var credentials registryCredentials
+	if opts.PullSecret != nil {
+		var err error
+		credentials, err = parsePullSecret(opts.PullSecret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch opts.AuthFallback {
+	case "", authFallbackAnonymous, authFallbackCredentials:
+	default:
+		return nil, fmt.Errorf("invalid AuthFallback %q (expected %q or %q)", opts.AuthFallback, authFallbackAnonymous, authFallbackCredentials)
+	}
+	trustedTransports, err := parseTrustedTransports(opts.TrustedTransports)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxBandwidth < 0 {
+		return nil, fmt.Errorf("MaxBandwidth must not be negative")
+	}
+	if opts.IdleTimeout < 0 {
+		return nil, fmt.Errorf("IdleTimeout must not be negative")
+	}
+	sysctx := &types.SystemContext{}
+	if opts.SystemContext != nil {
+		copied := *opts.SystemContext
+		sysctx = &copied
+	}
+	if sysctx.DockerRegistryUserAgent == "" {
+		sysctx.DockerRegistryUserAgent = defaultUserAgent
+	}
+	if opts.UserAgentSuffix != "" {
+		sysctx.DockerRegistryUserAgent += " " + opts.UserAgentSuffix
+	}
+	if strings.IndexFunc(sysctx.DockerRegistryUserAgent, unicode.IsControl) >= 0 {
+		return nil, fmt.Errorf("invalid User-Agent %q", sysctx.DockerRegistryUserAgent)
+	}
+	if opts.RetryDelay == 0 {
+		opts.RetryDelay = time.Second
+	}
+	if opts.RateLimitDelay == 0 {
+		opts.RateLimitDelay = 30 * time.Second
+	}
+	if opts.BlobCacheSize == 0 {
+		opts.BlobCacheSize = 10 * 1000 * 1000 * 1000
+	}
+	if opts.PrefetchSize < 0 {
+		return nil, fmt.Errorf("PrefetchSize must not be negative")
+	}
+	if opts.PrefetchSize == 0 {
+		opts.PrefetchSize = 2 * 1000 * 1000 * 1000
+	}
+
+	h := &proxyHandler{
+		imageref: image,
+		sysctx:   sysctx,
+		cache:    blobinfocache.DefaultCache(sysctx),
+		backend:  transportBackend{},
+		retry: retryPolicy{
+			attempts:       opts.Retries,
+			delay:          opts.RetryDelay,
+			rateLimited:    opts.RetryRateLimited,
+			rateLimitDelay: opts.RateLimitDelay,
+		},
+		timeouts: timeouts{
+			request:  opts.RequestTimeout,
+			response: opts.ResponseTimeout,
+			write:    opts.WriteTimeout,
+		},
+		offline:           opts.Offline,
+		trustedTransports: trustedTransports,
+		credentials:       credentials,
+		authFallback:      opts.AuthFallback,
+		bufferSize:        opts.BufferSize,
+		maxManifestSize:   opts.MaxManifestSize,
+		decryptConfig:     decryptConfig,
+		requests:          newRequestTracker(opts.IdleTimeout),
+		peers:             newPeerPolicy(opts.AllowUIDs, opts.AllowCIDs, opts.SamePidns),
+		stats:             &sessionStats{},
+		started:           time.Now(),
+	}
+	h.prefetched.maxSize = opts.PrefetchSize
+	if opts.MaxStreams > 0 {
+		h.streams = newStreamLimiter(opts.MaxStreams)
+	}
+	if opts.MaxBandwidth > 0 {
+		h.bandwidth = newBandwidthLimiter(opts.MaxBandwidth)
+	}
+	if opts.BlobCacheDir != "" {
+		var err error
+		h.blobCache, err = newBlobCache(opts.BlobCacheDir, opts.BlobCacheSize)
+		if err != nil {
+			return nil, fmt.Errorf("opening blob cache: %w", err)
+		}
+	}
+	h.manifests = newManifestCache(h.blobCache)
+	h.uncompressedSizes = &uncompressedSizes{}
+	h.tracerProvider = opts.TracerProvider
+	h.traced = h.tracedHandler()
+	if opts.AuditLog != "" {
+		var err error
+		h.audit, err = openAuditLog(opts.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Server{h: h}, nil
+}
+
+// Serve serves requests on conn until the client closes it, sends
+// POST /quit, or the server is stopped.  Connections served concurrently
+// share the opened image; use ServeListener for separate sessions.
+func (s *Server) Serve(conn io.ReadWriter) error {
+	return s.h.serveConn(conn)
+}
+
+// ServeStdio serves requests read from stdin, writing the responses to
+// stdout.
+func (s *Server) ServeStdio() error {
+	return s.h.serveConn(stdioConn{os.Stdin, os.Stdout})
+}
+
+// ServeConns serves each connection in parallel like Serve, returning
+// once all of them are done or one of them sent POST /quit.  The
+// connections are closed when the server is stopped.
+func (s *Server) ServeConns(conns []net.Conn) error {
+	for _, conn := range conns {
+		s.h.closeOnStop(conn)
+	}
+	return s.h.serveConns(conns)
+}
+
+// ServeListener accepts connections on l, serving each with protocol in
+// its own session, which opens its own image.  It returns once the server
+// is stopped, or if accepting fails.
+func (s *Server) ServeListener(l net.Listener, protocol Protocol) error {
+	s.h.closeOnStop(l)
+	switch protocol {
+	case ProtocolHTTP:
+		return s.h.serveListener(l, (*proxyHandler).serveConn)
+	case ProtocolVarlink:
+		return s.h.serveListener(l, (*proxyHandler).serveVarlink)
+	case ProtocolGRPC:
+		return s.h.serveListener(l, (*proxyHandler).serveGRPC)
+	}
+	return fmt.Errorf("unknown protocol %d", protocol)
+}
+
+// ServeActivated serves the sockets passed by systemd socket activation.
+// Listening sockets are served like with ServeListener, connected ones
+// like with ServeConns.
+func (s *Server) ServeActivated(files []*os.File) error {
+	return s.h.serveActivated(files)
+}
+
+// Idle returns a channel closed once no request was handled for the
+// IdleTimeout, which is never closed if there is none.
+func (s *Server) Idle() <-chan struct{} {
+	return s.h.requests.idleExpired()
+}
+
+// Stopped returns true once the server is shutting down, or a client of
+// Serve sent POST /quit.
+func (s *Server) Stopped() bool {
+	return s.h.isShutdown()
+}
+
+// Stop stops the server right away, closing its listeners and
+// connections.
+func (s *Server) Stop() {
+	s.h.stop()
+}
+
+// Shutdown stops the server gracefully: listeners are closed and
+// connections no longer read from, and the requests in progress are given
+// up to timeout to complete before the server is stopped.  An error is
+// returned if some of them had to be aborted.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	return s.h.drainAndStop(timeout)
+}
+
+// Close releases the opened image and destination, and closes the audit
+// log.  It must only be called once the server is done serving.
+func (s *Server) Close() error {
+	err := s.h.close()
+	if cerr := s.h.audit.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package imageproxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// implSetImage handles POST /image, whose body is an image reference which
+// replaces the IMAGE of the session, so that clients processing images
+// one after another needn't spawn a proxy for each.  It waits for the
+// other requests of the session (holding imageLock, so that new ones wait
+// in turn) and the prefetches, closes the current image, and opens the
+// new one, replying with an error if that fails.  The blob info cache and
+// prefetched blobs of the session are kept for the new image.
+func (h *proxyHandler) implSetImage(w http.ResponseWriter, r *http.Request) error {
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	ref := strings.TrimSpace(string(buf))
+	if ref == "" {
+		return invalidRequestf("no image reference in the body of POST /image")
+	}
+	h.imageLock.Lock()
+	defer h.imageLock.Unlock()
+	h.prefetched.wait()
+	h.lock.Lock()
+	imgsrc := h.imgsrc
+	h.imageref = ref
+	h.img = nil
+	h.imgsrc = nil
+	h.schema1Manifest = nil
+	h.lock.Unlock()
+	if imgsrc != nil {
+		if err := (*imgsrc).Close(); err != nil {
+			logrus.WithError(err).Warn("closing the previous image")
+		}
+	}
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(200)
+	return nil
+}
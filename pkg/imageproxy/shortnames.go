@@ -0,0 +1,123 @@
+package imageproxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+)
+
+// shortNameCandidates returns the images a docker:// reference without a
+// registry (e.g. docker://fedora:latest) may refer to, following
+// registries.conf like podman does: a short-name alias if there is one,
+// or else the name in each of the unqualified-search-registries.  As
+// there is nobody to prompt, several candidates are an error in
+// enforcing short-name-mode.  nil is returned if name isn't such a
+// short name, or registries.conf has no search registries; the name
+// then refers to Docker Hub as usual.
+func (h *proxyHandler) shortNameCandidates(name string) ([]types.ImageReference, error) {
+	prefix := docker.Transport.Name() + "://"
+	if !strings.HasPrefix(name, prefix) {
+		return nil, nil
+	}
+	short := strings.TrimPrefix(name, prefix)
+	ref, err := reference.Parse(short)
+	if err != nil {
+		// Let the usual parsing report the error
+		return nil, nil
+	}
+	named, ok := ref.(reference.Named)
+	if !ok {
+		return nil, nil
+	}
+	if domain := reference.Domain(named); strings.ContainsAny(domain, ".:") || domain == "localhost" {
+		return nil, nil
+	}
+	// The tag and/or digest
+	suffix := strings.TrimPrefix(short, named.Name())
+
+	var names []string
+	alias, _, err := sysregistriesv2.ResolveShortNameAlias(h.sysctx, named.Name())
+	if err != nil {
+		return nil, err
+	}
+	if alias != nil {
+		names = []string{alias.Name()}
+	} else {
+		registries, err := sysregistriesv2.UnqualifiedSearchRegistries(h.sysctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(registries) == 0 {
+			return nil, nil
+		}
+		mode, err := sysregistriesv2.GetShortNameMode(h.sysctx)
+		if err != nil {
+			return nil, err
+		}
+		if mode == types.ShortNameModeEnforcing && len(registries) > 1 {
+			return nil, fmt.Errorf("short name %q is ambiguous (unqualified-search-registries: %s) and short-name-mode is enforcing; use a fully qualified name", named.Name(), strings.Join(registries, ", "))
+		}
+		for _, registry := range registries {
+			names = append(names, registry+"/"+named.Name())
+		}
+	}
+
+	var candidates []types.ImageReference
+	for _, n := range names {
+		candidate, err := docker.ParseReference("//" + n + suffix)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// resolveImageName parses an image name, resolving short names.  As
+// opposed to opening an image, there is no way to pick among several
+// candidates, so that's an error.
+func (h *proxyHandler) resolveImageName(name string) (types.ImageReference, error) {
+	candidates, err := h.shortNameCandidates(name)
+	if err != nil {
+		return nil, err
+	}
+	switch len(candidates) {
+	case 0:
+		return h.parseImageRef(name)
+	case 1:
+		return h.parseImageRef(transports.ImageName(candidates[0]))
+	default:
+		var names []string
+		for _, c := range candidates {
+			names = append(names, transports.ImageName(c))
+		}
+		return nil, invalidRequestf("short name %q is ambiguous (could be %s); use a fully qualified name", name, strings.Join(names, ", "))
+	}
+}
+
+// openFirstImageSource opens the first of refs which can be opened,
+// trying them in order.
+func (h *proxyHandler) openFirstImageSource(ctx context.Context, refs []types.ImageReference) (types.ImageSource, error) {
+	var failures []string
+	var err error
+	for _, ref := range refs {
+		var src types.ImageSource
+		src, err = h.openImageSource(ctx, ref)
+		if err == nil {
+			return src, nil
+		}
+		err = withRegistry(ref, err)
+		failures = append(failures, fmt.Sprintf("%s: %v", transports.ImageName(ref), err))
+	}
+	if len(refs) == 1 {
+		return nil, err
+	}
+	// Wrap the last error so that it can still be classified
+	return nil, fmt.Errorf("none of the candidates for the short name could be opened (%s): %w", strings.Join(failures[:len(failures)-1], "; "), err)
+}
@@ -0,0 +1,242 @@
+package imageproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errShuttingDown is returned for requests received while the proxy is
+// shutting down.
+var errShuttingDown = errors.New("the proxy is shutting down")
+
+// requestTracker tracks the requests in progress, so that the proxy can
+// exit once it was idle for a while, and drain them before exiting.
+type requestTracker struct {
+	// idleTimeout is 0 if the proxy doesn't exit when idle
+	idleTimeout time.Duration
+	expired     chan struct{}
+
+	lock   sync.Mutex
+	active int
+	// idle is closed while no request is in progress
+	idle     chan struct{}
+	timer    *time.Timer
+	fired    bool
+	draining bool
+}
+
+func newRequestTracker(idleTimeout time.Duration) *requestTracker {
+	t := &requestTracker{
+		idleTimeout: idleTimeout,
+		expired:     make(chan struct{}),
+		idle:        make(chan struct{}),
+	}
+	close(t.idle)
+	if idleTimeout > 0 {
+		t.timer = time.AfterFunc(idleTimeout, t.fire)
+	}
+	return t
+}
+
+func (t *requestTracker) fire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// A request may have started just as the timer fired
+	if t.active > 0 || t.fired {
+		return
+	}
+	t.fired = true
+	close(t.expired)
+}
+
+// begin records that a request started; it returns false if the proxy is
+// draining, in which case the request must be refused.
+func (t *requestTracker) begin() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.draining {
+		return false
+	}
+	if t.active == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.active++
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return true
+}
+
+// end records that a request is done.
+func (t *requestTracker) end() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.active--
+	if t.active > 0 {
+		return
+	}
+	close(t.idle)
+	if t.timer != nil && !t.draining {
+		t.timer.Reset(t.idleTimeout)
+	}
+}
+
+// idleExpired returns a channel closed once the proxy was idle for
+// the idle timeout, which is never closed if there is none.
+func (t *requestTracker) idleExpired() <-chan struct{} {
+	return t.expired
+}
+
+// drain refuses further requests, and waits up to timeout for those in
+// progress to complete, returning false if some are still running.
+func (t *requestTracker) drain(timeout time.Duration) bool {
+	t.lock.Lock()
+	t.draining = true
+	idle := t.idle
+	t.lock.Unlock()
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (t *requestTracker) isDraining() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.draining
+}
+
+// sessionRequests counts the requests in progress in a session, so that
+// POST /quit can wait for the others.  The zero value has none.
+type sessionRequests struct {
+	lock   sync.Mutex
+	active int
+	// ended is closed when a request ends, if something waits for that
+	ended chan struct{}
+}
+
+func (s *sessionRequests) begin() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.active++
+}
+
+func (s *sessionRequests) end() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.active--
+	if s.ended != nil {
+		close(s.ended)
+		s.ended = nil
+	}
+}
+
+// waitUntil waits until at most n requests are in progress, or ctx is
+// done.
+func (s *sessionRequests) waitUntil(ctx context.Context, n int) error {
+	for {
+		s.lock.Lock()
+		if s.active <= n {
+			s.lock.Unlock()
+			return nil
+		}
+		if s.ended == nil {
+			s.ended = make(chan struct{})
+		}
+		ended := s.ended
+		s.lock.Unlock()
+		select {
+		case <-ended:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// implQuit handles POST /quit, which ends the session (the proxy, for
+// connections served together).  It replies once the other requests of
+// the session are done, e.g. blobs being written to pipes with ?fd=1, so
+// that clients can tell a clean shutdown from a crash; with ?force=1,
+// those carrying a Request-Id are aborted instead of waited for.
+func (h *proxyHandler) implQuit(w http.ResponseWriter, r *http.Request) error {
+	force, err := queryBool(r, "force")
+	if err != nil {
+		return err
+	}
+	if force {
+		h.inflight.cancelAll()
+	} else if err := h.active.waitUntil(r.Context(), 1); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(200)
+	h.lock.Lock()
+	h.shutdown = true
+	h.lock.Unlock()
+	return nil
+}
+
+// closeOnStop registers a connection or listener to close when the proxy
+// is stopped, which unblocks whatever is serving it.  The returned
+// function unregisters it.
+func (h *proxyHandler) closeOnStop(c io.Closer) func() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.shutdown {
+		c.Close()
+		return func() {}
+	}
+	if h.stoppers == nil {
+		h.stoppers = make(map[io.Closer]struct{})
+	}
+	h.stoppers[c] = struct{}{}
+	return func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		delete(h.stoppers, c)
+	}
+}
+
+// stop shuts down the proxy, closing the registered connections and
+// listeners.
+func (h *proxyHandler) stop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.shutdown = true
+	for c := range h.stoppers {
+		c.Close()
+	}
+	h.stoppers = nil
+}
+
+// drainAndStop shuts down the proxy gracefully: listeners are closed and
+// connections no longer read from, so that no new requests are accepted,
+// and the requests in progress are given up to timeout to complete
+// before the proxy is stopped.  An error is returned if some of them
+// had to be aborted.
+func (h *proxyHandler) drainAndStop(timeout time.Duration) error {
+	h.lock.Lock()
+	for c := range h.stoppers {
+		switch c := c.(type) {
+		case net.Listener:
+			c.Close()
+		case interface{ CloseRead() error }:
+			c.CloseRead()
+		}
+	}
+	h.lock.Unlock()
+	drained := h.requests.drain(timeout)
+	h.stop()
+	if !drained {
+		return fmt.Errorf("aborted the requests still in progress after %s", timeout)
+	}
+	return nil
+}
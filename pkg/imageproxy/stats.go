@@ -0,0 +1,70 @@
+package imageproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// sessionStats counts what a session did, for GET /stats.  The counters
+// are updated atomically.
+type sessionStats struct {
+	requests      int64
+	bytesStreamed int64
+	blobsServed   int64
+	cacheHits     int64
+	retries       int64
+	activeStreams int64
+}
+
+// statsKey is the context key for the stats of the session a request
+// belongs to.
+type statsKey struct{}
+
+func withStats(ctx context.Context, stats *sessionStats) context.Context {
+	return context.WithValue(ctx, statsKey{}, stats)
+}
+
+// countRetry counts a retry for the session of ctx, if any.
+func countRetry(ctx context.Context) {
+	if stats, ok := ctx.Value(statsKey{}).(*sessionStats); ok {
+		atomic.AddInt64(&stats.retries, 1)
+	}
+}
+
+// blobServed counts the blob d of the opened image as served, and
+// records it in the audit log.  rangeHeader is the Range requested, if
+// only parts of it are.
+func (h *proxyHandler) blobServed(d digest.Digest, size int64, rangeHeader string) error {
+	atomic.AddInt64(&h.stats.blobsServed, 1)
+	return h.audit.record(auditRecord{Event: "blob", Image: h.imageName(), Digest: d, Size: size, Range: rangeHeader})
+}
+
+type statsReply struct {
+	Requests      int64 `json:"requests"`
+	BytesStreamed int64 `json:"bytesStreamed"`
+	BlobsServed   int64 `json:"blobsServed"`
+	CacheHits     int64 `json:"cacheHits"`
+	Retries       int64 `json:"retries"`
+	ActiveStreams int64 `json:"activeStreams"`
+}
+
+// implStats handles GET /stats, returning the counters of this session.
+// The request itself isn't counted yet.
+func (h *proxyHandler) implStats(w http.ResponseWriter, r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return err
+	}
+	return writeReply(w, r, statsReply{
+		Requests:      atomic.LoadInt64(&h.stats.requests),
+		BytesStreamed: atomic.LoadInt64(&h.stats.bytesStreamed),
+		BlobsServed:   atomic.LoadInt64(&h.stats.blobsServed),
+		CacheHits:     atomic.LoadInt64(&h.stats.cacheHits),
+		Retries:       atomic.LoadInt64(&h.stats.retries),
+		ActiveStreams: atomic.LoadInt64(&h.stats.activeStreams),
+	})
+}
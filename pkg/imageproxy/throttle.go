@@ -0,0 +1,65 @@
+package imageproxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// bandwidthLimiter limits the combined rate of all blob transfers.
+type bandwidthLimiter struct {
+	// rate is in bytes per second
+	rate int64
+
+	lock sync.Mutex
+	// next is when the data transferred so far has been paid for
+	next time.Time
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes may be transferred.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	until := l.next
+	l.lock.Unlock()
+	return sleepContext(ctx, time.Until(until))
+}
+
+// throttledReader reads from a blob at a limited rate.
+type throttledReader struct {
+	ctx     context.Context
+	limiter *bandwidthLimiter
+	r       io.ReadCloser
+	// waited is the time spent waiting so far
+	waited time.Duration
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Avoid sleeping for more than a second at a time
+	if int64(len(p)) > t.limiter.rate {
+		p = p[:t.limiter.rate]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		start := time.Now()
+		werr := t.limiter.wait(t.ctx, n)
+		t.waited += time.Since(start)
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (t *throttledReader) Close() error {
+	return t.r.Close()
+}
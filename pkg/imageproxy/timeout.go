@@ -0,0 +1,99 @@
+package imageproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// errNoResponse is wrapped by errors for operations which timed out.
+var errNoResponse = errors.New("no response")
+
+// timeouts bounds how long operations may take.  The dial and TLS
+// handshake timeouts of the registry client are fixed by containers/image
+// (30s and 10s), but both are covered by the response timeout.
+type timeouts struct {
+	// request is the overall deadline for handling a request,
+	// including streaming the response
+	request time.Duration
+	// response is how long to wait for the image source to start
+	// responding to an operation (connecting, TLS handshake, and
+	// response headers for registries)
+	response time.Duration
+	// write is how long a write to a client may block before the
+	// client is considered dead
+	write time.Duration
+}
+
+// withResponseTimeout calls fn, cancelling the context passed to it if
+// fn doesn't return within the response timeout.  Once fn has returned
+// successfully, the context stays valid, so streams it opened can still
+// be read, until the returned cancel function is called; callers must
+// call it once done with them.  If fn failed, the context is already
+// cancelled.  A timeout is reported as an ordinary error, so it may be
+// retried; it is only reported if fn failed, as otherwise what fn opened
+// would be leaked.
+func (h *proxyHandler) withResponseTimeout(ctx context.Context, fn func(context.Context) error) (context.CancelFunc, error) {
+	if h.timeouts.response <= 0 {
+		return func() {}, fn(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	var lock sync.Mutex
+	returned, timedOut := false, false
+	t := time.AfterFunc(h.timeouts.response, func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if !returned {
+			timedOut = true
+			cancel()
+		}
+	})
+	err := fn(ctx)
+	t.Stop()
+	lock.Lock()
+	returned = true
+	lock.Unlock()
+	if err != nil {
+		cancel()
+		if timedOut {
+			err = fmt.Errorf("%w within %s: %v", errNoResponse, h.timeouts.response, err)
+		}
+		return func() {}, err
+	}
+	return cancel, nil
+}
+
+// cancelOnClose cancels the context of a stream once it is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// stallWriter fails writes to conn which make no progress within timeout,
+// so that a client which stopped reading doesn't block the response (and
+// the transfer feeding it) forever.
+type stallWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (s *stallWriter) Write(p []byte) (int, error) {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := s.conn.Write(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = fmt.Errorf("client stopped reading for %s: %w", s.timeout, err)
+	}
+	return n, err
+}
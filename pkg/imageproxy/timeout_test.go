@@ -0,0 +1,55 @@
+package imageproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithResponseTimeout(t *testing.T) {
+	h := &proxyHandler{timeouts: timeouts{response: 10 * time.Millisecond}}
+
+	var failed context.Context
+	_, err := h.withResponseTimeout(context.Background(), func(ctx context.Context) error {
+		failed = ctx
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, errNoResponse) {
+		t.Errorf("blocked operation: %v", err)
+	}
+	if failed.Err() == nil {
+		t.Errorf("context not cancelled after failure")
+	}
+
+	// An operation which succeeds despite the timer firing isn't failed,
+	// as what it opened would be leaked
+	cancel, err := h.withResponseTimeout(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	cancel()
+	if err != nil {
+		t.Errorf("late success: %v", err)
+	}
+
+	// Once the operation returned, the context stays valid
+	var opened context.Context
+	cancel, err = h.withResponseTimeout(context.Background(), func(ctx context.Context) error {
+		opened = ctx
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if opened.Err() != nil {
+		t.Errorf("context cancelled after success: %v", opened.Err())
+	}
+	// until the caller is done with it
+	cancel()
+	if opened.Err() == nil {
+		t.Errorf("context not cancelled by the returned function")
+	}
+}
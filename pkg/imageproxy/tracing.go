@@ -0,0 +1,163 @@
+package imageproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans of the proxy.
+const tracerName = "github.com/cgwalters/container-image-proxy"
+
+// noopTracer is used when tracing is disabled.
+var noopTracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+
+// NewTracerProvider returns a tracer provider exporting traces to the
+// OpenTelemetry collector at endpoint (e.g. http://localhost:4318) using
+// OTLP over HTTP, for Options.TracerProvider.  If endpoint is empty, the
+// standard OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// environment variables are used; without either, it returns nil.  The
+// provider must be shut down before exiting, to export the remaining spans.
+func NewTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid OTLP endpoint %q", endpoint)
+		}
+		opts = append(opts, otlptracehttp.WithEndpoint(u.Host), otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/")+"/v1/traces"))
+		if u.Scheme == "http" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+	} else if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.Merge(resource.NewSchemaless(
+		semconv.ServiceNameKey.String("container-image-proxy"),
+		semconv.ServiceVersionKey.String(Version),
+	), resource.Environment())
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
+
+// tracedHandler returns h instrumented with otelhttp: each request gets a
+// span named after its endpoint, as a child of the caller's if it sends a
+// W3C traceparent header.
+func (h *proxyHandler) tracedHandler() http.Handler {
+	if h.tracerProvider == nil {
+		return h
+	}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get("Request-Id"); id != "" {
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request.id", id))
+		}
+		h.ServeHTTP(w, r)
+	})
+	return otelhttp.NewHandler(inner, "request",
+		otelhttp.WithTracerProvider(h.tracerProvider),
+		otelhttp.WithPropagators(propagation.TraceContext{}),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return metricEndpoint(r)
+		}))
+}
+
+// startSpan starts a span of an operation of the proxy, as a child of the
+// span of ctx if any.  It is a no-op span unless tracing is enabled.
+func (h *proxyHandler) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := noopTracer
+	if h.tracerProvider != nil {
+		tracer = h.tracerProvider.Tracer(tracerName, trace.WithInstrumentationVersion(Version))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// registrySpan starts a span for a call containers/image makes to the
+// registry of ref.  containers/image doesn't allow instrumenting its HTTP
+// client, so this is as close to the requests as spans get: the requests
+// of a call, including those for tokens, are all part of its span.
+func (h *proxyHandler) registrySpan(ctx context.Context, ref types.ImageReference, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if named := ref.DockerReference(); named != nil {
+		attrs = append(attrs, semconv.NetPeerNameKey.String(reference.Domain(named)))
+	}
+	return h.startSpan(ctx, "registry "+name, attrs...)
+}
+
+// tracedImageSource is a docker:// image source whose calls to the
+// registry are traced with registrySpan.
+type tracedImageSource struct {
+	types.ImageSource
+	h *proxyHandler
+}
+
+// tracedRegistrySource returns src traced if it is a docker:// image
+// source and tracing is enabled, src otherwise.
+func (h *proxyHandler) tracedRegistrySource(src types.ImageSource) types.ImageSource {
+	if h.tracerProvider == nil || src.Reference().Transport().Name() != docker.Transport.Name() {
+		return src
+	}
+	return &tracedImageSource{ImageSource: src, h: h}
+}
+
+func (s *tracedImageSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	var attrs []attribute.KeyValue
+	if instanceDigest != nil {
+		attrs = append(attrs, attribute.String("manifest.digest", instanceDigest.String()))
+	}
+	ctx, span := s.h.registrySpan(ctx, s.Reference(), "get manifest", attrs...)
+	buf, mimeType, err := s.ImageSource.GetManifest(ctx, instanceDigest)
+	endSpan(span, err)
+	return buf, mimeType, err
+}
+
+// GetBlob traces fetching a blob until the registry sends its contents,
+// which are then read as requested by the client.
+func (s *tracedImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	ctx, span := s.h.registrySpan(ctx, s.Reference(), "get blob", attribute.String("blob.digest", info.Digest.String()))
+	stream, size, err := s.ImageSource.GetBlob(ctx, info, cache)
+	if err == nil {
+		span.SetAttributes(attribute.Int64("blob.size", size))
+	}
+	endSpan(span, err)
+	return stream, size, err
+}
+
+func (s *tracedImageSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	ctx, span := s.h.registrySpan(ctx, s.Reference(), "get signatures")
+	sigs, err := s.ImageSource.GetSignatures(ctx, instanceDigest)
+	endSpan(span, err)
+	return sigs, err
+}
@@ -0,0 +1,208 @@
+package imageproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// Where GET /uncompressed-size got the size from
+const (
+	sizeSourceCache        = "cache"
+	sizeSourceTOC          = "toc"
+	sizeSourceDecompressed = "decompressed"
+)
+
+// uncompressedSize is the reply of GET /uncompressed-size/<digest>.
+type uncompressedSize struct {
+	Size int64 `json:"size"`
+	// Exact is false for estimates from the TOC of chunked layers
+	Exact  bool   `json:"exact"`
+	Source string `json:"source"`
+}
+
+// uncompressedSizes records the uncompressed sizes of the layers which
+// were decompressed, by digest, for all sessions.
+type uncompressedSizes struct {
+	lock  sync.Mutex
+	sizes map[digest.Digest]int64
+}
+
+func (s *uncompressedSizes) get(d digest.Digest) (int64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	size, ok := s.sizes[d]
+	return size, ok
+}
+
+func (s *uncompressedSizes) put(d digest.Digest, size int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sizes == nil {
+		s.sizes = make(map[digest.Digest]int64)
+	}
+	s.sizes[d] = size
+}
+
+// implUncompressedSize handles GET /uncompressed-size/<digest>, returning
+// the size of the decompressed layer, so that clients can preallocate
+// space and report progress when applying it.  It is known if the layer
+// was already decompressed, and estimated from the TOC of zstd:chunked
+// and eStargz layers; otherwise, or with ?exact=1, the layer is fetched
+// and decompressed to measure it.
+func (h *proxyHandler) implUncompressedSize(w http.ResponseWriter, r *http.Request, digestStr string) error {
+	if err := h.ensureImage(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		return err
+	}
+	exact, err := queryBool(r, "exact")
+	if err != nil {
+		return err
+	}
+	d, err := digest.Parse(digestStr)
+	if err != nil {
+		return err
+	}
+	info, err := h.layerInfo(d)
+	if err != nil {
+		return notFoundf("%v", err)
+	}
+	ctx := r.Context()
+	if size, ok := h.uncompressedSizes.get(d); ok {
+		return writeReply(w, r, uncompressedSize{Size: size, Exact: true, Source: sizeSourceCache})
+	}
+	if !exact {
+		if size, ok := h.estimateUncompressedSize(ctx, info); ok {
+			return writeReply(w, r, uncompressedSize{Size: size, Source: sizeSourceTOC})
+		}
+	}
+	size, err := h.measureUncompressedSize(ctx, d)
+	if err != nil {
+		return err
+	}
+	return writeReply(w, r, uncompressedSize{Size: size, Exact: true, Source: sizeSourceDecompressed})
+}
+
+// tocEntry is the part of the TOC entries of zstd:chunked and eStargz
+// layers needed to estimate the size of the tar.
+type tocEntry struct {
+	Type     string            `json:"type"`
+	Name     string            `json:"name"`
+	LinkName string            `json:"linkName"`
+	Size     int64             `json:"size"`
+	Xattrs   map[string]string `json:"xattrs"`
+}
+
+// estimateUncompressedSize estimates the size of a chunked layer from its
+// TOC: the headers and padded contents of its entries, which the tar
+// has in addition to PAX headers for long names and extended attributes.
+func (h *proxyHandler) estimateUncompressedSize(ctx context.Context, info types.BlobInfo) (int64, bool) {
+	var data []byte
+	var err error
+	if _, ok := info.Annotations[zstdChunkedManifestChecksumKey]; ok {
+		data, err = h.readZstdChunkedTOC(ctx, info)
+	} else if _, ok := info.Annotations[estargz.TOCJSONDigestAnnotation]; ok {
+		data, err = h.readEstargzTOC(ctx, info)
+	} else {
+		return 0, false
+	}
+	var toc struct {
+		Entries []tocEntry `json:"entries"`
+	}
+	if err != nil || json.Unmarshal(data, &toc) != nil {
+		return 0, false
+	}
+	const block = 512
+	padded := func(n int64) int64 {
+		return (n + block - 1) / block * block
+	}
+	// The end of the archive
+	size := int64(2 * block)
+	for _, e := range toc.Entries {
+		// The other chunks of a file are within its entry
+		if e.Type == "chunk" {
+			continue
+		}
+		size += block + padded(e.Size)
+		pax := 0
+		if len(e.Name) > 100 {
+			pax += len(e.Name) + 16
+		}
+		if len(e.LinkName) > 100 {
+			pax += len(e.LinkName) + 20
+		}
+		for k, v := range e.Xattrs {
+			pax += len(k) + len(v) + 24
+		}
+		if pax > 0 {
+			size += block + padded(int64(pax))
+		}
+	}
+	return size, true
+}
+
+// measureUncompressedSize fetches and decompresses the layer d to measure
+// its uncompressed size, which is recorded.  The layer is verified, as a
+// GET /blobs/<digest>?decompress=1 would.
+func (h *proxyHandler) measureUncompressedSize(ctx context.Context, d digest.Digest) (int64, error) {
+	diffID, err := h.layerDiffID(ctx, d)
+	if err != nil {
+		return 0, err
+	}
+	decryption, err := h.layerDecryption(d)
+	if err != nil {
+		return 0, err
+	}
+	if decryption == nil {
+		if info, err := h.layerInfo(d); err == nil && isEncryptedLayer(info) {
+			return 0, invalidRequestf("layer %s is encrypted, and no decryption keys were given", d)
+		}
+	}
+	blobr, _, err := h.getBlob(ctx, types.BlobInfo{Digest: d, Size: -1})
+	if err != nil {
+		return 0, err
+	}
+	defer blobr.Close()
+	if decryption != nil {
+		blobr, err = decryption.reader(blobr)
+		if err != nil {
+			return 0, err
+		}
+	}
+	decompressor, stream, err := compression.DetectCompression(blobr)
+	if err != nil {
+		return 0, err
+	}
+	if decompressor != nil {
+		rc, err := decompressor(stream)
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		stream = rc
+	}
+	diffIDVerifier := h.blobVerifier(diffID)
+	var out io.Writer = io.Discard
+	if diffIDVerifier != nil {
+		out = diffIDVerifier
+	}
+	size, err := io.Copy(out, stream)
+	if err != nil {
+		return 0, err
+	}
+	if diffIDVerifier != nil && !diffIDVerifier.Verified() {
+		return 0, fmt.Errorf("Corrupted blob, expecting diffID %s", diffID)
+	}
+	h.uncompressedSizes.put(d, size)
+	return size, nil
+}
@@ -0,0 +1,142 @@
+package imageproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// paramTypes are the types of the query parameters, checked before a
+// request is handled: "bool" parameters take 1, true, 0, false and the
+// like (as strconv.ParseBool), and "count" ones an integer of at least 1.
+var paramTypes = map[string]string{
+	"ref":        "string",
+	"decompress": "bool",
+	"diffid":     "bool",
+	"sanitize":   "bool",
+	"whiteouts":  "string",
+	"exact":      "bool",
+	"fd":         "bool",
+	"config":     "bool",
+	"name":       "string",
+	"tag":        "string",
+	"parallel":   "count",
+	"raw":        "bool",
+	"force":      "bool",
+}
+
+// badRequestError is a request for something which doesn't exist, which
+// is replied to with status (rather than 500).  allow lists the methods
+// of the path, for 405 Method Not Allowed.
+type badRequestError struct {
+	invalidRequestError
+	status int
+	allow  []string
+}
+
+func (e *badRequestError) Unwrap() error {
+	return e.invalidRequestError
+}
+
+// matchEndpoint returns the endpoints for path, and the digest in it if
+// the path ends with one.
+func matchEndpoint(path string) ([]*endpoint, string) {
+	var matched []*endpoint
+	var digestStr string
+	for i := range endpoints {
+		e := &endpoints[i]
+		if prefix := strings.TrimSuffix(e.Path, "<digest>"); prefix != e.Path {
+			if strings.HasPrefix(path, prefix) {
+				matched = append(matched, e)
+				digestStr = path[len(prefix):]
+			}
+		} else if path == e.Path {
+			matched = append(matched, e)
+		}
+	}
+	return matched, digestStr
+}
+
+// validateRequest checks the method, path and query parameters of r
+// against endpoints, so that mistakes are reported before anything is
+// done, naming what is wrong and what was expected.
+func validateRequest(r *http.Request) error {
+	matched, digestStr := matchEndpoint(r.URL.Path)
+	if len(matched) == 0 {
+		return &badRequestError{
+			invalidRequestError: invalidRequestError{fmt.Errorf("unknown request path %q; see GET /capabilities", r.URL.Path)},
+			status:              http.StatusBadRequest,
+		}
+	}
+	var e *endpoint
+	var allow []string
+	for _, m := range matched {
+		if m.Method == r.Method {
+			e = m
+		}
+		allow = append(allow, m.Method)
+	}
+	if e == nil {
+		return &badRequestError{
+			invalidRequestError: invalidRequestError{fmt.Errorf("%s %s is not supported; expected %s", r.Method, r.URL.Path, strings.Join(allow, " or "))},
+			status:              http.StatusMethodNotAllowed,
+			allow:               allow,
+		}
+	}
+	if strings.HasSuffix(e.Path, "<digest>") {
+		if _, err := digest.Parse(digestStr); err != nil {
+			return invalidRequestf("invalid digest %q in the path: %w", digestStr, err)
+		}
+	}
+
+	query := r.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !e.acceptsParameter(name) {
+			if len(e.Parameters) == 0 {
+				return invalidRequestf("unknown parameter %q: %s %s takes no parameters", name, e.Method, e.Path)
+			}
+			return invalidRequestf("unknown parameter %q: %s %s takes %s", name, e.Method, e.Path, strings.Join(e.Parameters, ", "))
+		}
+		values := query[name]
+		if len(values) > 1 {
+			return invalidRequestf("parameter %q given %d times; expected once", name, len(values))
+		}
+		if err := checkParameter(name, values[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *endpoint) acceptsParameter(name string) bool {
+	for _, p := range e.Parameters {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkParameter checks that the value of a query parameter has its type.
+func checkParameter(name, value string) error {
+	switch paramTypes[name] {
+	case "bool":
+		if _, err := strconv.ParseBool(value); value != "" && err != nil {
+			return invalidRequestf("invalid parameter %s=%q: expected a boolean (1, true, 0 or false)", name, value)
+		}
+	case "count":
+		if n, err := strconv.Atoi(value); value != "" && (err != nil || n < 1) {
+			return invalidRequestf("invalid parameter %s=%q: expected an integer of at least 1", name, value)
+		}
+	}
+	return nil
+}
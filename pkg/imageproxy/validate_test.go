@@ -0,0 +1,69 @@
+package imageproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateRequest(t *testing.T) {
+	const layer = "sha256:5da0759c13284927e63f2ffeb9924cf103328da122ae0db4f49f8760c061cbbd"
+	for _, c := range []struct {
+		method, target string
+		// status is that of the error reply, 0 if the request is valid
+		status int
+	}{
+		{http.MethodGet, "/manifest", 0},
+		{http.MethodHead, "/manifest?ref=oci:/x", 0},
+		{http.MethodGet, "/blobs/" + layer + "?decompress=1&fd=true&diffid=", 0},
+		{http.MethodPut, "/destination/blobs/" + layer + "?config=1", 0},
+		{http.MethodPost, "/prefetch?parallel=4", 0},
+		{http.MethodGet, "/nope", http.StatusBadRequest},
+		{http.MethodGet, "/quit", http.StatusMethodNotAllowed},
+		{"PATCH", "/manifest", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/manifest?ref=oci:/x", http.StatusInternalServerError},
+		{http.MethodGet, "/blobs/sha256:00", http.StatusInternalServerError},
+		{http.MethodGet, "/blobs/" + layer + "?decompress=yes", http.StatusInternalServerError},
+		{http.MethodGet, "/blobs/" + layer + "?fd=1&fd=1", http.StatusInternalServerError},
+		{http.MethodGet, "/flattened?parallel=0", http.StatusInternalServerError},
+	} {
+		err := validateRequest(httptest.NewRequest(c.method, "http://proxy"+c.target, nil))
+		if c.status == 0 {
+			if err != nil {
+				t.Errorf("%s %s: %v", c.method, c.target, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s %s was accepted", c.method, c.target)
+			continue
+		}
+		if code := errorCode(err); code != errorCodeInvalid {
+			t.Errorf("%s %s: code %s, expected %s", c.method, c.target, code, errorCodeInvalid)
+		}
+		w := httptest.NewRecorder()
+		(&proxyHandler{}).replyError(w, httptest.NewRequest(c.method, "http://proxy"+c.target, nil), err)
+		if w.Code != c.status {
+			t.Errorf("%s %s: status %d, expected %d", c.method, c.target, w.Code, c.status)
+		}
+	}
+}
+
+func TestMetricEndpoint(t *testing.T) {
+	const layer = "sha256:5da0759c13284927e63f2ffeb9924cf103328da122ae0db4f49f8760c061cbbd"
+	for _, c := range []struct {
+		method, target, expected string
+	}{
+		{http.MethodGet, "/manifest?raw=1", "GET /manifest"},
+		{http.MethodHead, "/blobs/" + layer, "HEAD /blobs"},
+		{http.MethodPut, "/destination/blobs/" + layer, "PUT /destination/blobs"},
+		{http.MethodGet, "/export/oci-archive", "GET /export/oci-archive"},
+		{http.MethodGet, "/nope/" + layer, "other"},
+		{http.MethodGet, "/\xff", "other"},
+		{"PATCH", "/manifest", "other"},
+	} {
+		if got := metricEndpoint(httptest.NewRequest(c.method, "http://proxy"+c.target, nil)); got != c.expected {
+			t.Errorf("%s %s: %q, expected %q", c.method, c.target, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package imageproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxVarlinkMessage bounds the size of a varlink call.
+const maxVarlinkMessage = 1 << 20
+
+const varlinkInterface = "org.containers.imageproxy"
+
+// varlinkDescription describes the interface served with --varlink.
+const varlinkDescription = `# Fetches container images and their blobs using containers/image.
+# The methods correspond to the HTTP requests of the same name; see the
+# README for their details.
+interface org.containers.imageproxy
+
+# Returns the manifest converted into OCI format (or as is, if raw), the
+# digest of the original manifest, and that of the converted one.
+method GetManifest(raw: ?bool) -> (manifest: object, digest: string, ociDigest: ?string)
+
+# Resolves the image (or ref) to its manifest digest.
+method GetDigest(ref: ?string) -> (digest: string)
+
+# Returns a summary of the image in the format of skopeo inspect.
+method Inspect() -> (info: object)
+
+# Returns the layers of the image.
+method GetLayers() -> (layers: []object)
+
+# Lists the tags of the repository of the image (or ref).
+method GetTags(ref: ?string) -> (repository: string, tags: []string)
+
+# Writes a blob, decompressed if asked to, to the file descriptor sent
+# along with the call.  With sanitize, the entries of the decompressed
+# layer are checked, failing with EUNSAFE on the first unsafe one; with
+# whiteouts ("overlay" or "oci"), its whiteouts are rewritten.
+method GetBlob(digest: string, decompress: ?bool, sanitize: ?bool,
+               whiteouts: ?string) -> ()
+
+# Returns the uncompressed size of a layer, exact unless estimated from
+# its TOC (unless exact is set), and where it was known from: cache, toc
+# or decompressed.
+method GetBlobUncompressedSize(digest: string, exact: ?bool) -> (size: int, exact: bool,
+                                                                 source: string)
+
+# Returns the table of contents of a zstd:chunked or eStargz layer, and its
+# format: zstd:chunked or estargz.
+method GetTOC(digest: string) -> (format: string, toc: object)
+
+# Returns the counters of this connection.
+method GetStats() -> (requests: int, bytesStreamed: int, blobsServed: int,
+                      cacheHits: int, retries: int, activeStreams: int)
+
+# Returns the version of the proxy and its uptime in seconds.
+method Ping() -> (version: string, uptime: float)
+
+# Describes the requests and features supported.
+method GetCapabilities() -> (capabilities: object)
+
+# Shuts down the proxy.
+method Quit() -> ()
+
+# Any failure, with the same code (e.g. ENOTFOUND) as HTTP error replies.
+error ImageProxyError(code: string, message: string, retryable: bool,
+                      status: ?int, endpoint: ?string)
+`
+
+const varlinkServiceDescription = `# The Varlink Service Interface is provided by every varlink service. It
+# describes the service and the interfaces it implements.
+interface org.varlink.service
+
+method GetInfo() -> (
+  vendor: string,
+  product: string,
+  version: string,
+  url: string,
+  interfaces: []string
+)
+
+method GetInterfaceDescription(interface: string) -> (description: string)
+
+error InterfaceNotFound (interface: string)
+error MethodNotFound (method: string)
+error MethodNotImplemented (method: string)
+error InvalidParameter (parameter: string)
+`
+
+type varlinkCall struct {
+	Method     string          `json:"method"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	Oneway     bool            `json:"oneway,omitempty"`
+}
+
+// The parameters of the methods which take some.  Unknown parameters are
+// ignored, so that clients can pass those of newer versions.
+type (
+	varlinkInterfaceParameters struct {
+		Interface string `json:"interface"`
+	}
+	varlinkManifestParameters struct {
+		Raw bool `json:"raw"`
+	}
+	varlinkRefParameters struct {
+		Ref string `json:"ref"`
+	}
+	varlinkBlobParameters struct {
+		Digest     string `json:"digest"`
+		Decompress bool   `json:"decompress"`
+		Sanitize   bool   `json:"sanitize"`
+		Whiteouts  string `json:"whiteouts"`
+	}
+	varlinkTOCParameters struct {
+		Digest string `json:"digest"`
+	}
+	varlinkUncompressedSizeParameters struct {
+		Digest string `json:"digest"`
+		Exact  bool   `json:"exact"`
+	}
+)
+
+type varlinkReply struct {
+	Parameters interface{} `json:"parameters"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// varlinkResponse buffers the response to a request made for a varlink
+// call.
+type varlinkResponse struct {
+	headers http.Header
+	body    bytes.Buffer
+}
+
+func (rw *varlinkResponse) Header() http.Header {
+	return rw.headers
+}
+
+func (rw *varlinkResponse) Write(buf []byte) (int, error) {
+	return rw.body.Write(buf)
+}
+
+func (rw *varlinkResponse) WriteHeader(statusCode int) {}
+
+// serveVarlink serves the org.containers.imageproxy varlink interface on
+// conn, translating each call into the equivalent request.
+func (h *proxyHandler) serveVarlink(conn io.ReadWriter) error {
+	var in io.Reader = conn
+	var fds *fdReader
+	if uc, ok := conn.(*net.UnixConn); ok {
+		var err error
+		fds, err = newFdReader(uc)
+		if err != nil {
+			return err
+		}
+		in = fds
+	}
+	defer fds.close()
+	r := bufio.NewReaderSize(in, maxVarlinkMessage)
+	for {
+		msg, err := r.ReadSlice(0)
+		if err == io.EOF && len(msg) == 0 {
+			return nil
+		}
+		if err == bufio.ErrBufferFull {
+			return fmt.Errorf("varlink call larger than %d bytes", maxVarlinkMessage)
+		}
+		if err != nil {
+			return err
+		}
+		var call varlinkCall
+		if err := json.Unmarshal(msg[:len(msg)-1], &call); err != nil {
+			return fmt.Errorf("invalid varlink call: %w", err)
+		}
+		reply := h.varlinkCall(&call, fds)
+		if !call.Oneway {
+			buf, err := json.Marshal(reply)
+			if err != nil {
+				return err
+			}
+			if nc, ok := conn.(net.Conn); ok && h.timeouts.write > 0 {
+				nc.SetWriteDeadline(time.Now().Add(h.timeouts.write))
+			}
+			if _, err := conn.Write(append(buf, 0)); err != nil {
+				return err
+			}
+		}
+		if h.isShutdown() {
+			return nil
+		}
+	}
+}
+
+func varlinkError(name string, parameters interface{}) varlinkReply {
+	return varlinkReply{Error: name, Parameters: parameters}
+}
+
+func invalidVarlinkParameter(name string) varlinkReply {
+	return varlinkError("org.varlink.service.InvalidParameter", map[string]string{"parameter": name})
+}
+
+// decodeVarlinkParameters decodes the parameters of call into params, a
+// pointer to the struct for its method.  If they are invalid, the error
+// reply names the parameter at fault, or "parameters" if they aren't an
+// object.
+func decodeVarlinkParameters(call *varlinkCall, params interface{}) *varlinkReply {
+	raw := call.Parameters
+	if len(raw) == 0 || string(raw) == "null" {
+		raw = json.RawMessage("{}")
+	}
+	if err := json.Unmarshal(raw, params); err != nil {
+		name := "parameters"
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			name = typeErr.Field
+		}
+		reply := invalidVarlinkParameter(name)
+		return &reply
+	}
+	return nil
+}
+
+func (h *proxyHandler) varlinkCall(call *varlinkCall, fds *fdReader) varlinkReply {
+	switch call.Method {
+	case "org.varlink.service.GetInfo":
+		if reply := decodeVarlinkParameters(call, &struct{}{}); reply != nil {
+			return *reply
+		}
+		return varlinkReply{Parameters: map[string]interface{}{
+			"vendor":     "containers",
+			"product":    "container-image-proxy",
+			"version":    Version,
+			"url":        "https://github.com/cgwalters/container-image-proxy",
+			"interfaces": []string{"org.varlink.service", varlinkInterface},
+		}}
+	case "org.varlink.service.GetInterfaceDescription":
+		var params varlinkInterfaceParameters
+		if reply := decodeVarlinkParameters(call, &params); reply != nil {
+			return *reply
+		}
+		switch params.Interface {
+		case "":
+			return invalidVarlinkParameter("interface")
+		case "org.varlink.service":
+			return varlinkReply{Parameters: map[string]string{"description": varlinkServiceDescription}}
+		case varlinkInterface:
+			return varlinkReply{Parameters: map[string]string{"description": varlinkDescription}}
+		}
+		return varlinkError("org.varlink.service.InterfaceNotFound", map[string]string{"interface": params.Interface})
+	}
+
+	query := url.Values{}
+	var method, path string
+	// wrap names the reply parameter holding the response, if it isn't
+	// returned as the parameters themselves
+	var wrap string
+	// params are those of the method, if it takes any
+	var params interface{} = &struct{}{}
+	switch call.Method {
+	case varlinkInterface + ".GetManifest":
+		method, path, params = http.MethodGet, "/manifest", &varlinkManifestParameters{}
+	case varlinkInterface + ".GetDigest":
+		method, path, params = http.MethodGet, "/digest", &varlinkRefParameters{}
+	case varlinkInterface + ".Inspect":
+		method, path, wrap = http.MethodGet, "/inspect", "info"
+	case varlinkInterface + ".GetLayers":
+		method, path, wrap = http.MethodGet, "/layers", "layers"
+	case varlinkInterface + ".GetTags":
+		method, path, params = http.MethodGet, "/tags", &varlinkRefParameters{}
+	case varlinkInterface + ".GetBlob":
+		method, params = http.MethodGet, &varlinkBlobParameters{}
+	case varlinkInterface + ".GetTOC":
+		method, params = http.MethodGet, &varlinkTOCParameters{}
+	case varlinkInterface + ".GetBlobUncompressedSize":
+		method, params = http.MethodGet, &varlinkUncompressedSizeParameters{}
+	case varlinkInterface + ".GetStats":
+		method, path = http.MethodGet, "/stats"
+	case varlinkInterface + ".Ping":
+		method, path = http.MethodGet, "/ping"
+	case varlinkInterface + ".GetCapabilities":
+		method, path, wrap = http.MethodGet, "/capabilities", "capabilities"
+	case varlinkInterface + ".Quit":
+		method, path = http.MethodPost, "/quit"
+	default:
+		return varlinkError("org.varlink.service.MethodNotFound", map[string]string{"method": call.Method})
+	}
+	if reply := decodeVarlinkParameters(call, params); reply != nil {
+		return *reply
+	}
+	var passed *os.File
+	switch p := params.(type) {
+	case *varlinkManifestParameters:
+		if p.Raw {
+			query.Set("raw", "1")
+		}
+	case *varlinkRefParameters:
+		if p.Ref != "" {
+			query.Set("ref", p.Ref)
+		}
+	case *varlinkBlobParameters:
+		if p.Digest == "" {
+			return invalidVarlinkParameter("digest")
+		}
+		path = "/blobs/" + p.Digest
+		query.Set("fd", "1")
+		if p.Decompress {
+			query.Set("decompress", "1")
+		}
+		if p.Sanitize {
+			query.Set("sanitize", "1")
+		}
+		if p.Whiteouts != "" {
+			query.Set("whiteouts", p.Whiteouts)
+		}
+		if fds != nil {
+			passed = fds.take()
+		}
+	case *varlinkTOCParameters:
+		if p.Digest == "" {
+			return invalidVarlinkParameter("digest")
+		}
+		path = "/toc/" + p.Digest
+	case *varlinkUncompressedSizeParameters:
+		if p.Digest == "" {
+			return invalidVarlinkParameter("digest")
+		}
+		path = "/uncompressed-size/" + p.Digest
+		if p.Exact {
+			query.Set("exact", "1")
+		}
+	}
+	if passed != nil {
+		defer passed.Close()
+	}
+
+	ctx := context.Background()
+	if passed != nil {
+		ctx = context.WithValue(ctx, passedFileKey{}, passed)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, path, http.NoBody)
+	if err != nil {
+		// Only the digest is part of the path
+		return invalidVarlinkParameter("digest")
+	}
+	req.URL.RawQuery = query.Encode()
+	resp := &varlinkResponse{headers: make(http.Header)}
+	if status := h.serveInternal(resp, req); status >= 300 {
+		var reply errorReply
+		if err := json.Unmarshal(resp.body.Bytes(), &reply); err != nil {
+			reply = errorReply{Code: errorCodeInvalid, Message: http.StatusText(status)}
+		}
+		return varlinkError(varlinkInterface+".ImageProxyError", reply)
+	}
+	body := resp.body.Bytes()
+	switch {
+	case path == "/manifest":
+		params := map[string]interface{}{
+			"manifest": json.RawMessage(body),
+			"digest":   resp.headers.Get("Manifest-Digest"),
+		}
+		if d := resp.headers.Get("OCI-Manifest-Digest"); d != "" {
+			params["ociDigest"] = d
+		}
+		return varlinkReply{Parameters: params}
+	case strings.HasPrefix(path, "/toc/"):
+		return varlinkReply{Parameters: map[string]interface{}{
+			"format": resp.headers.Get("Toc-Format"),
+			"toc":    json.RawMessage(body),
+		}}
+	case path == "/digest":
+		return varlinkReply{Parameters: map[string]string{"digest": strings.TrimSpace(string(body))}}
+	case len(body) == 0:
+		return varlinkReply{Parameters: struct{}{}}
+	case wrap != "":
+		return varlinkReply{Parameters: map[string]json.RawMessage{wrap: body}}
+	default:
+		return varlinkReply{Parameters: json.RawMessage(body)}
+	}
+}
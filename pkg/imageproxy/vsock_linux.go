@@ -0,0 +1,188 @@
+package imageproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockAddr is the address of an AF_VSOCK socket, which the net package
+// doesn't support.
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a vsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a vsockAddr) String() string {
+	return fmt.Sprintf("vm(%d):%d", a.cid, a.port)
+}
+
+func sockaddrToVsock(sa unix.Sockaddr) vsockAddr {
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		return vsockAddr{cid: vm.CID, port: vm.Port}
+	}
+	return vsockAddr{}
+}
+
+// vsockConn is a connected AF_VSOCK socket.  Its file is non-blocking, so
+// that it uses the runtime poller and supports deadlines like net.Conn.
+type vsockConn struct {
+	*os.File
+	local, remote vsockAddr
+}
+
+func newVsockConn(fd int) (*vsockConn, error) {
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	c := &vsockConn{File: os.NewFile(uintptr(fd), "vsock")}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		c.local = sockaddrToVsock(sa)
+	}
+	if sa, err := unix.Getpeername(fd); err == nil {
+		c.remote = sockaddrToVsock(sa)
+	}
+	return c, nil
+}
+
+// CloseRead shuts down the reading side of the connection.
+func (c *vsockConn) CloseRead() error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var shutdownErr error
+	if err := raw.Control(func(fd uintptr) {
+		shutdownErr = unix.Shutdown(int(fd), unix.SHUT_RD)
+	}); err != nil {
+		return err
+	}
+	return shutdownErr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// vsockListener is a listening AF_VSOCK socket.
+type vsockListener struct {
+	f    *os.File
+	addr vsockAddr
+}
+
+// ListenVsock listens for connections from any VM (or from the host,
+// inside a VM) on port.
+func ListenVsock(port uint32) (net.Listener, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("creating vsock socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("binding vsock port %d: %w", port, err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("listening on vsock port %d: %w", port, err)
+	}
+	return newVsockListener(fd), nil
+}
+
+func newVsockListener(fd int) *vsockListener {
+	l := &vsockListener{f: os.NewFile(uintptr(fd), "vsock")}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		l.addr = sockaddrToVsock(sa)
+	}
+	return l
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	raw, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var nfd int
+	var acceptErr error
+	err = raw.Read(func(fd uintptr) bool {
+		nfd, _, acceptErr = unix.Accept4(int(fd), unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK)
+		// Wait for a connection
+		return acceptErr != unix.EAGAIN
+	})
+	if err == nil {
+		err = acceptErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newVsockConn(nfd)
+}
+
+func (l *vsockListener) Close() error {
+	return l.f.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// dupVsock returns a non-blocking duplicate of f if it is an AF_VSOCK
+// socket, or -1 if it is another kind of socket.
+func dupVsock(f *os.File) (int, error) {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	newFd := -1
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		var domain int
+		domain, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if sockErr != nil || domain != unix.AF_VSOCK {
+			return
+		}
+		newFd, sockErr = unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0)
+	}); err != nil {
+		return -1, err
+	}
+	return newFd, sockErr
+}
+
+// FileConn is like net.FileConn, but also supports AF_VSOCK sockets.
+func FileConn(f *os.File) (net.Conn, error) {
+	fd, err := dupVsock(f)
+	if err != nil {
+		return nil, err
+	}
+	if fd < 0 {
+		return net.FileConn(f)
+	}
+	return newVsockConn(fd)
+}
+
+// FileListener is like net.FileListener, but also supports AF_VSOCK
+// sockets.
+func FileListener(f *os.File) (net.Listener, error) {
+	fd, err := dupVsock(f)
+	if err != nil {
+		return nil, err
+	}
+	if fd < 0 {
+		return net.FileListener(f)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return newVsockListener(fd), nil
+}
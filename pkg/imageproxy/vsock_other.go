@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package imageproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// ListenVsock is only implemented on Linux.
+func ListenVsock(port uint32) (net.Listener, error) {
+	return nil, fmt.Errorf("vsock is only supported on Linux")
+}
+
+func FileConn(f *os.File) (net.Conn, error) {
+	return net.FileConn(f)
+}
+
+func FileListener(f *os.File) (net.Listener, error) {
+	return net.FileListener(f)
+}
@@ -0,0 +1,186 @@
+package imageproxy
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"strings"
+)
+
+// Whiteout formats of ?whiteouts=
+const (
+	// whiteoutsOverlay are those of overlayfs: a whiteout is a character
+	// device 0/0, and an opaque directory has the trusted.overlay.opaque
+	// extended attribute set to "y"
+	whiteoutsOverlay = "overlay"
+	// whiteoutsOCI are the ".wh." files of the OCI image spec (and AUFS)
+	whiteoutsOCI = "oci"
+)
+
+// paxOverlayOpaque is the PAX record of the overlayfs opaque attribute.
+const paxOverlayOpaque = "SCHILY.xattr.trusted.overlay.opaque"
+
+// whiteoutRewriter rewrites the whiteouts of layer tarballs into another
+// format as they are streamed, so that clients get a single one.
+type whiteoutRewriter struct {
+	format   string
+	sanitize bool
+	tw       *tar.Writer
+	// dirs are the directory entries seen, to mark opaque ones with
+	// their own metadata
+	dirs map[string]*tar.Header
+	// opaque are the directories made opaque so far
+	opaque map[string]bool
+}
+
+// rewriteWhiteouts copies the layer tarball r to w, with its whiteouts in
+// format (whiteoutsOverlay or whiteoutsOCI).  The other entries are copied
+// unchanged; with sanitize, they are checked like by copySanitizedTar.
+func rewriteWhiteouts(w io.Writer, r io.Reader, format string, sanitize bool) error {
+	rw := &whiteoutRewriter{
+		format:   format,
+		sanitize: sanitize,
+		tw:       tar.NewWriter(w),
+		dirs:     make(map[string]*tar.Header),
+		opaque:   make(map[string]bool),
+	}
+	tr := tar.NewReader(r)
+	for {
+		var hdr *tar.Header
+		var err error
+		if sanitize {
+			hdr, err = nextSanitizedEntry(tr)
+		} else {
+			hdr, err = tr.Next()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := rw.entry(hdr, tr); err != nil {
+			return err
+		}
+	}
+	if err := rw.tw.Close(); err != nil {
+		return err
+	}
+	// The padding after the end of the archive, so that all of the
+	// layer is verified
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// entryDir returns the cleaned directory of the entry name, and its base.
+func entryDir(name string) (string, string) {
+	name = path.Clean(name)
+	return path.Dir(name), path.Base(name)
+}
+
+func (rw *whiteoutRewriter) entry(hdr *tar.Header, data io.Reader) error {
+	dir, base := entryDir(hdr.Name)
+	if hdr.Typeflag == tar.TypeDir {
+		rw.dirs[path.Clean(hdr.Name)] = hdr
+	}
+	if rw.format == whiteoutsOverlay {
+		switch {
+		case base == whiteoutOpaque:
+			return rw.writeOpaqueDir(dir, hdr)
+		case strings.HasPrefix(base, whiteoutPrefix):
+			return rw.tw.WriteHeader(&tar.Header{
+				Name:     path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)),
+				Typeflag: tar.TypeChar,
+				Uid:      hdr.Uid,
+				Gid:      hdr.Gid,
+				ModTime:  hdr.ModTime,
+				Format:   hdr.Format,
+			})
+		case hdr.Typeflag == tar.TypeDir && rw.opaque[path.Clean(hdr.Name)]:
+			setPAXRecord(hdr, paxOverlayOpaque, "y")
+		}
+	} else {
+		switch {
+		case hdr.Typeflag == tar.TypeChar && hdr.Devmajor == 0 && hdr.Devminor == 0:
+			return rw.tw.WriteHeader(&tar.Header{
+				Name:     path.Join(dir, whiteoutPrefix+base),
+				Typeflag: tar.TypeReg,
+				Mode:     0600,
+				Uid:      hdr.Uid,
+				Gid:      hdr.Gid,
+				ModTime:  hdr.ModTime,
+				Format:   hdr.Format,
+			})
+		case hdr.Typeflag == tar.TypeDir && hdr.PAXRecords[paxOverlayOpaque] == "y":
+			deletePAXRecord(hdr, paxOverlayOpaque)
+			if err := rw.tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			return rw.tw.WriteHeader(&tar.Header{
+				Name:     path.Join(path.Clean(hdr.Name), whiteoutOpaque),
+				Typeflag: tar.TypeReg,
+				Mode:     0600,
+				Uid:      hdr.Uid,
+				Gid:      hdr.Gid,
+				ModTime:  hdr.ModTime,
+				Format:   hdr.Format,
+			})
+		}
+	}
+	if err := rw.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(rw.tw, data)
+	return err
+}
+
+// writeOpaqueDir writes an entry for dir with the overlayfs opaque
+// attribute, replacing the opaque whiteout marker.  The metadata is that
+// of the entry of dir in the layer, if it was already seen; a later entry
+// gets the attribute too.
+func (rw *whiteoutRewriter) writeOpaqueDir(dir string, marker *tar.Header) error {
+	rw.opaque[dir] = true
+	hdr := rw.dirs[dir]
+	if hdr == nil {
+		hdr = &tar.Header{
+			Name:     dir + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			Uid:      marker.Uid,
+			Gid:      marker.Gid,
+			ModTime:  marker.ModTime,
+			Format:   marker.Format,
+		}
+	}
+	copied := *hdr
+	setPAXRecord(&copied, paxOverlayOpaque, "y")
+	return rw.tw.WriteHeader(&copied)
+}
+
+// setPAXRecord sets a PAX record of hdr, without modifying the records of
+// a header it was copied from.  Extended attributes are also in the
+// deprecated Xattrs, which tar.Writer still writes, so they are kept in
+// sync.
+func setPAXRecord(hdr *tar.Header, key, value string) {
+	records := map[string]string{key: value}
+	for k, v := range hdr.PAXRecords {
+		if k != key {
+			records[k] = v
+		}
+	}
+	hdr.PAXRecords = records
+	hdr.Xattrs = nil
+	hdr.Format = tar.FormatPAX
+}
+
+// deletePAXRecord removes a PAX record of hdr, see setPAXRecord.
+func deletePAXRecord(hdr *tar.Header, key string) {
+	records := make(map[string]string)
+	for k, v := range hdr.PAXRecords {
+		if k != key {
+			records[k] = v
+		}
+	}
+	hdr.PAXRecords = records
+	hdr.Xattrs = nil
+}
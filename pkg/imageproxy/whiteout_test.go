@@ -0,0 +1,85 @@
+package imageproxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteWhiteouts(t *testing.T) {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "etc/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "usr/.wh.lib", Typeflag: tar.TypeReg},
+		{Name: "var/.wh..wh..opq", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte("hosts"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		name     string
+		typeflag byte
+		mode     int64
+		opaque   string
+		data     string
+	}
+	entries := func(r io.Reader) []entry {
+		var list []entry
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return list
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(tr)
+			list = append(list, entry{hdr.Name, hdr.Typeflag, hdr.Mode, hdr.PAXRecords[paxOverlayOpaque], string(data)})
+		}
+	}
+
+	var overlay bytes.Buffer
+	if err := rewriteWhiteouts(&overlay, bytes.NewReader(layer.Bytes()), whiteoutsOverlay, true); err != nil {
+		t.Fatal(err)
+	}
+	expected := []entry{
+		{"etc/", tar.TypeDir, 0700, "", ""},
+		{"etc/", tar.TypeDir, 0700, "y", ""},
+		{"etc/hosts", tar.TypeReg, 0644, "", "hosts"},
+		{"usr/lib", tar.TypeChar, 0, "", ""},
+		{"var/", tar.TypeDir, 0755, "y", ""},
+	}
+	if got := entries(bytes.NewReader(overlay.Bytes())); !reflect.DeepEqual(got, expected) {
+		t.Errorf("overlay whiteouts:\n%v\nexpected\n%v", got, expected)
+	}
+	var oci bytes.Buffer
+	if err := rewriteWhiteouts(&oci, bytes.NewReader(overlay.Bytes()), whiteoutsOCI, true); err != nil {
+		t.Fatal(err)
+	}
+	expected = []entry{
+		{"etc/", tar.TypeDir, 0700, "", ""},
+		{"etc/", tar.TypeDir, 0700, "", ""},
+		{"etc/.wh..wh..opq", tar.TypeReg, 0600, "", ""},
+		{"etc/hosts", tar.TypeReg, 0644, "", "hosts"},
+		{"usr/.wh.lib", tar.TypeReg, 0600, "", ""},
+		{"var/", tar.TypeDir, 0755, "", ""},
+		{"var/.wh..wh..opq", tar.TypeReg, 0600, "", ""},
+	}
+	if got := entries(&oci); !reflect.DeepEqual(got, expected) {
+		t.Errorf("OCI whiteouts:\n%v\nexpected\n%v", got, expected)
+	}
+}
@@ -0,0 +1,80 @@
+package imageproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sendFileChunk bounds each sendfile call, so that the write timeout
+// applies to reasonably sized writes.
+const sendFileChunk = 4 << 20
+
+// sendFile copies size bytes of src (from its start) to dst, which may be
+// a net.Conn or an *os.File (e.g. a pipe), using sendfile(2) so that the
+// data isn't copied through userspace.  handled is false if dst doesn't
+// support it and nothing was written; the caller must then copy the data
+// itself.  If timeout is set, a net.Conn on which a write makes no
+// progress for that long fails like with stallWriter.
+func sendFile(dst interface{}, timeout time.Duration, src *os.File, size int64) (written int64, handled bool, err error) {
+	sc, ok := dst.(syscall.Conn)
+	if !ok {
+		return 0, false, nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	conn, isConn := dst.(net.Conn)
+	srcFd := int(src.Fd())
+	var offset int64
+	for offset < size {
+		if isConn && timeout > 0 {
+			if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+				return written, true, err
+			}
+		}
+		chunk := size - offset
+		if chunk > sendFileChunk {
+			chunk = sendFileChunk
+		}
+		var n int
+		var serr error
+		werr := raw.Write(func(fd uintptr) bool {
+			n, serr = unix.Sendfile(int(fd), srcFd, &offset, int(chunk))
+			// Wait for the destination to be writable
+			return serr != unix.EAGAIN
+		})
+		if serr == nil {
+			serr = werr
+		}
+		// n is -1 on errors
+		if n > 0 {
+			written += int64(n)
+		}
+		if serr != nil {
+			if written == 0 && (serr == unix.EINVAL || serr == unix.ENOSYS) {
+				// Not supported for this kind of file
+				return 0, false, nil
+			}
+			if isConn && timeout > 0 && errors.Is(serr, os.ErrDeadlineExceeded) {
+				serr = fmt.Errorf("client stopped reading for %s: %w", timeout, serr)
+			}
+			return written, true, fmt.Errorf("sendfile: %w", serr)
+		}
+		if n == 0 {
+			return written, true, fmt.Errorf("sendfile: unexpected end of file after %d bytes", written)
+		}
+	}
+	if isConn && timeout > 0 {
+		if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+			return written, true, err
+		}
+	}
+	return written, true, nil
+}
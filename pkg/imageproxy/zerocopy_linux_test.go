@@ -0,0 +1,47 @@
+package imageproxy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSendFile(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("blob contents")
+	src, err := os.CreateTemp(dir, "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if _, err := src.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	dstPath := filepath.Join(dir, "dst")
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, handled, err := sendFile(dst, 0, src, int64(len(data)))
+	dst.Close()
+	if err != nil || !handled || written != int64(len(data)) {
+		t.Fatalf("sendFile: %d bytes written, handled %v: %v", written, handled, err)
+	}
+	if got, _ := os.ReadFile(dstPath); !bytes.Equal(got, data) {
+		t.Errorf("sent %q, expected %q", got, data)
+	}
+
+	// sendfile fails with EINVAL for files opened with O_APPEND, which
+	// must be left to the caller to copy
+	appended, err := os.OpenFile(filepath.Join(dir, "appended"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer appended.Close()
+	written, handled, err = sendFile(appended, 0, src, int64(len(data)))
+	if err != nil || handled || written != 0 {
+		t.Errorf("sendFile to an O_APPEND file: %d bytes written, handled %v: %v", written, handled, err)
+	}
+}
@@ -0,0 +1,7 @@
+// Package imageproxypb holds the code generated from imageproxy.proto, the
+// gRPC service served with --grpc-socket, with protoc-gen-go v1.27.1 and
+// protoc-gen-go-grpc v1.2.0 (matching the versions of the runtimes in
+// go.mod).
+package imageproxypb
+
+//go:generate protoc -I ../.. --go_out=../.. --go_opt=module=github.com/cgwalters/container-image-proxy --go-grpc_out=../.. --go-grpc_opt=module=github.com/cgwalters/container-image-proxy imageproxy.proto